@@ -4,33 +4,58 @@ package main
 import (
 	"bufio"
 	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
 	"crypto/rand"
+	"crypto/sha256"
+	"crypto/sha512"
+	_ "embed"
 	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"image"
+	"image/png"
+	"io"
 	"log"
+	"maps"
+	"math"
 	"net"
 	"net/http"
+	"net/netip"
+	"net/url"
 	"os"
 	"os/exec"
 	"os/signal"
 	"path/filepath"
 	"regexp"
 	"runtime"
+	"slices"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
 	"syscall"
+	"text/template"
 	"time"
 
 	"github.com/google/uuid"
+	"github.com/gorilla/websocket"
+	"golang.org/x/crypto/ssh"
 )
 
 const (
     // Progress Stages
+    StageQueued           = "queued" // Waiting for a create slot
     StageInitializing     = "initializing"
+    StageDownloadingImage = "downloading_image"
     StageCreatingDisk     = "creating_disk"
     StagePreparingCloudInit = "preparing_cloud_init"
+    StageWaitingLaunch    = "waiting_for_launch"
     StageStartingQEMU     = "starting_qemu"
     StageConfigVNC        = "configuring_vnc"
     StageInstallingTemplate = "installing_template" // New stage
@@ -60,19 +85,118 @@ const (
     CENTOS_7_IMAGE_URL = "https://os.virtfusion.net/images/centos-7-minimal-x86_64.qcow2"
     CENTOS_9_IMAGE_URL = "https://os-cdn.virtfusion.net/centos/centos-stream-9-x86_64.qcow2"
     
+    // openSUSE Images
+    OPENSUSE_15_5_IMAGE_URL = "https://download.opensuse.org/distribution/leap/15.5/appliances/openSUSE-Leap-15.5-Minimal-VM.x86_64-Cloud.qcow2"
+    
+    // Alpine Images
+    ALPINE_3_19_IMAGE_URL = "https://dl-cdn.alpinelinux.org/alpine/v3.19/releases/cloud/nocloud_alpine-3.19.1-x86_64-bios-cloudinit-r0.qcow2"
+    
     // Other constants
     BASE_DIR        = "/var/lib/vps-service/base"
     VPS_LIFETIME    = 15 * time.Minute
+    ADMIN_OWNER     = "admin" // Owner of the API_KEY key
     RAM_SIZE        = 4096  // 4GB
+    VCPU_COUNT      = 2     // vCPUs per guest
     DISK_SIZE       = 50    // 50GB
     DOWNLOAD_SPEED  = 50    // 50Mbps
     UPLOAD_SPEED    = 15    // 15Mbps
-    SSH_PORT_START  = 2200  // Starting port for SSH forwarding
+    VNC_PORT_RANGE  = "5900-6899"   // Default BLST_VNC_PORTS, VNC displays 0-999
+    SSH_PORT_RANGE  = "2200-3199"   // Default BLST_SSH_PORTS for SSH forwarding
+    FORWARD_PORT_RANGE = "10000-19999" // Default BLST_FORWARD_PORTS for template port forwarding
+    GUEST_AGENT_TIMEOUT = 20 * time.Minute // Max wait for the guest agent and cloud-init before verifying
+    GUEST_AGENT_METRICS_TIMEOUT = time.Second // Guest agent budget per metrics sample, the collector is serial
+    CGROUP_ROOT     = "/sys/fs/cgroup/blstlite" // Parent cgroup (v2) for per-VPS QEMU groups
+    CGROUP_MEMORY_OVERHEAD = 512 // MB allowed above guest RAM for QEMU itself
+    GZIP_MIN_SIZE   = 1024  // Responses smaller than this are sent uncompressed
+    CLOCK_TICKS_PER_SEC = 100 // USER_HZ used by /proc/[pid]/stat times
+    STATUS_CHECK_INTERVAL = 10 * time.Second // How often guest run states are refreshed
+    IO_ERROR_RESUME_MIN_FREE = 1 << 30 // Free bytes required on the disk's filesystem before auto-resume
+    MAX_REQUEST_BODY = 1 << 20 // Largest JSON body accepted by the API
+    LONG_REQUEST_TIMEOUT = 2 * time.Minute // Cap for handlers that wait on QEMU or the guest
+    SHUTDOWN_GRACE  = time.Minute // How long cleanup waits for in-flight creates to unwind
+    CONSOLE_TOKEN_TTL = 2 * time.Minute // Console tokens only need to live long enough to connect
+    IDEMPOTENCY_PASSWORD_TTL = 15 * time.Minute // How long a replayed create still returns the root password
+    DEFAULT_CPU_MODEL = "host" // Passes every host CPU feature through to the guest
+    METRICS_HISTORY_WINDOW = 10 * time.Minute // How far back the per-VPS metrics history reaches unless BLST_METRICS_HISTORY_SIZE is set
+    MAX_METRICS_HISTORY_SIZE = 10000 // Most samples kept per VPS, the history is preallocated for every running VPS
+    REBOOT_SHUTDOWN_TIMEOUT = 60 * time.Second // How long a clean reboot waits for the guest to power off
+    QEMU_EXIT_TIMEOUT = 10 * time.Second // How long a killed QEMU gets to exit and drop its disk locks
+    CPU_UNPLUG_TIMEOUT = 5 * time.Second // How long SetVCPUs waits for the guest to release unplugged vCPUs
+    STOP_TIMEOUT     = 2 * time.Minute // How long a stop waits for the guest to power off before killing it
+    MIN_STOP_TIMEOUT = 5 * time.Second
+    MAX_STOP_TIMEOUT = 10 * time.Minute
+    DEFAULT_STORAGE = "default" // Storage location name for baseDir/disks
+    DEFAULT_LISTEN_ADDRESS = ":8080" // BLST_LISTEN_ADDRESS when unset
+    STATE_FILE      = "state.json" // Instances and port assignments, under baseDir
+    QMP_DIAL_ATTEMPTS = 4 // Dials of a QMP socket that isn't up yet before giving up
+    QMP_DIAL_BACKOFF  = 100 * time.Millisecond // First retry delay, doubled on each attempt
+    EVENT_KEEPALIVE = 30 * time.Second // Idle event streams get a ping so proxies don't drop them
+    EVENT_BUFFER    = 16 // Events queued per subscriber before a slow one starts missing them
+    MAX_SSH_KEYS    = 32 // Authorized keys accepted on a single create
+    MIN_BALLOON_MB  = 256 // Smallest memory the balloon may shrink a guest to
+    MAX_IMAGE_DOWNLOAD = 20 << 30 // Default BLST_MAX_IMAGE_DOWNLOAD_BYTES for image_url downloads
+    CUSTOM_IMAGE_PREFIX = "custom-" // Image type of an image_url, followed by a hash of the URL
+    MAX_CUSTOM_IMAGES  = 10 // Default BLST_MAX_CUSTOM_IMAGES, custom base images kept in base/
+
+    // Event types
+    EventExpiringSoon  = "expiring_soon"
+    EventStatusChanged = "status_changed" // Status or creation stage moved
+    EventDeleted       = "deleted"
+    EventProgress      = "progress" // Creation progress moved within a stage
+    WAIT_MAX_TIMEOUT   = 10 * time.Minute // Longest a /api/vps/wait call may block
+
+    // Reboot modes
+    RebootModeClean = "clean" // ACPI power-off, then a fresh QEMU
+    RebootModeHard  = "hard"  // system_reset, like pressing the reset button
+
+    // Idle policy actions
+    IdleActionNone   = "none"
+    IdleActionStop   = "stop"
+    IdleActionDelete = "delete"
     StatusRunning    = "running"
     StatusStopped    = "stopped"
     StatusStarting   = "starting"
     StatusStopping   = "stopping"
     StatusRestarting = "restarting"
+    StatusPaused     = "paused"
+    StatusCrashed    = "crashed"
+    StatusIOError    = "io-error"
+    StatusRebuilding = "rebuilding"
+    StatusMoving     = "moving" // Disk is being relocated to another storage location
+    StatusCloning    = "cloning" // Disk is being copied into a new VPS
+    StatusRepairing  = "repairing" // Overlay is being rebased onto a fresh base image
+    StatusSnapshotting = "snapshotting" // qemu-img is taking or restoring an internal snapshot
+
+    // Guest networking modes
+    NetworkModeUser   = "user"   // QEMU user-mode NAT with hostfwd
+    NetworkModeBridge = "bridge" // Tap device attached to a host bridge
+    MAX_NICS          = 8        // Keeps tap names within 15 characters
+    MAX_PORT_FORWARDS = 16       // port_forwards per VPS on create
+
+    // Layouts the cloud-init seed ISO can take
+    CloudInitNoCloud     = "nocloud"     // user-data and meta-data at the root, volume cidata
+    CloudInitConfigDrive = "configdrive" // OpenStack openstack/latest tree, volume config-2
+
+    // How cloud-init data reaches the guest
+    CloudInitSeedISO    = "iso"    // Seed ISO on a second drive, needs genisoimage
+    CloudInitSeedSMBIOS = "smbios" // SMBIOS serial points NoCloud-Net at /seed/ over HTTP
+
+    // Instance disk formats
+    DiskFormatQCOW2 = "qcow2"
+    DiskFormatRaw   = "raw"
+    DISK_SECRET_ID  = "disk0-secret" // QEMU object id of an encrypted overlay's key
+
+    // Drive cache modes. writeback is the default: guests are short-lived and
+    // disposable, so host page cache speed beats crash consistency.
+    CacheModeNone         = "none"
+    CacheModeWriteback    = "writeback"
+    CacheModeWritethrough = "writethrough"
+    CacheModeUnsafe       = "unsafe"
+
+    // Template verification states
+    VerifyPending = "pending"
+    VerifyPassed  = "passed"
+    VerifyFailed  = "failed"
     
 )
 
@@ -99,25 +223,272 @@ var SUPPORTED_IMAGES = map[string]string{
     // CentOS
     "centos-7": CENTOS_7_IMAGE_URL,
     "centos-9": CENTOS_9_IMAGE_URL,
+    
+    // openSUSE
+    "opensuse-15.5": OPENSUSE_15_5_IMAGE_URL,
+    
+    // Alpine
+    "alpine-3.19": ALPINE_3_19_IMAGE_URL,
+}
+
+// OS families cloud-init package and service logic knows how to handle. An
+// image_url must name one of these since getOSFamily can't tell from the URL.
+var OS_FAMILIES = []string{"ubuntu", "debian", "fedora", "rocky", "almalinux", "centos", "opensuse", "alpine"}
+
+// Helper function to name the base image prepared from an image_url
+func customImageType(imageURL string) string {
+    sum := sha256.Sum256([]byte(imageURL))
+    return CUSTOM_IMAGE_PREFIX + hex.EncodeToString(sum[:8])
+}
+
+// Helper function to check for a name made by customImageType
+func isCustomImageType(imageType string) bool {
+    hash, found := strings.CutPrefix(imageType, CUSTOM_IMAGE_PREFIX)
+    if !found || len(hash) != 16 {
+        return false
+    }
+    _, err := hex.DecodeString(hash)
+    return err == nil
+}
+
+// Check that an image_url is something we are willing to download. Host
+// names are only checked once dialed, see imageURLClient.
+func validateImageURL(imageURL string) error {
+    if len(imageURL) > 2048 {
+        return fmt.Errorf("invalid image_url: longer than 2048 characters")
+    }
+    parsed, err := url.Parse(imageURL)
+    if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+        return fmt.Errorf("invalid image_url: must be an http:// or https:// URL")
+    }
+    if addr, err := netip.ParseAddr(parsed.Hostname()); err == nil && !isPublicAddr(addr) {
+        return fmt.Errorf("invalid image_url: %w: %s", errNonPublicAddress, addr)
+    }
+    return nil
+}
+
+var errNonPublicAddress = errors.New("address is not publicly routable")
+
+// Helper function to tell a public unicast address from loopback, private,
+// link-local (which includes 169.254.169.254) and other special ranges
+func isPublicAddr(addr netip.Addr) bool {
+    addr = addr.Unmap()
+    return addr.IsGlobalUnicast() && !addr.IsPrivate()
+}
+
+// A net.Dialer Control hook refusing connections to non-public addresses.
+// It sees the address actually dialed, so a name that resolves to a private
+// address or a redirect to one is caught as well.
+func refuseNonPublicDial(network, address string, c syscall.RawConn) error {
+    addrPort, err := netip.ParseAddrPort(address)
+    if err != nil {
+        return fmt.Errorf("refusing to dial %s: %v", address, err)
+    }
+    if !isPublicAddr(addrPort.Addr()) {
+        return fmt.Errorf("refusing to dial %s: %w", address, errNonPublicAddress)
+    }
+    return nil
+}
+
+// Client for image_url downloads. Any operator key can pick the URL, so it
+// may not reach the host, the cloud metadata service or the private network.
+// Proxies from the environment are not used, they would dial on our behalf.
+var imageURLClient = &http.Client{
+    Transport: &http.Transport{
+        DialContext: (&net.Dialer{
+            Timeout:   30 * time.Second,
+            KeepAlive: 30 * time.Second,
+            Control:   refuseNonPublicDial,
+        }).DialContext,
+        TLSHandshakeTimeout:   10 * time.Second,
+        ResponseHeaderTimeout: time.Minute,
+    },
+}
+
+// Expected SHA256 of each image's download, checked before it becomes a base
+// image. Most URLs above track a rolling "current" or "latest" build whose
+// hash changes with every release and can't be pinned here. fedora-38
+// (38-1.6) and alpine-3.19 (3.19.1-r0) name a fixed build and belong in this
+// map, taken from the distribution's signed CHECKSUM or .sha512 file next to
+// the image. Any image can also be pinned with BLST_IMAGE_SHA256=type=hex,...
+// Images without a checksum aren't verified.
+var IMAGE_SHA256 = map[string]string{}
+
+// Helper function to get the configured checksum of an image, if any
+func imageChecksum(imageType string) (string, error) {
+    for _, entry := range strings.Split(os.Getenv("BLST_IMAGE_SHA256"), ",") {
+        name, sum, found := strings.Cut(strings.TrimSpace(entry), "=")
+        if !found || name != imageType {
+            continue
+        }
+        sum = strings.ToLower(strings.TrimSpace(sum))
+        if decoded, err := hex.DecodeString(sum); err != nil || len(decoded) != sha256.Size {
+            return "", fmt.Errorf("invalid SHA256 for %s in BLST_IMAGE_SHA256: %q", imageType, sum)
+        }
+        return sum, nil
+    }
+    return IMAGE_SHA256[imageType], nil
+}
+
+// Helper function to hash a file with SHA256
+func fileSHA256(path string) (string, error) {
+    file, err := os.Open(path)
+    if err != nil {
+        return "", err
+    }
+    defer file.Close()
+
+    hash := sha256.New()
+    if _, err := io.Copy(hash, file); err != nil {
+        return "", err
+    }
+    return hex.EncodeToString(hash.Sum(nil)), nil
 }
 
 type VPS struct {
     ID          string    `json:"id"`
     Name        string    `json:"name"`
     Hostname    string    `json:"hostname"`
+    Owner       string    `json:"owner"`     // API key owner that created it
     Status      string    `json:"status"`
     ImageType   string    `json:"image_type"`
+    ImageURL    string    `json:"image_url,omitempty"` // Source of a custom image type
+    OSFamily    string    `json:"os_family,omitempty"` // Given with ImageURL, curated images go by getOSFamily
     Template    string    `json:"template"`        // Add template to VPS struct
+    TemplateVars map[string]string `json:"template_vars,omitempty"` // Overrides for the template's Variables
     QEMUPid     int       `json:"qemu_pid,omitempty"`
     VNCPort     int       `json:"vnc_port"`
-    SSHPort     int       `json:"ssh_port"`
+    SSHPort     int       `json:"ssh_port"`        // Zero when the primary NIC is bridged
     CreatedAt   time.Time `json:"created_at"`
     ExpiresAt   time.Time `json:"expires_at"`
     ImagePath   string    `json:"image_path"`
-    Password    string    `json:"password"`
+    DiskFormat  string    `json:"disk_format"`     // qcow2 overlay or full raw copy
+    Encrypted   bool      `json:"encrypted,omitempty"` // qcow2 overlay uses LUKS encryption
+    Storage     string    `json:"storage,omitempty"`   // Storage location holding the disk, empty for the default
+    StandaloneDisk bool   `json:"standalone_disk,omitempty"` // qcow2 disk was flattened and has no backing file
+    CacheMode   string    `json:"cache_mode"`      // QEMU cache mode for the main drive
+    MemoryMB    int       `json:"memory_mb"`
+    VCPUs       int       `json:"vcpus"`           // Boot count, the floor for hot-unplug
+    MaxVCPUs    int       `json:"max_vcpus"`       // -smp maxcpus, the ceiling for hot-plug
+    CurrentVCPUs int      `json:"current_vcpus"`   // Plugged in now, VCPUs after every start
+    BalloonMB   int       `json:"balloon_mb,omitempty"` // Memory the balloon leaves the guest, unset means all of MemoryMB
+    DiskGB      int       `json:"disk_gb"`
+    Password    string    `json:"password,omitempty"` // Only set on the create response, never stored
+    PasswordHash string   `json:"-"` // SHA-512 crypt of the root password, handed to cloud-init
     Stage       string    `json:"stage"`           // Current stage of creation
     Progress    int       `json:"progress"`        // Progress percentage (0-100)
+    StageHistory []StageEvent `json:"stage_history,omitempty"` // When each creation stage started
     ErrorMsg    string    `json:"error,omitempty"` // Error message if something fails
+    Verification *VerificationResult `json:"verification,omitempty"` // Post-install template checks
+    Degraded    bool      `json:"degraded"`        // Set when template verification fails
+    Proxy       *ProxyConfig `json:"proxy,omitempty"` // Proxy used for in-guest package installs
+    PortForwards []PortForward `json:"port_forwards,omitempty"` // Extra host -> guest forwards on the primary NIC, requested or from the template
+    IdleSince   *time.Time `json:"idle_since,omitempty"`       // Start of the current idle period
+    IdleShutdownAt *time.Time `json:"idle_shutdown_at,omitempty"` // When the idle policy will act
+    RunState    string    `json:"run_state,omitempty"` // Guest run state reported by QMP query-status
+    Alert       string    `json:"alert,omitempty"`     // Operational problem needing attention
+    Network     *NetworkConfig `json:"network,omitempty"` // Static addressing, bridged networking only
+    NICs        []NICConfig `json:"nics,omitempty"` // Guest NICs; empty means one NIC in NetworkMode
+    NetworkMode string    `json:"network_mode"`    // user or bridge, the type of the primary NIC
+    GuestIP     string    `json:"guest_ip,omitempty"` // Primary bridge NIC's address as reported by the guest agent
+    MetricsDisabled bool  `json:"metrics_disabled,omitempty"` // Skipped by the metrics collector
+    Media       string    `json:"media,omitempty"` // ISO from the uploads dir in the CD-ROM drive
+    CPUModel    string    `json:"cpu_model"`
+    CPUFlags    []string  `json:"cpu_flags,omitempty"` // e.g. +avx2, -vmx
+    IOThrottle  *IOThrottle `json:"io_throttle,omitempty"` // Disk I/O limits, reapplied on every start
+    CloudInitDatasource string `json:"cloud_init_datasource"` // Layout of the seed ISO
+    CloudInitLabel string `json:"cloud_init_label"`           // Volume label of the seed ISO
+    CloudInitSeed string `json:"cloud_init_seed"`             // iso or smbios
+    SeedToken   string    `json:"-"` // Guards the /seed/ URL handed to an smbios-seeded guest
+    SSHAuthorizedKeys []string `json:"ssh_authorized_keys,omitempty"` // Installed for root by cloud-init
+    DisablePasswordAuth bool `json:"disable_password_auth,omitempty"` // sshd accepts keys only
+}
+
+// Optional settings accepted when creating a VPS
+type CreateVPSOptions struct {
+    Owner      string
+    ImageURL   string // Set when imageType is a custom image
+    OSFamily   string
+    Proxy      *ProxyConfig
+    Network    *NetworkConfig
+    NICs       []NICConfig
+    NetworkMode string // Empty means the type of NICs[0], then BLST_NETWORK_MODE
+    PortForwards []PortForward // Forwards on the primary NIC beside SSH and the template's
+    TemplateVars map[string]string
+    DiskFormat string
+    EncryptDisk bool
+    CacheMode  string
+    MemoryMB   int // Zero means the template default, then the global one
+    VCPUs      int
+    DiskGB     int
+    DisableMetrics bool
+    CPUModel   string
+    CPUFlags   []string
+    CloudInitDatasource string
+    CloudInitLabel string
+    SSHAuthorizedKeys []string
+    DisablePasswordAuth bool
+    ClientIP   string // Counted against BLST_MAX_VPS_PER_IP when set
+    MaxVPSes   int // Live VPSes Owner may hold, 0 means unlimited
+}
+
+// Disk I/O limits in bytes and operations per second. Zero means unlimited.
+// Field names match QMP's block_set_io_throttle.
+type IOThrottle struct {
+    BPS       int64 `json:"bps"`
+    BPSRead   int64 `json:"bps_rd"`
+    BPSWrite  int64 `json:"bps_wr"`
+    IOPS      int64 `json:"iops"`
+    IOPSRead  int64 `json:"iops_rd"`
+    IOPSWrite int64 `json:"iops_wr"`
+}
+
+type StageEvent struct {
+    Stage  string    `json:"stage"`
+    At     time.Time `json:"at"`
+    Detail string    `json:"detail,omitempty"`
+}
+
+// A guest network interface. The first NIC carries the SSH and template
+// forwards and any static network config.
+type NICConfig struct {
+    Type     string        `json:"type"`               // user or bridge
+    Bridge   string        `json:"bridge,omitempty"`   // Host bridge for bridge NICs, defaults to BLST_BRIDGE
+    MAC      string        `json:"mac,omitempty"`      // Derived from the VPS ID when empty
+    Forwards []PortForward `json:"forwards,omitempty"` // Extra host -> guest forwards, user NICs only
+}
+
+type PortForward struct {
+    HostPort  int    `json:"host_port"`
+    GuestPort int    `json:"guest_port"`
+    Protocol  string `json:"protocol"`
+}
+
+// Static guest addressing written to cloud-init's network-config (v2)
+type NetworkConfig struct {
+    Address string   `json:"address"`          // CIDR, e.g. 192.168.10.20/24
+    Gateway string   `json:"gateway,omitempty"`
+    DNS     []string `json:"dns,omitempty"`
+}
+
+type ProxyConfig struct {
+    HTTPProxy  string `json:"http_proxy,omitempty"`
+    HTTPSProxy string `json:"https_proxy,omitempty"`
+    NoProxy    string `json:"no_proxy,omitempty"`
+}
+
+type VerificationResult struct {
+    Status     string        `json:"status"`
+    Checks     []VerifyCheck `json:"checks"`
+    Error      string        `json:"error,omitempty"`
+    FinishedAt time.Time     `json:"finished_at,omitempty"`
+}
+
+type VerifyCheck struct {
+    Command  string `json:"command"`
+    ExitCode int    `json:"exit_code"`
+    Output   string `json:"output,omitempty"`
+    Passed   bool   `json:"passed"`
 }
 
 
@@ -128,22 +499,97 @@ type VPSTemplate struct {
     OSVariants  []string         `json:"os_variants"`     // Supported OS images
     Packages    map[string][]string `json:"packages"`     // OS-specific packages
     Commands    map[string][]string `json:"commands"`     // OS-specific commands
+    Verify      map[string][]string `json:"verify"`       // OS-specific post-install checks
+    ExposePorts []int             `json:"expose_ports"` // Guest ports forwarded to the host
+    Variables   map[string]string `json:"variables"`    // Defaults for {{.Name}} placeholders in Commands
+    // Resources used when a create request doesn't set them; zero falls back
+    // to RAM_SIZE, VCPU_COUNT and DISK_SIZE
+    DefaultMemoryMB int `json:"default_memory_mb,omitempty"`
+    DefaultVCPUs    int `json:"default_vcpus,omitempty"`
+    DefaultDiskGB   int `json:"default_disk_gb,omitempty"`
 }
 
 type VPSManager struct {
     instances    map[string]*VPS
-    ipInstances  map[string]string  // maps IP -> VPS ID
+    ipInstances  map[string][]string // maps client IP -> VPS IDs created from it
+    maxVPSPerIP  int // Live VPSes one client IP may hold, 0 means unlimited
+    trustedProxies []*net.IPNet // Peers whose X-Forwarded-For is believed
     mutex        sync.RWMutex
-    nextVNCPort  int
-    nextSSHPort  int
+    vncPorts     portRange // Pools new VPSes draw their ports from
+    sshPorts     portRange
+    forwardPorts portRange
     baseDir      string
     metricsCache map[string]*MetricsCache
     metricsMutex sync.RWMutex
+    createdTotal int64 // VPSes created since startup, for /metrics
+    serialConsoles map[string]bool // VPS IDs with a serial console session open
+    idlePolicy   IdlePolicy
+    autoResumeIOError bool
+    virtioRNG    bool // Give guests a virtio-rng device fed from /dev/urandom
+    q35Machine   bool // Opt-in q35 machine with in-kernel irqchip and no user config
+    networkMode  string
+    bridge       string // Host bridge used in bridged mode
+    bindAddress  string // Host address for VNC and forwarded ports; "::" is dual-stack
+    defaultTemplate string // Used when a create request omits the template
+    defaultImage    string // Used when a create request omits the image type
+    maxImageDownload int64 // Largest image_url download accepted, in bytes
+    maxCustomImages int // custom-* base images kept before new image_urls are refused
+    qemuBin      string
+    qemuExtraArgs []string // Operator-supplied args appended after the managed ones
+    cpuModels    map[string]bool // From "-cpu help" at startup
+    cpuFlags     map[string]bool
+    downloads    map[string]*imageDownload // In-flight base image downloads by image type
+    downloadsMutex sync.Mutex
+    launchSlots  chan struct{} // Semaphore bounding concurrent QEMU launches
+    createSlots  chan struct{} // Semaphore bounding concurrent creates and rebuilds
+    queuedCreates map[string]context.CancelFunc // Creates waiting for a slot, by VPS ID
+    createTimeout time.Duration // Deadline for a whole create, including any image download
+    removeFailed bool // Drop failed creates instead of keeping a failed record
+    consoleSecret []byte // HMAC key for console tokens
+    expiryWarning time.Duration // How long before ExpiresAt the expiring_soon event fires
+    metricsInterval time.Duration
+    metricsHistorySize int // Samples kept per VPS
+    cloudInitDatasource string // Seed ISO layout when a create request doesn't pick one
+    cloudInitLabel string
+    cloudInitSeed string
+    seedURL      string // Base URL guests reach this service on for smbios seeding
+    storagePaths map[string]string // Disk storage locations by name, from BLST_STORAGE_PATHS
+    idempotencyKeys map[string]*idempotencyEntry // Create requests by owner and Idempotency-Key
+    idempotencyMutex sync.Mutex
+    readinessMutex sync.Mutex
+    failedReadiness string // Checks that failed at the last /readyz, so only changes are logged
+    idempotencyTTL time.Duration
+    idempotencyCipher cipher.AEAD // Seals root passwords kept for replays, random per process
+    maxLifetime  time.Duration // Longest a VPS may live, counted from CreatedAt, however often it's extended
+    expiryTimers map[string]*time.Timer // Per-VPS scheduleCleanup timers, reset when the expiry moves
+    maxMemoryMB  int // Per-VPS resource caps, default to host capacity
+    maxVCPUs     int
+    maxDiskGB    int
+    stateMutex   sync.Mutex // Serializes writes of the state file
+    lastState    []byte     // Last state written, to skip unchanged saves
+    events       *eventHub
+
+    // Cancelled on shutdown. Create and rebuild goroutines are tracked in
+    // workers so cleanup can let them unwind before tearing instances down.
+    ctx          context.Context
+    cancel       context.CancelFunc
+    workers      sync.WaitGroup
+    cleanupOnce  sync.Once
+}
+
+// IdlePolicy stops or deletes a running VPS once its CPU and network usage
+// stay below the thresholds for the grace period. ExpiresAt remains a hard cap.
+type IdlePolicy struct {
+    Action       string
+    CPUThreshold float64       // Percent
+    NetThreshold float64       // Bytes per second, RX + TX
+    Grace        time.Duration
 }
 
 
 type MetricsCache struct {
     LastUpdate     time.Time
+    LastCPUTicks   int64
     LastDiskStats  DiskMetrics
     LastNetStats   NetworkMetrics
     MetricsHistory []ResourceMetrics
@@ -155,13 +601,13 @@ var SUPPORTED_TEMPLATES = map[string]VPSTemplate{
         ID:          "blank",
         Name:        "Blank Server",
         Description: "Basic server with no additional software",
-        OSVariants:  []string{"ubuntu-24.04", "ubuntu-22.04", "ubuntu-20.04", "debian-12", "debian-11", "fedora-40", "fedora-38", "rocky-9", "rocky-8", "almalinux-9", "almalinux-8",},
+        OSVariants:  []string{"ubuntu-24.04", "ubuntu-22.04", "ubuntu-20.04", "debian-12", "debian-11", "fedora-40", "fedora-38", "rocky-9", "rocky-8", "almalinux-9", "almalinux-8", "centos-9", "centos-7", "opensuse-15.5", "alpine-3.19",},
     },
     "docker": {
         ID:          "docker",
         Name:        "Docker Development Environment",
         Description: "Server with Docker and Docker Compose pre-installed",
-        OSVariants:  []string{"ubuntu-22.04", "ubuntu-20.04", "debian-12", "debian-11", "fedora-40", "fedora-38", "rocky-9", "rocky-8", "almalinux-9", "almalinux-8"},
+        OSVariants:  []string{"ubuntu-22.04", "ubuntu-20.04", "debian-12", "debian-11", "fedora-40", "fedora-38", "rocky-9", "rocky-8", "almalinux-9", "almalinux-8", "opensuse-15.5", "alpine-3.19"},
         Packages: map[string][]string{
             "ubuntu": {"apt-transport-https", "ca-certificates", "curl", "software-properties-common"},
             "debian": {"apt-transport-https", "ca-certificates", "curl", "software-properties-common"},
@@ -169,6 +615,8 @@ var SUPPORTED_TEMPLATES = map[string]VPSTemplate{
             "rocky":  {"yum-utils", "epel-release"},
             "almalinux": {"yum-utils", "epel-release"},
             "centos": {"yum-utils", "epel-release"},
+            "opensuse": {"docker", "docker-compose"},
+            "alpine": {"docker", "docker-cli-compose"},
         },
         Commands: map[string][]string{
             "ubuntu": {
@@ -217,13 +665,36 @@ var SUPPORTED_TEMPLATES = map[string]VPSTemplate{
                 "systemctl enable docker",
                 "systemctl start docker",
             },
+            "opensuse": {
+                "systemctl enable docker",
+                "systemctl start docker",
+            },
+            "alpine": {
+                "rc-update add docker default",
+                "rc-service docker start",
+            },
+        },
+        Verify: map[string][]string{
+            "ubuntu":    {"docker --version", "systemctl is-active docker"},
+            "debian":    {"docker --version", "systemctl is-active docker"},
+            "fedora":    {"docker --version", "systemctl is-active docker"},
+            "rocky":     {"docker --version", "systemctl is-active docker"},
+            "almalinux": {"docker --version", "systemctl is-active docker"},
+            "centos":    {"docker --version", "systemctl is-active docker"},
+            "opensuse":  {"docker --version", "systemctl is-active docker"},
+            "alpine":    {"docker --version", "rc-service docker status"},
         },
+        ExposePorts: []int{80, 443},
+        // Images and build caches add up quickly
+        DefaultMemoryMB: 8192,
+        DefaultVCPUs:    4,
+        DefaultDiskGB:   80,
     },
     "nodejs": {
         ID:          "nodejs",
         Name:        "Node.js Development Environment",
         Description: "Server with Node.js, NPM, and common development tools",
-        OSVariants:  []string{"ubuntu-22.04", "ubuntu-20.04", "debian-12", "debian-11", "fedora-40", "fedora-38", "rocky-9", "rocky-8", "almalinux-9", "almalinux-8"},
+        OSVariants:  []string{"ubuntu-22.04", "ubuntu-20.04", "debian-12", "debian-11", "fedora-40", "fedora-38", "rocky-9", "rocky-8", "almalinux-9", "almalinux-8", "opensuse-15.5"},
         Packages: map[string][]string{
             "ubuntu": {"curl", "build-essential"},
             "debian": {"curl", "build-essential"},
@@ -231,51 +702,68 @@ var SUPPORTED_TEMPLATES = map[string]VPSTemplate{
             "rocky": {"curl", "gcc", "gcc-c++", "make", "epel-release", "python3"},
             "almalinux": {"curl", "gcc", "gcc-c++", "make", "epel-release", "python3"},
             "centos": {"curl", "gcc", "gcc-c++", "make", "epel-release", "python3"},
+            "opensuse": {"curl", "gcc", "gcc-c++", "make", "python3"},
         },
         Commands: map[string][]string{
             "ubuntu": {
-                "curl -fsSL https://deb.nodesource.com/setup_18.x | bash -",
+                "curl -fsSL https://deb.nodesource.com/setup_{{.NodeVersion}}.x | bash -",
                 "apt-get install -y nodejs",
                 "npm install -g yarn pm2 typescript ts-node",
             },
             "debian": {
-                "curl -fsSL https://deb.nodesource.com/setup_18.x | bash -",
+                "curl -fsSL https://deb.nodesource.com/setup_{{.NodeVersion}}.x | bash -",
                 "apt-get install -y nodejs",
                 "npm install -g yarn pm2 typescript ts-node",
             },
             "fedora": {
                 "dnf -y module reset nodejs",
-                "dnf -y module enable nodejs:18",
+                "dnf -y module enable nodejs:{{.NodeVersion}}",
                 "dnf -y install nodejs",
                 "npm install -g yarn pm2 typescript ts-node",
             },
             "rocky": {
-                "curl -fsSL https://rpm.nodesource.com/setup_18.x | bash -",
+                "curl -fsSL https://rpm.nodesource.com/setup_{{.NodeVersion}}.x | bash -",
                 "dnf -y install nodejs",
                 "npm install -g yarn pm2 typescript ts-node",
             },
             "almalinux": {
-                "curl -fsSL https://rpm.nodesource.com/setup_18.x | bash -",
+                "curl -fsSL https://rpm.nodesource.com/setup_{{.NodeVersion}}.x | bash -",
                 "dnf -y install nodejs",
                 "npm install -g yarn pm2 typescript ts-node",
             },
             "centos": {
                 "if [ -f /etc/centos-release ] && grep -q 'CentOS Linux release 7' /etc/centos-release; then " +
-                    "curl -fsSL https://rpm.nodesource.com/setup_18.x | bash - && " +
+                    "curl -fsSL https://rpm.nodesource.com/setup_{{.NodeVersion}}.x | bash - && " +
                     "yum -y install nodejs; " +
                 "else " +
-                    "curl -fsSL https://rpm.nodesource.com/setup_18.x | bash - && " +
+                    "curl -fsSL https://rpm.nodesource.com/setup_{{.NodeVersion}}.x | bash - && " +
                     "dnf -y install nodejs; " +
                 "fi",
                 "npm install -g yarn pm2 typescript ts-node",
             },
+            "opensuse": {
+                "zypper --non-interactive install nodejs{{.NodeVersion}} npm{{.NodeVersion}}",
+                "npm install -g yarn pm2 typescript ts-node",
+            },
+        },
+        Variables: map[string]string{
+            "NodeVersion": "18",
+        },
+        Verify: map[string][]string{
+            "ubuntu":    {"node --version", "npm --version"},
+            "debian":    {"node --version", "npm --version"},
+            "fedora":    {"node --version", "npm --version"},
+            "rocky":     {"node --version", "npm --version"},
+            "almalinux": {"node --version", "npm --version"},
+            "centos":    {"node --version", "npm --version"},
+            "opensuse":  {"node --version", "npm --version"},
         },
     },
     "golang": {
         ID:          "golang",
         Name:        "Go Development Environment",
         Description: "Server with Go and common development tools",
-        OSVariants:  []string{"ubuntu-22.04", "ubuntu-20.04", "debian-12", "debian-11", "fedora-40", "fedora-38", "rocky-9", "rocky-8", "almalinux-9", "almalinux-8"},
+        OSVariants:  []string{"ubuntu-22.04", "ubuntu-20.04", "debian-12", "debian-11", "fedora-40", "fedora-38", "rocky-9", "rocky-8", "almalinux-9", "almalinux-8", "opensuse-15.5", "alpine-3.19"},
         Packages: map[string][]string{
             "ubuntu": {"curl", "git", "build-essential"},
             "debian": {"curl", "git", "build-essential"},
@@ -283,63 +771,95 @@ var SUPPORTED_TEMPLATES = map[string]VPSTemplate{
             "rocky": {"curl", "git", "gcc", "gcc-c++", "make"},
             "almalinux": {"curl", "git", "gcc", "gcc-c++", "make"},
             "centos": {"curl", "git", "gcc", "gcc-c++", "make"},
+            "opensuse": {"curl", "git", "gcc", "gcc-c++", "make", "tar", "gzip"},
+            "alpine": {"curl", "git", "build-base"},
         },
         Commands: map[string][]string{
             "ubuntu": {
-                "curl -OL https://go.dev/dl/go1.21.5.linux-amd64.tar.gz",
-                "rm -rf /usr/local/go && tar -C /usr/local -xzf go1.21.5.linux-amd64.tar.gz",
+                "curl -OL https://go.dev/dl/go{{.GoVersion}}.linux-amd64.tar.gz",
+                "rm -rf /usr/local/go && tar -C /usr/local -xzf go{{.GoVersion}}.linux-amd64.tar.gz",
                 "echo 'export PATH=$PATH:/usr/local/go/bin' >> /etc/profile",
                 "echo 'export PATH=$PATH:/usr/local/go/bin' >> /root/.bashrc",
-                "rm go1.21.5.linux-amd64.tar.gz",
+                "rm go{{.GoVersion}}.linux-amd64.tar.gz",
                 "/usr/local/go/bin/go install golang.org/x/tools/gopls@latest",
                 "/usr/local/go/bin/go install github.com/go-delve/delve/cmd/dlv@latest",
             },
             "debian": {
-                "curl -OL https://go.dev/dl/go1.21.5.linux-amd64.tar.gz",
-                "rm -rf /usr/local/go && tar -C /usr/local -xzf go1.21.5.linux-amd64.tar.gz",
+                "curl -OL https://go.dev/dl/go{{.GoVersion}}.linux-amd64.tar.gz",
+                "rm -rf /usr/local/go && tar -C /usr/local -xzf go{{.GoVersion}}.linux-amd64.tar.gz",
                 "echo 'export PATH=$PATH:/usr/local/go/bin' >> /etc/profile",
                 "echo 'export PATH=$PATH:/usr/local/go/bin' >> /root/.bashrc",
-                "rm go1.21.5.linux-amd64.tar.gz",
+                "rm go{{.GoVersion}}.linux-amd64.tar.gz",
                 "/usr/local/go/bin/go install golang.org/x/tools/gopls@latest",
                 "/usr/local/go/bin/go install github.com/go-delve/delve/cmd/dlv@latest",
             },
             "fedora": {
-                "curl -OL https://go.dev/dl/go1.21.5.linux-amd64.tar.gz",
-                "rm -rf /usr/local/go && tar -C /usr/local -xzf go1.21.5.linux-amd64.tar.gz",
+                "curl -OL https://go.dev/dl/go{{.GoVersion}}.linux-amd64.tar.gz",
+                "rm -rf /usr/local/go && tar -C /usr/local -xzf go{{.GoVersion}}.linux-amd64.tar.gz",
                 "echo 'export PATH=$PATH:/usr/local/go/bin' >> /etc/profile",
                 "echo 'export PATH=$PATH:/usr/local/go/bin' >> /root/.bashrc",
-                "rm go1.21.5.linux-amd64.tar.gz",
+                "rm go{{.GoVersion}}.linux-amd64.tar.gz",
                 "/usr/local/go/bin/go install golang.org/x/tools/gopls@latest",
                 "/usr/local/go/bin/go install github.com/go-delve/delve/cmd/dlv@latest",
             },
             "rocky": {
-                "curl -OL https://go.dev/dl/go1.21.5.linux-amd64.tar.gz",
-                "rm -rf /usr/local/go && tar -C /usr/local -xzf go1.21.5.linux-amd64.tar.gz",
+                "curl -OL https://go.dev/dl/go{{.GoVersion}}.linux-amd64.tar.gz",
+                "rm -rf /usr/local/go && tar -C /usr/local -xzf go{{.GoVersion}}.linux-amd64.tar.gz",
                 "echo 'export PATH=$PATH:/usr/local/go/bin' >> /etc/profile",
                 "echo 'export PATH=$PATH:/usr/local/go/bin' >> /root/.bashrc",
-                "rm go1.21.5.linux-amd64.tar.gz",
+                "rm go{{.GoVersion}}.linux-amd64.tar.gz",
                 "/usr/local/go/bin/go install golang.org/x/tools/gopls@latest",
                 "/usr/local/go/bin/go install github.com/go-delve/delve/cmd/dlv@latest",
             },
             "almalinux": {
-                "curl -OL https://go.dev/dl/go1.21.5.linux-amd64.tar.gz",
-                "rm -rf /usr/local/go && tar -C /usr/local -xzf go1.21.5.linux-amd64.tar.gz",
+                "curl -OL https://go.dev/dl/go{{.GoVersion}}.linux-amd64.tar.gz",
+                "rm -rf /usr/local/go && tar -C /usr/local -xzf go{{.GoVersion}}.linux-amd64.tar.gz",
                 "echo 'export PATH=$PATH:/usr/local/go/bin' >> /etc/profile",
                 "echo 'export PATH=$PATH:/usr/local/go/bin' >> /root/.bashrc",
-                "rm go1.21.5.linux-amd64.tar.gz",
+                "rm go{{.GoVersion}}.linux-amd64.tar.gz",
                 "/usr/local/go/bin/go install golang.org/x/tools/gopls@latest",
                 "/usr/local/go/bin/go install github.com/go-delve/delve/cmd/dlv@latest",
             },
             "centos": {
-                "curl -OL https://go.dev/dl/go1.21.5.linux-amd64.tar.gz",
-                "rm -rf /usr/local/go && tar -C /usr/local -xzf go1.21.5.linux-amd64.tar.gz",
+                "curl -OL https://go.dev/dl/go{{.GoVersion}}.linux-amd64.tar.gz",
+                "rm -rf /usr/local/go && tar -C /usr/local -xzf go{{.GoVersion}}.linux-amd64.tar.gz",
+                "echo 'export PATH=$PATH:/usr/local/go/bin' >> /etc/profile",
+                "echo 'export PATH=$PATH:/usr/local/go/bin' >> /root/.bashrc",
+                "rm go{{.GoVersion}}.linux-amd64.tar.gz",
+                "/usr/local/go/bin/go install golang.org/x/tools/gopls@latest",
+                "/usr/local/go/bin/go install github.com/go-delve/delve/cmd/dlv@latest",
+            },
+            "opensuse": {
+                "curl -OL https://go.dev/dl/go{{.GoVersion}}.linux-amd64.tar.gz",
+                "rm -rf /usr/local/go && tar -C /usr/local -xzf go{{.GoVersion}}.linux-amd64.tar.gz",
                 "echo 'export PATH=$PATH:/usr/local/go/bin' >> /etc/profile",
                 "echo 'export PATH=$PATH:/usr/local/go/bin' >> /root/.bashrc",
-                "rm go1.21.5.linux-amd64.tar.gz",
+                "rm go{{.GoVersion}}.linux-amd64.tar.gz",
+                "/usr/local/go/bin/go install golang.org/x/tools/gopls@latest",
+                "/usr/local/go/bin/go install github.com/go-delve/delve/cmd/dlv@latest",
+            },
+            "alpine": {
+                "curl -OL https://go.dev/dl/go{{.GoVersion}}.linux-amd64.tar.gz",
+                "rm -rf /usr/local/go && tar -C /usr/local -xzf go{{.GoVersion}}.linux-amd64.tar.gz",
+                "echo 'export PATH=$PATH:/usr/local/go/bin' >> /etc/profile",
+                "rm go{{.GoVersion}}.linux-amd64.tar.gz",
                 "/usr/local/go/bin/go install golang.org/x/tools/gopls@latest",
                 "/usr/local/go/bin/go install github.com/go-delve/delve/cmd/dlv@latest",
             },
         },
+        Variables: map[string]string{
+            "GoVersion": "1.21.5",
+        },
+        Verify: map[string][]string{
+            "ubuntu":    {"/usr/local/go/bin/go version"},
+            "debian":    {"/usr/local/go/bin/go version"},
+            "fedora":    {"/usr/local/go/bin/go version"},
+            "rocky":     {"/usr/local/go/bin/go version"},
+            "almalinux": {"/usr/local/go/bin/go version"},
+            "centos":    {"/usr/local/go/bin/go version"},
+            "opensuse":  {"/usr/local/go/bin/go version"},
+            "alpine":    {"/usr/local/go/bin/go version"},
+        },
     },
     "python": {
         ID:          "python",
@@ -403,9 +923,321 @@ var SUPPORTED_TEMPLATES = map[string]VPSTemplate{
                 "echo 'alias pip=pip3' >> /root/.bashrc",
             },
         },
+        Verify: map[string][]string{
+            "ubuntu":    {"python3 --version", "python3 -m pip --version"},
+            "debian":    {"python3 --version", "python3 -m pip --version"},
+            "fedora":    {"python3 --version", "python3 -m pip --version"},
+            "rocky":     {"python3 --version", "python3 -m pip --version"},
+            "almalinux": {"python3 --version", "python3 -m pip --version"},
+            "centos":    {"python3 --version", "python3 -m pip --version"},
+        },
+    },
+    "lamp": {
+        ID:          "lamp",
+        Name:        "LAMP Stack",
+        Description: "Server with Apache, MySQL/MariaDB, and PHP",
+        OSVariants:  []string{"ubuntu-22.04", "ubuntu-20.04", "debian-12", "debian-11", "fedora-40", "fedora-38", "rocky-9", "rocky-8", "almalinux-9", "almalinux-8", "opensuse-15.5"},
+        Packages: map[string][]string{
+            "ubuntu":    {"apache2", "mysql-server", "php", "libapache2-mod-php", "php-mysql"},
+            "debian":    {"apache2", "mariadb-server", "php", "libapache2-mod-php", "php-mysql"},
+            "fedora":    {"httpd", "mariadb-server", "php", "php-mysqlnd"},
+            "rocky":     {"httpd", "mariadb-server", "php", "php-mysqlnd"},
+            "almalinux": {"httpd", "mariadb-server", "php", "php-mysqlnd"},
+            "centos":    {"httpd", "mariadb-server", "php", "php-mysqlnd"},
+            "opensuse":  {"apache2", "apache2-mod_php8", "php8", "php8-mysql", "mariadb"},
+        },
+        Commands: map[string][]string{
+            "ubuntu": {
+                "systemctl enable apache2",
+                "systemctl start apache2",
+                "systemctl enable mysql",
+                "systemctl start mysql",
+                "if command -v ufw >/dev/null 2>&1; then ufw allow 80/tcp && ufw allow 443/tcp; fi",
+            },
+            "debian": {
+                "systemctl enable apache2",
+                "systemctl start apache2",
+                "systemctl enable mariadb",
+                "systemctl start mariadb",
+                "if command -v ufw >/dev/null 2>&1; then ufw allow 80/tcp && ufw allow 443/tcp; fi",
+            },
+            "fedora": {
+                "systemctl enable httpd",
+                "systemctl start httpd",
+                "systemctl enable mariadb",
+                "systemctl start mariadb",
+                "if systemctl is-active --quiet firewalld; then firewall-cmd --permanent --add-service=http && firewall-cmd --permanent --add-service=https && firewall-cmd --reload; fi",
+            },
+            "rocky": {
+                "systemctl enable httpd",
+                "systemctl start httpd",
+                "systemctl enable mariadb",
+                "systemctl start mariadb",
+                "if systemctl is-active --quiet firewalld; then firewall-cmd --permanent --add-service=http && firewall-cmd --permanent --add-service=https && firewall-cmd --reload; fi",
+            },
+            "almalinux": {
+                "systemctl enable httpd",
+                "systemctl start httpd",
+                "systemctl enable mariadb",
+                "systemctl start mariadb",
+                "if systemctl is-active --quiet firewalld; then firewall-cmd --permanent --add-service=http && firewall-cmd --permanent --add-service=https && firewall-cmd --reload; fi",
+            },
+            "centos": {
+                "systemctl enable httpd",
+                "systemctl start httpd",
+                "systemctl enable mariadb",
+                "systemctl start mariadb",
+                "if systemctl is-active --quiet firewalld; then firewall-cmd --permanent --add-service=http && firewall-cmd --permanent --add-service=https && firewall-cmd --reload; fi",
+            },
+            "opensuse": {
+                "a2enmod php8",
+                // The default document root is empty, which Apache answers with 403
+                "test -e /srv/www/htdocs/index.html || echo '<html><body><h1>It works!</h1></body></html>' > /srv/www/htdocs/index.html",
+                "systemctl enable apache2",
+                "systemctl start apache2",
+                "systemctl enable mariadb",
+                "systemctl start mariadb",
+                "if systemctl is-active --quiet firewalld; then firewall-cmd --permanent --add-service=http && firewall-cmd --permanent --add-service=https && firewall-cmd --reload; fi",
+            },
+        },
+        Verify: map[string][]string{
+            "ubuntu":    {"systemctl is-active apache2", "systemctl is-active mysql", "curl -fsS -o /dev/null http://localhost/"},
+            "debian":    {"systemctl is-active apache2", "systemctl is-active mariadb", "curl -fsS -o /dev/null http://localhost/"},
+            "fedora":    {"systemctl is-active httpd", "systemctl is-active mariadb", "curl -fsS -o /dev/null http://localhost/"},
+            "rocky":     {"systemctl is-active httpd", "systemctl is-active mariadb", "curl -fsS -o /dev/null http://localhost/"},
+            "almalinux": {"systemctl is-active httpd", "systemctl is-active mariadb", "curl -fsS -o /dev/null http://localhost/"},
+            "centos":    {"systemctl is-active httpd", "systemctl is-active mariadb", "curl -fsS -o /dev/null http://localhost/"},
+            "opensuse":  {"systemctl is-active apache2", "systemctl is-active mariadb", "curl -fsS -o /dev/null http://localhost/"},
+        },
+        ExposePorts: []int{80, 443},
+    },
+    "wordpress": {
+        ID:          "wordpress",
+        Name:        "WordPress",
+        Description: "WordPress on Apache, MySQL/MariaDB, and PHP, ready for the web installer",
+        OSVariants:  []string{"ubuntu-22.04", "ubuntu-20.04", "debian-12", "debian-11", "fedora-40", "fedora-38", "rocky-9", "rocky-8", "almalinux-9", "almalinux-8"},
+        Packages: map[string][]string{
+            "ubuntu":    {"apache2", "mysql-server", "php", "libapache2-mod-php", "php-mysql", "php-curl", "php-gd", "php-mbstring", "php-xml", "php-zip", "curl"},
+            "debian":    {"apache2", "mariadb-server", "php", "libapache2-mod-php", "php-mysql", "php-curl", "php-gd", "php-mbstring", "php-xml", "php-zip", "curl"},
+            "fedora":    {"httpd", "mariadb-server", "php", "php-mysqlnd", "php-gd", "php-mbstring", "php-xml", "curl", "tar"},
+            "rocky":     {"httpd", "mariadb-server", "php", "php-mysqlnd", "php-gd", "php-mbstring", "php-xml", "curl", "tar"},
+            "almalinux": {"httpd", "mariadb-server", "php", "php-mysqlnd", "php-gd", "php-mbstring", "php-xml", "curl", "tar"},
+            "centos":    {"httpd", "mariadb-server", "php", "php-mysqlnd", "php-gd", "php-mbstring", "php-xml", "curl", "tar"},
+        },
+        Commands: map[string][]string{
+            "ubuntu": {
+                "systemctl enable mysql",
+                "systemctl start mysql",
+                "WP_DB_PASS=$(openssl rand -hex 16)",
+                "mysql -e \"CREATE DATABASE IF NOT EXISTS wordpress; CREATE USER IF NOT EXISTS 'wordpress'@'localhost' IDENTIFIED BY '$WP_DB_PASS'; GRANT ALL PRIVILEGES ON wordpress.* TO 'wordpress'@'localhost'; FLUSH PRIVILEGES;\"",
+                "echo \"$WP_DB_PASS\" > /root/.wordpress-db-password && chmod 600 /root/.wordpress-db-password",
+                "curl -fsSL https://wordpress.org/latest.tar.gz | tar -xz -C /var/www/html --strip-components=1",
+                "rm -f /var/www/html/index.html",
+                "cp /var/www/html/wp-config-sample.php /var/www/html/wp-config.php",
+                "sed -i \"s/database_name_here/wordpress/; s/username_here/wordpress/; s/password_here/$WP_DB_PASS/\" /var/www/html/wp-config.php",
+                "chown -R www-data:www-data /var/www/html",
+                "systemctl enable apache2",
+                "systemctl restart apache2",
+                "if command -v ufw >/dev/null 2>&1; then ufw allow 80/tcp && ufw allow 443/tcp; fi",
+            },
+            "debian": {
+                "systemctl enable mariadb",
+                "systemctl start mariadb",
+                "WP_DB_PASS=$(openssl rand -hex 16)",
+                "mysql -e \"CREATE DATABASE IF NOT EXISTS wordpress; CREATE USER IF NOT EXISTS 'wordpress'@'localhost' IDENTIFIED BY '$WP_DB_PASS'; GRANT ALL PRIVILEGES ON wordpress.* TO 'wordpress'@'localhost'; FLUSH PRIVILEGES;\"",
+                "echo \"$WP_DB_PASS\" > /root/.wordpress-db-password && chmod 600 /root/.wordpress-db-password",
+                "curl -fsSL https://wordpress.org/latest.tar.gz | tar -xz -C /var/www/html --strip-components=1",
+                "rm -f /var/www/html/index.html",
+                "cp /var/www/html/wp-config-sample.php /var/www/html/wp-config.php",
+                "sed -i \"s/database_name_here/wordpress/; s/username_here/wordpress/; s/password_here/$WP_DB_PASS/\" /var/www/html/wp-config.php",
+                "chown -R www-data:www-data /var/www/html",
+                "systemctl enable apache2",
+                "systemctl restart apache2",
+                "if command -v ufw >/dev/null 2>&1; then ufw allow 80/tcp && ufw allow 443/tcp; fi",
+            },
+            "fedora": {
+                "systemctl enable mariadb",
+                "systemctl start mariadb",
+                "WP_DB_PASS=$(openssl rand -hex 16)",
+                "mysql -e \"CREATE DATABASE IF NOT EXISTS wordpress; CREATE USER IF NOT EXISTS 'wordpress'@'localhost' IDENTIFIED BY '$WP_DB_PASS'; GRANT ALL PRIVILEGES ON wordpress.* TO 'wordpress'@'localhost'; FLUSH PRIVILEGES;\"",
+                "echo \"$WP_DB_PASS\" > /root/.wordpress-db-password && chmod 600 /root/.wordpress-db-password",
+                "curl -fsSL https://wordpress.org/latest.tar.gz | tar -xz -C /var/www/html --strip-components=1",
+                "rm -f /var/www/html/index.html",
+                "cp /var/www/html/wp-config-sample.php /var/www/html/wp-config.php",
+                "sed -i \"s/database_name_here/wordpress/; s/username_here/wordpress/; s/password_here/$WP_DB_PASS/\" /var/www/html/wp-config.php",
+                "chown -R apache:apache /var/www/html",
+                "if command -v restorecon >/dev/null 2>&1; then restorecon -R /var/www/html; fi",
+                "systemctl enable httpd",
+                "systemctl restart httpd",
+                "if systemctl is-active --quiet firewalld; then firewall-cmd --permanent --add-service=http && firewall-cmd --permanent --add-service=https && firewall-cmd --reload; fi",
+            },
+            "rocky": {
+                "systemctl enable mariadb",
+                "systemctl start mariadb",
+                "WP_DB_PASS=$(openssl rand -hex 16)",
+                "mysql -e \"CREATE DATABASE IF NOT EXISTS wordpress; CREATE USER IF NOT EXISTS 'wordpress'@'localhost' IDENTIFIED BY '$WP_DB_PASS'; GRANT ALL PRIVILEGES ON wordpress.* TO 'wordpress'@'localhost'; FLUSH PRIVILEGES;\"",
+                "echo \"$WP_DB_PASS\" > /root/.wordpress-db-password && chmod 600 /root/.wordpress-db-password",
+                "curl -fsSL https://wordpress.org/latest.tar.gz | tar -xz -C /var/www/html --strip-components=1",
+                "rm -f /var/www/html/index.html",
+                "cp /var/www/html/wp-config-sample.php /var/www/html/wp-config.php",
+                "sed -i \"s/database_name_here/wordpress/; s/username_here/wordpress/; s/password_here/$WP_DB_PASS/\" /var/www/html/wp-config.php",
+                "chown -R apache:apache /var/www/html",
+                "if command -v restorecon >/dev/null 2>&1; then restorecon -R /var/www/html; fi",
+                "systemctl enable httpd",
+                "systemctl restart httpd",
+                "if systemctl is-active --quiet firewalld; then firewall-cmd --permanent --add-service=http && firewall-cmd --permanent --add-service=https && firewall-cmd --reload; fi",
+            },
+            "almalinux": {
+                "systemctl enable mariadb",
+                "systemctl start mariadb",
+                "WP_DB_PASS=$(openssl rand -hex 16)",
+                "mysql -e \"CREATE DATABASE IF NOT EXISTS wordpress; CREATE USER IF NOT EXISTS 'wordpress'@'localhost' IDENTIFIED BY '$WP_DB_PASS'; GRANT ALL PRIVILEGES ON wordpress.* TO 'wordpress'@'localhost'; FLUSH PRIVILEGES;\"",
+                "echo \"$WP_DB_PASS\" > /root/.wordpress-db-password && chmod 600 /root/.wordpress-db-password",
+                "curl -fsSL https://wordpress.org/latest.tar.gz | tar -xz -C /var/www/html --strip-components=1",
+                "rm -f /var/www/html/index.html",
+                "cp /var/www/html/wp-config-sample.php /var/www/html/wp-config.php",
+                "sed -i \"s/database_name_here/wordpress/; s/username_here/wordpress/; s/password_here/$WP_DB_PASS/\" /var/www/html/wp-config.php",
+                "chown -R apache:apache /var/www/html",
+                "if command -v restorecon >/dev/null 2>&1; then restorecon -R /var/www/html; fi",
+                "systemctl enable httpd",
+                "systemctl restart httpd",
+                "if systemctl is-active --quiet firewalld; then firewall-cmd --permanent --add-service=http && firewall-cmd --permanent --add-service=https && firewall-cmd --reload; fi",
+            },
+            "centos": {
+                "systemctl enable mariadb",
+                "systemctl start mariadb",
+                "WP_DB_PASS=$(openssl rand -hex 16)",
+                "mysql -e \"CREATE DATABASE IF NOT EXISTS wordpress; CREATE USER IF NOT EXISTS 'wordpress'@'localhost' IDENTIFIED BY '$WP_DB_PASS'; GRANT ALL PRIVILEGES ON wordpress.* TO 'wordpress'@'localhost'; FLUSH PRIVILEGES;\"",
+                "echo \"$WP_DB_PASS\" > /root/.wordpress-db-password && chmod 600 /root/.wordpress-db-password",
+                "curl -fsSL https://wordpress.org/latest.tar.gz | tar -xz -C /var/www/html --strip-components=1",
+                "rm -f /var/www/html/index.html",
+                "cp /var/www/html/wp-config-sample.php /var/www/html/wp-config.php",
+                "sed -i \"s/database_name_here/wordpress/; s/username_here/wordpress/; s/password_here/$WP_DB_PASS/\" /var/www/html/wp-config.php",
+                "chown -R apache:apache /var/www/html",
+                "if command -v restorecon >/dev/null 2>&1; then restorecon -R /var/www/html; fi",
+                "systemctl enable httpd",
+                "systemctl restart httpd",
+                "if systemctl is-active --quiet firewalld; then firewall-cmd --permanent --add-service=http && firewall-cmd --permanent --add-service=https && firewall-cmd --reload; fi",
+            },
+        },
+        Verify: map[string][]string{
+            "ubuntu":    {"systemctl is-active apache2", "systemctl is-active mysql", "curl -fsS -o /dev/null http://localhost/wp-admin/install.php"},
+            "debian":    {"systemctl is-active apache2", "systemctl is-active mariadb", "curl -fsS -o /dev/null http://localhost/wp-admin/install.php"},
+            "fedora":    {"systemctl is-active httpd", "systemctl is-active mariadb", "curl -fsS -o /dev/null http://localhost/wp-admin/install.php"},
+            "rocky":     {"systemctl is-active httpd", "systemctl is-active mariadb", "curl -fsS -o /dev/null http://localhost/wp-admin/install.php"},
+            "almalinux": {"systemctl is-active httpd", "systemctl is-active mariadb", "curl -fsS -o /dev/null http://localhost/wp-admin/install.php"},
+            "centos":    {"systemctl is-active httpd", "systemctl is-active mariadb", "curl -fsS -o /dev/null http://localhost/wp-admin/install.php"},
+        },
+        ExposePorts: []int{80, 443},
+        DefaultDiskGB: 80,
     },
 }
 
+// Templates registered through /api/templates/create, one JSON file each
+// under baseDir/templates. They sit beside SUPPORTED_TEMPLATES and can't
+// replace a built-in one.
+var userTemplates = &templateRegistry{templates: make(map[string]VPSTemplate)}
+
+type templateRegistry struct {
+    mutex     sync.RWMutex
+    dir       string
+    templates map[string]VPSTemplate
+}
+
+var errBuiltInTemplate = errors.New("built-in templates can't be replaced")
+
+// Read every saved template from dir. A file that no longer validates is
+// skipped with a warning rather than failing startup.
+func (t *templateRegistry) load(dir string) error {
+    entries, err := os.ReadDir(dir)
+    if err != nil {
+        return fmt.Errorf("failed to read templates directory: %v", err)
+    }
+
+    t.mutex.Lock()
+    defer t.mutex.Unlock()
+    t.dir = dir
+    for _, entry := range entries {
+        if entry.IsDir() || filepath.Ext(entry.Name()) != ".json" {
+            continue
+        }
+        data, err := os.ReadFile(filepath.Join(dir, entry.Name()))
+        if err != nil {
+            log.Printf("Warning: Failed to read template %s: %v", entry.Name(), err)
+            continue
+        }
+        var template VPSTemplate
+        if err := json.Unmarshal(data, &template); err != nil {
+            log.Printf("Warning: Failed to parse template %s: %v", entry.Name(), err)
+            continue
+        }
+        if err := validateUserTemplate(&template); err != nil {
+            log.Printf("Warning: Skipping template %s: %v", entry.Name(), err)
+            continue
+        }
+        if template.ID+".json" != entry.Name() {
+            log.Printf("Warning: Skipping template %s: id %q doesn't match the file name", entry.Name(), template.ID)
+            continue
+        }
+        t.templates[template.ID] = template
+    }
+    if len(t.templates) > 0 {
+        log.Printf("Loaded %d user templates", len(t.templates))
+    }
+    return nil
+}
+
+// Save a validated template, replacing any user template with the same ID.
+// Reports whether it replaced one.
+func (t *templateRegistry) put(template VPSTemplate) (bool, error) {
+    if _, exists := SUPPORTED_TEMPLATES[template.ID]; exists {
+        return false, fmt.Errorf("%w: %s", errBuiltInTemplate, template.ID)
+    }
+    data, err := json.MarshalIndent(template, "", "  ")
+    if err != nil {
+        return false, fmt.Errorf("failed to encode template: %v", err)
+    }
+
+    t.mutex.Lock()
+    defer t.mutex.Unlock()
+    path := filepath.Join(t.dir, template.ID+".json")
+    tmpPath := path + ".tmp"
+    if err := os.WriteFile(tmpPath, data, 0644); err != nil {
+        return false, fmt.Errorf("failed to write template: %v", err)
+    }
+    if err := os.Rename(tmpPath, path); err != nil {
+        os.Remove(tmpPath)
+        return false, fmt.Errorf("failed to save template: %v", err)
+    }
+    _, replaced := t.templates[template.ID]
+    t.templates[template.ID] = template
+    return replaced, nil
+}
+
+// Helper function to look up a built-in or user template
+func lookupTemplate(id string) (VPSTemplate, bool) {
+    if template, exists := SUPPORTED_TEMPLATES[id]; exists {
+        return template, true
+    }
+    userTemplates.mutex.RLock()
+    defer userTemplates.mutex.RUnlock()
+    template, exists := userTemplates.templates[id]
+    return template, exists
+}
+
+// Helper function to list the built-in templates followed by the user ones
+func allTemplates() []VPSTemplate {
+    userTemplates.mutex.RLock()
+    defer userTemplates.mutex.RUnlock()
+    templates := make([]VPSTemplate, 0, len(SUPPORTED_TEMPLATES)+len(userTemplates.templates))
+    for _, template := range SUPPORTED_TEMPLATES {
+        templates = append(templates, template)
+    }
+    for _, template := range userTemplates.templates {
+        templates = append(templates, template)
+    }
+    return templates
+}
 
 func getBaseImagePath(imageType string) string {
     return filepath.Join(BASE_DIR, imageType + ".qcow2")
@@ -427,1201 +1259,8555 @@ func checkProcess(pid int) error {
     }
 
     cmdline := string(cmdlineBytes)
-    if !strings.Contains(cmdline, "qemu-system") {
+    if !strings.Contains(cmdline, "qemu-system") && !strings.Contains(cmdline, filepath.Base(qemuBinary())) {
         return fmt.Errorf("process is not a QEMU process")
     }
 
     return nil
 }
 
-func generatePassword() (string, error) {
-    bytes := make([]byte, 4)
-    if _, err := rand.Read(bytes); err != nil {
-        return "", err
+// Create the per-VPS cgroup and set its CPU quota and memory ceiling. Must be
+// called before QEMU is launched; the process is attached with addToCgroup.
+func createCgroup(id string, vcpus int, memoryMB int) error {
+    if _, err := os.Stat("/sys/fs/cgroup/cgroup.controllers"); err != nil {
+        return fmt.Errorf("cgroup v2 not available: %v", err)
     }
-    return base64.URLEncoding.EncodeToString(bytes)[:6], nil
-}
 
-func NewVPSManager(baseDir string) (*VPSManager, error) {
-    dirs := []string{"images", "disks", "logs", "base"}
-    for _, dir := range dirs {
-        path := filepath.Join(baseDir, dir)
-        if err := os.MkdirAll(path, 0755); err != nil {
-            return nil, fmt.Errorf("failed to create directory %s: %v", path, err)
-        }
+    // Delegate the cpu and memory controllers down to the per-VPS groups
+    if err := os.MkdirAll(CGROUP_ROOT, 0755); err != nil {
+        return fmt.Errorf("failed to create cgroup root: %v", err)
     }
-
-    for imageType := range SUPPORTED_IMAGES {
-        baseImagePath := getBaseImagePath(imageType)
-        if _, err := os.Stat(baseImagePath); os.IsNotExist(err) {
-            if err := downloadAndPrepareBaseImage(imageType); err != nil {
-                log.Printf("Warning: Failed to prepare %s base image: %v", imageType, err)
-            }
+    for _, dir := range []string{filepath.Dir(CGROUP_ROOT), CGROUP_ROOT} {
+        control := filepath.Join(dir, "cgroup.subtree_control")
+        if err := os.WriteFile(control, []byte("+cpu +memory"), 0644); err != nil {
+            return fmt.Errorf("failed to enable controllers in %s: %v", dir, err)
         }
     }
 
+    group := filepath.Join(CGROUP_ROOT, id)
+    if err := os.MkdirAll(group, 0755); err != nil {
+        return fmt.Errorf("failed to create cgroup: %v", err)
+    }
 
-    manager := &VPSManager{
-        instances:     make(map[string]*VPS),
-        ipInstances:   make(map[string]string),
-        nextVNCPort:   5900,
-        nextSSHPort:   SSH_PORT_START,
-        baseDir:       baseDir,
-        metricsCache:  make(map[string]*MetricsCache),
+    if err := setCgroupCPUs(id, vcpus); err != nil {
+        return err
     }
 
+    memoryMax := fmt.Sprintf("%d", int64(memoryMB+CGROUP_MEMORY_OVERHEAD)*1024*1024)
+    if err := os.WriteFile(filepath.Join(group, "memory.max"), []byte(memoryMax), 0644); err != nil {
+        return fmt.Errorf("failed to set memory.max: %v", err)
+    }
 
-    // Start metrics collection routine
-    go manager.metricsCollector()
-    
-    return manager, nil
+    return nil
 }
 
-
-func (m *VPSManager) hasVPSForIP(ip string) (bool, string) {
-    m.mutex.RLock()
-    defer m.mutex.RUnlock()
-    
-    if vpsID, exists := m.ipInstances[ip]; exists {
-        if vps, ok := m.instances[vpsID]; ok {
-            // Check if VPS has expired
-            if time.Now().After(vps.ExpiresAt) {
-                return false, ""
-            }
-            return true, vpsID
-        }
+// Set a VPS's CPU quota, also used when vCPUs are hot-plugged
+func setCgroupCPUs(id string, vcpus int) error {
+    // Quota is expressed per 100ms period, one full period per vCPU
+    cpuMax := fmt.Sprintf("%d 100000", vcpus*100000)
+    if err := os.WriteFile(filepath.Join(CGROUP_ROOT, id, "cpu.max"), []byte(cpuMax), 0644); err != nil {
+        return fmt.Errorf("failed to set cpu.max: %v", err)
     }
-    return false, ""
+    return nil
 }
 
-
-func downloadAndPrepareBaseImage(imageType string) error {
-    imageURL, exists := SUPPORTED_IMAGES[imageType]
-    if !exists {
-        return fmt.Errorf("unsupported image type: %s", imageType)
+func addToCgroup(id string, pid int) error {
+    group := filepath.Join(CGROUP_ROOT, id)
+    if _, err := os.Stat(group); err != nil {
+        return fmt.Errorf("cgroup does not exist: %v", err)
     }
+    return os.WriteFile(filepath.Join(group, "cgroup.procs"), []byte(strconv.Itoa(pid)), 0644)
+}
 
-    log.Printf("Starting base image preparation for %s", imageType)
-    
-    tmpDir := "/tmp/vps-download"
-    if err := os.MkdirAll(tmpDir, 0755); err != nil {
-        return fmt.Errorf("failed to create temp directory: %v", err)
+// Remove the per-VPS cgroup. The kernel refuses while QEMU is still exiting,
+// so retry briefly after a kill.
+func removeCgroup(id string) {
+    group := filepath.Join(CGROUP_ROOT, id)
+    if _, err := os.Stat(group); os.IsNotExist(err) {
+        return
     }
-    defer os.RemoveAll(tmpDir)
 
-    tmpImagePath := filepath.Join(tmpDir, filepath.Base(imageURL))
-    baseImagePath := getBaseImagePath(imageType)
-    
-    log.Printf("Downloading %s image to %s", imageType, tmpImagePath)
-    downloadCmd := exec.Command("wget",
-        "--progress=bar:force",
-        "-O", tmpImagePath,
-        imageURL)
-    downloadCmd.Stdout = os.Stdout
-    downloadCmd.Stderr = os.Stderr
-    
-    if err := downloadCmd.Run(); err != nil {
-        return fmt.Errorf("failed to download image: %v", err)
+    var err error
+    for i := 0; i < 10; i++ {
+        if err = os.Remove(group); err == nil || os.IsNotExist(err) {
+            return
+        }
+        time.Sleep(500 * time.Millisecond)
     }
+    log.Printf("Warning: Failed to remove cgroup for VPS %s: %v", id, err)
+}
 
-    baseDir := filepath.Dir(baseImagePath)
-    if err := os.MkdirAll(baseDir, 0755); err != nil {
-        return fmt.Errorf("failed to create base directory: %v", err)
-    }
+// Tap interface names are limited to 15 characters
+func tapName(id string) string {
+    return "blst" + strings.ReplaceAll(id, "-", "")[:10]
+}
 
-    log.Printf("Converting and resizing image to %dG", DISK_SIZE)
-    convertCmd := exec.Command("qemu-img", "convert",
-        "-f", "qcow2",
-        "-O", "qcow2",
-        tmpImagePath,
-        baseImagePath)
-    
-    if output, err := convertCmd.CombinedOutput(); err != nil {
-        return fmt.Errorf("failed to convert image: %v, output: %s", err, string(output))
+// Helper function to name the tap of a VPS's i-th NIC. The first keeps the
+// plain name so single-NIC guests are unchanged.
+func nicTapName(id string, i int) string {
+    if i == 0 {
+        return tapName(id)
     }
+    return tapName(id) + strconv.Itoa(i)
+}
 
-    resizeCmd := exec.Command("qemu-img", "resize", baseImagePath, fmt.Sprintf("%dG", DISK_SIZE))
-    if output, err := resizeCmd.CombinedOutput(); err != nil {
-        return fmt.Errorf("failed to resize image: %v, output: %s", err, string(output))
+// Helper function to get the MAC of a VPS's i-th NIC. Derived MACs vary the
+// fourth octet by index so they stay stable and unique per VPS.
+func nicMAC(id string, i int, nic NICConfig) string {
+    if nic.MAC != "" {
+        return nic.MAC
     }
-
-    if err := os.Chmod(baseImagePath, 0644); err != nil {
-        return fmt.Errorf("failed to set image permissions: %v", err)
+    if i == 0 {
+        return generateMacAddress(id)
     }
-
-    log.Printf("Base image preparation completed successfully for %s", imageType)
-    return nil
+    cleanID := strings.ReplaceAll(id, "-", "")
+    return fmt.Sprintf("52:54:%02x:%s:%s:%s", i, cleanID[0:2], cleanID[2:4], cleanID[4:6])
 }
 
-func prependIndent(commands []string, indent string) []string {
-    indented := make([]string, len(commands))
-    for i, cmd := range commands {
-        indented[i] = indent + cmd
+// Helper function to get a VPS's NICs, defaulting to one in its network mode
+func (m *VPSManager) vpsNICs(vps *VPS) []NICConfig {
+    if len(vps.NICs) > 0 {
+        return vps.NICs
     }
-    return indented
+    if vps.NetworkMode != "" {
+        return []NICConfig{{Type: vps.NetworkMode}}
+    }
+    return []NICConfig{{Type: m.networkMode}}
 }
 
-func createCloudInitISO(path string, rootPassword string, imageType string, hostname string, template string) error {
-    tmpDir, err := os.MkdirTemp("", "cloud-init")
-    if err != nil {
-        return err
-    }
-    defer os.RemoveAll(tmpDir)
+var bridgeNamePattern = regexp.MustCompile(`^[A-Za-z0-9_.-]{1,15}$`)
 
-    // Get template configuration
-    templateConfig, exists := SUPPORTED_TEMPLATES[template]
-    if !exists {
-        templateConfig = SUPPORTED_TEMPLATES["blank"]
+func (m *VPSManager) validateNICs(nics []NICConfig) error {
+    if len(nics) > MAX_NICS {
+        return fmt.Errorf("at most %d NICs are supported", MAX_NICS)
     }
 
-    // Determine OS family for package management
-    osFamily := getOSFamily(imageType)
-    if osFamily == "" {
-        return fmt.Errorf("unsupported OS type: %s", imageType)
-    }
+    macs := make(map[string]bool)
+    hostPorts := make(map[string]bool)
+    for i := range nics {
+        nic := &nics[i]
+        switch nic.Type {
+        case NetworkModeUser:
+            if nic.Bridge != "" {
+                return fmt.Errorf("nic %d: bridge is only valid for bridge NICs", i)
+            }
+        case NetworkModeBridge:
+            if len(nic.Forwards) > 0 {
+                return fmt.Errorf("nic %d: forwards are only valid for user NICs", i)
+            }
+            if nic.Bridge == "" {
+                nic.Bridge = m.bridge
+            }
+            if !bridgeNamePattern.MatchString(nic.Bridge) {
+                return fmt.Errorf("nic %d: invalid bridge name: %s", i, nic.Bridge)
+            }
+            if _, err := exec.LookPath("ip"); err != nil {
+                return fmt.Errorf("nic %d: bridge NICs need the ip tool on the host", i)
+            }
+            if _, err := os.Stat(filepath.Join("/sys/class/net", nic.Bridge, "bridge")); err != nil {
+                return fmt.Errorf("nic %d: host bridge %s does not exist", i, nic.Bridge)
+            }
+        default:
+            return fmt.Errorf("nic %d: unsupported type: %s", i, nic.Type)
+        }
+
+        if nic.MAC != "" {
+            hw, err := net.ParseMAC(nic.MAC)
+            if err != nil || len(hw) != 6 || hw[0]&1 == 1 {
+                return fmt.Errorf("nic %d: invalid unicast MAC address: %s", i, nic.MAC)
+            }
+            nic.MAC = hw.String()
+            if macs[nic.MAC] {
+                return fmt.Errorf("nic %d: duplicate MAC address: %s", i, nic.MAC)
+            }
+            macs[nic.MAC] = true
+        }
+
+        if err := validatePortForwards(nic.Forwards, hostPorts); err != nil {
+            return fmt.Errorf("nic %d: %v", i, err)
+        }
+    }
+    return nil
+}
+
+// Check requested forwards and default their protocol to tcp. hostPorts
+// collects protocol/port keys so duplicates across calls are caught too.
+func validatePortForwards(forwards []PortForward, hostPorts map[string]bool) error {
+    for j := range forwards {
+        fwd := &forwards[j]
+        if fwd.Protocol == "" {
+            fwd.Protocol = "tcp"
+        }
+        if fwd.Protocol != "tcp" && fwd.Protocol != "udp" {
+            return fmt.Errorf("unsupported forward protocol: %s", fwd.Protocol)
+        }
+        if fwd.HostPort < 1024 || fwd.HostPort > 65535 || fwd.GuestPort < 1 || fwd.GuestPort > 65535 {
+            return fmt.Errorf("forward ports must be 1024-65535 on the host and 1-65535 in the guest")
+        }
+        key := fmt.Sprintf("%s/%d", fwd.Protocol, fwd.HostPort)
+        if hostPorts[key] {
+            return fmt.Errorf("host port %s is forwarded twice", key)
+        }
+        hostPorts[key] = true
+    }
+    return nil
+}
+
+// Helper function to collect the host ports every VPS holds, keyed
+// protocol/port like validatePortForwards. The caller must hold m.mutex.
+func (m *VPSManager) hostPortsInUseLocked() map[string]bool {
+    inUse := make(map[string]bool)
+    for _, vps := range m.instances {
+        inUse[fmt.Sprintf("tcp/%d", vps.VNCPort)] = true
+        if vps.SSHPort > 0 {
+            inUse[fmt.Sprintf("tcp/%d", vps.SSHPort)] = true
+        }
+        for _, fwd := range vps.PortForwards {
+            inUse[fmt.Sprintf("%s/%d", fwd.Protocol, fwd.HostPort)] = true
+        }
+        for _, nic := range vps.NICs {
+            for _, fwd := range nic.Forwards {
+                inUse[fmt.Sprintf("%s/%d", fwd.Protocol, fwd.HostPort)] = true
+            }
+        }
+    }
+    return inUse
+}
+
+var errPortsExhausted = errors.New("no free host port left")
+
+// Hand out the lowest port in r that no VPS holds. A deleted VPS's ports are
+// free again as soon as it leaves m.instances, so each candidate is also
+// test-bound in case its QEMU, or anything else on the host, still has it.
+// The port is added to inUse so one caller can take several. The caller must
+// hold m.mutex.
+func (m *VPSManager) allocatePortLocked(r portRange, inUse map[string]bool) (int, error) {
+    for port := r.First; port <= r.Last; port++ {
+        key := fmt.Sprintf("tcp/%d", port)
+        if inUse[key] {
+            continue
+        }
+        listener, err := net.Listen("tcp", net.JoinHostPort(m.bindAddress, strconv.Itoa(port)))
+        if err != nil {
+            continue
+        }
+        listener.Close()
+        inUse[key] = true
+        return port, nil
+    }
+    return 0, fmt.Errorf("%w in %d-%d", errPortsExhausted, r.First, r.Last)
+}
+
+// Create the tap of every bridge NIC a VPS has
+func (m *VPSManager) createTapDevices(vps *VPS) error {
+    for i, nic := range m.vpsNICs(vps) {
+        if nic.Type != NetworkModeBridge {
+            continue
+        }
+        bridge := nic.Bridge
+        if bridge == "" {
+            bridge = m.bridge
+        }
+        if err := createTapDevice(nicTapName(vps.ID, i), bridge); err != nil {
+            return err
+        }
+    }
+    return nil
+}
+
+// Create (or reuse) a tap device and attach it to the bridge. Taps are
+// persistent so they survive QEMU restarts and are removed with the VPS.
+func createTapDevice(tap string, bridge string) error {
+    if _, err := os.Stat(filepath.Join("/sys/class/net", tap)); os.IsNotExist(err) {
+        if output, err := exec.Command("ip", "tuntap", "add", "dev", tap, "mode", "tap").CombinedOutput(); err != nil {
+            return fmt.Errorf("failed to create tap device: %v, output: %s", err, string(output))
+        }
+    }
+    if output, err := exec.Command("ip", "link", "set", tap, "master", bridge).CombinedOutput(); err != nil {
+        return fmt.Errorf("failed to attach tap device to %s: %v, output: %s", bridge, err, string(output))
+    }
+    if output, err := exec.Command("ip", "link", "set", tap, "up").CombinedOutput(); err != nil {
+        return fmt.Errorf("failed to bring up tap device: %v, output: %s", err, string(output))
+    }
+    return nil
+}
+
+// Remove every tap a VPS may have, one per bridge NIC
+func removeTapDevice(id string) {
+    for i := 0; i < MAX_NICS; i++ {
+        tap := nicTapName(id, i)
+        if _, err := os.Stat(filepath.Join("/sys/class/net", tap)); os.IsNotExist(err) {
+            continue
+        }
+        if output, err := exec.Command("ip", "link", "delete", tap).CombinedOutput(); err != nil {
+            log.Printf("Warning: Failed to remove tap device %s: %v, output: %s", tap, err, string(output))
+        }
+    }
+}
+
+func generatePassword() (string, error) {
+    bytes := make([]byte, 4)
+    if _, err := rand.Read(bytes); err != nil {
+        return "", err
+    }
+    return base64.URLEncoding.EncodeToString(bytes)[:6], nil
+}
+
+const cryptAlphabet = "./0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+
+// Hash a password with SHA-512 crypt ($6$, 5000 rounds, 16 character salt)
+// so cloud-init can set it through passwd: without the plaintext on disk
+func hashPassword(plain string) (string, error) {
+    salt := make([]byte, 16)
+    if _, err := rand.Read(salt); err != nil {
+        return "", err
+    }
+    for i := range salt {
+        salt[i] = cryptAlphabet[salt[i]&0x3f]
+    }
+    return sha512Crypt([]byte(plain), salt), nil
+}
+
+// SHA-512 crypt as specified by Ulrich Drepper, with the default round count
+func sha512Crypt(key, salt []byte) string {
+    const rounds = 5000
+
+    alt := sha512.New()
+    alt.Write(key)
+    alt.Write(salt)
+    alt.Write(key)
+    altSum := alt.Sum(nil)
+
+    a := sha512.New()
+    a.Write(key)
+    a.Write(salt)
+    n := len(key)
+    for ; n > 64; n -= 64 {
+        a.Write(altSum)
+    }
+    a.Write(altSum[:n])
+    for n = len(key); n > 0; n >>= 1 {
+        if n&1 != 0 {
+            a.Write(altSum)
+        } else {
+            a.Write(key)
+        }
+    }
+    sum := a.Sum(nil)
+
+    dp := sha512.New()
+    for range key {
+        dp.Write(key)
+    }
+    p := bytes.Repeat(dp.Sum(nil), len(key)/64+1)[:len(key)]
+
+    ds := sha512.New()
+    for i := 0; i < 16+int(sum[0]); i++ {
+        ds.Write(salt)
+    }
+    sSeq := ds.Sum(nil)[:len(salt)]
+
+    for i := 0; i < rounds; i++ {
+        c := sha512.New()
+        if i&1 != 0 {
+            c.Write(p)
+        } else {
+            c.Write(sum)
+        }
+        if i%3 != 0 {
+            c.Write(sSeq)
+        }
+        if i%7 != 0 {
+            c.Write(p)
+        }
+        if i&1 != 0 {
+            c.Write(sum)
+        } else {
+            c.Write(p)
+        }
+        sum = c.Sum(nil)
+    }
+
+    // rounds= is optional at the default, but spelling it out keeps the
+    // cost visible in the stored hash
+    var out strings.Builder
+    fmt.Fprintf(&out, "$6$rounds=%d$", rounds)
+    out.Write(salt)
+    out.WriteByte('$')
+    encode := func(b2, b1, b0 byte, chars int) {
+        w := uint(b2)<<16 | uint(b1)<<8 | uint(b0)
+        for ; chars > 0; chars-- {
+            out.WriteByte(cryptAlphabet[w&0x3f])
+            w >>= 6
+        }
+    }
+    // Bytes are emitted in the order the spec permutes them
+    for i := 0; i < 21; i++ {
+        encode(sum[i*22%63], sum[(i*22+21)%63], sum[(i*22+42)%63], 4)
+    }
+    encode(0, 0, sum[63], 2)
+    return out.String()
+}
+
+func NewVPSManager(baseDir string) (*VPSManager, error) {
+    dirs := []string{"images", "disks", "logs", "base", "uploads", "templates"}
+    for _, dir := range dirs {
+        path := filepath.Join(baseDir, dir)
+        if err := os.MkdirAll(path, 0755); err != nil {
+            return nil, fmt.Errorf("failed to create directory %s: %v", path, err)
+        }
+    }
+
+    for imageType, imageURL := range SUPPORTED_IMAGES {
+        baseImagePath := getBaseImagePath(imageType)
+        if _, err := os.Stat(baseImagePath); os.IsNotExist(err) {
+            if err := downloadAndPrepareBaseImage(context.Background(), imageType, imageURL, 0, nil); err != nil {
+                log.Printf("Warning: Failed to prepare %s base image: %v", imageType, err)
+            }
+        }
+    }
+
+
+    manager := &VPSManager{
+        instances:     make(map[string]*VPS),
+        ipInstances:   make(map[string][]string),
+        // Off by default: behind the bundled frontend every create comes
+        // from its address unless it forwards the browser's, see
+        // TRUSTED_PROXY_HOPS in frontend/example.env
+        maxVPSPerIP:   getEnvInt("BLST_MAX_VPS_PER_IP", 0),
+        baseDir:       baseDir,
+        metricsCache:  make(map[string]*MetricsCache),
+        idlePolicy:    loadIdlePolicy(),
+        autoResumeIOError: getEnvBool("BLST_IO_ERROR_AUTO_RESUME", false),
+        virtioRNG:     getEnvBool("BLST_VIRTIO_RNG", true),
+        // BLST_QEMU_FAST_BOOT is the old name. The profile was never shown
+        // to boot faster than pc, so the name no longer promises it.
+        q35Machine:    getEnvBool("BLST_QEMU_Q35", getEnvBool("BLST_QEMU_FAST_BOOT", false)),
+        networkMode:   getEnvString("BLST_NETWORK_MODE", NetworkModeUser),
+        bridge:        getEnvString("BLST_BRIDGE", "br0"),
+        // VNC has no authentication, so raw VNC and SSH forwards stay on
+        // loopback and the console is reached through /api/vps/vnc. Earlier
+        // releases bound everything to 0.0.0.0; set BLST_BIND_ADDRESS=0.0.0.0
+        // to keep exposing them publicly.
+        bindAddress:   getEnvString("BLST_BIND_ADDRESS", "127.0.0.1"),
+        defaultTemplate: getEnvString("BLST_DEFAULT_TEMPLATE", "blank"),
+        defaultImage:    getEnvString("BLST_DEFAULT_IMAGE", "ubuntu-22.04"),
+        maxImageDownload: int64(getEnvInt("BLST_MAX_IMAGE_DOWNLOAD_BYTES", MAX_IMAGE_DOWNLOAD)),
+        maxCustomImages: getEnvInt("BLST_MAX_CUSTOM_IMAGES", MAX_CUSTOM_IMAGES),
+        qemuExtraArgs:   strings.Fields(os.Getenv("BLST_QEMU_EXTRA_ARGS")),
+        downloads:       make(map[string]*imageDownload),
+        launchSlots:     make(chan struct{}, getEnvInt("BLST_MAX_CONCURRENT_LAUNCHES", 4)),
+        createSlots:     make(chan struct{}, max(getEnvInt("BLST_MAX_CONCURRENT_CREATES", 8), 1)),
+        queuedCreates:   make(map[string]context.CancelFunc),
+        serialConsoles:  make(map[string]bool),
+        createTimeout:   getEnvDuration("BLST_CREATE_TIMEOUT", 30*time.Minute),
+        removeFailed:    getEnvBool("BLST_REMOVE_FAILED", false),
+        expiryWarning:   getEnvDuration("BLST_EXPIRY_WARNING", 2*time.Minute),
+        metricsInterval: getEnvDuration("BLST_METRICS_INTERVAL", 2*time.Second),
+        metricsHistorySize: getEnvInt("BLST_METRICS_HISTORY_SIZE", 0),
+        cloudInitDatasource: getEnvString("BLST_CLOUD_INIT_DATASOURCE", CloudInitNoCloud),
+        cloudInitLabel:  os.Getenv("BLST_CLOUD_INIT_LABEL"),
+        cloudInitSeed:   getEnvString("BLST_CLOUD_INIT_SEED", CloudInitSeedISO),
+        events:          newEventHub(),
+        idempotencyKeys: make(map[string]*idempotencyEntry),
+        idempotencyTTL:  getEnvDuration("BLST_IDEMPOTENCY_TTL", 24*time.Hour),
+        maxLifetime:     getEnvDuration("BLST_MAX_LIFETIME", 24*time.Hour),
+        expiryTimers:    make(map[string]*time.Timer),
+        maxMemoryMB:     getEnvInt("BLST_MAX_MEMORY_MB", 0),
+        maxVCPUs:        getEnvInt("BLST_MAX_VCPUS", 0),
+        maxDiskGB:       getEnvInt("BLST_MAX_DISK_GB", 0),
+    }
+
+    qemuBin, err := exec.LookPath(qemuBinary())
+    if err != nil {
+        return nil, fmt.Errorf("%s not found: %v", qemuBinary(), err)
+    }
+    manager.qemuBin = qemuBin
+    if len(manager.qemuExtraArgs) > 0 {
+        log.Printf("Extra QEMU args: %s", strings.Join(manager.qemuExtraArgs, " "))
+    }
+
+    manager.cpuModels, manager.cpuFlags, err = queryCPUModels(qemuBin)
+    if err != nil {
+        // Guests can still use the default host model
+        log.Printf("Warning: Failed to list QEMU CPU models, only %q is accepted: %v", DEFAULT_CPU_MODEL, err)
+        manager.cpuModels = map[string]bool{DEFAULT_CPU_MODEL: true}
+        manager.cpuFlags = map[string]bool{}
+    }
+
+    if err := userTemplates.load(filepath.Join(baseDir, "templates")); err != nil {
+        return nil, err
+    }
+    if _, exists := lookupTemplate(manager.defaultTemplate); !exists {
+        return nil, fmt.Errorf("unsupported default template: %s", manager.defaultTemplate)
+    }
+    if _, exists := SUPPORTED_IMAGES[manager.defaultImage]; !exists {
+        return nil, fmt.Errorf("unsupported default image: %s", manager.defaultImage)
+    }
+    log.Printf("Default template: %s, default image: %s", manager.defaultTemplate, manager.defaultImage)
+
+    if manager.cloudInitLabel == "" {
+        manager.cloudInitLabel = defaultCloudInitLabel(manager.cloudInitDatasource)
+    }
+    if err := validateCloudInitSeed(manager.cloudInitDatasource, manager.cloudInitLabel); err != nil {
+        return nil, err
+    }
+    switch manager.cloudInitSeed {
+    case CloudInitSeedISO:
+    case CloudInitSeedSMBIOS:
+        if manager.cloudInitDatasource == CloudInitConfigDrive {
+            return nil, fmt.Errorf("BLST_CLOUD_INIT_DATASOURCE=configdrive needs BLST_CLOUD_INIT_SEED=iso")
+        }
+        // 10.0.2.2 is the host only from behind user-mode NAT
+        if manager.networkMode == NetworkModeBridge && os.Getenv("BLST_SEED_URL") == "" {
+            return nil, fmt.Errorf("BLST_SEED_URL is required for smbios seeding with bridged networking")
+        }
+        if manager.seedURL, err = seedURLFromEnv(); err != nil {
+            return nil, err
+        }
+        log.Printf("Guests fetch cloud-init from %s/seed/", manager.seedURL)
+    default:
+        return nil, fmt.Errorf("unsupported BLST_CLOUD_INIT_SEED: %s", manager.cloudInitSeed)
+    }
+
+    manager.storagePaths, err = loadStoragePaths(baseDir)
+    if err != nil {
+        return nil, err
+    }
+
+    if err := manager.loadResourceLimits(); err != nil {
+        return nil, err
+    }
+    if manager.maxLifetime < VPS_LIFETIME {
+        return nil, fmt.Errorf("BLST_MAX_LIFETIME must be at least %s", VPS_LIFETIME)
+    }
+    if manager.metricsInterval <= 0 {
+        return nil, fmt.Errorf("BLST_METRICS_INTERVAL must be positive")
+    }
+    if manager.metricsHistorySize < 0 || manager.metricsHistorySize > MAX_METRICS_HISTORY_SIZE {
+        return nil, fmt.Errorf("BLST_METRICS_HISTORY_SIZE must be between 0 and %d", MAX_METRICS_HISTORY_SIZE)
+    }
+    // Unset, the history spans METRICS_HISTORY_WINDOW whatever the interval,
+    // as far as the cap allows
+    if manager.metricsHistorySize == 0 {
+        manager.metricsHistorySize = min(max(int(METRICS_HISTORY_WINDOW/manager.metricsInterval), 1), MAX_METRICS_HISTORY_SIZE)
+    }
+    if manager.maxVPSPerIP < 0 {
+        return nil, fmt.Errorf("BLST_MAX_VPS_PER_IP must not be negative")
+    }
+    if manager.maxImageDownload <= 0 {
+        return nil, fmt.Errorf("BLST_MAX_IMAGE_DOWNLOAD_BYTES must be positive")
+    }
+    if manager.maxCustomImages < 0 {
+        return nil, fmt.Errorf("BLST_MAX_CUSTOM_IMAGES must not be negative")
+    }
+    // The frontend usually runs on the same host and forwards the browser's IP
+    manager.trustedProxies, err = parseTrustedProxies(getEnvString("BLST_TRUSTED_PROXIES", "127.0.0.0/8,::1"))
+    if err != nil {
+        return nil, err
+    }
+    if manager.maxVPSPerIP > 0 {
+        log.Printf("Limiting each client IP to %d live VPSes. Behind the frontend this only works with its TRUSTED_PROXY_HOPS set; otherwise all of its users share one address.", manager.maxVPSPerIP)
+    }
+    if manager.vncPorts, err = parsePortRange("BLST_VNC_PORTS", VNC_PORT_RANGE); err != nil {
+        return nil, err
+    }
+    // QEMU takes a display number, port 5900 + n
+    if manager.vncPorts.First < 5900 {
+        return nil, fmt.Errorf("BLST_VNC_PORTS must start at 5900 or above")
+    }
+    if manager.sshPorts, err = parsePortRange("BLST_SSH_PORTS", SSH_PORT_RANGE); err != nil {
+        return nil, err
+    }
+    if manager.forwardPorts, err = parsePortRange("BLST_FORWARD_PORTS", FORWARD_PORT_RANGE); err != nil {
+        return nil, err
+    }
+
+    manager.ctx, manager.cancel = context.WithCancel(context.Background())
+
+    // A random secret means tokens don't survive a restart, which is fine for
+    // their lifetime. Set BLST_CONSOLE_SECRET to share tokens across replicas.
+    if secret := os.Getenv("BLST_CONSOLE_SECRET"); secret != "" {
+        manager.consoleSecret = []byte(secret)
+    } else {
+        manager.consoleSecret = make([]byte, 32)
+        if _, err := rand.Read(manager.consoleSecret); err != nil {
+            return nil, fmt.Errorf("failed to generate console secret: %v", err)
+        }
+    }
+    if manager.idempotencyCipher, err = newIdempotencyCipher(); err != nil {
+        return nil, err
+    }
+
+    if net.ParseIP(manager.bindAddress) == nil {
+        return nil, fmt.Errorf("invalid bind address: %s", manager.bindAddress)
+    }
+
+    switch manager.networkMode {
+    case NetworkModeUser:
+    case NetworkModeBridge:
+        if _, err := os.Stat(filepath.Join("/sys/class/net", manager.bridge, "bridge")); err != nil {
+            return nil, fmt.Errorf("bridged networking requires bridge %s to exist: %v", manager.bridge, err)
+        }
+        log.Printf("Using bridged networking on %s", manager.bridge)
+    default:
+        return nil, fmt.Errorf("unsupported network mode: %s", manager.networkMode)
+    }
+
+    if err := manager.loadState(); err != nil {
+        return nil, err
+    }
+    manager.reconcile()
+
+    // Start metrics collection routine
+    go manager.metricsCollector()
+
+    // Refresh guest run states so paused or errored guests surface promptly
+    go manager.statusMonitor()
+    
+    return manager, nil
+}
+
+
+// What STATE_FILE holds. Instances are stored as persistedVPS so secrets the
+// API never returns survive too.
+type persistedState struct {
+    Instances       []persistedVPS    `json:"instances"`
+    IPInstances     map[string][]string `json:"ip_instances,omitempty"`
+}
+
+type persistedVPS struct {
+    *VPS
+    SeedToken string `json:"seed_token,omitempty"`
+    PasswordHash string `json:"password_hash,omitempty"`
+}
+
+// Write the instances and port counters to STATE_FILE. The caller must hold
+// m.mutex, read or write. The file is written beside the old one and renamed
+// over it so a crash mid-write leaves the previous state intact.
+func (m *VPSManager) saveStateLocked() {
+    state := persistedState{
+        Instances:       make([]persistedVPS, 0, len(m.instances)),
+        IPInstances:     m.ipInstances,
+    }
+    for _, vps := range m.instances {
+        state.Instances = append(state.Instances, persistedVPS{VPS: vps, SeedToken: vps.SeedToken, PasswordHash: vps.PasswordHash})
+    }
+    // Stable order so unchanged state compares equal
+    sort.Slice(state.Instances, func(i, j int) bool {
+        return state.Instances[i].ID < state.Instances[j].ID
+    })
+
+    data, err := json.MarshalIndent(state, "", "  ")
+    if err != nil {
+        log.Printf("Warning: Failed to encode state: %v", err)
+        return
+    }
+
+    m.stateMutex.Lock()
+    defer m.stateMutex.Unlock()
+    if bytes.Equal(data, m.lastState) {
+        return
+    }
+
+    // Holds root passwords and seed tokens
+    path := filepath.Join(m.baseDir, STATE_FILE)
+    tmpPath := path + ".tmp"
+    if err := os.WriteFile(tmpPath, data, 0600); err != nil {
+        log.Printf("Warning: Failed to write state: %v", err)
+        return
+    }
+    if err := os.Rename(tmpPath, path); err != nil {
+        os.Remove(tmpPath)
+        log.Printf("Warning: Failed to save state: %v", err)
+        return
+    }
+    m.lastState = data
+}
+
+// Restore instances from STATE_FILE at startup. Guests whose QEMU is still
+// running are picked up as they are; the rest are marked stopped. Creates,
+// rebuilds and moves that were interrupted can't be resumed.
+func (m *VPSManager) loadState() error {
+    path := filepath.Join(m.baseDir, STATE_FILE)
+    data, err := os.ReadFile(path)
+    if os.IsNotExist(err) {
+        return nil
+    } else if err != nil {
+        return fmt.Errorf("failed to read state: %v", err)
+    }
+
+    var state persistedState
+    if err := json.Unmarshal(data, &state); err != nil {
+        return fmt.Errorf("failed to parse %s: %v", path, err)
+    }
+
+    running := 0
+    for _, entry := range state.Instances {
+        vps := entry.VPS
+        if vps == nil || vps.ID == "" {
+            continue
+        }
+        vps.SeedToken = entry.SeedToken
+        vps.PasswordHash = entry.PasswordHash
+        // Older state files stored the plaintext password
+        if vps.Password != "" {
+            if vps.PasswordHash == "" {
+                if hash, err := hashPassword(vps.Password); err == nil {
+                    vps.PasswordHash = hash
+                }
+            }
+            vps.Password = ""
+        }
+        // Older VPSes followed BLST_NETWORK_MODE; pin them to the mode they
+        // were running under so changing it doesn't rewire them
+        if vps.NetworkMode == "" {
+            vps.NetworkMode = m.vpsNICs(vps)[0].Type
+        }
+
+        alive := vps.QEMUPid > 0 && checkProcess(vps.QEMUPid) == nil
+        switch {
+        case vps.Status == "creating" || vps.Status == StatusRebuilding:
+            if alive {
+                if proc, err := os.FindProcess(vps.QEMUPid); err == nil {
+                    proc.Kill()
+                }
+            }
+            vps.Status = "failed"
+            vps.Stage = StageFailed
+            vps.ErrorMsg = "interrupted by a service restart"
+            vps.QEMUPid = 0
+        case vps.Status == "failed":
+        case alive:
+            // Whatever was driving a power operation or move is gone
+            switch vps.Status {
+            case StatusStarting, StatusStopping, StatusRestarting, StatusMoving, StatusCloning:
+                vps.Status = StatusRunning
+            }
+            running++
+        default:
+            if vps.Status != StatusStopped {
+                log.Printf("VPS %s (ID: %s) is no longer running", vps.Name, vps.ID)
+            }
+            vps.Status = StatusStopped
+            vps.QEMUPid = 0
+            vps.RunState = ""
+        }
+
+        m.instances[vps.ID] = vps
+    }
+
+    for ip, ids := range state.IPInstances {
+        for _, id := range ids {
+            if _, exists := m.instances[id]; exists {
+                m.ipInstances[ip] = append(m.ipInstances[ip], id)
+            }
+        }
+    }
+
+    m.mutex.Lock()
+    m.saveStateLocked()
+    m.mutex.Unlock()
+
+    // Failed ones too, or their records would outlive every restart
+    for _, vps := range m.instances {
+        go m.scheduleCleanup(vps)
+    }
+    log.Printf("Restored %d VPS instances from %s, %d still running", len(m.instances), path, running)
+    return nil
+}
+
+// Match instance directories against running QEMU processes. A guest whose
+// qemu.pid points at a live QEMU started from that directory is adopted: known
+// instances get their PID back, and unknown ones are rebuilt from the QEMU
+// command line, owned by the admin, so their ports stay reserved even
+// without a state file.
+func (m *VPSManager) reconcile() {
+    disksDir := filepath.Join(m.baseDir, "disks")
+    entries, err := os.ReadDir(disksDir)
+    if err != nil {
+        log.Printf("Warning: Failed to scan %s: %v", disksDir, err)
+        return
+    }
+
+    adopted := 0
+    for _, entry := range entries {
+        if !entry.IsDir() {
+            continue
+        }
+        id := entry.Name()
+        instanceDir := filepath.Join(disksDir, id)
+        pidFile := filepath.Join(instanceDir, "qemu.pid")
+
+        data, err := os.ReadFile(pidFile)
+        if err != nil {
+            continue
+        }
+        pid, err := strconv.Atoi(strings.TrimSpace(string(data)))
+        if err != nil || pid <= 0 || checkProcess(pid) != nil {
+            continue
+        }
+        cmdline, err := os.ReadFile(fmt.Sprintf("/proc/%d/cmdline", pid))
+        if err != nil {
+            continue
+        }
+        // A recycled PID could belong to another guest
+        args := strings.Split(strings.TrimRight(string(cmdline), "\x00"), "\x00")
+        if !slices.Contains(args, pidFile) {
+            continue
+        }
+        found := parseQEMUArgs(args)
+
+        m.mutex.Lock()
+        if vps, exists := m.instances[id]; exists {
+            if vps.QEMUPid != pid {
+                log.Printf("Adopting running QEMU process %d for VPS %s (ID: %s)", pid, vps.Name, id)
+                vps.QEMUPid = pid
+                if vps.Status == StatusStopped || vps.Status == "failed" {
+                    vps.Status = StatusRunning
+                    vps.ErrorMsg = ""
+                }
+                adopted++
+            }
+            m.mutex.Unlock()
+            continue
+        }
+
+        createdAt := time.Now()
+        if info, err := entry.Info(); err == nil {
+            createdAt = info.ModTime()
+        }
+        vps := &found
+        vps.ID = id
+        vps.Owner = ADMIN_OWNER
+        vps.Status = StatusRunning
+        vps.QEMUPid = pid
+        vps.CreatedAt = createdAt
+        vps.ExpiresAt = createdAt.Add(VPS_LIFETIME)
+        vps.Stage = StageCompleted
+        vps.Progress = 100
+        if vps.Name == "" {
+            vps.Name = id
+        }
+        vps.Hostname = vps.Name
+        if vps.CPUModel == "" {
+            vps.CPUModel = DEFAULT_CPU_MODEL
+        }
+        m.instances[id] = vps
+        m.mutex.Unlock()
+
+        // Overlays name their base image, which gives the image type
+        if vps.DiskFormat == DiskFormatQCOW2 && vps.ImagePath != "" {
+            if backing, err := backingFile(vps.ImagePath); err == nil {
+                imageType := strings.TrimSuffix(filepath.Base(backing), ".qcow2")
+                if _, supported := SUPPORTED_IMAGES[imageType]; supported {
+                    vps.ImageType = imageType
+                }
+            }
+        }
+
+        log.Printf("Recovered VPS %s (ID: %s) from running QEMU process %d", vps.Name, id, pid)
+        adopted++
+        go m.scheduleCleanup(vps)
+    }
+
+    if adopted > 0 {
+        m.mutex.Lock()
+        m.saveStateLocked()
+        m.mutex.Unlock()
+        log.Printf("Reconciled %d running QEMU processes", adopted)
+    }
+}
+
+// Recover what buildQEMUArgs put on a QEMU command line: name, resources,
+// main disk, VNC and forwarded ports, and the smbios seed token
+func parseQEMUArgs(args []string) VPS {
+    var vps VPS
+    drives := 0
+    for i := 0; i+1 < len(args); i++ {
+        value := args[i+1]
+        switch args[i] {
+        case "-name":
+            for _, opt := range strings.Split(value, ",") {
+                if name, found := strings.CutPrefix(opt, "guest="); found {
+                    vps.Name = name
+                }
+            }
+        case "-m":
+            vps.MemoryMB, _ = strconv.Atoi(value)
+        case "-smp":
+            opts := strings.Split(value, ",")
+            vps.VCPUs, _ = strconv.Atoi(opts[0])
+            vps.CurrentVCPUs = vps.VCPUs
+            for _, opt := range opts[1:] {
+                if maxCPUs, found := strings.CutPrefix(opt, "maxcpus="); found {
+                    vps.MaxVCPUs, _ = strconv.Atoi(maxCPUs)
+                }
+            }
+        case "-cpu":
+            vps.CPUModel = strings.Split(value, ",")[0]
+        case "-drive":
+            // The main disk always comes first
+            drives++
+            if drives != 1 {
+                continue
+            }
+            for _, opt := range strings.Split(value, ",") {
+                key, val, _ := strings.Cut(opt, "=")
+                switch key {
+                case "file":
+                    vps.ImagePath = val
+                case "format":
+                    vps.DiskFormat = val
+                case "cache":
+                    vps.CacheMode = val
+                case "encrypt.key-secret":
+                    vps.Encrypted = true
+                }
+            }
+        case "-vnc":
+            if idx := strings.LastIndex(value, ":"); idx >= 0 {
+                if display, err := strconv.Atoi(strings.Split(value[idx+1:], ",")[0]); err == nil {
+                    vps.VNCPort = 5900 + display
+                }
+            }
+        case "-netdev":
+            if strings.HasPrefix(value, "tap,id=net0,") {
+                vps.NetworkMode = NetworkModeBridge
+            }
+            if !strings.HasPrefix(value, "user,id=net0") {
+                continue
+            }
+            vps.NetworkMode = NetworkModeUser
+            seen := make(map[int]bool)
+            for _, opt := range strings.Split(value, ",") {
+                fwd, found := strings.CutPrefix(opt, "hostfwd=")
+                if !found {
+                    continue
+                }
+                // proto:host:port-:guestport
+                parts := strings.Split(fwd, "-:")
+                if len(parts) != 2 {
+                    continue
+                }
+                hostIdx := strings.LastIndex(parts[0], ":")
+                hostPort, err1 := strconv.Atoi(parts[0][hostIdx+1:])
+                guestPort, err2 := strconv.Atoi(parts[1])
+                if err1 != nil || err2 != nil || seen[hostPort] {
+                    continue
+                }
+                seen[hostPort] = true
+                if guestPort == 22 && vps.SSHPort == 0 {
+                    vps.SSHPort = hostPort
+                    continue
+                }
+                vps.PortForwards = append(vps.PortForwards, PortForward{
+                    HostPort:  hostPort,
+                    GuestPort: guestPort,
+                    Protocol:  strings.Split(parts[0], ":")[0],
+                })
+            }
+        case "-smbios":
+            if _, url, found := strings.Cut(value, ";s="); found {
+                parts := strings.Split(strings.TrimSuffix(url, "/"), "/")
+                vps.CloudInitSeed = CloudInitSeedSMBIOS
+                vps.SeedToken = parts[len(parts)-1]
+            }
+        }
+    }
+    if vps.CloudInitSeed == "" {
+        vps.CloudInitSeed = CloudInitSeedISO
+    }
+    return vps
+}
+
+// Report whether ip already holds BLST_MAX_VPS_PER_IP live VPSes, along
+// with the newest of them
+func (m *VPSManager) hasVPSForIP(ip string) (bool, string) {
+    m.mutex.RLock()
+    defer m.mutex.RUnlock()
+
+    live := m.liveVPSesForIPLocked(ip)
+    if m.maxVPSPerIP > 0 && len(live) >= m.maxVPSPerIP {
+        return true, live[len(live)-1]
+    }
+    return false, ""
+}
+
+// Helper function to list the VPSes created from ip that still count against
+// its limit. Failed and expired ones don't. The caller must hold m.mutex.
+func (m *VPSManager) liveVPSesForIPLocked(ip string) []string {
+    var live []string
+    for _, id := range m.ipInstances[ip] {
+        vps, exists := m.instances[id]
+        if !exists || vps.Status == "failed" || time.Now().After(vps.ExpiresAt) {
+            continue
+        }
+        live = append(live, id)
+    }
+    return live
+}
+
+// Helper function to count the VPSes of owner that still count against its
+// API key's quota. Failed and expired ones don't. The caller must hold m.mutex.
+func (m *VPSManager) liveVPSCountForOwnerLocked(owner string) int {
+    count := 0
+    for _, vps := range m.instances {
+        if vps.Owner != owner || vps.Status == "failed" || time.Now().After(vps.ExpiresAt) {
+            continue
+        }
+        count++
+    }
+    return count
+}
+
+// Report whether owner already holds maxVPSes live VPSes
+func (m *VPSManager) ownerAtQuota(owner string, maxVPSes int) bool {
+    if maxVPSes <= 0 {
+        return false
+    }
+    m.mutex.RLock()
+    defer m.mutex.RUnlock()
+    return m.liveVPSCountForOwnerLocked(owner) >= maxVPSes
+}
+
+// Helper function to drop a VPS from the IP it was created from. The caller
+// must hold m.mutex.
+func (m *VPSManager) forgetIPInstanceLocked(id string) {
+    for ip, ids := range m.ipInstances {
+        if i := slices.Index(ids, id); i >= 0 {
+            ids = slices.Delete(ids, i, i+1)
+            if len(ids) == 0 {
+                delete(m.ipInstances, ip)
+            } else {
+                m.ipInstances[ip] = ids
+            }
+            return
+        }
+    }
+}
+
+// An inclusive range of host ports, e.g. 2200-3199
+type portRange struct {
+    First int
+    Last  int
+}
+
+// Helper function to read a port range setting such as BLST_SSH_PORTS
+func parsePortRange(key string, defaultValue string) (portRange, error) {
+    value := getEnvString(key, defaultValue)
+    first, last, found := strings.Cut(value, "-")
+    if !found {
+        last = first
+    }
+    var r portRange
+    var err1, err2 error
+    r.First, err1 = strconv.Atoi(strings.TrimSpace(first))
+    r.Last, err2 = strconv.Atoi(strings.TrimSpace(last))
+    if err1 != nil || err2 != nil || r.First < 1024 || r.Last > 65535 || r.First > r.Last {
+        return portRange{}, fmt.Errorf("invalid %s: %s, want a range like %s within 1024-65535", key, value, defaultValue)
+    }
+    return r, nil
+}
+
+// Parse a comma-separated list of CIDRs and bare addresses
+func parseTrustedProxies(value string) ([]*net.IPNet, error) {
+    var proxies []*net.IPNet
+    for _, entry := range strings.Split(value, ",") {
+        entry = strings.TrimSpace(entry)
+        if entry == "" {
+            continue
+        }
+        if !strings.Contains(entry, "/") {
+            ip := net.ParseIP(entry)
+            if ip == nil {
+                return nil, fmt.Errorf("invalid BLST_TRUSTED_PROXIES entry: %s", entry)
+            }
+            bits := 128
+            if ip.To4() != nil {
+                ip, bits = ip.To4(), 32
+            }
+            proxies = append(proxies, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+            continue
+        }
+        _, network, err := net.ParseCIDR(entry)
+        if err != nil {
+            return nil, fmt.Errorf("invalid BLST_TRUSTED_PROXIES entry: %s", entry)
+        }
+        proxies = append(proxies, network)
+    }
+    return proxies, nil
+}
+
+func (m *VPSManager) isTrustedProxy(ip net.IP) bool {
+    for _, network := range m.trustedProxies {
+        if network.Contains(ip) {
+            return true
+        }
+    }
+    return false
+}
+
+// Work out the caller's IP. X-Forwarded-For is only believed when the peer
+// is a trusted proxy, and is read right to left so a client can't spoof its
+// address by sending the header itself.
+func (m *VPSManager) clientIP(r *http.Request) string {
+    host, _, err := net.SplitHostPort(r.RemoteAddr)
+    if err != nil {
+        host = r.RemoteAddr
+    }
+    peer := net.ParseIP(host)
+    if peer == nil || !m.isTrustedProxy(peer) {
+        return host
+    }
+
+    hops := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+    for i := len(hops) - 1; i >= 0; i-- {
+        ip := net.ParseIP(strings.TrimSpace(hops[i]))
+        if ip == nil {
+            break
+        }
+        peer = ip
+        if !m.isTrustedProxy(ip) {
+            break
+        }
+    }
+    return peer.String()
+}
+
+
+// Download imageURL, then convert and resize it into the base image for
+// imageType. maxBytes caps the download, 0 means no limit. progress, if set,
+// receives bytes downloaded so far and the total (-1 when the server doesn't say).
+func downloadAndPrepareBaseImage(ctx context.Context, imageType string, imageURL string, maxBytes int64, progress func(done, total int64)) error {
+    expected, err := imageChecksum(imageType)
+    if err != nil {
+        return err
+    }
+
+    log.Printf("Starting base image preparation for %s", imageType)
+    
+    tmpDir := "/tmp/vps-download"
+    if err := os.MkdirAll(tmpDir, 0755); err != nil {
+        return fmt.Errorf("failed to create temp directory: %v", err)
+    }
+
+    tmpImagePath := filepath.Join(tmpDir, imageType+".img")
+    baseImagePath := getBaseImagePath(imageType)
+
+    // Curated URLs are ours, custom ones come from API callers
+    client := http.DefaultClient
+    if isCustomImageType(imageType) {
+        client = imageURLClient
+    }
+    
+    log.Printf("Downloading %s image to %s", imageType, tmpImagePath)
+    if err := downloadFile(ctx, client, imageURL, tmpImagePath, maxBytes, progress); err != nil {
+        return fmt.Errorf("failed to download image: %v", err)
+    }
+    defer os.Remove(tmpImagePath)
+
+    if expected != "" {
+        actual, err := fileSHA256(tmpImagePath)
+        if err != nil {
+            return fmt.Errorf("failed to hash downloaded image: %v", err)
+        }
+        if actual != expected {
+            return fmt.Errorf("checksum mismatch for %s image: expected sha256 %s, got %s", imageType, expected, actual)
+        }
+        log.Printf("Verified SHA256 of %s image", imageType)
+    }
+    if err := checkStandaloneImage(tmpImagePath); err != nil {
+        return err
+    }
+
+    baseDir := filepath.Dir(baseImagePath)
+    if err := os.MkdirAll(baseDir, 0755); err != nil {
+        return fmt.Errorf("failed to create base directory: %v", err)
+    }
+
+    log.Printf("Converting and resizing image to %dG", DISK_SIZE)
+    convertCmd := exec.Command("qemu-img", "convert",
+        "-f", "qcow2",
+        "-O", "qcow2",
+        tmpImagePath,
+        baseImagePath)
+    
+    if output, err := convertCmd.CombinedOutput(); err != nil {
+        return fmt.Errorf("failed to convert image: %v, output: %s", err, string(output))
+    }
+
+    resizeCmd := exec.Command("qemu-img", "resize", baseImagePath, fmt.Sprintf("%dG", DISK_SIZE))
+    if output, err := resizeCmd.CombinedOutput(); err != nil {
+        return fmt.Errorf("failed to resize image: %v, output: %s", err, string(output))
+    }
+
+    if err := os.Chmod(baseImagePath, 0644); err != nil {
+        return fmt.Errorf("failed to set image permissions: %v", err)
+    }
+
+    log.Printf("Base image preparation completed successfully for %s", imageType)
+    return nil
+}
+
+// Check that a downloaded image is a plain qcow2. A crafted one could name a
+// host file as its backing or data file, which convert would copy in.
+func checkStandaloneImage(path string) error {
+    output, err := exec.Command("qemu-img", "info", "--output=json", path).Output()
+    if err != nil {
+        return fmt.Errorf("failed to inspect downloaded image: %v", err)
+    }
+
+    var info struct {
+        Format          string `json:"format"`
+        BackingFilename string `json:"backing-filename"`
+        FormatSpecific  struct {
+            Data struct {
+                DataFile string `json:"data-file"`
+            } `json:"data"`
+        } `json:"format-specific"`
+    }
+    if err := json.Unmarshal(output, &info); err != nil {
+        return fmt.Errorf("failed to parse qemu-img info: %v", err)
+    }
+    if info.Format != "qcow2" {
+        return fmt.Errorf("downloaded image is %s, expected qcow2", info.Format)
+    }
+    if info.BackingFilename != "" || info.FormatSpecific.Data.DataFile != "" {
+        return fmt.Errorf("downloaded image refers to external files")
+    }
+    return nil
+}
+
+// A base image download shared by every create that needs the image
+type imageDownload struct {
+    done  chan struct{} // Closed once the download and conversion finish
+    err   error
+    mutex sync.Mutex
+    bytes int64
+    total int64
+}
+
+func (d *imageDownload) update(done, total int64) {
+    d.mutex.Lock()
+    d.bytes, d.total = done, total
+    d.mutex.Unlock()
+}
+
+// Prepare the base image for imageType, joining a download already in
+// progress instead of starting a second one. imageURL is required for custom
+// images and ignored otherwise. progress is polled from the shared download so
+// every waiting create reports the same numbers.
+func (m *VPSManager) ensureBaseImage(ctx context.Context, imageType string, imageURL string, progress func(done, total int64)) error {
+    // Only image_url downloads are capped, the curated ones are known
+    maxBytes := m.maxImageDownload
+    if curatedURL, exists := SUPPORTED_IMAGES[imageType]; exists {
+        imageURL, maxBytes = curatedURL, 0
+    } else if imageURL == "" || customImageType(imageURL) != imageType {
+        return fmt.Errorf("unsupported image type: %s", imageType)
+    }
+
+    m.downloadsMutex.Lock()
+    download, inFlight := m.downloads[imageType]
+    if !inFlight {
+        // Another create may have finished it while we waited for the lock
+        if _, err := os.Stat(getBaseImagePath(imageType)); err == nil {
+            m.downloadsMutex.Unlock()
+            return nil
+        }
+        if isCustomImageType(imageType) {
+            if err := m.checkCustomImageRoomLocked(); err != nil {
+                m.downloadsMutex.Unlock()
+                return err
+            }
+        }
+        download = &imageDownload{done: make(chan struct{}), total: -1}
+        m.downloads[imageType] = download
+        go func() {
+            download.err = downloadAndPrepareBaseImage(m.ctx, imageType, imageURL, maxBytes, download.update)
+            m.downloadsMutex.Lock()
+            delete(m.downloads, imageType)
+            m.downloadsMutex.Unlock()
+            close(download.done)
+        }()
+    }
+    m.downloadsMutex.Unlock()
+
+    ticker := time.NewTicker(time.Second)
+    defer ticker.Stop()
+    for {
+        select {
+        case <-download.done:
+            return download.err
+        case <-ctx.Done():
+            // Leave the shared download running for other creates
+            return contextError(ctx)
+        case <-ticker.C:
+            download.mutex.Lock()
+            done, total := download.bytes, download.total
+            download.mutex.Unlock()
+            progress(done, total)
+        }
+    }
+}
+
+var errCustomImageLimit = errors.New("too many custom base images")
+
+// Check that a new custom base image may be downloaded without going over
+// BLST_MAX_CUSTOM_IMAGES. Images already prepared or downloading don't need
+// room. The caller holds downloadsMutex.
+func (m *VPSManager) checkCustomImageRoomLocked() error {
+    count := 0
+    for imageType := range m.downloads {
+        if isCustomImageType(imageType) {
+            count++
+        }
+    }
+    prepared, err := filepath.Glob(filepath.Join(BASE_DIR, CUSTOM_IMAGE_PREFIX+"*.qcow2"))
+    if err != nil {
+        return err
+    }
+    for _, path := range prepared {
+        if isCustomImageType(strings.TrimSuffix(filepath.Base(path), ".qcow2")) {
+            count++
+        }
+    }
+    if count >= m.maxCustomImages {
+        return fmt.Errorf("%w: %d of %d in use, delete unused ones with DELETE /api/images", errCustomImageLimit, count, m.maxCustomImages)
+    }
+    return nil
+}
+
+// Check up front that a create from imageType won't be refused for want of
+// room for its custom base image
+func (m *VPSManager) checkCustomImageRoom(imageType string) error {
+    m.downloadsMutex.Lock()
+    defer m.downloadsMutex.Unlock()
+    if _, inFlight := m.downloads[imageType]; inFlight {
+        return nil
+    }
+    if _, err := os.Stat(getBaseImagePath(imageType)); err == nil {
+        return nil
+    }
+    return m.checkCustomImageRoomLocked()
+}
+
+// Stream url to path. Data goes to path+".part" first and an interrupted
+// download is resumed with an HTTP range request on the next attempt. A
+// download growing past maxBytes is abandoned, 0 means no limit.
+func downloadFile(ctx context.Context, client *http.Client, url string, path string, maxBytes int64, progress func(done, total int64)) error {
+    partPath := path + ".part"
+
+    var offset int64
+    if info, err := os.Stat(partPath); err == nil {
+        offset = info.Size()
+    }
+
+    req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+    if err != nil {
+        return err
+    }
+    if offset > 0 {
+        req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+    }
+
+    resp, err := client.Do(req)
+    if err != nil {
+        return err
+    }
+    defer resp.Body.Close()
+
+    flags := os.O_CREATE | os.O_WRONLY
+    switch resp.StatusCode {
+    case http.StatusPartialContent:
+        log.Printf("Resuming download of %s at %d bytes", url, offset)
+        flags |= os.O_APPEND
+    case http.StatusOK:
+        // Server ignored the range, start over
+        offset = 0
+        flags |= os.O_TRUNC
+    case http.StatusRequestedRangeNotSatisfiable:
+        // The partial file holds the whole image only if it is exactly as
+        // long as the server says; otherwise it is stale, start over
+        var size int64
+        if _, err := fmt.Sscanf(resp.Header.Get("Content-Range"), "bytes */%d", &size); err == nil && size == offset {
+            return os.Rename(partPath, path)
+        }
+        log.Printf("Discarding partial download of %s: %d bytes, server reports %q", url, offset, resp.Header.Get("Content-Range"))
+        resp.Body.Close()
+        if err := os.Remove(partPath); err != nil {
+            return err
+        }
+        return downloadFile(ctx, client, url, path, maxBytes, progress)
+    default:
+        return fmt.Errorf("unexpected status: %s", resp.Status)
+    }
+
+    file, err := os.OpenFile(partPath, flags, 0644)
+    if err != nil {
+        return err
+    }
+    defer file.Close()
+
+    total := int64(-1)
+    if resp.ContentLength >= 0 {
+        total = offset + resp.ContentLength
+    }
+    tooLarge := func() error {
+        file.Close()
+        os.Remove(partPath)
+        return fmt.Errorf("download is larger than the %d byte limit", maxBytes)
+    }
+    if maxBytes > 0 && total > maxBytes {
+        return tooLarge()
+    }
+
+    body := io.Reader(resp.Body)
+    if maxBytes > 0 {
+        // One byte over the limit is enough to know it was exceeded
+        body = io.LimitReader(resp.Body, maxBytes-offset+1)
+    }
+    writer := &progressWriter{done: offset, total: total, report: progress}
+    if _, err := io.Copy(io.MultiWriter(file, writer), body); err != nil {
+        return err
+    }
+    if maxBytes > 0 && writer.done > maxBytes {
+        return tooLarge()
+    }
+    if total >= 0 && writer.done != total {
+        return fmt.Errorf("download incomplete: got %d of %d bytes", writer.done, total)
+    }
+    if progress != nil {
+        progress(writer.done, total)
+    }
+
+    if err := file.Close(); err != nil {
+        return err
+    }
+    return os.Rename(partPath, path)
+}
+
+// Counts bytes written and reports them at most once per second
+type progressWriter struct {
+    done       int64
+    total      int64
+    report     func(done, total int64)
+    lastReport time.Time
+}
+
+func (p *progressWriter) Write(b []byte) (int, error) {
+    p.done += int64(len(b))
+    if p.report != nil && time.Since(p.lastReport) >= time.Second {
+        p.lastReport = time.Now()
+        p.report(p.done, p.total)
+    }
+    return len(b), nil
+}
+
+func prependIndent(commands []string, indent string) []string {
+    indented := make([]string, len(commands))
+    for i, cmd := range commands {
+        indented[i] = indent + cmd
+    }
+    return indented
+}
+
+// Render cloud-init for the VPS and build the ISO at path. The rendered files
+// are kept in a cloud-init directory beside the ISO for later inspection.
+func createCloudInitISO(path string, vps *VPS) error {
+    // Stage beside the ISO so the finished directory can be renamed into place
+    tmpDir, err := os.MkdirTemp(filepath.Dir(path), ".cloud-init-")
+    if err != nil {
+        return err
+    }
+    defer os.RemoveAll(tmpDir)
+
+    // Get template configuration
+    templateConfig, exists := lookupTemplate(vps.Template)
+    if !exists {
+        templateConfig = SUPPORTED_TEMPLATES["blank"]
+    }
+
+    // Determine OS family for package management
+    osFamily := vpsOSFamily(vps)
+    if osFamily == "" {
+        return fmt.Errorf("unsupported OS type: %s", vps.ImageType)
+    }
+
+    // Get OS-specific packages and commandsa
+    packages := templateConfig.Packages[osFamily]
+    commands, err := renderTemplateCommands(templateConfig.Commands[osFamily], templateConfig.Variables, vps.TemplateVars)
+    if err != nil {
+        return err
+    }
+
+    // Combine all commands including package installation
+    var allCommands []string
+
+    // runcmd executes as a single script, so exported proxy variables apply
+    // to every install command that follows
+    allCommands = append(allCommands, formatProxyExports(vps.Proxy)...)
+
+    // Add package installation commands based on OS family
+    if len(packages) > 0 {
+        switch osFamily {
+        case "ubuntu", "debian":
+            allCommands = append(allCommands,
+                "apt-get update",
+                "DEBIAN_FRONTEND=noninteractive apt-get install -y "+strings.Join(packages, " "))
+        case "fedora", "rocky", "almalinux", "centos":
+            allCommands = append(allCommands,
+                "dnf update -y",
+                "dnf install -y "+strings.Join(packages, " "))
+        case "opensuse":
+            allCommands = append(allCommands,
+                "zypper --non-interactive refresh",
+                "zypper --non-interactive install "+strings.Join(packages, " "))
+        case "alpine":
+            allCommands = append(allCommands,
+                "apk update",
+                "apk add "+strings.Join(packages, " "))
+        }
+    }
+
+    // Add template-specific commands
+    allCommands = append(allCommands, commands...)
+
+    // The password still works on the VNC console when SSH takes keys only
+    passwordAuth := !vps.DisablePasswordAuth
+    permitRootLogin := "yes"
+    if !passwordAuth {
+        permitRootLogin = "prohibit-password"
+    }
+    // Adopted guests have no known password, leave theirs alone. root already
+    // exists on cloud images and older cloud-init only applies passwd: to
+    // users it creates, so chpasswd gets the hash too and sees it is hashed.
+    passwd, chpasswdList := "", ""
+    if vps.PasswordHash != "" {
+        passwd = fmt.Sprintf("    passwd: \"%s\"\n", vps.PasswordHash)
+        chpasswdList = fmt.Sprintf("  list: |\n    root:%s\n", vps.PasswordHash)
+    }
+
+    // Create cloud-init user-data content
+    var userData bytes.Buffer
+    userData.WriteString(fmt.Sprintf(`#cloud-config
+users:
+  - name: root
+    lock_passwd: false
+    ssh_pwauth: %t
+%s%s
+chpasswd:
+%s  expire: false
+
+ssh_pwauth: %t
+disable_root: false
+
+hostname: %s
+%s
+
+package_update: true
+package_upgrade: true
+
+# Install required packages
+packages:
+%s
+
+# Run commands
+runcmd:
+  - sed -i 's/#PermitRootLogin.*/PermitRootLogin %s/' /etc/ssh/sshd_config
+%s%s
+`, passwordAuth, passwd, formatAuthorizedKeys(vps.SSHAuthorizedKeys), chpasswdList, passwordAuth, vps.Hostname, formatProxyWriteFiles(vps.Proxy, osFamily), formatPackageList(append([]string{"qemu-guest-agent"}, packages...)), permitRootLogin, formatServiceCommands(osFamily), formatCommandList(allCommands)))
+
+    if err := os.WriteFile(filepath.Join(tmpDir, "user-data"), userData.Bytes(), 0644); err != nil {
+        return err
+    }
+
+    // A stable instance-id keeps cloud-init from re-running first boot
+    // setup when the ISO is regenerated for an existing VPS
+    metaData := fmt.Sprintf("instance-id: %s\nlocal-hostname: %s\n", vps.ID, vps.Hostname)
+    if err := os.WriteFile(filepath.Join(tmpDir, "meta-data"), []byte(metaData), 0644); err != nil {
+        return err
+    }
+
+    if vps.Network != nil {
+        // Static addressing always applies to the first NIC
+        var primary NICConfig
+        if len(vps.NICs) > 0 {
+            primary = vps.NICs[0]
+        }
+        networkConfig := formatNetworkConfig(vps.Network, nicMAC(vps.ID, 0, primary))
+        if err := os.WriteFile(filepath.Join(tmpDir, "network-config"), []byte(networkConfig), 0644); err != nil {
+            return err
+        }
+    }
+
+    // smbios-seeded guests fetch the rendered files from /seed/ instead
+    if vps.CloudInitSeed != CloudInitSeedSMBIOS {
+        if err := buildCloudInitISO(path, tmpDir, vps.CloudInitDatasource, vps.CloudInitLabel); err != nil {
+            return err
+        }
+    }
+
+    renderedDir := filepath.Join(filepath.Dir(path), "cloud-init")
+    if err := os.RemoveAll(renderedDir); err != nil {
+        return fmt.Errorf("failed to replace rendered cloud-init: %v", err)
+    }
+    if err := os.Rename(tmpDir, renderedDir); err != nil {
+        return fmt.Errorf("failed to save rendered cloud-init: %v", err)
+    }
+
+    return nil
+}
+
+var cloudInitLabelPattern = regexp.MustCompile(`^[A-Za-z0-9_-]{1,32}$`)
+
+// Helper function to get the volume label cloud-init looks for with a datasource
+func defaultCloudInitLabel(datasource string) string {
+    if datasource == CloudInitConfigDrive {
+        return "config-2"
+    }
+    return "cidata"
+}
+
+func validateCloudInitSeed(datasource string, label string) error {
+    if datasource != CloudInitNoCloud && datasource != CloudInitConfigDrive {
+        return fmt.Errorf("unsupported cloud-init datasource: %s", datasource)
+    }
+    if !cloudInitLabelPattern.MatchString(label) {
+        return fmt.Errorf("invalid cloud-init volume label: %s", label)
+    }
+    return nil
+}
+
+// Pack already rendered cloud-init files from dir into a seed ISO laid out
+// for datasource
+func buildCloudInitISO(path string, dir string, datasource string, label string) error {
+    if label == "" {
+        label = defaultCloudInitLabel(datasource)
+    }
+
+    var isoFiles []string
+    if datasource == CloudInitConfigDrive {
+        layoutDir, err := os.MkdirTemp(filepath.Dir(path), ".config-drive-")
+        if err != nil {
+            return err
+        }
+        defer os.RemoveAll(layoutDir)
+        if err := writeConfigDrive(layoutDir, dir); err != nil {
+            return err
+        }
+        isoFiles = []string{layoutDir}
+    } else {
+        isoFiles = []string{filepath.Join(dir, "user-data"), filepath.Join(dir, "meta-data")}
+        if _, err := os.Stat(filepath.Join(dir, "network-config")); err == nil {
+            isoFiles = append(isoFiles, filepath.Join(dir, "network-config"))
+        }
+    }
+
+    cmd := exec.Command("genisoimage", append([]string{"-output", path, "-volid", label, "-joliet", "-rock"}, isoFiles...)...)
+    
+    if output, err := cmd.CombinedOutput(); err != nil {
+        return fmt.Errorf("failed to create ISO: %v, output: %s", err, string(output))
+    }
+    return nil
+}
+
+// Lay out rendered NoCloud files from src as an OpenStack config drive in dst
+func writeConfigDrive(dst string, src string) error {
+    latest := filepath.Join(dst, "openstack", "latest")
+    if err := os.MkdirAll(latest, 0755); err != nil {
+        return err
+    }
+
+    userData, err := os.ReadFile(filepath.Join(src, "user-data"))
+    if err != nil {
+        return err
+    }
+    if err := os.WriteFile(filepath.Join(latest, "user_data"), userData, 0644); err != nil {
+        return err
+    }
+
+    // meta-data only ever holds the flat keys createCloudInitISO writes
+    metaData, err := os.ReadFile(filepath.Join(src, "meta-data"))
+    if err != nil {
+        return err
+    }
+    fields := make(map[string]string)
+    for _, line := range strings.Split(string(metaData), "\n") {
+        if key, value, ok := strings.Cut(line, ":"); ok {
+            fields[strings.TrimSpace(key)] = strings.TrimSpace(value)
+        }
+    }
+    metaJSON, err := json.Marshal(map[string]string{
+        "uuid":     fields["instance-id"],
+        "hostname": fields["local-hostname"],
+        "name":     fields["local-hostname"],
+    })
+    if err != nil {
+        return err
+    }
+    return os.WriteFile(filepath.Join(latest, "meta_data.json"), metaJSON, 0644)
+}
+
+// Helper function to format command list for cloud-init
+func formatCommandList(commands []string) string {
+    var formatted strings.Builder
+    for _, cmd := range commands {
+        // Quoted like the authorized keys, a bare command starting with [ or
+        // containing ": " would change the YAML's structure
+        quoted, _ := json.Marshal(cmd)
+        formatted.WriteString(fmt.Sprintf("  - %s\n", quoted))
+    }
+    return formatted.String()
+}
+
+// Helper function to format the root user's authorized keys. Keys are written
+// as JSON strings, which YAML reads as double-quoted scalars.
+func formatAuthorizedKeys(keys []string) string {
+    if len(keys) == 0 {
+        return ""
+    }
+    var formatted strings.Builder
+    formatted.WriteString("    ssh_authorized_keys:\n")
+    for _, key := range keys {
+        quoted, _ := json.Marshal(key)
+        formatted.WriteString(fmt.Sprintf("      - %s\n", quoted))
+    }
+    return formatted.String()
+}
+
+// Helper function to build proxy exports for the runcmd script
+func formatProxyExports(proxy *ProxyConfig) []string {
+    if proxy == nil {
+        return nil
+    }
+
+    var exports []string
+    if proxy.HTTPProxy != "" {
+        exports = append(exports,
+            fmt.Sprintf("export http_proxy=%s", proxy.HTTPProxy),
+            fmt.Sprintf("export HTTP_PROXY=%s", proxy.HTTPProxy))
+    }
+    if proxy.HTTPSProxy != "" {
+        exports = append(exports,
+            fmt.Sprintf("export https_proxy=%s", proxy.HTTPSProxy),
+            fmt.Sprintf("export HTTPS_PROXY=%s", proxy.HTTPSProxy))
+    }
+    if proxy.NoProxy != "" {
+        exports = append(exports,
+            fmt.Sprintf("export no_proxy=%s", proxy.NoProxy),
+            fmt.Sprintf("export NO_PROXY=%s", proxy.NoProxy))
+    }
+    return exports
+}
+
+// Helper function to write proxy settings for the environment and package
+// manager. write_files runs before package_update, so installs use the proxy.
+func formatProxyWriteFiles(proxy *ProxyConfig, osFamily string) string {
+    if proxy == nil {
+        return ""
+    }
+
+    var env strings.Builder
+    if proxy.HTTPProxy != "" {
+        env.WriteString(fmt.Sprintf("      http_proxy=%s\n      HTTP_PROXY=%s\n", proxy.HTTPProxy, proxy.HTTPProxy))
+    }
+    if proxy.HTTPSProxy != "" {
+        env.WriteString(fmt.Sprintf("      https_proxy=%s\n      HTTPS_PROXY=%s\n", proxy.HTTPSProxy, proxy.HTTPSProxy))
+    }
+    if proxy.NoProxy != "" {
+        env.WriteString(fmt.Sprintf("      no_proxy=%s\n      NO_PROXY=%s\n", proxy.NoProxy, proxy.NoProxy))
+    }
+
+    var formatted strings.Builder
+    formatted.WriteString("write_files:\n")
+    formatted.WriteString("  - path: /etc/environment\n    append: true\n    content: |\n")
+    formatted.WriteString(env.String())
+
+    switch osFamily {
+    case "ubuntu", "debian":
+        // apt has no no_proxy setting, so a no_proxy-only config has nothing for it
+        if proxy.HTTPProxy == "" && proxy.HTTPSProxy == "" {
+            break
+        }
+        formatted.WriteString("  - path: /etc/apt/apt.conf.d/95proxy\n    content: |\n")
+        if proxy.HTTPProxy != "" {
+            formatted.WriteString(fmt.Sprintf("      Acquire::http::Proxy \"%s\";\n", proxy.HTTPProxy))
+        }
+        if proxy.HTTPSProxy != "" {
+            formatted.WriteString(fmt.Sprintf("      Acquire::https::Proxy \"%s\";\n", proxy.HTTPSProxy))
+        }
+    case "fedora", "rocky", "almalinux", "centos":
+        // dnf/yum take a single proxy for all repositories
+        repoProxy := proxy.HTTPProxy
+        if repoProxy == "" {
+            repoProxy = proxy.HTTPSProxy
+        }
+        if repoProxy != "" {
+            confPath := "/etc/dnf/dnf.conf"
+            if osFamily == "centos" {
+                confPath = "/etc/yum.conf"
+            }
+            formatted.WriteString(fmt.Sprintf("  - path: %s\n    append: true\n    content: |\n      proxy=%s\n", confPath, repoProxy))
+        }
+    case "opensuse":
+        // zypper reads the system-wide proxy settings
+        formatted.WriteString("  - path: /etc/sysconfig/proxy\n    content: |\n      PROXY_ENABLED=\"yes\"\n")
+        formatted.WriteString(fmt.Sprintf("      HTTP_PROXY=\"%s\"\n      HTTPS_PROXY=\"%s\"\n      NO_PROXY=\"%s\"\n", proxy.HTTPProxy, proxy.HTTPSProxy, proxy.NoProxy))
+    case "alpine":
+        // Nothing reads /etc/environment on Alpine and apk only takes the
+        // proxy from the environment, so export it from the login profile
+        formatted.WriteString("  - path: /etc/profile.d/proxy.sh\n    content: |\n")
+        formatted.WriteString(strings.ReplaceAll(env.String(), "      ", "      export "))
+    }
+
+    return formatted.String()
+}
+
+// Validate proxy settings before they are written into cloud-init
+func validateProxyConfig(proxy *ProxyConfig) error {
+    for name, value := range map[string]string{"http_proxy": proxy.HTTPProxy, "https_proxy": proxy.HTTPSProxy} {
+        if value == "" {
+            continue
+        }
+        parsed, err := url.Parse(value)
+        if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+            return fmt.Errorf("invalid %s: must be an http:// or https:// URL", name)
+        }
+        if strings.ContainsAny(value, " \t\r\n\"'") {
+            return fmt.Errorf("invalid %s: contains illegal characters", name)
+        }
+    }
+
+    if proxy.NoProxy != "" && !regexp.MustCompile(`^[a-zA-Z0-9.,:/*_-]+$`).MatchString(proxy.NoProxy) {
+        return fmt.Errorf("invalid no_proxy: expected a comma-separated list of hosts")
+    }
+
+    return nil
+}
+
+// Check that each key is a single OpenSSH authorized_keys line. Options such
+// as command= are refused since they would be applied to the root login.
+func validateSSHAuthorizedKeys(keys []string) ([]string, error) {
+    if len(keys) > MAX_SSH_KEYS {
+        return nil, fmt.Errorf("at most %d ssh_authorized_keys are allowed", MAX_SSH_KEYS)
+    }
+    normalized := make([]string, 0, len(keys))
+    for i, key := range keys {
+        key = strings.TrimSpace(key)
+        if strings.ContainsAny(key, "\r\n") {
+            return nil, fmt.Errorf("ssh_authorized_keys[%d]: must be a single line", i)
+        }
+        for _, c := range key {
+            if c < ' ' || c == 0x7f {
+                return nil, fmt.Errorf("ssh_authorized_keys[%d]: contains control characters", i)
+            }
+        }
+        _, _, options, _, err := ssh.ParseAuthorizedKey([]byte(key))
+        if err != nil {
+            return nil, fmt.Errorf("ssh_authorized_keys[%d]: not a valid OpenSSH public key", i)
+        }
+        if len(options) > 0 {
+            return nil, fmt.Errorf("ssh_authorized_keys[%d]: key options are not allowed", i)
+        }
+        normalized = append(normalized, key)
+    }
+    return normalized, nil
+}
+
+// Helper function to fill {{.Name}} placeholders in template commands from the
+// template defaults merged with per-VPS overrides
+func renderTemplateCommands(commands []string, defaults map[string]string, overrides map[string]string) ([]string, error) {
+    vars := make(map[string]string)
+    for name, value := range defaults {
+        vars[name] = value
+    }
+    for name, value := range overrides {
+        vars[name] = value
+    }
+
+    rendered := make([]string, 0, len(commands))
+    for _, command := range commands {
+        tmpl, err := template.New("command").Option("missingkey=error").Parse(command)
+        if err != nil {
+            return nil, fmt.Errorf("failed to parse template command: %v", err)
+        }
+        var out strings.Builder
+        if err := tmpl.Execute(&out, vars); err != nil {
+            return nil, fmt.Errorf("failed to render template command: %v", err)
+        }
+        rendered = append(rendered, out.String())
+    }
+    return rendered, nil
+}
+
+// Values end up in shell commands, so only allow version-like strings
+func validateTemplateVars(templateName string, vars map[string]string) error {
+    templateConfig, _ := lookupTemplate(templateName)
+    defaults := templateConfig.Variables
+    for name, value := range vars {
+        if _, exists := defaults[name]; !exists {
+            return fmt.Errorf("template %s has no variable %s", templateName, name)
+        }
+        if !regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`).MatchString(value) {
+            return fmt.Errorf("invalid value for %s: %q", name, value)
+        }
+    }
+    return nil
+}
+
+// Helper function to format a cloud-init v2 network-config, matched on the
+// guest NIC's MAC so interface naming differences between images don't matter
+func formatNetworkConfig(network *NetworkConfig, mac string) string {
+    var config strings.Builder
+    config.WriteString("version: 2\nethernets:\n  eth0:\n")
+    config.WriteString(fmt.Sprintf("    match:\n      macaddress: \"%s\"\n", mac))
+    config.WriteString("    set-name: eth0\n")
+    config.WriteString(fmt.Sprintf("    addresses:\n      - %s\n", network.Address))
+    if network.Gateway != "" {
+        if strings.Contains(network.Gateway, ":") {
+            config.WriteString(fmt.Sprintf("    gateway6: %s\n", network.Gateway))
+        } else {
+            config.WriteString(fmt.Sprintf("    gateway4: %s\n", network.Gateway))
+        }
+    }
+    if len(network.DNS) > 0 {
+        config.WriteString("    nameservers:\n      addresses:\n")
+        for _, server := range network.DNS {
+            config.WriteString(fmt.Sprintf("        - %s\n", server))
+        }
+    }
+    return config.String()
+}
+
+func validateNetworkConfig(network *NetworkConfig) error {
+    if _, _, err := net.ParseCIDR(network.Address); err != nil {
+        return fmt.Errorf("invalid address: expected CIDR notation, e.g. 192.168.10.20/24")
+    }
+    if network.Gateway != "" && net.ParseIP(network.Gateway) == nil {
+        return fmt.Errorf("invalid gateway: %s", network.Gateway)
+    }
+    for _, server := range network.DNS {
+        if net.ParseIP(server) == nil {
+            return fmt.Errorf("invalid dns server: %s", server)
+        }
+    }
+    return nil
+}
+
+// Helper function to restart sshd and start the guest agent from runcmd.
+// Alpine runs OpenRC rather than systemd.
+func formatServiceCommands(osFamily string) string {
+    if osFamily == "alpine" {
+        return "  - rc-service sshd restart\n" +
+            "  - rc-update add qemu-guest-agent default\n" +
+            "  - rc-service qemu-guest-agent start\n"
+    }
+    return "  - systemctl restart ssh || systemctl restart sshd\n" +
+        "  - systemctl enable --now qemu-guest-agent\n"
+}
+
+// Helper function to format package list for cloud-init
+func formatPackageList(packages []string) string {
+    var formatted strings.Builder
+    for _, pkg := range packages {
+        formatted.WriteString(fmt.Sprintf("  - %s\n", pkg))
+    }
+    return formatted.String()
+}
+
+// Helper function to get the OS family of a VPS, which a custom image carries itself
+func vpsOSFamily(vps *VPS) string {
+    if vps.OSFamily != "" {
+        return vps.OSFamily
+    }
+    return getOSFamily(vps.ImageType)
+}
+
+// Helper function to determine OS family
+func getOSFamily(imageType string) string {
+    switch {
+    case strings.HasPrefix(imageType, "ubuntu"):
+        return "ubuntu"
+    case strings.HasPrefix(imageType, "debian"):
+        return "debian"
+    case strings.HasPrefix(imageType, "fedora"):
+        return "fedora"
+    case strings.HasPrefix(imageType, "rocky"):
+        return "rocky"
+    case strings.HasPrefix(imageType, "almalinux"):
+        return "almalinux"
+    case strings.HasPrefix(imageType, "centos"):
+        return "centos"
+    case strings.HasPrefix(imageType, "opensuse"):
+        return "opensuse"
+    case strings.HasPrefix(imageType, "alpine"):
+        return "alpine"
+    default:
+        return ""
+    }
+}
+
+// Check that a template exists and can be installed on an image. customFamily
+// is the OS family of a custom image, which may use any variant of that family.
+func validateTemplateAndOS(template string, imageType string, customFamily string) error {
+    templateConfig, exists := lookupTemplate(template)
+    if !exists {
+        return fmt.Errorf("unsupported template: %s", template)
+    }
+
+    if len(templateConfig.OSVariants) > 0 {
+        supported := false
+        for _, variant := range templateConfig.OSVariants {
+            if variant == imageType || (customFamily != "" && getOSFamily(variant) == customFamily) {
+                supported = true
+                break
+            }
+        }
+        if !supported {
+            return fmt.Errorf("template %s does not support OS %s, it supports %s", template, imageType, strings.Join(templateConfig.OSVariants, ", "))
+        }
+    }
+
+    // Packages and Commands are keyed by OS family, so a family missing from
+    // both would quietly install nothing
+    osFamily := customFamily
+    if osFamily == "" {
+        osFamily = getOSFamily(imageType)
+    }
+    if osFamily == "" {
+        return fmt.Errorf("unsupported OS type: %s", imageType)
+    }
+    _, hasPackages := templateConfig.Packages[osFamily]
+    _, hasCommands := templateConfig.Commands[osFamily]
+    if (len(templateConfig.Packages) > 0 || len(templateConfig.Commands) > 0) && !hasPackages && !hasCommands {
+        return fmt.Errorf("template %s has no install steps for %s", template, osFamily)
+    }
+
+    return nil
+}
+
+// Run the template's verification commands through the guest agent and
+// record the outcome on the VPS
+func (m *VPSManager) verifyTemplate(vps *VPS) {
+    templateConfig, exists := lookupTemplate(vps.Template)
+    if !exists {
+        return
+    }
+    checks := templateConfig.Verify[vpsOSFamily(vps)]
+    if len(checks) == 0 {
+        return
+    }
+
+    m.mutex.Lock()
+    vps.Verification = &VerificationResult{Status: VerifyPending}
+    m.mutex.Unlock()
+
+    finish := func(status string, errMsg string, results []VerifyCheck) {
+        m.mutex.Lock()
+        defer m.mutex.Unlock()
+        vps.Verification = &VerificationResult{
+            Status:     status,
+            Checks:     results,
+            Error:      errMsg,
+            FinishedAt: time.Now(),
+        }
+        vps.Degraded = status != VerifyPassed
+    }
+
+    agentSocket := filepath.Join(m.baseDir, "disks", vps.ID, "qemu-ga.sock")
+    if err := waitForGuestAgent(agentSocket, GUEST_AGENT_TIMEOUT); err != nil {
+        log.Printf("Template verification for VPS %s skipped: %v", vps.ID, err)
+        finish(VerifyFailed, err.Error(), nil)
+        return
+    }
+
+    // Install commands run from cloud-init, so wait for it before checking
+    if _, _, err := guestExec(agentSocket, "cloud-init status --wait", GUEST_AGENT_TIMEOUT); err != nil {
+        log.Printf("Warning: Failed waiting for cloud-init on VPS %s: %v", vps.ID, err)
+    }
+
+    results := make([]VerifyCheck, 0, len(checks))
+    passed := true
+    for _, command := range checks {
+        exitCode, output, err := guestExec(agentSocket, command, 2*time.Minute)
+        if err != nil {
+            output = err.Error()
+        }
+        if len(output) > 512 {
+            output = output[:512]
+        }
+        check := VerifyCheck{
+            Command:  command,
+            ExitCode: exitCode,
+            Output:   strings.TrimSpace(output),
+            Passed:   err == nil && exitCode == 0,
+        }
+        if !check.Passed {
+            passed = false
+        }
+        results = append(results, check)
+    }
+
+    if passed {
+        log.Printf("Template %s verification passed for VPS %s", vps.Template, vps.ID)
+        finish(VerifyPassed, "", results)
+    } else {
+        log.Printf("Template %s verification failed for VPS %s", vps.Template, vps.ID)
+        finish(VerifyFailed, "one or more verification commands failed", results)
+    }
+}
+
+// Modify the HTTP handler for listing templates to include OS compatibility
+func (m *VPSManager) handleListTemplates(w http.ResponseWriter, r *http.Request) {
+    if !allowMethods(w, r, http.MethodGet, http.MethodHead) {
+        return
+    }
+
+    // Get OS filter from query parameter
+    osType := r.URL.Query().Get("os")
+
+    available := allTemplates()
+    templates := make([]struct {
+        VPSTemplate
+        Compatible bool `json:"compatible"`
+    }, 0, len(available))
+
+    for _, template := range available {
+        compatible := true
+        if osType != "" {
+            compatible = false
+            for _, variant := range template.OSVariants {
+                if variant == osType {
+                    compatible = true
+                    break
+                }
+            }
+        }
+
+        templates = append(templates, struct {
+            VPSTemplate
+            Compatible bool `json:"compatible"`
+        }{
+            VPSTemplate: template,
+            Compatible: compatible,
+        })
+    }
+
+    writeJSON(w, http.StatusOK, templates)
+}
+
+// Check a template submitted through the API. Its packages and commands end
+// up in cloud-init user-data, so each must be a single line, and defaults
+// follow the same rules as template_vars.
+func validateUserTemplate(template *VPSTemplate) error {
+    if !regexp.MustCompile(`^[a-z0-9][a-z0-9_-]{0,63}$`).MatchString(template.ID) {
+        return fmt.Errorf("invalid id: expected 1-64 lowercase letters, digits, _ or -")
+    }
+    if template.Name == "" {
+        template.Name = template.ID
+    }
+    if len(template.OSVariants) == 0 {
+        return fmt.Errorf("at least one OS variant is required")
+    }
+    for _, variant := range template.OSVariants {
+        if _, exists := SUPPORTED_IMAGES[variant]; !exists {
+            return fmt.Errorf("unsupported OS variant: %s", variant)
+        }
+    }
+
+    for field, byFamily := range map[string]map[string][]string{"packages": template.Packages, "commands": template.Commands, "verify": template.Verify} {
+        for family, entries := range byFamily {
+            if !slices.Contains(OS_FAMILIES, family) {
+                return fmt.Errorf("%s: unknown OS family %s, expected one of: %s", field, family, strings.Join(OS_FAMILIES, ", "))
+            }
+            for _, entry := range entries {
+                if strings.TrimSpace(entry) == "" || strings.ContainsAny(entry, "\r\n") {
+                    return fmt.Errorf("%s.%s: entries must be single non-empty lines", field, family)
+                }
+                if field == "packages" && !regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9.+_:=~-]*$`).MatchString(entry) {
+                    return fmt.Errorf("packages.%s: invalid package name %q", family, entry)
+                }
+            }
+        }
+    }
+    for name, value := range template.Variables {
+        if !regexp.MustCompile(`^[A-Za-z][A-Za-z0-9_]{0,63}$`).MatchString(name) {
+            return fmt.Errorf("invalid variable name: %q", name)
+        }
+        if !regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`).MatchString(value) {
+            return fmt.Errorf("invalid default for %s: %q", name, value)
+        }
+    }
+    for family, commands := range template.Commands {
+        if _, err := renderTemplateCommands(commands, template.Variables, nil); err != nil {
+            return fmt.Errorf("commands.%s: %v", family, err)
+        }
+    }
+
+    if len(template.ExposePorts) > MAX_PORT_FORWARDS {
+        return fmt.Errorf("at most %d expose_ports are allowed", MAX_PORT_FORWARDS)
+    }
+    for _, port := range template.ExposePorts {
+        if port < 1 || port > 65535 {
+            return fmt.Errorf("invalid expose port: %d", port)
+        }
+    }
+    if template.DefaultMemoryMB < 0 || template.DefaultVCPUs < 0 || template.DefaultDiskGB < 0 {
+        return fmt.Errorf("default resources must not be negative")
+    }
+
+    // Each variant must get install steps, the same check a create makes
+    for _, variant := range template.OSVariants {
+        family := getOSFamily(variant)
+        _, hasPackages := template.Packages[family]
+        _, hasCommands := template.Commands[family]
+        if (len(template.Packages) > 0 || len(template.Commands) > 0) && !hasPackages && !hasCommands {
+            return fmt.Errorf("no install steps for %s, which OS variant %s needs", family, variant)
+        }
+    }
+    return nil
+}
+
+// Register a template at runtime, or replace a user template with the same ID
+func (m *VPSManager) handleCreateTemplate(w http.ResponseWriter, r *http.Request) {
+    if !allowMethods(w, r, http.MethodPost) {
+        return
+    }
+    if !identityFromRequest(r).Admin() {
+        http.Error(w, "Admin API key required", http.StatusForbidden)
+        return
+    }
+
+    var template VPSTemplate
+    if !decodeJSONBody(w, r, &template) {
+        return
+    }
+    if err := validateUserTemplate(&template); err != nil {
+        http.Error(w, err.Error(), http.StatusBadRequest)
+        return
+    }
+
+    replaced, err := userTemplates.put(template)
+    if errors.Is(err, errBuiltInTemplate) {
+        http.Error(w, err.Error(), http.StatusConflict)
+        return
+    } else if err != nil {
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+
+    if replaced {
+        log.Printf("Replaced user template %s", template.ID)
+        writeJSON(w, http.StatusOK, template)
+        return
+    }
+    log.Printf("Registered user template %s", template.ID)
+    writeJSON(w, http.StatusCreated, template)
+}
+
+func (m *VPSManager) CreateVPS(name string, hostname string, imageType string, template string, opts CreateVPSOptions) (*VPS, error) {
+    m.mutex.Lock()
+    defer m.mutex.Unlock()
+
+    if m.ctx.Err() != nil {
+        return nil, fmt.Errorf("server is shutting down")
+    }
+
+    // Checked again under the lock so a burst from one IP can't slip past
+    var ipInstances []string
+    if opts.ClientIP != "" {
+        ipInstances = m.liveVPSesForIPLocked(opts.ClientIP)
+        if m.maxVPSPerIP > 0 && len(ipInstances) >= m.maxVPSPerIP {
+            return nil, errIPLimitReached
+        }
+    }
+    if opts.MaxVPSes > 0 && m.liveVPSCountForOwnerLocked(opts.Owner) >= opts.MaxVPSes {
+        return nil, fmt.Errorf("%w (%d)", errQuotaReached, opts.MaxVPSes)
+    }
+
+    // QEMU would fail to bind a port another guest already forwards
+    inUse := m.hostPortsInUseLocked()
+    requested := slices.Clone(opts.PortForwards)
+    for _, nic := range opts.NICs {
+        requested = append(requested, nic.Forwards...)
+    }
+    for _, fwd := range requested {
+        key := fmt.Sprintf("%s/%d", fwd.Protocol, fwd.HostPort)
+        if inUse[key] {
+            return nil, fmt.Errorf("%w: %s", errHostPortInUse, key)
+        }
+        inUse[key] = true
+    }
+
+    log.Printf("Starting VPS creation process for: %s with image: %s, template: %s and hostname: %s", 
+        name, imageType, template, hostname)
+
+    // Initialize VPS with template
+    vps := &VPS{
+        ID:          uuid.New().String(),
+        Name:        name,
+        Hostname:    hostname,
+        Owner:       opts.Owner,
+        Status:      "creating",
+        ImageType:   imageType,
+        ImageURL:    opts.ImageURL,
+        OSFamily:    opts.OSFamily,
+        Template:    template,  // Add template to VPS struct
+        TemplateVars: opts.TemplateVars,
+        Proxy:       opts.Proxy,
+        PortForwards: opts.PortForwards,
+        Network:     opts.Network,
+        NICs:        opts.NICs,
+        NetworkMode: opts.NetworkMode,
+        DiskFormat:  opts.DiskFormat,
+        Encrypted:   opts.EncryptDisk,
+        CacheMode:   opts.CacheMode,
+        MemoryMB:    opts.MemoryMB,
+        VCPUs:       opts.VCPUs,
+        DiskGB:      opts.DiskGB,
+        MetricsDisabled: opts.DisableMetrics,
+        CPUModel:    opts.CPUModel,
+        CPUFlags:    opts.CPUFlags,
+        CloudInitDatasource: opts.CloudInitDatasource,
+        CloudInitLabel: opts.CloudInitLabel,
+        CloudInitSeed: m.cloudInitSeed,
+        SSHAuthorizedKeys: opts.SSHAuthorizedKeys,
+        DisablePasswordAuth: opts.DisablePasswordAuth,
+        CreatedAt:   time.Now(),
+        ExpiresAt:   time.Now().Add(VPS_LIFETIME),
+        Stage:       StageInitializing,
+        Progress:    0,
+    }
+    if vps.DiskFormat == "" {
+        vps.DiskFormat = DiskFormatQCOW2
+    }
+    if vps.NetworkMode == "" {
+        vps.NetworkMode = m.vpsNICs(vps)[0].Type
+    }
+    if vps.CacheMode == "" {
+        vps.CacheMode = CacheModeWriteback
+    }
+    if vps.CPUModel == "" {
+        vps.CPUModel = DEFAULT_CPU_MODEL
+    }
+    if vps.CloudInitSeed == CloudInitSeedSMBIOS {
+        token := make([]byte, 16)
+        if _, err := rand.Read(token); err != nil {
+            return nil, fmt.Errorf("failed to generate seed token: %v", err)
+        }
+        vps.SeedToken = base64.RawURLEncoding.EncodeToString(token)
+    }
+    // Only the hash is kept, the plaintext goes back on this response alone
+    password, err := generatePassword()
+    if err != nil {
+        return nil, fmt.Errorf("failed to generate password: %v", err)
+    }
+    vps.PasswordHash, err = hashPassword(password)
+    if err != nil {
+        return nil, fmt.Errorf("failed to hash password: %v", err)
+    }
+    resolveResources(vps)
+    m.resetLiveResourcesLocked(vps)
+    if vps.VNCPort, err = m.allocatePortLocked(m.vncPorts, inUse); err != nil {
+        return nil, fmt.Errorf("VNC port: %w", err)
+    }
+    // A bridged guest is reached on its own address, not a host forward
+    if vps.NetworkMode != NetworkModeBridge {
+        if vps.SSHPort, err = m.allocatePortLocked(m.sshPorts, inUse); err != nil {
+            return nil, fmt.Errorf("SSH port: %w", err)
+        }
+    }
+
+    // Forward any ports the template needs reachable, e.g. 80/443 for web stacks
+    if templateConfig, exists := lookupTemplate(template); exists {
+        for _, guestPort := range templateConfig.ExposePorts {
+            hostPort, err := m.allocatePortLocked(m.forwardPorts, inUse)
+            if err != nil {
+                return nil, fmt.Errorf("forward port: %w", err)
+            }
+            vps.PortForwards = append(vps.PortForwards, PortForward{
+                HostPort:  hostPort,
+                GuestPort: guestPort,
+                Protocol:  "tcp",
+            })
+        }
+    }
+    
+    // Store the instance immediately so progress can be tracked
+    m.instances[vps.ID] = vps
+    m.createdTotal++
+    if opts.ClientIP != "" {
+        m.ipInstances[opts.ClientIP] = append(ipInstances, vps.ID)
+    }
+    m.saveStateLocked()
+
+    // Run creation in a goroutine to allow progress tracking
+    m.workers.Add(1)
+    go func() {
+        defer m.workers.Done()
+        if err := m.createVPSWithProgress(vps); errors.Is(err, errDequeued) {
+            log.Printf("VPS %s was deleted while queued", vps.ID)
+            return
+        } else if err != nil {
+            log.Printf("Failed to create VPS %s: %v", vps.ID, err)
+            m.markFailed(vps, err)
+            return
+        }
+
+        // Schedule cleanup
+        go m.scheduleCleanup(vps)
+    }()
+
+    created := *vps
+    created.Password = password
+    return &created, nil
+}
+
+// Helper function to set up the vCPU counts and balloon for a fresh QEMU,
+// which boots with VCPUs and all of MemoryMB again. VPSes from before hot-plug
+// get their ceiling here on their next start. The caller must hold m.mutex.
+func (m *VPSManager) resetLiveResourcesLocked(vps *VPS) {
+    if vps.MaxVCPUs < vps.VCPUs {
+        vps.MaxVCPUs = max(m.maxVCPUs, vps.VCPUs)
+    }
+    vps.CurrentVCPUs = vps.VCPUs
+    vps.BalloonMB = 0
+}
+
+// Helper function to fill in resources the request left unset, taking the
+// template's defaults first and the globals after that
+func resolveResources(vps *VPS) {
+    templateConfig, _ := lookupTemplate(vps.Template)
+    if vps.MemoryMB == 0 {
+        vps.MemoryMB = templateConfig.DefaultMemoryMB
+    }
+    if vps.MemoryMB == 0 {
+        vps.MemoryMB = RAM_SIZE
+    }
+    if vps.VCPUs == 0 {
+        vps.VCPUs = templateConfig.DefaultVCPUs
+    }
+    if vps.VCPUs == 0 {
+        vps.VCPUs = VCPU_COUNT
+    }
+    if vps.DiskGB == 0 {
+        vps.DiskGB = templateConfig.DefaultDiskGB
+    }
+    if vps.DiskGB == 0 {
+        vps.DiskGB = DISK_SIZE
+    }
+}
+
+// Helper function to read the host's total memory from /proc/meminfo
+func hostMemoryMB() (int, error) {
+    data, err := os.ReadFile("/proc/meminfo")
+    if err != nil {
+        return 0, err
+    }
+    for _, line := range strings.Split(string(data), "\n") {
+        if value, found := strings.CutPrefix(line, "MemTotal:"); found {
+            kb, err := strconv.Atoi(strings.TrimSuffix(strings.TrimSpace(value), " kB"))
+            if err != nil {
+                return 0, fmt.Errorf("failed to parse MemTotal: %v", err)
+            }
+            return kb / 1024, nil
+        }
+    }
+    return 0, fmt.Errorf("MemTotal not found in /proc/meminfo")
+}
+
+// Fill in the per-VPS caps the environment left unset from what the host
+// has, and refuse caps beyond it. Disks are capped by the size of the
+// filesystem holding them since qcow2 overlays can grow to full size.
+func (m *VPSManager) loadResourceLimits() error {
+    memoryMB, err := hostMemoryMB()
+    if err != nil {
+        return fmt.Errorf("failed to read host memory: %v", err)
+    }
+    var stat syscall.Statfs_t
+    if err := syscall.Statfs(filepath.Join(m.baseDir, "disks"), &stat); err != nil {
+        return fmt.Errorf("failed to read disk capacity: %v", err)
+    }
+    diskGB := int(stat.Blocks * uint64(stat.Bsize) >> 30)
+
+    for _, limit := range []struct {
+        name  string
+        value *int
+        host  int
+    }{
+        {"BLST_MAX_MEMORY_MB", &m.maxMemoryMB, memoryMB},
+        {"BLST_MAX_VCPUS", &m.maxVCPUs, runtime.NumCPU()},
+        {"BLST_MAX_DISK_GB", &m.maxDiskGB, diskGB},
+    } {
+        if *limit.value < 0 {
+            return fmt.Errorf("%s must not be negative", limit.name)
+        }
+        if *limit.value == 0 {
+            *limit.value = limit.host
+        } else if *limit.value > limit.host {
+            return fmt.Errorf("%s=%d exceeds the host's %d", limit.name, *limit.value, limit.host)
+        }
+    }
+    log.Printf("Per-VPS limits: %d MB memory, %d vCPUs, %d GB disk", m.maxMemoryMB, m.maxVCPUs, m.maxDiskGB)
+    return nil
+}
+
+// Check a VPS's resources, after template defaults, against the caps
+func (m *VPSManager) checkResourceLimits(vps *VPS) error {
+    if vps.MemoryMB > m.maxMemoryMB {
+        return fmt.Errorf("memory_mb %d exceeds the limit of %d", vps.MemoryMB, m.maxMemoryMB)
+    }
+    if vps.VCPUs > m.maxVCPUs {
+        return fmt.Errorf("vcpus %d exceeds the limit of %d", vps.VCPUs, m.maxVCPUs)
+    }
+    if vps.DiskGB > m.maxDiskGB {
+        return fmt.Errorf("disk_gb %d exceeds the limit of %d", vps.DiskGB, m.maxDiskGB)
+    }
+    return nil
+}
+
+func (m *VPSManager) createVPSWithProgress(vps *VPS) (err error) {
+    // Time spent queued doesn't count against the create timeout
+    if err := m.acquireCreateSlot(vps); err != nil {
+        return err
+    }
+    defer m.releaseCreateSlot()
+
+    ctx, cancel := context.WithTimeout(m.ctx, m.createTimeout)
+    defer cancel()
+    defer func() {
+        if err == nil {
+            return
+        }
+        m.abortCreate(vps)
+        if ctx.Err() == context.DeadlineExceeded {
+            err = fmt.Errorf("creation timed out after %s: %v", m.createTimeout, err)
+        }
+    }()
+
+    updateProgress := func(stage string, progress int) {
+        m.mutex.Lock()
+        changed := vps.Stage != stage
+        if changed || len(vps.StageHistory) == 0 {
+            vps.StageHistory = append(vps.StageHistory, StageEvent{Stage: stage, At: time.Now()})
+        }
+        moved := vps.Progress != progress
+        vps.Stage = stage
+        vps.Progress = progress
+        if changed {
+            m.publishState(vps)
+        } else if moved {
+            // Not saved to the state file, downloads report many of these
+            m.events.publish(VPSEvent{
+                Type:     EventProgress,
+                VPSID:    vps.ID,
+                Status:   vps.Status,
+                Stage:    stage,
+                Progress: progress,
+                Owner:    vps.Owner,
+            })
+        }
+        m.mutex.Unlock()
+    }
+
+    // Validate image type
+    updateProgress(StageInitializing, 10)
+    if _, exists := SUPPORTED_IMAGES[vps.ImageType]; !exists && vps.ImageURL == "" {
+        return fmt.Errorf("unsupported image type: %s", vps.ImageType)
+    }
+
+    // Validate hostname
+    if !isValidHostname(vps.Hostname) {
+        return fmt.Errorf("invalid hostname format: %s", vps.Hostname)
+    }
+
+    // Check/prepare base image
+    updateProgress(StageInitializing, 20)
+    baseImagePath := getBaseImagePath(vps.ImageType)
+    if _, err := os.Stat(baseImagePath); os.IsNotExist(err) {
+        updateProgress(StageDownloadingImage, 20)
+        // Map the download onto 20-35% so clients see it moving
+        reportDownload := func(done, total int64) {
+            if total > 0 {
+                updateProgress(StageDownloadingImage, 20+int(15*done/total))
+            }
+        }
+        if err := m.ensureBaseImage(ctx, vps.ImageType, vps.ImageURL, reportDownload); err != nil {
+            return fmt.Errorf("failed to prepare base image: %v", err)
+        }
+    }
+
+    if err := contextError(ctx); err != nil {
+        return err
+    }
+
+    // Create instance directory
+    instanceDir := filepath.Join(m.baseDir, "disks", vps.ID)
+    if err := os.MkdirAll(instanceDir, 0755); err != nil {
+        return fmt.Errorf("failed to create instance directory: %v", err)
+    }
+
+    // Create disk image
+    updateProgress(StageCreatingDisk, 40)
+    var createDisk *exec.Cmd
+    if vps.DiskFormat == DiskFormatRaw {
+        // Full standalone copy, trades disk space and create time for overlay-free I/O
+        vps.ImagePath = filepath.Join(instanceDir, "disk.raw")
+        createDisk = exec.CommandContext(ctx, "qemu-img", "convert",
+            "-f", "qcow2",
+            "-O", "raw",
+            baseImagePath,
+            vps.ImagePath)
+    } else {
+        vps.ImagePath = filepath.Join(instanceDir, "disk.qcow2")
+        args := []string{"create",
+            "-f", "qcow2",
+            "-F", "qcow2",
+            "-b", baseImagePath,
+        }
+        // Only the overlay is encrypted, the shared base image stays plain
+        if vps.Encrypted {
+            keyPath, err := m.createDiskKey(vps.ID)
+            if err != nil {
+                return err
+            }
+            args = append(args,
+                "--object", diskSecretObject(keyPath),
+                "-o", "encrypt.format=luks,encrypt.key-secret="+DISK_SECRET_ID)
+        }
+        args = append(args, vps.ImagePath, fmt.Sprintf("%dG", vps.DiskGB))
+        createDisk = exec.CommandContext(ctx, "qemu-img", args...)
+    }
+    
+    if output, err := createDisk.CombinedOutput(); err != nil {
+        return fmt.Errorf("failed to create disk: %v, output: %s", err, string(output))
+    }
+
+    // The raw copy keeps the base image's size, so grow it separately
+    if vps.DiskFormat == DiskFormatRaw && vps.DiskGB > DISK_SIZE {
+        resizeDisk := exec.CommandContext(ctx, "qemu-img", "resize", "-f", "raw", vps.ImagePath, fmt.Sprintf("%dG", vps.DiskGB))
+        if output, err := resizeDisk.CombinedOutput(); err != nil {
+            return fmt.Errorf("failed to resize disk: %v, output: %s", err, string(output))
+        }
+    }
+
+    if err := contextError(ctx); err != nil {
+        return err
+    }
+
+    // Create cloud-init ISO
+    updateProgress(StagePreparingCloudInit, 60)
+    cloudInitPath := filepath.Join(instanceDir, "cloud-init.iso")
+    if err := createCloudInitISO(cloudInitPath, vps); err != nil {
+        return fmt.Errorf("failed to create cloud-init ISO: %v", err)
+    }
+
+    // Past this point QEMU is launched and the pid recorded even during
+    // shutdown, so cleanup can kill it instead of leaking it
+    if err := contextError(ctx); err != nil {
+        return err
+    }
+
+    // Wait for a launch slot so bursts of creates don't all boot at once
+    updateProgress(StageWaitingLaunch, 75)
+    wait, err := m.acquireLaunchSlot(ctx)
+    if err != nil {
+        return err
+    }
+    slotHeld := true
+    releaseSlot := func() {
+        if slotHeld {
+            slotHeld = false
+            m.releaseLaunchSlot()
+        }
+    }
+    defer releaseSlot()
+    m.mutex.Lock()
+    vps.StageHistory[len(vps.StageHistory)-1].Detail = fmt.Sprintf("waited %s for a launch slot", wait.Round(time.Millisecond))
+    m.mutex.Unlock()
+
+    // Start QEMU
+    updateProgress(StageStartingQEMU, 80)
+    pidFile := filepath.Join(instanceDir, "qemu.pid")
+    logFile := filepath.Join(m.baseDir, "logs", fmt.Sprintf("%s.log", vps.ID))
+
+    m.mutex.Lock()
+    m.resetLiveResourcesLocked(vps)
+    m.mutex.Unlock()
+    args := m.buildQEMUArgs(vps)
+    if err := writeQEMUCommand(instanceDir, m.qemuBin, args, vps); err != nil {
+        log.Printf("Warning: Failed to record QEMU command for VPS %s: %v", vps.ID, err)
+    }
+
+    if err := m.createTapDevices(vps); err != nil {
+        return err
+    }
+
+    if err := createCgroup(vps.ID, vps.VCPUs, vps.MemoryMB); err != nil {
+        log.Printf("Warning: Resource limits for VPS %s not enforced: %v", vps.ID, err)
+    }
+
+    cmd := exec.Command(m.qemuBin, args...)
+    
+    stdout, err := os.Create(logFile)
+    if err != nil {
+        return fmt.Errorf("failed to create log file: %v", err)
+    }
+    defer stdout.Close()
+    cmd.Stdout = stdout
+    cmd.Stderr = stdout
+
+    if err := cmd.Start(); err != nil {
+        return fmt.Errorf("failed to start QEMU: %v", err)
+    }
+
+    // Wait for PID file
+    var pid int
+    timeout := time.After(30 * time.Second)
+    ticker := time.NewTicker(500 * time.Millisecond)
+    defer ticker.Stop()
+
+    for {
+        select {
+        case <-timeout:
+            logs, _ := os.ReadFile(logFile)
+            return fmt.Errorf("timeout waiting for QEMU to start. Logs: %s", string(logs))
+            
+        case <-ticker.C:
+            if pidBytes, err := os.ReadFile(pidFile); err == nil {
+                if _, err := fmt.Sscanf(string(pidBytes), "%d", &pid); err == nil {
+                    goto pidFound
+                }
+            }
+        }
+    }
+
+pidFound:
+    // Verify QEMU process
+    retries := 3
+    for i := 0; i < retries; i++ {
+        if err := checkProcess(pid); err == nil {
+            break
+        }
+        if i == retries-1 {
+            logs, _ := os.ReadFile(logFile)
+            return fmt.Errorf("QEMU process verification failed after %d retries. Logs: %s", retries, string(logs))
+        }
+        time.Sleep(time.Second)
+    }
+
+    vps.QEMUPid = pid
+    releaseSlot()
+    if err := addToCgroup(vps.ID, pid); err != nil {
+        log.Printf("Warning: Failed to place QEMU for VPS %s in cgroup: %v", vps.ID, err)
+    }
+
+    // Complete
+    updateProgress(StageCompleted, 100)
+    m.mutex.Lock()
+    m.setStatus(vps, "running")
+    m.mutex.Unlock()
+
+    // Check the template installed correctly once cloud-init finishes
+    go m.verifyTemplate(vps)
+
+    return nil
+}
+
+var errDequeued = errors.New("removed from the create queue")
+
+// Block until a create slot is free. A VPS that has to wait is shown in
+// StageQueued, and deleting it while it waits returns errDequeued.
+func (m *VPSManager) acquireCreateSlot(vps *VPS) error {
+    select {
+    case m.createSlots <- struct{}{}:
+        return nil
+    default:
+    }
+
+    ctx, cancel := context.WithCancel(m.ctx)
+    defer cancel()
+
+    m.mutex.Lock()
+    m.queuedCreates[vps.ID] = cancel
+    vps.Stage = StageQueued
+    vps.Progress = 0
+    vps.StageHistory = append(vps.StageHistory, StageEvent{Stage: StageQueued, At: time.Now()})
+    m.publishState(vps)
+    m.mutex.Unlock()
+
+    acquired := false
+    select {
+    case m.createSlots <- struct{}{}:
+        acquired = true
+    case <-ctx.Done():
+    }
+
+    // Leaving the queue under the lock means a delete either cancelled ctx
+    // already or will find the create no longer queued. select picks at
+    // random when both cases are ready, so a slot may have been taken anyway.
+    m.mutex.Lock()
+    delete(m.queuedCreates, vps.ID)
+    err := ctx.Err()
+    m.mutex.Unlock()
+    if err == nil {
+        return nil
+    }
+    if acquired {
+        m.releaseCreateSlot()
+    }
+    if err := m.checkShutdown(); err != nil {
+        return err
+    }
+    return errDequeued
+}
+
+func (m *VPSManager) releaseCreateSlot() {
+    <-m.createSlots
+}
+
+// Block until a QEMU launch slot is free, returning how long that took
+func (m *VPSManager) acquireLaunchSlot(ctx context.Context) (time.Duration, error) {
+    start := time.Now()
+    select {
+    case m.launchSlots <- struct{}{}:
+        return time.Since(start), nil
+    case <-ctx.Done():
+        return time.Since(start), contextError(ctx)
+    }
+}
+
+func (m *VPSManager) releaseLaunchSlot() {
+    <-m.launchSlots
+}
+
+func (m *VPSManager) checkShutdown() error {
+    return contextError(m.ctx)
+}
+
+// Helper function to describe why a create or shutdown context ended
+func contextError(ctx context.Context) error {
+    switch ctx.Err() {
+    case nil:
+        return nil
+    case context.DeadlineExceeded:
+        return fmt.Errorf("deadline exceeded")
+    default:
+        return fmt.Errorf("aborted, server is shutting down")
+    }
+}
+
+// Record a failed create or rebuild, or forget it entirely when
+// BLST_REMOVE_FAILED is set. Its resources are already released by abortCreate.
+func (m *VPSManager) markFailed(vps *VPS, err error) {
+    m.mutex.Lock()
+    defer m.mutex.Unlock()
+
+    if m.removeFailed {
+        delete(m.instances, vps.ID)
+        m.forgetIPInstanceLocked(vps.ID)
+        m.events.publish(VPSEvent{Type: EventDeleted, VPSID: vps.ID, Owner: vps.Owner})
+        return
+    }
+    vps.Stage = StageFailed
+    vps.ErrorMsg = err.Error()
+    m.setStatus(vps, "failed")
+}
+
+// Host-level cleanup abortCreate runs. Variables so tests, which can't create
+// taps or cgroups without root, can see what would be removed.
+var (
+    teardownCgroup = removeCgroup
+    teardownTaps   = removeTapDevice
+)
+
+// Kill anything a failed create started and remove its half-built instance
+// directory. QEMU may be up before its pid is recorded, so fall back to the
+// pidfile.
+func (m *VPSManager) abortCreate(vps *VPS) {
+    instanceDir := filepath.Join(m.baseDir, "disks", vps.ID)
+
+    m.mutex.Lock()
+    pid := vps.QEMUPid
+    vps.QEMUPid = 0
+    m.mutex.Unlock()
+    if pid <= 0 {
+        if pidBytes, err := os.ReadFile(filepath.Join(instanceDir, "qemu.pid")); err == nil {
+            fmt.Sscanf(string(pidBytes), "%d", &pid)
+        }
+    }
+    if pid > 0 && checkProcess(pid) == nil {
+        if proc, err := os.FindProcess(pid); err == nil {
+            log.Printf("Killing QEMU process %d for failed VPS %s", pid, vps.ID)
+            proc.Kill()
+        }
+    }
+
+    if err := os.RemoveAll(instanceDir); err != nil {
+        log.Printf("Warning: Failed to remove instance directory for VPS %s: %v", vps.ID, err)
+    }
+    os.Remove(m.diskKeyPath(vps.ID))
+    go teardownCgroup(vps.ID)
+    teardownTaps(vps.ID)
+}
+
+func isValidHostname(hostname string) bool {
+    if len(hostname) > 253 {
+        return false
+    }
+    
+    parts := strings.Split(hostname, ".")
+    for _, part := range parts {
+        if len(part) > 63 {
+            return false
+        }
+        if !regexp.MustCompile(`^[a-zA-Z0-9]([a-zA-Z0-9-]*[a-zA-Z0-9])?$`).MatchString(part) {
+            return false
+        }
+    }
+    
+    return true
+}
+
+
+// Ask the guest to power off and wait up to timeout for it in the background,
+// killing QEMU when it doesn't. Zero means STOP_TIMEOUT.
+func (m *VPSManager) StopVPS(id string, timeout time.Duration) error {
+    if timeout <= 0 {
+        timeout = STOP_TIMEOUT
+    }
+
+    m.mutex.Lock()
+    defer m.mutex.Unlock()
+
+    vps, exists := m.instances[id]
+    if !exists {
+        return fmt.Errorf("VPS not found")
+    }
+
+    if vps.Status == StatusStopped {
+        return fmt.Errorf("VPS is already stopped")
+    }
+    if vps.Status == StatusMoving || vps.Status == StatusCloning || vps.Status == StatusRepairing || vps.Status == StatusSnapshotting {
+        return fmt.Errorf("VPS is busy, current status: %s", vps.Status)
+    }
+
+    if vps.QEMUPid <= 0 {
+        return fmt.Errorf("VPS does not have a valid PID")
+    }
+
+    monitorSocket := filepath.Join(m.baseDir, "disks", vps.ID, "qemu-monitor.sock")
+    output, err := m.executeQMPCommand(monitorSocket, `{ "execute": "system_powerdown" }`)
+    if err == nil {
+        err = parseQMPReturn(output, nil)
+    }
+    if err != nil {
+        return fmt.Errorf("failed to request power-off: %v", err)
+    }
+
+    m.setStatus(vps, StatusStopping)
+    pid := vps.QEMUPid
+
+    // Wait for shutdown to complete
+    go func() {
+        deadline := time.After(timeout)
+        ticker := time.NewTicker(time.Second)
+        defer ticker.Stop()
+
+        for {
+            select {
+            case <-deadline:
+                // Force stop if graceful shutdown fails. A dying QEMU still
+                // holds the disk's write lock, so the VPS only counts as
+                // stopped once the process is gone.
+                log.Printf("Warning: VPS %s did not power off within %s, killing QEMU", id, timeout)
+                err := killQEMU(pid)
+                m.mutex.Lock()
+                if err != nil {
+                    // Left stopping; validateInstances marks it stopped
+                    // whenever the process does exit
+                    log.Printf("Warning: Failed to stop VPS %s: %v", id, err)
+                    vps.Alert = fmt.Sprintf("forced shutdown failed: %v", err)
+                } else {
+                    vps.ErrorMsg = fmt.Sprintf("forced shutdown: guest did not power off within %s", timeout)
+                    m.setStatus(vps, StatusStopped)
+                }
+                m.mutex.Unlock()
+                return
+                
+            case <-ticker.C:
+                if err := checkProcess(pid); err != nil {
+                    m.mutex.Lock()
+                    m.setStatus(vps, StatusStopped)
+                    m.mutex.Unlock()
+                    return
+                }
+            }
+        }
+    }()
+
+    return nil
+}
+
+// Build the QEMU command line for a VPS. Shared by create and start so a
+// restarted guest comes back with the same hardware.
+func (m *VPSManager) buildQEMUArgs(vps *VPS) []string {
+    instanceDir := filepath.Join(m.baseDir, "disks", vps.ID)
+    pidFile := filepath.Join(instanceDir, "qemu.pid")
+    cloudInitPath := filepath.Join(instanceDir, "cloud-init.iso")
+    monitorSocket := filepath.Join(instanceDir, "qemu-monitor.sock")
+    agentSocket := filepath.Join(instanceDir, "qemu-ga.sock")
+    serialSocket := filepath.Join(instanceDir, "serial.sock")
+
+    diskFormat := vps.DiskFormat
+    if diskFormat == "" {
+        diskFormat = DiskFormatQCOW2
+    }
+    cacheMode := vps.CacheMode
+    if cacheMode == "" {
+        cacheMode = CacheModeWriteback
+    }
+    disk := fmt.Sprintf("file=%s,format=%s,cache=%s,aio=threads", vps.ImagePath, diskFormat, cacheMode)
+    if vps.Encrypted {
+        disk += ",encrypt.key-secret=" + DISK_SECRET_ID
+    }
+    if t := vps.IOThrottle; t != nil {
+        disk += fmt.Sprintf(",throttling.bps-total=%d,throttling.bps-read=%d,throttling.bps-write=%d"+
+            ",throttling.iops-total=%d,throttling.iops-read=%d,throttling.iops-write=%d",
+            t.BPS, t.BPSRead, t.BPSWrite, t.IOPS, t.IOPSRead, t.IOPSWrite)
+    }
+
+    maxCPUs := max(vps.MaxVCPUs, vps.VCPUs)
+
+    // pc stays the default for compatibility with older guests and hosts
+    machine := "pc,accel=kvm,usb=off,vmport=off"
+    if m.q35Machine {
+        machine = "q35,accel=kvm,usb=off,vmport=off,kernel-irqchip=on"
+    }
+
+    args := []string{
+        "-name", fmt.Sprintf("guest=%s,debug-threads=on", vps.Name),
+        "-machine", machine,
+        "-cpu", formatCPU(vps),
+        "-m", fmt.Sprintf("%d", vps.MemoryMB),
+        // Spare sockets up to maxcpus are what vCPUs are hot-plugged into
+        "-smp", fmt.Sprintf("%d,maxcpus=%d,sockets=%d,cores=1,threads=1", vps.VCPUs, maxCPUs, maxCPUs),
+        "-drive", disk,
+        "-drive", m.cdromDrive(vps),
+        "-device", "ide-cd,drive=cdrom0,id=cd0",
+        "-vnc", fmt.Sprintf("%s:%d", formatHostAddress(m.bindAddress), vps.VNCPort-5900),
+        "-qmp", fmt.Sprintf("unix:%s,server,nowait", monitorSocket),
+        "-chardev", fmt.Sprintf("socket,path=%s,server=on,wait=off,id=qga0", agentSocket),
+        "-device", "virtio-balloon,id=balloon0",
+        "-device", "virtio-serial",
+        "-device", "virtserialport,chardev=qga0,name=org.qemu.guest_agent.0",
+        // ttyS0, for /api/vps/console. wait=off keeps the guest from blocking
+        // while nobody is attached.
+        "-chardev", fmt.Sprintf("socket,path=%s,server=on,wait=off,id=serial0", serialSocket),
+        "-serial", "chardev:serial0",
+        "-pidfile", pidFile,
+        "-daemonize",
+        "-enable-kvm",
+    }
+
+    for i, nic := range m.vpsNICs(vps) {
+        var netdev string
+        switch nic.Type {
+        case NetworkModeBridge:
+            // Bridged NICs get a real LAN presence, so no forwards are needed
+            netdev = fmt.Sprintf("tap,id=net%d,ifname=%s,script=no,downscript=no", i, nicTapName(vps.ID, i))
+        default:
+            forwards := nic.Forwards
+            if i == 0 {
+                sshForward := PortForward{HostPort: vps.SSHPort, GuestPort: 22, Protocol: "tcp"}
+                forwards = append(append([]PortForward{sshForward}, vps.PortForwards...), forwards...)
+            }
+            netdev = fmt.Sprintf("user,id=net%d", i) + formatHostForwards(forwards, m.bindAddress)
+        }
+        args = append(args,
+            "-device", fmt.Sprintf("virtio-net-pci,netdev=net%d,mac=%s", i, nicMAC(vps.ID, i, nic)),
+            "-netdev", netdev,
+        )
+    }
+
+    if vps.CloudInitSeed == CloudInitSeedSMBIOS {
+        // QEMU splits options on commas, which the URL never contains
+        args = append(args, "-smbios", fmt.Sprintf("type=1,serial=ds=nocloud-net;s=%s/seed/%s/%s/", m.seedURL, vps.ID, vps.SeedToken))
+    } else {
+        args = append(args, "-drive", fmt.Sprintf("file=%s,format=raw", cloudInitPath))
+    }
+
+    // The secret has to exist before the drive that references it
+    if vps.Encrypted {
+        args = append([]string{"-object", diskSecretObject(m.diskKeyPath(vps.ID))}, args...)
+    }
+
+    if m.q35Machine {
+        args = append([]string{"-no-user-config"}, args...)
+    }
+
+    // Fresh guests otherwise stall on SSH host key generation waiting for entropy
+    if m.virtioRNG {
+        args = append(args,
+            "-object", "rng-random,filename=/dev/urandom,id=rng0",
+            "-device", "virtio-rng-pci,rng=rng0",
+        )
+    }
+
+    // e.g. BLST_QEMU_EXTRA_ARGS="-overcommit mem-lock=off"
+    args = append(args, m.qemuExtraArgs...)
+
+    return args
+}
+
+// Helper function to get where a VPS's disk encryption key is kept. Keys live
+// outside the instance directory so copies of the disks don't carry them.
+func (m *VPSManager) diskKeyPath(id string) string {
+    return filepath.Join(m.baseDir, "keys", id+".key")
+}
+
+// Generate a random LUKS passphrase for a VPS overlay and store it readable
+// by the service user only
+func (m *VPSManager) createDiskKey(id string) (string, error) {
+    key := make([]byte, 32)
+    if _, err := rand.Read(key); err != nil {
+        return "", fmt.Errorf("failed to generate disk key: %v", err)
+    }
+
+    path := m.diskKeyPath(id)
+    if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+        return "", fmt.Errorf("failed to create key directory: %v", err)
+    }
+    if err := os.WriteFile(path, []byte(base64.StdEncoding.EncodeToString(key)), 0600); err != nil {
+        return "", fmt.Errorf("failed to write disk key: %v", err)
+    }
+    return path, nil
+}
+
+// Helper function to describe the secret object holding a disk key, shared by
+// qemu-img and QEMU so the key never appears on a command line
+func diskSecretObject(keyPath string) string {
+    return fmt.Sprintf("secret,id=%s,file=%s,format=base64", DISK_SECRET_ID, keyPath)
+}
+
+// Helper function to describe the CD-ROM drive, keeping any attached ISO in
+// the tray across restarts
+func (m *VPSManager) cdromDrive(vps *VPS) string {
+    drive := "if=none,id=cdrom0,media=cdrom,readonly=on"
+    if vps.Media == "" {
+        return drive
+    }
+    // Boot with an empty tray rather than failing if the ISO was removed
+    path, err := m.uploadedISOPath(vps.Media)
+    if err != nil {
+        log.Printf("Warning: Dropping media for VPS %s: %v", vps.ID, err)
+        return drive
+    }
+    return drive + ",format=raw,file=" + path
+}
+
+// Helper function to resolve an ISO name to a file in the uploads dir. Only
+// bare names are accepted so requests can't reach anywhere else on the host.
+func (m *VPSManager) uploadedISOPath(name string) (string, error) {
+    // Commas would split the QEMU -drive option the name ends up in
+    if name == "" || name != filepath.Base(name) || strings.HasPrefix(name, ".") || strings.Contains(name, ",") {
+        return "", fmt.Errorf("invalid ISO name: %s", name)
+    }
+    if !strings.HasSuffix(strings.ToLower(name), ".iso") {
+        return "", fmt.Errorf("not an ISO: %s", name)
+    }
+
+    path := filepath.Join(m.baseDir, "uploads", name)
+    info, err := os.Stat(path)
+    if err != nil || !info.Mode().IsRegular() {
+        return "", fmt.Errorf("ISO not found in uploads: %s", name)
+    }
+    return path, nil
+}
+
+// Helper function to check that the running QEMU has the CD-ROM drive. Guests
+// started before it existed only get one on their next boot.
+func (m *VPSManager) hasCDROM(monitorSocket string) (bool, error) {
+    output, err := m.executeQMPCommand(monitorSocket, `{ "execute": "query-block" }`)
+    if err != nil {
+        return false, err
+    }
+
+    var devices []struct {
+        Device string `json:"device"`
+    }
+    if err := parseQMPReturn(output, &devices); err != nil {
+        return false, err
+    }
+    for _, device := range devices {
+        if device.Device == "cdrom0" {
+            return true, nil
+        }
+    }
+    return false, nil
+}
+
+// Insert an uploaded ISO into a running VPS's CD-ROM drive, or eject the
+// current one when name is empty
+func (m *VPSManager) ChangeMedia(id string, name string) error {
+    var path string
+    if name != "" {
+        var err error
+        if path, err = m.uploadedISOPath(name); err != nil {
+            return err
+        }
+    }
+
+    m.mutex.RLock()
+    vps, exists := m.instances[id]
+    var status string
+    if exists {
+        status = vps.Status
+    }
+    m.mutex.RUnlock()
+    if !exists {
+        return errVPSNotFound
+    }
+    if status != StatusRunning {
+        return fmt.Errorf("VPS must be running to change media")
+    }
+
+    monitorSocket := filepath.Join(m.baseDir, "disks", id, "qemu-monitor.sock")
+    present, err := m.hasCDROM(monitorSocket)
+    if err != nil {
+        return fmt.Errorf("failed to query drives: %v", err)
+    }
+    if !present {
+        return fmt.Errorf("VPS has no CD-ROM drive yet, one is added on its next start")
+    }
+
+    command := `{ "execute": "eject", "arguments": { "id": "cd0", "force": true } }`
+    if path != "" {
+        arguments, _ := json.Marshal(map[string]string{"id": "cd0", "filename": path, "format": "raw"})
+        command = fmt.Sprintf(`{ "execute": "blockdev-change-medium", "arguments": %s }`, arguments)
+    }
+    output, err := m.executeQMPCommand(monitorSocket, command)
+    if err == nil {
+        err = parseQMPReturn(output, nil)
+    }
+    if err != nil {
+        return fmt.Errorf("failed to change media: %v", err)
+    }
+
+    m.mutex.Lock()
+    vps.Media = name
+    m.mutex.Unlock()
+    return nil
+}
+
+func (m *VPSManager) handleAttachISO(w http.ResponseWriter, r *http.Request) {
+    if !allowMethods(w, r, http.MethodPost) {
+        return
+    }
+
+    id, ok := m.vpsIDFromRequest(w, r)
+    if !ok {
+        return
+    }
+    iso := r.URL.Query().Get("iso")
+    if _, err := m.uploadedISOPath(iso); err != nil {
+        http.Error(w, err.Error(), http.StatusBadRequest)
+        return
+    }
+
+    if err := m.ChangeMedia(id, iso); err != nil {
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+
+    w.WriteHeader(http.StatusOK)
+}
+
+func (m *VPSManager) handleEjectISO(w http.ResponseWriter, r *http.Request) {
+    if !allowMethods(w, r, http.MethodPost) {
+        return
+    }
+
+    id, ok := m.vpsIDFromRequest(w, r)
+    if !ok {
+        return
+    }
+
+    if err := m.ChangeMedia(id, ""); err != nil {
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+
+    w.WriteHeader(http.StatusOK)
+}
+
+func validateIOThrottle(t IOThrottle) error {
+    if t.BPS < 0 || t.BPSRead < 0 || t.BPSWrite < 0 || t.IOPS < 0 || t.IOPSRead < 0 || t.IOPSWrite < 0 {
+        return fmt.Errorf("throttle limits must not be negative")
+    }
+    // QEMU rejects a total limit alongside a per-direction one
+    if t.BPS > 0 && (t.BPSRead > 0 || t.BPSWrite > 0) {
+        return fmt.Errorf("bps can't be combined with bps_rd or bps_wr")
+    }
+    if t.IOPS > 0 && (t.IOPSRead > 0 || t.IOPSWrite > 0) {
+        return fmt.Errorf("iops can't be combined with iops_rd or iops_wr")
+    }
+    return nil
+}
+
+// Helper function to find a running VPS's system disk in query-block and read
+// its current limits
+func (m *VPSManager) queryDiskThrottle(monitorSocket string, imagePath string) (string, IOThrottle, error) {
+    output, err := m.executeQMPCommand(monitorSocket, `{ "execute": "query-block" }`)
+    if err != nil {
+        return "", IOThrottle{}, err
+    }
+
+    var devices []struct {
+        Device   string `json:"device"`
+        Inserted *struct {
+            File string `json:"file"`
+            IOThrottle
+        } `json:"inserted"`
+    }
+    if err := parseQMPReturn(output, &devices); err != nil {
+        return "", IOThrottle{}, err
+    }
+    // Encrypted overlays report a json: filename that still contains the path
+    for _, device := range devices {
+        if device.Inserted != nil && strings.Contains(device.Inserted.File, imagePath) {
+            return device.Device, device.Inserted.IOThrottle, nil
+        }
+    }
+    return "", IOThrottle{}, fmt.Errorf("system disk not found in query-block")
+}
+
+// Apply disk I/O limits to a VPS. Running guests get them immediately through
+// QMP; either way they are kept for the next start.
+func (m *VPSManager) SetIOThrottle(id string, limits IOThrottle) error {
+    if err := validateIOThrottle(limits); err != nil {
+        return err
+    }
+
+    m.mutex.RLock()
+    vps, exists := m.instances[id]
+    var status, imagePath string
+    if exists {
+        status, imagePath = vps.Status, vps.ImagePath
+    }
+    m.mutex.RUnlock()
+    if !exists {
+        return errVPSNotFound
+    }
+
+    if status == StatusRunning {
+        monitorSocket := filepath.Join(m.baseDir, "disks", id, "qemu-monitor.sock")
+        device, _, err := m.queryDiskThrottle(monitorSocket, imagePath)
+        if err != nil {
+            return fmt.Errorf("failed to find disk: %v", err)
+        }
+        command, err := json.Marshal(map[string]interface{}{
+            "execute": "block_set_io_throttle",
+            "arguments": map[string]interface{}{
+                "device":  device,
+                "bps":     limits.BPS,
+                "bps_rd":  limits.BPSRead,
+                "bps_wr":  limits.BPSWrite,
+                "iops":    limits.IOPS,
+                "iops_rd": limits.IOPSRead,
+                "iops_wr": limits.IOPSWrite,
+            },
+        })
+        if err != nil {
+            return err
+        }
+        output, err := m.executeQMPCommand(monitorSocket, string(command))
+        if err != nil {
+            return fmt.Errorf("failed to set throttle: %v", err)
+        }
+        if err := parseQMPReturn(output, nil); err != nil {
+            return fmt.Errorf("failed to set throttle: %v", err)
+        }
+    }
+
+    m.mutex.Lock()
+    if limits == (IOThrottle{}) {
+        vps.IOThrottle = nil
+    } else {
+        vps.IOThrottle = &limits
+    }
+    m.mutex.Unlock()
+
+    log.Printf("Disk I/O limits for VPS %s set to %+v", id, limits)
+    return nil
+}
+
+// Inflate or deflate a running VPS's balloon so the guest keeps mb of its
+// memory. The guest can't be given more than the MemoryMB it booted with.
+func (m *VPSManager) SetMemory(id string, mb int) error {
+    m.mutex.Lock()
+    defer m.mutex.Unlock()
+
+    vps, exists := m.instances[id]
+    if !exists {
+        return errVPSNotFound
+    }
+    if vps.Status != StatusRunning {
+        return fmt.Errorf("%w, current status: %s", errVPSNotRunning, vps.Status)
+    }
+    if mb < MIN_BALLOON_MB || mb > vps.MemoryMB {
+        return fmt.Errorf("%w: mb must be between %d and the VPS's %d", errInvalidMemory, MIN_BALLOON_MB, vps.MemoryMB)
+    }
+
+    monitorSocket := filepath.Join(m.baseDir, "disks", id, "qemu-monitor.sock")
+    command := fmt.Sprintf(`{ "execute": "balloon", "arguments": { "value": %d } }`, int64(mb)<<20)
+    output, err := m.executeQMPCommand(monitorSocket, command)
+    if err == nil {
+        err = parseQMPReturn(output, nil)
+    }
+    if err != nil {
+        // Guests started before the balloon device was added have none
+        return fmt.Errorf("failed to set balloon, a VPS started by an older release needs a restart: %v", err)
+    }
+
+    log.Printf("Balloon of VPS %s set to %d MB of %d MB", id, mb, vps.MemoryMB)
+    vps.BalloonMB = mb
+    if mb == vps.MemoryMB {
+        vps.BalloonMB = 0
+    }
+    m.publishState(vps)
+    return nil
+}
+
+func (m *VPSManager) handleSetMemory(w http.ResponseWriter, r *http.Request) {
+    if !allowMethods(w, r, http.MethodPost) {
+        return
+    }
+
+    id, ok := m.vpsIDFromRequest(w, r)
+    if !ok {
+        return
+    }
+
+    mb, err := strconv.Atoi(r.URL.Query().Get("mb"))
+    if err != nil {
+        http.Error(w, "mb must be an integer", http.StatusBadRequest)
+        return
+    }
+
+    if err := m.SetMemory(id, mb); err != nil {
+        status := http.StatusInternalServerError
+        if errors.Is(err, errVPSNotFound) {
+            status = http.StatusNotFound
+        } else if errors.Is(err, errVPSNotRunning) {
+            status = http.StatusConflict
+        } else if errors.Is(err, errInvalidMemory) {
+            status = http.StatusBadRequest
+        }
+        http.Error(w, err.Error(), status)
+        return
+    }
+
+    vps, err := m.GetVPS(id)
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusNotFound)
+        return
+    }
+    writeJSON(w, http.StatusOK, vps)
+}
+
+// A CPU slot from query-hotpluggable-cpus. qom-path is only set when the slot
+// holds a CPU; ones added by device_add live under /machine/peripheral/.
+type hotpluggableCPU struct {
+    Type    string                 `json:"type"`
+    Props   map[string]interface{} `json:"props"`
+    QOMPath string                 `json:"qom-path"`
+}
+
+// One socket per CPU, so socket-id orders them
+func cpuSocketID(slot hotpluggableCPU) int {
+    id, _ := slot.Props["socket-id"].(float64)
+    return int(id)
+}
+
+// Helper function to list a running VPS's CPU slots by socket: the empty
+// ones, the ones plugged in at runtime, and how many hold a CPU
+func (m *VPSManager) queryCPUSlots(monitorSocket string) (empty, hotplugged []hotpluggableCPU, present int, err error) {
+    output, err := m.executeQMPCommand(monitorSocket, `{ "execute": "query-hotpluggable-cpus" }`)
+    if err != nil {
+        return nil, nil, 0, fmt.Errorf("failed to query CPUs: %v", err)
+    }
+    var slots []hotpluggableCPU
+    if err := parseQMPReturn(output, &slots); err != nil {
+        return nil, nil, 0, fmt.Errorf("failed to query CPUs: %v", err)
+    }
+    slices.SortFunc(slots, func(a, b hotpluggableCPU) int { return cpuSocketID(a) - cpuSocketID(b) })
+
+    for _, slot := range slots {
+        switch {
+        case slot.QOMPath == "":
+            empty = append(empty, slot)
+        case strings.HasPrefix(slot.QOMPath, "/machine/peripheral/"):
+            hotplugged = append(hotplugged, slot)
+            present++
+        default:
+            present++
+        }
+    }
+    return empty, hotplugged, present, nil
+}
+
+// Helper function to wait for unplugged vCPUs to leave query-hotpluggable-cpus,
+// returning how many are still present when count is reached or timeout passes
+func (m *VPSManager) waitForCPUUnplug(monitorSocket string, count int, timeout time.Duration) (int, error) {
+    deadline := time.Now().Add(timeout)
+    for {
+        _, _, present, err := m.queryCPUSlots(monitorSocket)
+        if err != nil || present <= count || time.Now().After(deadline) {
+            return present, err
+        }
+        time.Sleep(200 * time.Millisecond)
+    }
+}
+
+// Plug or unplug vCPUs of a running VPS until count are present. Only CPUs
+// plugged in at runtime are removed, never the ones it booted with. The guest
+// has to bring new CPUs online, which udev does on most distros, and agree
+// to release removed ones.
+func (m *VPSManager) SetVCPUs(id string, count int) error {
+    m.mutex.Lock()
+    defer m.mutex.Unlock()
+
+    vps, exists := m.instances[id]
+    if !exists {
+        return errVPSNotFound
+    }
+    if vps.Status != StatusRunning {
+        return fmt.Errorf("%w, current status: %s", errVPSNotRunning, vps.Status)
+    }
+    // Unplugging a boot CPU can take down the guest
+    if count < vps.VCPUs {
+        return fmt.Errorf("%w: can't go below the %d vCPUs the VPS booted with", errInvalidVCPUs, vps.VCPUs)
+    }
+    // Guests started before hot-plug support have no spare sockets
+    if count > max(vps.MaxVCPUs, vps.VCPUs) {
+        return fmt.Errorf("%w: count %d exceeds the maximum of %d", errInvalidVCPUs, count, max(vps.MaxVCPUs, vps.VCPUs))
+    }
+
+    monitorSocket := filepath.Join(m.baseDir, "disks", id, "qemu-monitor.sock")
+    empty, hotplugged, present, err := m.queryCPUSlots(monitorSocket)
+    if err != nil {
+        return err
+    }
+
+    var commands []map[string]interface{}
+    if count > present {
+        if count-present > len(empty) {
+            return fmt.Errorf("%w: only %d free CPU slots, restart the VPS to get up to %d", errInvalidVCPUs, len(empty), vps.MaxVCPUs)
+        }
+        for _, slot := range empty[:count-present] {
+            arguments := map[string]interface{}{
+                "driver": slot.Type,
+                "id":     fmt.Sprintf("vcpu%d", cpuSocketID(slot)),
+            }
+            for key, value := range slot.Props {
+                arguments[key] = value
+            }
+            commands = append(commands, map[string]interface{}{"execute": "device_add", "arguments": arguments})
+        }
+    } else if count < present {
+        // Highest sockets first, the reverse of the order they were added
+        for i := len(hotplugged) - 1; i >= 0 && len(commands) < present-count; i-- {
+            commands = append(commands, map[string]interface{}{
+                "execute":   "device_del",
+                "arguments": map[string]interface{}{"id": filepath.Base(hotplugged[i].QOMPath)},
+            })
+        }
+    }
+
+    for _, command := range commands {
+        data, err := json.Marshal(command)
+        if err != nil {
+            return err
+        }
+        output, err := m.executeQMPCommand(monitorSocket, string(data))
+        if err == nil {
+            err = parseQMPReturn(output, nil)
+        }
+        if err != nil {
+            return fmt.Errorf("failed to %s CPU: %v", command["execute"], err)
+        }
+    }
+
+    // device_del only asks the guest to give the CPU up
+    if count < present {
+        if present, err = m.waitForCPUUnplug(monitorSocket, count, CPU_UNPLUG_TIMEOUT); err != nil {
+            return err
+        }
+        if present > count {
+            if err := setCgroupCPUs(id, present); err != nil {
+                log.Printf("Warning: CPU quota for VPS %s not updated: %v", id, err)
+            }
+            vps.CurrentVCPUs = present
+            m.publishState(vps)
+            return fmt.Errorf("guest still holds %d of the vCPUs being removed after %s, VPS has %d vCPUs", present-count, CPU_UNPLUG_TIMEOUT, present)
+        }
+    }
+
+    if err := setCgroupCPUs(id, count); err != nil {
+        log.Printf("Warning: CPU quota for VPS %s not updated: %v", id, err)
+    }
+    log.Printf("VPS %s now has %d vCPUs (booted with %d, max %d)", id, count, vps.VCPUs, vps.MaxVCPUs)
+    vps.CurrentVCPUs = count
+    m.publishState(vps)
+    return nil
+}
+
+func (m *VPSManager) handleSetVCPUs(w http.ResponseWriter, r *http.Request) {
+    if !allowMethods(w, r, http.MethodPost) {
+        return
+    }
+
+    id, ok := m.vpsIDFromRequest(w, r)
+    if !ok {
+        return
+    }
+
+    count, err := strconv.Atoi(r.URL.Query().Get("count"))
+    if err != nil {
+        http.Error(w, "count must be an integer", http.StatusBadRequest)
+        return
+    }
+
+    if err := m.SetVCPUs(id, count); err != nil {
+        status := http.StatusInternalServerError
+        if errors.Is(err, errVPSNotFound) {
+            status = http.StatusNotFound
+        } else if errors.Is(err, errVPSNotRunning) {
+            status = http.StatusConflict
+        } else if errors.Is(err, errInvalidVCPUs) {
+            status = http.StatusBadRequest
+        }
+        http.Error(w, err.Error(), status)
+        return
+    }
+
+    vps, err := m.GetVPS(id)
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusNotFound)
+        return
+    }
+    writeJSON(w, http.StatusOK, vps)
+}
+
+// Grow a VPS's disk to newGB. A stopped VPS is resized with qemu-img; a
+// running one with QMP block_resize, after which the guest is asked to rescan
+// its disks. Only the overlay's virtual size changes, reads past the end of
+// the smaller base image return zeros. The guest still has to grow its
+// partition and filesystem, which cloud-init's growpart does on the next boot.
+func (m *VPSManager) ResizeDisk(id string, newGB int) error {
+    m.mutex.Lock()
+    defer m.mutex.Unlock()
+
+    vps, exists := m.instances[id]
+    if !exists {
+        return errVPSNotFound
+    }
+    if vps.Status != StatusRunning && vps.Status != StatusStopped {
+        return fmt.Errorf("%w, current status: %s", errVPSBusy, vps.Status)
+    }
+    if vps.ImagePath == "" {
+        return fmt.Errorf("VPS has no disk")
+    }
+    // Shrinking would cut off whatever the guest keeps at the end of the disk
+    if newGB <= vps.DiskGB {
+        return fmt.Errorf("%w: disk_gb must be larger than the current %d, disks can only grow", errInvalidDiskSize, vps.DiskGB)
+    }
+    if newGB > m.maxDiskGB {
+        return fmt.Errorf("%w: disk_gb %d exceeds the limit of %d", errInvalidDiskSize, newGB, m.maxDiskGB)
+    }
+
+    instanceDir := filepath.Join(m.baseDir, "disks", id)
+    if vps.Status == StatusRunning {
+        monitorSocket := filepath.Join(instanceDir, "qemu-monitor.sock")
+        device, _, err := m.queryDiskThrottle(monitorSocket, vps.ImagePath)
+        if err != nil {
+            return fmt.Errorf("failed to find disk: %v", err)
+        }
+        command, err := json.Marshal(map[string]interface{}{
+            "execute": "block_resize",
+            "arguments": map[string]interface{}{
+                "device": device,
+                "size":   int64(newGB) << 30,
+            },
+        })
+        if err != nil {
+            return err
+        }
+        output, err := m.executeQMPCommand(monitorSocket, string(command))
+        if err == nil {
+            err = parseQMPReturn(output, nil)
+        }
+        if err != nil {
+            return fmt.Errorf("failed to resize disk: %v", err)
+        }
+
+        // The disk is on IDE (pc) or AHCI (q35), which unlike virtio-blk
+        // never tells the guest its capacity changed. A rescan through the
+        // agent is worth a try, but the new size is only certain to show
+        // after a reboot.
+        agentSocket := filepath.Join(instanceDir, "qemu-ga.sock")
+        go func() {
+            rescan := `for f in /sys/class/block/*/device/rescan; do echo 1 > "$f"; done`
+            if exitCode, output, err := guestExec(agentSocket, rescan, 30*time.Second); err != nil || exitCode != 0 {
+                log.Printf("Warning: Failed to rescan disks in VPS %s: %v %s", id, err, output)
+            }
+        }()
+    } else {
+        var args []string
+        if vps.DiskFormat == DiskFormatRaw {
+            args = []string{"resize", "-f", "raw", vps.ImagePath}
+        } else {
+            args = append([]string{"resize"}, m.qcow2ImageArgs(id, vps.ImagePath, vps.Encrypted)...)
+        }
+        args = append(args, fmt.Sprintf("%dG", newGB))
+        if output, err := exec.Command("qemu-img", args...).CombinedOutput(); err != nil {
+            return fmt.Errorf("failed to resize disk: %v, output: %s", err, string(output))
+        }
+    }
+
+    log.Printf("Resized disk of VPS %s from %dG to %dG", id, vps.DiskGB, newGB)
+    vps.DiskGB = newGB
+    m.publishState(vps)
+    return nil
+}
+
+func (m *VPSManager) handleResizeDisk(w http.ResponseWriter, r *http.Request) {
+    if !allowMethods(w, r, http.MethodPost) {
+        return
+    }
+
+    id, ok := m.vpsIDFromRequest(w, r)
+    if !ok {
+        return
+    }
+
+    var req struct {
+        DiskGB int `json:"disk_gb"`
+    }
+    if !decodeJSONBody(w, r, &req) {
+        return
+    }
+
+    if err := m.ResizeDisk(id, req.DiskGB); err != nil {
+        status := http.StatusInternalServerError
+        if errors.Is(err, errVPSNotFound) {
+            status = http.StatusNotFound
+        } else if errors.Is(err, errVPSBusy) {
+            status = http.StatusConflict
+        } else if errors.Is(err, errInvalidDiskSize) {
+            status = http.StatusBadRequest
+        }
+        http.Error(w, err.Error(), status)
+        return
+    }
+
+    vps, err := m.GetVPS(id)
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusNotFound)
+        return
+    }
+    writeJSON(w, http.StatusOK, vps)
+}
+
+// GET reports a VPS's disk I/O limits, live from QEMU when it is running.
+// POST sets them from an IOThrottle body; all zeros removes them.
+func (m *VPSManager) handleThrottle(w http.ResponseWriter, r *http.Request) {
+    if !allowMethods(w, r, http.MethodGet, http.MethodHead, http.MethodPost) {
+        return
+    }
+
+    id, ok := m.vpsIDFromRequest(w, r)
+    if !ok {
+        return
+    }
+
+    if r.Method == http.MethodPost {
+        var limits IOThrottle
+        if !decodeJSONBody(w, r, &limits) {
+            return
+        }
+        if err := validateIOThrottle(limits); err != nil {
+            http.Error(w, err.Error(), http.StatusBadRequest)
+            return
+        }
+        if err := m.SetIOThrottle(id, limits); err != nil {
+            http.Error(w, err.Error(), http.StatusInternalServerError)
+            return
+        }
+        writeJSON(w, http.StatusOK, limits)
+        return
+    }
+
+    m.mutex.RLock()
+    vps, exists := m.instances[id]
+    var limits IOThrottle
+    var status, imagePath string
+    if exists {
+        if vps.IOThrottle != nil {
+            limits = *vps.IOThrottle
+        }
+        status, imagePath = vps.Status, vps.ImagePath
+    }
+    m.mutex.RUnlock()
+    if !exists {
+        http.Error(w, errVPSNotFound.Error(), http.StatusNotFound)
+        return
+    }
+
+    if status == StatusRunning {
+        monitorSocket := filepath.Join(m.baseDir, "disks", id, "qemu-monitor.sock")
+        _, live, err := m.queryDiskThrottle(monitorSocket, imagePath)
+        if err != nil {
+            http.Error(w, fmt.Sprintf("failed to query disk: %v", err), http.StatusInternalServerError)
+            return
+        }
+        limits = live
+    }
+
+    writeJSON(w, http.StatusOK, limits)
+}
+
+// The QEMU command line a VPS was last launched with, kept in qemu-cmd.json
+type QEMUCommand struct {
+    Binary    string    `json:"binary"`
+    Args      []string  `json:"args"`
+    StartedAt time.Time `json:"started_at"`
+}
+
+// Inline secret values QEMU options can carry, e.g. -object secret,data=...
+var qemuSecretOption = regexp.MustCompile(`((?:^|,)(?:data|password)=)[^,]*`)
+
+// Helper function to record the command a VPS is launched with, minus
+// anything secret. Disk keys are passed by file, so only their path shows.
+func writeQEMUCommand(instanceDir string, binary string, args []string, vps *VPS) error {
+    redacted := make([]string, len(args))
+    for i, arg := range args {
+        arg = qemuSecretOption.ReplaceAllString(arg, "${1}[REDACTED]")
+        if vps.SeedToken != "" {
+            arg = strings.ReplaceAll(arg, vps.SeedToken, "[REDACTED]")
+        }
+        redacted[i] = arg
+    }
+
+    data, err := json.MarshalIndent(QEMUCommand{Binary: binary, Args: redacted, StartedAt: time.Now()}, "", "  ")
+    if err != nil {
+        return err
+    }
+    return os.WriteFile(filepath.Join(instanceDir, "qemu-cmd.json"), data, 0644)
+}
+
+func (m *VPSManager) StartVPS(id string) error {
+    // Taken before the manager lock so a queued start never blocks creates
+    // that already hold a slot and need the lock to report progress
+    wait, err := m.acquireLaunchSlot(m.ctx)
+    if err != nil {
+        return err
+    }
+    defer m.releaseLaunchSlot()
+    if wait > time.Second {
+        log.Printf("VPS %s waited %s for a launch slot", id, wait.Round(time.Millisecond))
+    }
+
+    m.mutex.Lock()
+    defer m.mutex.Unlock()
+
+    vps, exists := m.instances[id]
+    if !exists {
+        return fmt.Errorf("VPS not found")
+    }
+
+    if vps.Status == StatusRunning {
+        return fmt.Errorf("VPS is already running")
+    }
+    // A stopping QEMU still holds the disk until it exits
+    if vps.Status == StatusMoving || vps.Status == StatusCloning || vps.Status == StatusRepairing || vps.Status == StatusSnapshotting || vps.Status == StatusStopping {
+        return fmt.Errorf("VPS is busy, current status: %s", vps.Status)
+    }
+
+    if err := m.checkShutdown(); err != nil {
+        return err
+    }
+
+    instanceDir := filepath.Join(m.baseDir, "disks", vps.ID)
+    pidFile := filepath.Join(instanceDir, "qemu.pid")
+    logFile := filepath.Join(m.baseDir, "logs", fmt.Sprintf("%s.log", vps.ID))
+    monitorSocket := filepath.Join(instanceDir, "qemu-monitor.sock")
+    agentSocket := filepath.Join(instanceDir, "qemu-ga.sock")
+
+    // Remove existing monitor, agent and serial sockets if they exist
+    os.Remove(monitorSocket)
+    os.Remove(agentSocket)
+    os.Remove(filepath.Join(instanceDir, "serial.sock"))
+
+    // Boot with the cloud-init the guest was created with rather than one
+    // rendered from the current template. Only repack the saved files if the
+    // ISO itself has gone missing.
+    cloudInitPath := filepath.Join(instanceDir, "cloud-init.iso")
+    if _, err := os.Stat(cloudInitPath); os.IsNotExist(err) && vps.CloudInitSeed != CloudInitSeedSMBIOS {
+        if err := buildCloudInitISO(cloudInitPath, filepath.Join(instanceDir, "cloud-init"), vps.CloudInitDatasource, vps.CloudInitLabel); err != nil {
+            return fmt.Errorf("cloud-init ISO missing and could not be rebuilt: %v", err)
+        }
+        log.Printf("Rebuilt missing cloud-init ISO for VPS %s from its saved files", vps.ID)
+    }
+
+    // QEMU's own error for a missing backing file doesn't say which one
+    if err := checkBackingChain(vps); err != nil {
+        vps.Alert = err.Error()
+        return err
+    }
+
+    m.resetLiveResourcesLocked(vps)
+    args := m.buildQEMUArgs(vps)
+    if err := writeQEMUCommand(instanceDir, m.qemuBin, args, vps); err != nil {
+        log.Printf("Warning: Failed to record QEMU command for VPS %s: %v", vps.ID, err)
+    }
+
+    if err := m.createTapDevices(vps); err != nil {
+        return err
+    }
+    // The LAN may lease a different address this boot
+    vps.GuestIP = ""
+
+    if err := createCgroup(vps.ID, vps.VCPUs, vps.MemoryMB); err != nil {
+        log.Printf("Warning: Resource limits for VPS %s not enforced: %v", vps.ID, err)
+    }
+
+    cmd := exec.Command(m.qemuBin, args...)
+    
+    stdout, err := os.Create(logFile)
+    if err != nil {
+        return fmt.Errorf("failed to create log file: %v", err)
+    }
+    defer stdout.Close()
+    cmd.Stdout = stdout
+    cmd.Stderr = stdout
+
+    m.setStatus(vps, StatusStarting)
+
+    if err := cmd.Start(); err != nil {
+        m.setStatus(vps, StatusStopped)
+        return fmt.Errorf("failed to start QEMU: %v", err)
+    }
+
+    // Wait for PID file
+    var pid int
+    timeout := time.After(30 * time.Second)
+    ticker := time.NewTicker(500 * time.Millisecond)
+    defer ticker.Stop()
+
+    for {
+        select {
+        case <-timeout:
+            m.setStatus(vps, StatusStopped)
+            logs, _ := os.ReadFile(logFile)
+            return fmt.Errorf("timeout waiting for QEMU to start. Logs: %s", string(logs))
+            
+        case <-ticker.C:
+            if pidBytes, err := os.ReadFile(pidFile); err == nil {
+                if _, err := fmt.Sscanf(string(pidBytes), "%d", &pid); err == nil {
+                    goto pidFound
+                }
+            }
+        }
+    }
+
+pidFound:
+    // Verify QEMU process
+    retries := 3
+    for i := 0; i < retries; i++ {
+        if err := checkProcess(pid); err == nil {
+            break
+        }
+        if i == retries-1 {
+            m.setStatus(vps, StatusStopped)
+            logs, _ := os.ReadFile(logFile)
+            return fmt.Errorf("QEMU process verification failed after %d retries. Logs: %s", retries, string(logs))
+        }
+        time.Sleep(time.Second)
+    }
+
+    vps.QEMUPid = pid
+    if err := addToCgroup(vps.ID, pid); err != nil {
+        log.Printf("Warning: Failed to place QEMU for VPS %s in cgroup: %v", vps.ID, err)
+    }
+    if strings.HasPrefix(vps.ErrorMsg, "forced shutdown") {
+        vps.ErrorMsg = ""
+    }
+    m.setStatus(vps, StatusRunning)
+
+    return nil
+}
+
+func (m *VPSManager) RestartVPS(id string) error {
+    m.mutex.Lock()
+    defer m.mutex.Unlock()
+
+    vps, exists := m.instances[id]
+    if !exists {
+        return fmt.Errorf("VPS not found")
+    }
+
+    if vps.Status != StatusRunning {
+        return fmt.Errorf("VPS must be running to restart")
+    }
+
+    if vps.QEMUPid <= 0 {
+        return fmt.Errorf("VPS does not have a valid PID")
+    }
+
+    // Get the QEMU monitor socket path
+    instanceDir := filepath.Join(m.baseDir, "disks", vps.ID)
+    monitorSocket := filepath.Join(instanceDir, "qemu-monitor.sock")
+
+    // Create a temporary file for command output
+    tmpFile, err := os.CreateTemp("", "qemu-command-*")
+    if err != nil {
+        return fmt.Errorf("failed to create temp file: %v", err)
+    }
+    defer os.Remove(tmpFile.Name())
+
+    // Send system_reset command to QEMU monitor
+    cmd := exec.Command("echo", "system_reset")
+    socat := exec.Command("socat", "-", fmt.Sprintf("UNIX-CONNECT:%s", monitorSocket))
+    
+    // Connect the commands
+    socatIn, err := socat.StdinPipe()
+    if err != nil {
+        return fmt.Errorf("failed to create pipe: %v", err)
+    }
+    
+    cmd.Stdout = socatIn
+    socat.Stdout = tmpFile
+    socat.Stderr = tmpFile
+
+    // Start socat first
+    if err := socat.Start(); err != nil {
+        return fmt.Errorf("failed to start socat: %v", err)
+    }
+
+    // Run the echo command
+    if err := cmd.Run(); err != nil {
+        return fmt.Errorf("failed to send command: %v", err)
+    }
+
+    // Close stdin pipe
+    socatIn.Close()
+
+    // Wait for socat to finish
+    if err := socat.Wait(); err != nil {
+        output, _ := os.ReadFile(tmpFile.Name())
+        return fmt.Errorf("failed to execute command: %v, output: %s", err, string(output))
+    }
+
+    m.setStatus(vps, StatusRestarting)
+
+    // Update status after a delay
+    go func() {
+        time.Sleep(30 * time.Second)
+        m.mutex.Lock()
+        m.setStatus(vps, StatusRunning)
+        m.mutex.Unlock()
+    }()
+
+    return nil
+}
+
+// Reboot a VPS cleanly: ask the guest to power off over ACPI, then in the
+// background wait for QEMU to exit and start it again. A guest that ignores
+// the request for REBOOT_SHUTDOWN_TIMEOUT is killed so the reboot still completes.
+func (m *VPSManager) RebootVPS(id string) error {
+    m.mutex.Lock()
+    vps, exists := m.instances[id]
+    if !exists {
+        m.mutex.Unlock()
+        return fmt.Errorf("VPS not found")
+    }
+    if vps.Status != StatusRunning {
+        m.mutex.Unlock()
+        return fmt.Errorf("VPS must be running to reboot")
+    }
+    if vps.QEMUPid <= 0 {
+        m.mutex.Unlock()
+        return fmt.Errorf("VPS does not have a valid PID")
+    }
+    pid := vps.QEMUPid
+    m.setStatus(vps, StatusRestarting)
+    m.mutex.Unlock()
+
+    monitorSocket := filepath.Join(m.baseDir, "disks", id, "qemu-monitor.sock")
+    output, err := m.executeQMPCommand(monitorSocket, `{ "execute": "system_powerdown" }`)
+    if err == nil {
+        err = parseQMPReturn(output, nil)
+    }
+    if err != nil {
+        m.mutex.Lock()
+        m.setStatus(vps, StatusRunning)
+        m.mutex.Unlock()
+        return fmt.Errorf("failed to request power-off: %v", err)
+    }
+
+    // Shutdown alone can take REBOOT_SHUTDOWN_TIMEOUT, too long to hold the request
+    m.workers.Add(1)
+    go func() {
+        defer m.workers.Done()
+        if err := m.finishReboot(vps, pid); err != nil {
+            log.Printf("Failed to reboot VPS %s: %v", id, err)
+            m.mutex.Lock()
+            vps.Alert = fmt.Sprintf("reboot failed: %v", err)
+            m.publishState(vps)
+            m.mutex.Unlock()
+        }
+    }()
+    return nil
+}
+
+// Wait for the guest of a clean reboot to power off, killing QEMU if it
+// doesn't, and start the VPS again once the old QEMU is gone
+func (m *VPSManager) finishReboot(vps *VPS, pid int) error {
+    deadline := time.Now().Add(REBOOT_SHUTDOWN_TIMEOUT)
+    for checkProcess(pid) == nil {
+        if time.Now().After(deadline) {
+            log.Printf("Warning: VPS %s ignored the power-off request, killing QEMU", vps.ID)
+            if err := killQEMU(pid); err != nil {
+                m.mutex.Lock()
+                m.setStatus(vps, StatusRunning)
+                m.mutex.Unlock()
+                return err
+            }
+            break
+        }
+        time.Sleep(time.Second)
+    }
+
+    m.mutex.Lock()
+    m.setStatus(vps, StatusStopped)
+    vps.RunState = ""
+    m.mutex.Unlock()
+
+    if err := m.StartVPS(vps.ID); err != nil {
+        return fmt.Errorf("VPS powered off but failed to start again: %v", err)
+    }
+    return nil
+}
+
+// Kill QEMU and wait for it to exit. Until it has, it still holds its disk's
+// write lock and a new QEMU on the same disk fails to start.
+func killQEMU(pid int) error {
+    if proc, err := os.FindProcess(pid); err == nil {
+        proc.Kill()
+    }
+    deadline := time.Now().Add(QEMU_EXIT_TIMEOUT)
+    for checkProcess(pid) == nil {
+        if time.Now().After(deadline) {
+            return fmt.Errorf("QEMU process %d still running %s after being killed", pid, QEMU_EXIT_TIMEOUT)
+        }
+        time.Sleep(100 * time.Millisecond)
+    }
+    return nil
+}
+
+// Freeze a running guest's vCPUs with QMP stop. Memory stays allocated, so
+// the guest carries on where it was when resumed.
+func (m *VPSManager) PauseVPS(id string) error {
+    m.mutex.Lock()
+    defer m.mutex.Unlock()
+
+    vps, exists := m.instances[id]
+    if !exists {
+        return fmt.Errorf("VPS not found")
+    }
+    if vps.Status == StatusPaused {
+        return fmt.Errorf("VPS is already paused")
+    }
+    if vps.Status != StatusRunning {
+        return fmt.Errorf("VPS must be running to pause, current status: %s", vps.Status)
+    }
+
+    monitorSocket := filepath.Join(m.baseDir, "disks", id, "qemu-monitor.sock")
+    output, err := m.executeQMPCommand(monitorSocket, `{ "execute": "stop" }`)
+    if err == nil {
+        err = parseQMPReturn(output, nil)
+    }
+    if err != nil {
+        return fmt.Errorf("failed to pause VPS: %v", err)
+    }
+
+    m.setStatus(vps, StatusPaused)
+    vps.RunState = "paused"
+    // Paused time isn't idle time
+    vps.IdleSince = nil
+    vps.IdleShutdownAt = nil
+    return nil
+}
+
+// Let a paused guest run again with QMP cont. Guests QEMU stopped after a
+// disk I/O error can be resumed the same way once the host has room.
+func (m *VPSManager) ResumeVPS(id string) error {
+    m.mutex.Lock()
+    defer m.mutex.Unlock()
+
+    vps, exists := m.instances[id]
+    if !exists {
+        return fmt.Errorf("VPS not found")
+    }
+    if vps.Status != StatusPaused && vps.Status != StatusIOError {
+        return fmt.Errorf("VPS is not paused, current status: %s", vps.Status)
+    }
+
+    monitorSocket := filepath.Join(m.baseDir, "disks", id, "qemu-monitor.sock")
+    output, err := m.executeQMPCommand(monitorSocket, `{ "execute": "cont" }`)
+    if err == nil {
+        err = parseQMPReturn(output, nil)
+    }
+    if err != nil {
+        return fmt.Errorf("failed to resume VPS: %v", err)
+    }
+
+    m.setStatus(vps, StatusRunning)
+    vps.RunState = "running"
+    return nil
+}
+
+func (m *VPSManager) handlePauseVPS(w http.ResponseWriter, r *http.Request) {
+    if !allowMethods(w, r, http.MethodPost) {
+        return
+    }
+
+    id, ok := m.vpsIDFromRequest(w, r)
+    if !ok {
+        return
+    }
+    if err := m.PauseVPS(id); err != nil {
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+
+    w.WriteHeader(http.StatusOK)
+}
+
+func (m *VPSManager) handleResumeVPS(w http.ResponseWriter, r *http.Request) {
+    if !allowMethods(w, r, http.MethodPost) {
+        return
+    }
+
+    id, ok := m.vpsIDFromRequest(w, r)
+    if !ok {
+        return
+    }
+    if err := m.ResumeVPS(id); err != nil {
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+
+    w.WriteHeader(http.StatusOK)
+}
+
+func (m *VPSManager) handleRebootVPS(w http.ResponseWriter, r *http.Request) {
+    if !allowMethods(w, r, http.MethodPost) {
+        return
+    }
+
+    id, ok := m.vpsIDFromRequest(w, r)
+    if !ok {
+        return
+    }
+
+    // A clean reboot finishes in the background, poll the VPS's status
+    var err error
+    status := http.StatusOK
+    switch mode := r.URL.Query().Get("mode"); mode {
+    case "", RebootModeClean:
+        err = m.RebootVPS(id)
+        status = http.StatusAccepted
+    case RebootModeHard:
+        err = m.RestartVPS(id)
+    default:
+        http.Error(w, fmt.Sprintf("unsupported reboot mode: %s", mode), http.StatusBadRequest)
+        return
+    }
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+
+    w.WriteHeader(status)
+}
+
+// Rebuild the cloud-init ISO from the VPS's current settings. The new ISO is
+// written beside the old one and renamed so a running QEMU keeps its open copy.
+func (m *VPSManager) regenerateCloudInit(vps *VPS) error {
+    instanceDir := filepath.Join(m.baseDir, "disks", vps.ID)
+    cloudInitPath := filepath.Join(instanceDir, "cloud-init.iso")
+    tmpPath := cloudInitPath + ".tmp"
+
+    if err := createCloudInitISO(tmpPath, vps); err != nil {
+        os.Remove(tmpPath)
+        return fmt.Errorf("failed to create cloud-init ISO: %v", err)
+    }
+    if vps.CloudInitSeed == CloudInitSeedSMBIOS {
+        return nil
+    }
+    if err := os.Rename(tmpPath, cloudInitPath); err != nil {
+        os.Remove(tmpPath)
+        return fmt.Errorf("failed to replace cloud-init ISO: %v", err)
+    }
+    return nil
+}
+
+// Serve a VPS's rendered cloud-init to NoCloud-Net in the guest. Guests
+// can't send an API key, so the path carries the VPS's seed token instead:
+// /seed/<id>/<token>/<file>
+func (m *VPSManager) handleSeed(w http.ResponseWriter, r *http.Request) {
+    if !allowMethods(w, r, http.MethodGet, http.MethodHead) {
+        return
+    }
+
+    parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/seed/"), "/")
+    if len(parts) != 3 {
+        http.NotFound(w, r)
+        return
+    }
+    id, token, file := parts[0], parts[1], parts[2]
+
+    m.mutex.RLock()
+    vps, exists := m.instances[id]
+    valid := exists && vps.SeedToken != "" && hmac.Equal([]byte(token), []byte(vps.SeedToken))
+    m.mutex.RUnlock()
+    if !valid {
+        http.NotFound(w, r)
+        return
+    }
+
+    switch file {
+    case "user-data", "meta-data":
+    case "vendor-data":
+        // Asked for on every boot, but we never provide any
+        w.WriteHeader(http.StatusOK)
+        return
+    default:
+        http.NotFound(w, r)
+        return
+    }
+
+    // Read at request time so a hostname change reaches the next boot
+    data, err := os.ReadFile(filepath.Join(m.baseDir, "disks", id, "cloud-init", file))
+    if err != nil {
+        http.NotFound(w, r)
+        return
+    }
+    w.Header().Set("Content-Type", "text/plain")
+    w.Header().Set("Cache-Control", "no-store")
+    w.Write(data)
+}
+
+// Return the rendered cloud-init a VPS was last given, with the root password
+// hash redacted. ?file= returns a single file as text instead of all of them as JSON.
+func (m *VPSManager) handleGetCloudInit(w http.ResponseWriter, r *http.Request) {
+    if !allowMethods(w, r, http.MethodGet, http.MethodHead) {
+        return
+    }
+
+    id, ok := m.vpsIDFromRequest(w, r)
+    if !ok {
+        return
+    }
+    vps, err := m.GetVPS(id)
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusNotFound)
+        return
+    }
+
+    m.mutex.RLock()
+    passwordHash := vps.PasswordHash
+    m.mutex.RUnlock()
+
+    renderedDir := filepath.Join(m.baseDir, "disks", id, "cloud-init")
+    readFile := func(name string) (string, error) {
+        data, err := os.ReadFile(filepath.Join(renderedDir, name))
+        if err != nil {
+            return "", err
+        }
+        content := string(data)
+        if passwordHash != "" {
+            content = strings.ReplaceAll(content, passwordHash, "[REDACTED]")
+        }
+        return content, nil
+    }
+
+    if file := r.URL.Query().Get("file"); file != "" {
+        if file != "user-data" && file != "meta-data" && file != "network-config" {
+            http.Error(w, fmt.Sprintf("unknown cloud-init file: %s", file), http.StatusBadRequest)
+            return
+        }
+        content, err := readFile(file)
+        if err != nil {
+            http.Error(w, fmt.Sprintf("%s not recorded for this VPS", file), http.StatusNotFound)
+            return
+        }
+        w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+        io.WriteString(w, content)
+        return
+    }
+
+    userData, err := readFile("user-data")
+    if err != nil {
+        http.Error(w, "cloud-init not recorded for this VPS", http.StatusNotFound)
+        return
+    }
+    metaData, _ := readFile("meta-data")
+    networkConfig, _ := readFile("network-config")
+
+    writeJSON(w, http.StatusOK, struct {
+        UserData      string `json:"user_data"`
+        MetaData      string `json:"meta_data"`
+        NetworkConfig string `json:"network_config,omitempty"`
+    }{userData, metaData, networkConfig})
+}
+
+func (m *VPSManager) SetHostname(id string, hostname string) error {
+    if !isValidHostname(hostname) {
+        return fmt.Errorf("invalid hostname format: %s", hostname)
+    }
+
+    m.mutex.RLock()
+    vps, exists := m.instances[id]
+    var status string
+    if exists {
+        status = vps.Status
+    }
+    m.mutex.RUnlock()
+
+    if !exists {
+        return fmt.Errorf("VPS not found")
+    }
+
+    switch status {
+    case StatusRunning:
+        // Apply immediately inside the guest
+        agentSocket := filepath.Join(m.baseDir, "disks", vps.ID, "qemu-ga.sock")
+        exitCode, output, err := guestExec(agentSocket, fmt.Sprintf("hostnamectl set-hostname %s", hostname), 30*time.Second)
+        if err != nil {
+            return fmt.Errorf("cannot change hostname of running VPS, guest agent unavailable: %v", err)
+        }
+        if exitCode != 0 {
+            return fmt.Errorf("hostnamectl failed with exit code %d: %s", exitCode, strings.TrimSpace(output))
+        }
+    case StatusStopped:
+        // Applied by cloud-init on next boot
+    default:
+        return fmt.Errorf("VPS must be running or stopped to change hostname (current status: %s)", status)
+    }
+
+    m.mutex.Lock()
+    vps.Hostname = hostname
+    m.mutex.Unlock()
+
+    // cloud-init resets the hostname from meta-data on every boot, so the ISO
+    // must carry the new name in both cases
+    if err := m.regenerateCloudInit(vps); err != nil {
+        return err
+    }
+
+    log.Printf("Hostname for VPS %s changed to %s", id, hostname)
+    return nil
+}
+
+// Add new HTTP handlers for the start/stop operations
+func (m *VPSManager) handleStartVPS(w http.ResponseWriter, r *http.Request) {
+    if !allowMethods(w, r, http.MethodPost) {
+        return
+    }
+
+    id, ok := m.vpsIDFromRequest(w, r)
+    if !ok {
+        return
+    }
+    if err := m.StartVPS(id); err != nil {
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+
+    w.WriteHeader(http.StatusOK)
+}
+
+func (m *VPSManager) handleStopVPS(w http.ResponseWriter, r *http.Request) {
+    if !allowMethods(w, r, http.MethodPost) {
+        return
+    }
+
+    id, ok := m.vpsIDFromRequest(w, r)
+    if !ok {
+        return
+    }
+    // Clamped rather than rejected so a client asking for "forever" or
+    // "now" still gets a stop
+    var timeout time.Duration
+    if value := r.URL.Query().Get("timeout_seconds"); value != "" {
+        seconds, err := strconv.Atoi(value)
+        if err != nil {
+            http.Error(w, fmt.Sprintf("invalid timeout_seconds: %s", value), http.StatusBadRequest)
+            return
+        }
+        timeout = min(max(time.Duration(seconds)*time.Second, MIN_STOP_TIMEOUT), MAX_STOP_TIMEOUT)
+    }
+
+    if err := m.StopVPS(id, timeout); err != nil {
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+
+    w.WriteHeader(http.StatusOK)
+}
+// Add new HTTP handler for restart endpoint
+func (m *VPSManager) handleRestartVPS(w http.ResponseWriter, r *http.Request) {
+    if !allowMethods(w, r, http.MethodPost) {
+        return
+    }
+
+    id, ok := m.vpsIDFromRequest(w, r)
+    if !ok {
+        return
+    }
+    if err := m.RestartVPS(id); err != nil {
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+
+    w.WriteHeader(http.StatusOK)
+}
+
+func (m *VPSManager) handleSetHostname(w http.ResponseWriter, r *http.Request) {
+    if !allowMethods(w, r, http.MethodPost) {
+        return
+    }
+
+    hostname := r.URL.Query().Get("hostname")
+    if !isValidHostname(hostname) {
+        http.Error(w, fmt.Sprintf("invalid hostname format: %s", hostname), http.StatusBadRequest)
+        return
+    }
+
+    id, ok := m.vpsIDFromRequest(w, r)
+    if !ok {
+        return
+    }
+
+    if err := m.SetHostname(id, hostname); err != nil {
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+
+    w.WriteHeader(http.StatusOK)
+}
+
+// Reset a VPS to a fresh disk from the (possibly different) image and template,
+// keeping its ID, hostname, ports and MAC. Progress is reported like a create.
+func (m *VPSManager) RebuildVPS(id string, imageType string, template string) (*VPS, error) {
+    m.mutex.Lock()
+    defer m.mutex.Unlock()
+
+    vps, exists := m.instances[id]
+    if !exists {
+        return nil, fmt.Errorf("VPS not found")
+    }
+
+    if m.ctx.Err() != nil {
+        return nil, fmt.Errorf("server is shutting down")
+    }
+
+    if vps.Status == "creating" || vps.Status == StatusRebuilding || vps.Status == StatusMoving || vps.Status == StatusCloning || vps.Status == StatusRepairing || vps.Status == StatusSnapshotting {
+        return nil, fmt.Errorf("VPS is busy, current status: %s", vps.Status)
+    }
+
+    // A custom image can only be kept, its URL isn't known otherwise
+    var imageURL, osFamily string
+    if imageType == "" || imageType == vps.ImageType {
+        imageType, imageURL, osFamily = vps.ImageType, vps.ImageURL, vps.OSFamily
+    }
+    if template == "" {
+        template = vps.Template
+    }
+    if _, exists := SUPPORTED_IMAGES[imageType]; !exists && imageURL == "" {
+        return nil, fmt.Errorf("unsupported image type: %s", imageType)
+    }
+    if err := validateTemplateAndOS(template, imageType, osFamily); err != nil {
+        return nil, err
+    }
+
+    // Forwards requested at create stay. Of the old template's, keep the
+    // host port of any the new template still exposes.
+    oldTemplate, _ := lookupTemplate(vps.Template)
+    newTemplate, _ := lookupTemplate(template)
+    oldExposed := make(map[int]bool)
+    for _, guestPort := range oldTemplate.ExposePorts {
+        oldExposed[guestPort] = true
+    }
+    var forwards []PortForward
+    for _, fwd := range vps.PortForwards {
+        if !oldExposed[fwd.GuestPort] || fwd.Protocol != "tcp" {
+            forwards = append(forwards, fwd)
+        }
+    }
+    inUse := m.hostPortsInUseLocked()
+    for _, guestPort := range newTemplate.ExposePorts {
+        hostPort := 0
+        for _, fwd := range vps.PortForwards {
+            if fwd.GuestPort == guestPort && fwd.Protocol == "tcp" {
+                hostPort = fwd.HostPort
+            }
+        }
+        if slices.ContainsFunc(forwards, func(fwd PortForward) bool { return fwd.HostPort == hostPort && fwd.Protocol == "tcp" }) {
+            continue
+        }
+        if hostPort == 0 {
+            var err error
+            if hostPort, err = m.allocatePortLocked(m.forwardPorts, inUse); err != nil {
+                return nil, fmt.Errorf("forward port: %w", err)
+            }
+        }
+        forwards = append(forwards, PortForward{HostPort: hostPort, GuestPort: guestPort, Protocol: "tcp"})
+    }
+
+    pid := vps.QEMUPid
+    oldImagePath := vps.ImagePath
+
+    if template != vps.Template {
+        vps.TemplateVars = nil
+    }
+    vps.ImageType = imageType
+    vps.ImageURL = imageURL
+    vps.OSFamily = osFamily
+    vps.Template = template
+    vps.PortForwards = forwards
+    m.setStatus(vps, StatusRebuilding)
+    vps.Stage = StageInitializing
+    vps.Progress = 0
+    vps.StageHistory = nil
+    vps.ErrorMsg = ""
+    vps.QEMUPid = 0
+    vps.Verification = nil
+    vps.Degraded = false
+    vps.RunState = ""
+    vps.Alert = ""
+    vps.IdleSince = nil
+    vps.IdleShutdownAt = nil
+    vps.Storage = ""
+    vps.StandaloneDisk = false
+    // The rebuild changes vps as soon as the lock is released
+    rebuilt := *vps
+
+    m.workers.Add(1)
+    go func() {
+        defer m.workers.Done()
+        err := m.teardownForRebuild(vps, pid, oldImagePath)
+        if err == nil {
+            err = m.createVPSWithProgress(vps)
+        }
+        if errors.Is(err, errDequeued) {
+            log.Printf("VPS %s was deleted while queued", vps.ID)
+        } else if err != nil {
+            log.Printf("Failed to rebuild VPS %s: %v", vps.ID, err)
+            m.markFailed(vps, err)
+        }
+    }()
+
+    return &rebuilt, nil
+}
+
+// Power off the guest, killing QEMU if it won't go, and remove the old disk
+// and cloud-init ISO ahead of a rebuild
+func (m *VPSManager) teardownForRebuild(vps *VPS, pid int, imagePath string) error {
+    m.powerOffForDiskCopy(vps.ID, pid)
+    if pid > 0 && checkProcess(pid) == nil {
+        return fmt.Errorf("QEMU process %d did not exit", pid)
+    }
+
+    instanceDir := filepath.Join(m.baseDir, "disks", vps.ID)
+    for _, path := range []string{
+        imagePath,
+        filepath.Join(instanceDir, "cloud-init.iso"),
+        filepath.Join(instanceDir, "qemu.pid"),
+        filepath.Join(instanceDir, "qemu-monitor.sock"),
+        filepath.Join(instanceDir, "qemu-ga.sock"),
+        filepath.Join(instanceDir, "serial.sock"),
+    } {
+        if path == "" {
+            continue
+        }
+        if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+            return fmt.Errorf("failed to remove %s: %v", filepath.Base(path), err)
+        }
+    }
+    // The new disk goes back under the instance directory
+    if imagePath != "" && filepath.Dir(imagePath) != instanceDir {
+        os.Remove(filepath.Dir(imagePath))
+    }
+
+    return nil
+}
+
+func (m *VPSManager) handleRebuildVPS(w http.ResponseWriter, r *http.Request) {
+    if !allowMethods(w, r, http.MethodPost) {
+        return
+    }
+
+    id, ok := m.vpsIDFromRequest(w, r)
+    if !ok {
+        return
+    }
+    imageType := r.URL.Query().Get("image_type")
+    template := r.URL.Query().Get("template")
+
+    vps, err := m.RebuildVPS(id, imageType, template)
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+
+    writeJSON(w, http.StatusOK, vps)
+}
+
+type OrphanDir struct {
+    ID         string    `json:"id"`
+    Path       string    `json:"path"`
+    SizeBytes  int64     `json:"size_bytes"`
+    ModifiedAt time.Time `json:"modified_at"`
+}
+
+// Find instance directories with no matching VPS. Instances are registered
+// before their directory is created, so anything mid-create is never listed.
+func (m *VPSManager) findOrphanDirs() ([]OrphanDir, error) {
+    disksDir := filepath.Join(m.baseDir, "disks")
+
+    m.mutex.RLock()
+    entries, err := os.ReadDir(disksDir)
+    var candidates []os.DirEntry
+    for _, entry := range entries {
+        if _, exists := m.instances[entry.Name()]; !exists && entry.IsDir() {
+            candidates = append(candidates, entry)
+        }
+    }
+    m.mutex.RUnlock()
+    if err != nil {
+        return nil, fmt.Errorf("failed to read disks directory: %v", err)
+    }
+
+    orphans := make([]OrphanDir, 0, len(candidates))
+    for _, entry := range candidates {
+        path := filepath.Join(disksDir, entry.Name())
+        orphan := OrphanDir{ID: entry.Name(), Path: path, SizeBytes: diskUsage(path)}
+        if info, err := entry.Info(); err == nil {
+            orphan.ModifiedAt = info.ModTime()
+        }
+        orphans = append(orphans, orphan)
+    }
+    return orphans, nil
+}
+
+// Helper function to sum allocated (not apparent) bytes under path, so sparse
+// qcow2 overlays are counted at their real size
+func diskUsage(path string) int64 {
+    var total int64
+    filepath.WalkDir(path, func(_ string, d os.DirEntry, err error) error {
+        if err != nil || d.IsDir() {
+            return nil
+        }
+        if info, err := d.Info(); err == nil {
+            if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+                total += stat.Blocks * 512
+            } else {
+                total += info.Size()
+            }
+        }
+        return nil
+    })
+    return total
+}
+
+func (m *VPSManager) handleOrphans(w http.ResponseWriter, r *http.Request) {
+    if !allowMethods(w, r, http.MethodGet, http.MethodDelete) {
+        return
+    }
+    if !identityFromRequest(r).Admin() {
+        http.Error(w, "Admin API key required", http.StatusForbidden)
+        return
+    }
+
+    orphans, err := m.findOrphanDirs()
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+
+    if r.Method == http.MethodGet {
+        writeJSON(w, http.StatusOK, orphans)
+        return
+    }
+
+    // Re-check under the lock in case an ID was claimed since listing, and
+    // move the directories aside so the slow removal can run unlocked
+    claimed := make([]OrphanDir, 0, len(orphans))
+    m.mutex.Lock()
+    for _, orphan := range orphans {
+        if _, exists := m.instances[orphan.ID]; exists {
+            continue
+        }
+        trash := orphan.Path + ".removing"
+        if err := os.Rename(orphan.Path, trash); err != nil {
+            log.Printf("Warning: Failed to remove orphaned directory %s: %v", orphan.Path, err)
+            continue
+        }
+        claimed = append(claimed, orphan)
+    }
+    m.mutex.Unlock()
+
+    removed := make([]OrphanDir, 0, len(claimed))
+    var freed int64
+    for _, orphan := range claimed {
+        if err := os.RemoveAll(orphan.Path + ".removing"); err != nil {
+            log.Printf("Warning: Failed to remove orphaned directory %s: %v", orphan.Path, err)
+            continue
+        }
+        log.Printf("Removed orphaned instance directory %s (%d bytes)", orphan.Path, orphan.SizeBytes)
+        removed = append(removed, orphan)
+        freed += orphan.SizeBytes
+    }
+
+    writeJSON(w, http.StatusOK, struct {
+        Removed    []OrphanDir `json:"removed"`
+        FreedBytes int64       `json:"freed_bytes"`
+    }{removed, freed})
+}
+
+type SelfTestStage struct {
+    Stage    string    `json:"stage"`
+    At       time.Time `json:"at"`
+    Duration string    `json:"duration"`
+}
+
+type SelfTestReport struct {
+    Passed   bool            `json:"passed"`
+    VPSID    string          `json:"vps_id,omitempty"`
+    Image    string          `json:"image"`
+    Duration string          `json:"duration"`
+    Stages   []SelfTestStage `json:"stages"`
+    Error    string          `json:"error,omitempty"`
+}
+
+// Create a throwaway blank VPS, wait for it to complete and answer on VNC,
+// then delete it. The instance is removed whatever the outcome.
+func (m *VPSManager) runSelfTest(ctx context.Context, owner string, timeout time.Duration) SelfTestReport {
+    started := time.Now()
+    report := SelfTestReport{Image: m.defaultImage, Stages: []SelfTestStage{}}
+
+    // Subscribe before creating so no stage change is missed
+    events := m.events.subscribe()
+    defer m.events.unsubscribe(events)
+
+    name := "selftest-" + strconv.FormatInt(started.Unix(), 10)
+    vps, err := m.CreateVPS(name, name+".vps.local", m.defaultImage, "blank", CreateVPSOptions{
+        Owner:               owner,
+        MemoryMB:            1024,
+        VCPUs:               1,
+        DisableMetrics:      true,
+        CloudInitDatasource: m.cloudInitDatasource,
+        CloudInitLabel:      m.cloudInitLabel,
+    })
+    if err != nil {
+        report.Error = fmt.Sprintf("create failed: %v", err)
+        report.Duration = time.Since(started).Round(time.Millisecond).String()
+        return report
+    }
+    report.VPSID = vps.ID
+    defer func() {
+        // BLST_REMOVE_FAILED may have dropped it already
+        if err := m.DeleteVPS(vps.ID); err != nil && !errors.Is(err, errVPSNotFound) {
+            log.Printf("Warning: Failed to delete self-test VPS %s: %v", vps.ID, err)
+        }
+    }()
+
+    timer := time.NewTimer(timeout)
+    defer timer.Stop()
+
+    var final VPS
+wait:
+    for {
+        m.mutex.RLock()
+        final = *vps
+        m.mutex.RUnlock()
+        if final.Stage == StageCompleted || final.Status == "failed" {
+            break
+        }
+
+        select {
+        case <-events:
+        case <-timer.C:
+            report.Error = fmt.Sprintf("timed out after %s in stage %s", timeout, final.Stage)
+            break wait
+        case <-ctx.Done():
+            report.Error = "self-test cancelled"
+            break wait
+        case <-m.ctx.Done():
+            report.Error = "server is shutting down"
+            break wait
+        }
+    }
+
+    // Each stage lasts until the next one starts
+    for i, event := range final.StageHistory {
+        end := time.Now()
+        if i+1 < len(final.StageHistory) {
+            end = final.StageHistory[i+1].At
+        }
+        report.Stages = append(report.Stages, SelfTestStage{
+            Stage:    event.Stage,
+            At:       event.At,
+            Duration: end.Sub(event.At).Round(time.Millisecond).String(),
+        })
+    }
+
+    if report.Error == "" && final.Status == "failed" {
+        report.Error = fmt.Sprintf("create failed: %s", final.ErrorMsg)
+    }
+    if report.Error == "" {
+        vncStarted := time.Now()
+        host := m.bindAddress
+        if net.ParseIP(host).IsUnspecified() {
+            host = "127.0.0.1"
+        }
+        conn, err := net.DialTimeout("tcp", net.JoinHostPort(host, strconv.Itoa(final.VNCPort)), 5*time.Second)
+        if err != nil {
+            report.Error = fmt.Sprintf("VNC not reachable: %v", err)
+        } else {
+            conn.Close()
+        }
+        report.Stages = append(report.Stages, SelfTestStage{
+            Stage:    "vnc",
+            At:       vncStarted,
+            Duration: time.Since(vncStarted).Round(time.Millisecond).String(),
+        })
+    }
+
+    report.Passed = report.Error == ""
+    report.Duration = time.Since(started).Round(time.Millisecond).String()
+    return report
+}
+
+// Run an end-to-end self-test. Answers 200 with the report whether or not it
+// passed; ?timeout= bounds the wait for the instance (default BLST_CREATE_TIMEOUT).
+func (m *VPSManager) handleSelfTest(w http.ResponseWriter, r *http.Request) {
+    if !allowMethods(w, r, http.MethodPost) {
+        return
+    }
+    caller := identityFromRequest(r)
+    if !caller.Admin() {
+        http.Error(w, "Admin API key required", http.StatusForbidden)
+        return
+    }
+
+    timeout := m.createTimeout
+    if value := r.URL.Query().Get("timeout"); value != "" {
+        parsed, err := time.ParseDuration(value)
+        if err != nil || parsed <= 0 {
+            http.Error(w, fmt.Sprintf("invalid timeout: %s", value), http.StatusBadRequest)
+            return
+        }
+        timeout = parsed
+    }
+
+    // A full create outlasts the server's write timeout
+    controller := http.NewResponseController(w)
+    controller.SetWriteDeadline(time.Time{})
+
+    report := m.runSelfTest(r.Context(), caller.Owner, timeout)
+    if report.Passed {
+        log.Printf("Self-test passed in %s", report.Duration)
+    } else {
+        log.Printf("Self-test failed after %s: %s", report.Duration, report.Error)
+    }
+    writeJSON(w, http.StatusOK, report)
+}
+
+// Liveness probe, answering at all is the whole check
+func handleHealthz(w http.ResponseWriter, r *http.Request) {
+    if !allowMethods(w, r, http.MethodGet, http.MethodHead) {
+        return
+    }
+    writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+type ReadinessCheck struct {
+    Check string `json:"check"`
+    Error string `json:"error"`
+}
+
+type ReadinessReport struct {
+    Ready  bool             `json:"ready"`
+    Failed []ReadinessCheck `json:"failed,omitempty"`
+}
+
+// Readiness probe, so a node that lost KVM or its disk stops getting traffic
+func (m *VPSManager) handleReadyz(w http.ResponseWriter, r *http.Request) {
+    if !allowMethods(w, r, http.MethodGet, http.MethodHead) {
+        return
+    }
+
+    var report ReadinessReport
+    if err := verifySystemRequirements(); err != nil {
+        report.Failed = append(report.Failed, ReadinessCheck{Check: "system_requirements", Error: err.Error()})
+    }
+    if err := checkDirWritable(filepath.Join(m.baseDir, "base")); err != nil {
+        report.Failed = append(report.Failed, ReadinessCheck{Check: "base_image_dir", Error: err.Error()})
+    }
+
+    // Probes come every few seconds, so only log when the outcome changes
+    var failed []string
+    for _, check := range report.Failed {
+        failed = append(failed, check.Check)
+    }
+    m.readinessMutex.Lock()
+    if changed := strings.Join(failed, ","); changed != m.failedReadiness {
+        if len(report.Failed) > 0 {
+            log.Printf("Warning: readiness check failed: %+v", report.Failed)
+        } else {
+            log.Printf("Readiness checks pass again")
+        }
+        m.failedReadiness = changed
+    }
+    m.readinessMutex.Unlock()
+
+    if len(report.Failed) > 0 {
+        writeJSON(w, http.StatusServiceUnavailable, report)
+        return
+    }
+    report.Ready = true
+    writeJSON(w, http.StatusOK, report)
+}
+
+// Helper function to prove a directory can still be written, a read-only
+// remount or full disk shows up here
+func checkDirWritable(dir string) error {
+    file, err := os.CreateTemp(dir, ".readyz-*")
+    if err != nil {
+        return fmt.Errorf("%s is not writable: %v", dir, err)
+    }
+    name := file.Name()
+    file.Close()
+    return os.Remove(name)
+}
+
+// Console tokens are "<id>.<unix expiry>.<hmac>" so they can be checked
+// without any server-side state
+func (m *VPSManager) mintConsoleToken(id string) (string, time.Time) {
+    expiresAt := time.Now().Add(CONSOLE_TOKEN_TTL)
+    payload := fmt.Sprintf("%s.%d", id, expiresAt.Unix())
+    return payload + "." + m.signConsolePayload(payload), expiresAt
+}
+
+func (m *VPSManager) signConsolePayload(payload string) string {
+    mac := hmac.New(sha256.New, m.consoleSecret)
+    mac.Write([]byte(payload))
+    return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// Returns the VPS ID a console token was minted for
+func (m *VPSManager) verifyConsoleToken(token string) (string, error) {
+    parts := strings.Split(token, ".")
+    if len(parts) != 3 {
+        return "", fmt.Errorf("malformed token")
+    }
+
+    payload := parts[0] + "." + parts[1]
+    if !hmac.Equal([]byte(parts[2]), []byte(m.signConsolePayload(payload))) {
+        return "", fmt.Errorf("invalid token")
+    }
+
+    expiry, err := strconv.ParseInt(parts[1], 10, 64)
+    if err != nil || time.Now().After(time.Unix(expiry, 0)) {
+        return "", fmt.Errorf("token expired")
+    }
+
+    return parts[0], nil
+}
+
+func (m *VPSManager) handleConsoleToken(w http.ResponseWriter, r *http.Request) {
+    if !allowMethods(w, r, http.MethodPost) {
+        return
+    }
+
+    id, ok := m.vpsIDFromRequest(w, r)
+    if !ok {
+        return
+    }
+
+    token, expiresAt := m.mintConsoleToken(id)
+    writeJSON(w, http.StatusOK, struct {
+        Token     string    `json:"token"`
+        ExpiresAt time.Time `json:"expires_at"`
+        Path      string    `json:"path"` // WebSocket path for noVNC
+    }{token, expiresAt, "/api/vps/vnc?token=" + url.QueryEscape(token)})
+}
+
+var wsUpgrader = websocket.Upgrader{
+    ReadBufferSize:  32 * 1024,
+    WriteBufferSize: 32 * 1024,
+    Subprotocols:    []string{"binary"},
+    // Access is gated by the API key or a console token, not by origin
+    CheckOrigin: func(r *http.Request) bool { return true },
+}
+
+// Helper function to resolve the VPS a console WebSocket is for, from either
+// a console token or the ?id= the API key middleware has authorized
+func (m *VPSManager) consoleVPSID(w http.ResponseWriter, r *http.Request) (string, bool) {
+    token := r.URL.Query().Get("token")
+    if token == "" {
+        return m.vpsIDFromRequest(w, r)
+    }
+    tokenID, err := m.verifyConsoleToken(token)
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusUnauthorized)
+        return "", false
+    }
+    if requested := r.URL.Query().Get("id"); requested != "" && requested != tokenID {
+        http.Error(w, "Token does not match VPS", http.StatusForbidden)
+        return "", false
+    }
+    return tokenID, true
+}
+
+// WebSocket console for noVNC. Bridges WebSocket frames to the raw RFB stream
+// on the VPS VNC port. Reached either through the API key middleware with
+// ?id= or directly with a console token so the key never reaches the browser.
+func (m *VPSManager) handleVNC(w http.ResponseWriter, r *http.Request) {
+    if !allowMethods(w, r, http.MethodGet) {
+        return
+    }
+
+    id, ok := m.consoleVPSID(w, r)
+    if !ok {
+        return
+    }
+
+    vps, err := m.GetVPS(id)
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusNotFound)
+        return
+    }
+
+    // Dial VNC on the address it listens on unless that is a wildcard
+    host := "127.0.0.1"
+    if ip := net.ParseIP(m.bindAddress); ip != nil && !ip.IsUnspecified() {
+        host = m.bindAddress
+    }
+    vnc, err := net.DialTimeout("tcp", net.JoinHostPort(host, strconv.Itoa(vps.VNCPort)), 5*time.Second)
+    if err != nil {
+        http.Error(w, fmt.Sprintf("failed to connect to VNC: %v", err), http.StatusBadGateway)
+        return
+    }
+    defer vnc.Close()
+
+    bridgeWebSocket(w, r, vnc, "VNC connection closed")
+}
+
+// Upgrade to a WebSocket and copy bytes both ways between it and backend
+// until either side goes away. closeReason is sent if backend closes first.
+func bridgeWebSocket(w http.ResponseWriter, r *http.Request, backend net.Conn, closeReason string) {
+    // The console outlives the server's read/write timeouts
+    controller := http.NewResponseController(w)
+    controller.SetReadDeadline(time.Time{})
+    controller.SetWriteDeadline(time.Time{})
+
+    conn, err := wsUpgrader.Upgrade(w, r, nil)
+    if err != nil {
+        // Upgrade has already written the error response
+        return
+    }
+    defer conn.Close()
+
+    done := make(chan struct{})
+    go func() {
+        defer close(done)
+        buf := make([]byte, 32*1024)
+        for {
+            n, err := backend.Read(buf)
+            if n > 0 {
+                if err := conn.WriteMessage(websocket.BinaryMessage, buf[:n]); err != nil {
+                    return
+                }
+            }
+            if err != nil {
+                conn.WriteControl(websocket.CloseMessage,
+                    websocket.FormatCloseMessage(websocket.CloseNormalClosure, closeReason),
+                    time.Now().Add(time.Second))
+                return
+            }
+        }
+    }()
+
+    for {
+        _, reader, err := conn.NextReader()
+        if err != nil {
+            break
+        }
+        if _, err := io.Copy(backend, reader); err != nil {
+            break
+        }
+    }
+
+    // Unblock the backend reader and wait for it before the deferred closes
+    backend.Close()
+    <-done
+}
+
+// WebSocket serial console (ttyS0). Auth works like /api/vps/vnc. The chardev
+// takes one client at a time, so a second session is refused rather than
+// left hanging; closing the WebSocket only drops our end of the socket.
+func (m *VPSManager) handleSerialConsole(w http.ResponseWriter, r *http.Request) {
+    if !allowMethods(w, r, http.MethodGet) {
+        return
+    }
+
+    id, ok := m.consoleVPSID(w, r)
+    if !ok {
+        return
+    }
+
+    m.mutex.Lock()
+    vps, exists := m.instances[id]
+    if !exists {
+        m.mutex.Unlock()
+        http.Error(w, errVPSNotFound.Error(), http.StatusNotFound)
+        return
+    }
+    if vps.Status != StatusRunning && vps.Status != StatusPaused {
+        status := vps.Status
+        m.mutex.Unlock()
+        http.Error(w, fmt.Sprintf("VPS is not running (current status: %s)", status), http.StatusConflict)
+        return
+    }
+    if m.serialConsoles[id] {
+        m.mutex.Unlock()
+        http.Error(w, "Serial console is already in use", http.StatusConflict)
+        return
+    }
+    m.serialConsoles[id] = true
+    m.mutex.Unlock()
+    defer func() {
+        m.mutex.Lock()
+        delete(m.serialConsoles, id)
+        m.mutex.Unlock()
+    }()
+
+    serial, err := net.DialTimeout("unix", filepath.Join(m.baseDir, "disks", id, "serial.sock"), 5*time.Second)
+    if errors.Is(err, syscall.ENOENT) {
+        http.Error(w, "Serial console is available after the VPS is next started", http.StatusConflict)
+        return
+    } else if err != nil {
+        http.Error(w, fmt.Sprintf("failed to connect to serial console: %v", err), http.StatusBadGateway)
+        return
+    }
+    defer serial.Close()
+
+    bridgeWebSocket(w, r, serial, "Serial console closed")
+}
+
+// Capture a VPS's display with QMP screendump and return it as a PNG.
+// QEMU writes a PPM, which is converted here and then removed.
+func (m *VPSManager) ScreenshotVPS(id string) ([]byte, error) {
+    m.mutex.RLock()
+    vps, exists := m.instances[id]
+    var status string
+    if exists {
+        status = vps.Status
+    }
+    m.mutex.RUnlock()
+    if !exists {
+        return nil, errVPSNotFound
+    }
+    if status != StatusRunning && status != StatusPaused {
+        return nil, fmt.Errorf("%w (current status: %s)", errVPSNotRunning, status)
+    }
+
+    instanceDir := filepath.Join(m.baseDir, "disks", id)
+    tmpFile, err := os.CreateTemp(instanceDir, "screendump-*.ppm")
+    if err != nil {
+        return nil, fmt.Errorf("failed to create temp file: %v", err)
+    }
+    tmpFile.Close()
+    defer os.Remove(tmpFile.Name())
+
+    command, err := json.Marshal(map[string]interface{}{
+        "execute":   "screendump",
+        "arguments": map[string]string{"filename": tmpFile.Name()},
+    })
+    if err != nil {
+        return nil, err
+    }
+    output, err := m.executeQMPCommand(filepath.Join(instanceDir, "qemu-monitor.sock"), string(command))
+    if err == nil {
+        err = parseQMPReturn(output, nil)
+    }
+    if err != nil {
+        return nil, fmt.Errorf("failed to capture screen: %v", err)
+    }
+
+    file, err := os.Open(tmpFile.Name())
+    if err != nil {
+        return nil, fmt.Errorf("failed to open screendump: %v", err)
+    }
+    defer file.Close()
+    img, err := decodePPM(bufio.NewReader(file))
+    if err != nil {
+        return nil, fmt.Errorf("failed to decode screendump: %v", err)
+    }
+
+    var buf bytes.Buffer
+    if err := png.Encode(&buf, img); err != nil {
+        return nil, fmt.Errorf("failed to encode screenshot: %v", err)
+    }
+    return buf.Bytes(), nil
+}
+
+// Helper function to decode the binary (P6) PPM images QEMU's screendump
+// writes. The standard library has no PPM decoder.
+func decodePPM(reader *bufio.Reader) (image.Image, error) {
+    var header [4]int
+    for i := 0; i < len(header); i++ {
+        // Skip whitespace and # comments between header fields
+        for {
+            b, err := reader.ReadByte()
+            if err != nil {
+                return nil, err
+            }
+            if b == '#' {
+                if _, err := reader.ReadString('\n'); err != nil {
+                    return nil, err
+                }
+                continue
+            }
+            if b != ' ' && b != '\t' && b != '\n' && b != '\r' {
+                reader.UnreadByte()
+                break
+            }
+        }
+        var field []byte
+        for {
+            b, err := reader.ReadByte()
+            if err != nil {
+                return nil, err
+            }
+            if b == ' ' || b == '\t' || b == '\n' || b == '\r' {
+                break
+            }
+            field = append(field, b)
+        }
+        if i == 0 {
+            if string(field) != "P6" {
+                return nil, fmt.Errorf("unsupported PPM format %q", field)
+            }
+            continue
+        }
+        value, err := strconv.Atoi(string(field))
+        if err != nil || value <= 0 {
+            return nil, fmt.Errorf("invalid PPM header field %q", field)
+        }
+        header[i] = value
+    }
+    width, height, maxValue := header[1], header[2], header[3]
+    if maxValue != 255 {
+        return nil, fmt.Errorf("unsupported PPM max value %d", maxValue)
+    }
+    if width > 16384 || height > 16384 {
+        return nil, fmt.Errorf("PPM image too large: %dx%d", width, height)
+    }
+
+    img := image.NewNRGBA(image.Rect(0, 0, width, height))
+    row := make([]byte, width*3)
+    for y := 0; y < height; y++ {
+        if _, err := io.ReadFull(reader, row); err != nil {
+            return nil, err
+        }
+        pix := img.Pix[y*img.Stride:]
+        for x := 0; x < width; x++ {
+            pix[x*4] = row[x*3]
+            pix[x*4+1] = row[x*3+1]
+            pix[x*4+2] = row[x*3+2]
+            pix[x*4+3] = 0xff
+        }
+    }
+    return img, nil
+}
+
+func (m *VPSManager) handleScreenshot(w http.ResponseWriter, r *http.Request) {
+    if !allowMethods(w, r, http.MethodGet, http.MethodHead) {
+        return
+    }
+
+    id, ok := m.vpsIDFromRequest(w, r)
+    if !ok {
+        return
+    }
+
+    data, err := m.ScreenshotVPS(id)
+    if err != nil {
+        status := http.StatusInternalServerError
+        if errors.Is(err, errVPSNotFound) {
+            status = http.StatusNotFound
+        } else if errors.Is(err, errVPSNotRunning) {
+            status = http.StatusConflict
+        }
+        http.Error(w, err.Error(), status)
+        return
+    }
+
+    w.Header().Set("Content-Type", "image/png")
+    w.Header().Set("Cache-Control", "no-store")
+    w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+    w.WriteHeader(http.StatusOK)
+    if r.Method != http.MethodHead {
+        w.Write(data)
+    }
+}
+
+// Warn subscribers expiryWarning ahead of ExpiresAt, then delete the VPS.
+// ExpiresAt is re-read every time the timer fires, and ExtendVPS fires it
+// early, so moving the expiry skips a pending warning and schedules a new
+// one for the new expiry.
+func (m *VPSManager) scheduleCleanup(vps *VPS) {
+    timer := time.NewTimer(time.Hour)
+    m.mutex.Lock()
+    m.expiryTimers[vps.ID] = timer
+    m.mutex.Unlock()
+    defer func() {
+        timer.Stop()
+        m.mutex.Lock()
+        if m.expiryTimers[vps.ID] == timer {
+            delete(m.expiryTimers, vps.ID)
+        }
+        m.mutex.Unlock()
+    }()
+
+    var warnedFor time.Time
+    for {
+        m.mutex.RLock()
+        current, exists := m.instances[vps.ID]
+        expiresAt := vps.ExpiresAt
+        m.mutex.RUnlock()
+        if !exists || current != vps {
+            return
+        }
+
+        wait := time.Until(expiresAt)
+        if !warnedFor.Equal(expiresAt) {
+            warnAt := expiresAt.Add(-m.expiryWarning)
+            if time.Now().Before(warnAt) {
+                wait = time.Until(warnAt)
+            } else {
+                warnedFor = expiresAt
+                m.events.publish(VPSEvent{
+                    Type:      EventExpiringSoon,
+                    VPSID:     vps.ID,
+                    Message:   fmt.Sprintf("VPS %s will be deleted in %s", vps.Name, time.Until(expiresAt).Round(time.Second)),
+                    ExpiresAt: &expiresAt,
+                    Owner:     vps.Owner,
+                })
+                continue
+            }
+        }
+
+        if wait <= 0 {
+            m.DeleteVPS(vps.ID)
+            return
+        }
+
+        // Since Go 1.23 Reset drops any expiry left in the channel
+        timer.Reset(wait)
+        select {
+        case <-timer.C:
+        case <-m.ctx.Done():
+            return
+        }
+    }
+}
+
+var errLifetimeExceeded = errors.New("VPS is already at its maximum lifetime")
+
+// Push a VPS's expiry back by d, up to maxLifetime after it was created, and
+// wake its cleanup timer so the deletion is rescheduled
+func (m *VPSManager) ExtendVPS(id string, d time.Duration) (*VPS, error) {
+    m.mutex.Lock()
+    defer m.mutex.Unlock()
+
+    vps, exists := m.instances[id]
+    if !exists {
+        return nil, errVPSNotFound
+    }
+    limit := vps.CreatedAt.Add(m.maxLifetime)
+    expiresAt := vps.ExpiresAt.Add(d)
+    if expiresAt.After(limit) {
+        expiresAt = limit
+    }
+    if !expiresAt.After(vps.ExpiresAt) {
+        return nil, errLifetimeExceeded
+    }
+
+    vps.ExpiresAt = expiresAt
+    // Still being created if there's no timer yet; it reads the new expiry
+    // when it starts
+    if timer, scheduled := m.expiryTimers[id]; scheduled {
+        timer.Reset(0)
+    }
+    m.saveStateLocked()
+    log.Printf("Extended VPS %s until %s", id, expiresAt.Format(time.RFC3339))
+    return vps, nil
+}
+
+func (m *VPSManager) handleExtendVPS(w http.ResponseWriter, r *http.Request) {
+    if !allowMethods(w, r, http.MethodPost) {
+        return
+    }
+
+    id, ok := m.vpsIDFromRequest(w, r)
+    if !ok {
+        return
+    }
+
+    value := r.URL.Query().Get("duration")
+    d, err := time.ParseDuration(value)
+    if err != nil || d <= 0 {
+        http.Error(w, fmt.Sprintf("invalid duration: %q", value), http.StatusBadRequest)
+        return
+    }
+
+    vps, err := m.ExtendVPS(id, d)
+    if errors.Is(err, errVPSNotFound) {
+        http.Error(w, err.Error(), http.StatusNotFound)
+        return
+    } else if err != nil {
+        http.Error(w, err.Error(), http.StatusConflict)
+        return
+    }
+
+    m.mutex.RLock()
+    expiresAt := vps.ExpiresAt
+    m.mutex.RUnlock()
+    writeJSON(w, http.StatusOK, struct {
+        ExpiresAt          time.Time `json:"expires_at"`
+        SecondsUntilExpiry int64     `json:"seconds_until_expiry"`
+    }{expiresAt, int64(time.Until(expiresAt).Seconds())})
+}
+
+// VPSEvent is pushed to /api/events subscribers
+type VPSEvent struct {
+    Type      string     `json:"type"`
+    VPSID     string     `json:"vps_id"`
+    At        time.Time  `json:"at"`
+    Message   string     `json:"message,omitempty"`
+    ExpiresAt *time.Time `json:"expires_at,omitempty"`
+    Status    string     `json:"status,omitempty"`
+    Stage     string     `json:"stage,omitempty"`
+    Progress  int        `json:"progress,omitempty"`
+    Owner     string     `json:"-"` // Streams only carry the caller's events
+}
+
+// Helper function to change a VPS status and tell subscribers. Callers hold
+// m.mutex.
+func (m *VPSManager) setStatus(vps *VPS, status string) {
+    if vps.Status == status {
+        return
+    }
+    vps.Status = status
+    m.publishState(vps)
+}
+
+func (m *VPSManager) publishState(vps *VPS) {
+    m.saveStateLocked()
+    m.events.publish(VPSEvent{
+        Type:   EventStatusChanged,
+        VPSID:  vps.ID,
+        Status: vps.Status,
+        Stage:  vps.Stage,
+        Owner:  vps.Owner,
+    })
+}
+
+// Block until a VPS reaches ?status= and/or ?stage=, driven by status_changed
+// events. Answers 408 on timeout and 409 if the VPS fails first.
+func (m *VPSManager) handleWaitVPS(w http.ResponseWriter, r *http.Request) {
+    if !allowMethods(w, r, http.MethodGet) {
+        return
+    }
+
+    status := r.URL.Query().Get("status")
+    stage := r.URL.Query().Get("stage")
+    if status == "" && stage == "" {
+        http.Error(w, "status or stage is required", http.StatusBadRequest)
+        return
+    }
+
+    timeout := time.Minute
+    if value := r.URL.Query().Get("timeout"); value != "" {
+        parsed, err := time.ParseDuration(value)
+        if err != nil || parsed <= 0 || parsed > WAIT_MAX_TIMEOUT {
+            http.Error(w, fmt.Sprintf("invalid timeout: %s (max %s)", value, WAIT_MAX_TIMEOUT), http.StatusBadRequest)
+            return
+        }
+        timeout = parsed
+    }
+
+    id, ok := m.vpsIDFromRequest(w, r)
+    if !ok {
+        return
+    }
+
+    // Subscribe before the first check so a change in between isn't missed
+    events := m.events.subscribe()
+    defer m.events.unsubscribe(events)
+
+    // The wait may outlast the server's write timeout
+    controller := http.NewResponseController(w)
+    controller.SetWriteDeadline(time.Time{})
+
+    timer := time.NewTimer(timeout)
+    defer timer.Stop()
+
+    for {
+        m.mutex.RLock()
+        vps, exists := m.instances[id]
+        var current VPS
+        if exists {
+            current = *vps
+        }
+        m.mutex.RUnlock()
+
+        if !exists {
+            http.Error(w, "VPS was deleted while waiting", http.StatusNotFound)
+            return
+        }
+        if (status == "" || current.Status == status) && (stage == "" || current.Stage == stage) {
+            writeJSON(w, http.StatusOK, &current)
+            return
+        }
+        if current.Status == "failed" && status != "failed" && stage != StageFailed {
+            writeJSON(w, http.StatusConflict, &current)
+            return
+        }
+
+        // Sleep until something about this VPS changes
+        for waiting := true; waiting; {
+            select {
+            case event := <-events:
+                waiting = event.VPSID != id
+            case <-timer.C:
+                writeJSON(w, http.StatusRequestTimeout, &current)
+                return
+            case <-r.Context().Done():
+                return
+            case <-m.ctx.Done():
+                http.Error(w, "server is shutting down", http.StatusServiceUnavailable)
+                return
+            }
+        }
+    }
+}
+
+// eventHub fans events out to subscribers. Publishing never blocks; a
+// subscriber that falls more than EVENT_BUFFER events behind misses some.
+type eventHub struct {
+    mutex       sync.Mutex
+    subscribers map[chan VPSEvent]string // Channel -> VPS ID it wants, "" for all
+}
+
+func newEventHub() *eventHub {
+    return &eventHub{
+        subscribers: make(map[chan VPSEvent]string),
+    }
+}
+
+func (h *eventHub) subscribe() chan VPSEvent {
+    return h.subscribeVPS("")
+}
+
+// Subscribe to one VPS's events only, so a busy server can't fill the
+// channel with other instances' events
+func (h *eventHub) subscribeVPS(id string) chan VPSEvent {
+    ch := make(chan VPSEvent, EVENT_BUFFER)
+    h.mutex.Lock()
+    h.subscribers[ch] = id
+    h.mutex.Unlock()
+    return ch
+}
+
+func (h *eventHub) unsubscribe(ch chan VPSEvent) {
+    h.mutex.Lock()
+    delete(h.subscribers, ch)
+    h.mutex.Unlock()
+}
+
+func (h *eventHub) publish(event VPSEvent) {
+    if event.At.IsZero() {
+        event.At = time.Now()
+    }
+
+    h.mutex.Lock()
+    defer h.mutex.Unlock()
+    for ch, id := range h.subscribers {
+        if id != "" && id != event.VPSID {
+            continue
+        }
+        select {
+        case ch <- event:
+        default:
+            log.Printf("Warning: Dropping %s event for a slow subscriber", event.Type)
+        }
+    }
+}
+
+// Stream events as Server-Sent Events, or as JSON text messages when the
+// client asks for a WebSocket. ?id= or ?name= limits the stream to one VPS;
+// either way only the caller's own instances are reported.
+func (m *VPSManager) handleEvents(w http.ResponseWriter, r *http.Request) {
+    if !allowMethods(w, r, http.MethodGet) {
+        return
+    }
+
+    caller := identityFromRequest(r)
+    var id string
+    if r.URL.Query().Get("id") != "" || r.URL.Query().Get("name") != "" {
+        var ok bool
+        if id, ok = m.vpsIDFromRequest(w, r); !ok {
+            return
+        }
+    }
+
+    // Streams outlive the server's read/write timeouts
+    controller := http.NewResponseController(w)
+    controller.SetReadDeadline(time.Time{})
+    controller.SetWriteDeadline(time.Time{})
+
+    events := m.events.subscribe()
+    defer m.events.unsubscribe(events)
+
+    var send func(event VPSEvent) error
+    var ping func() error
+    if websocket.IsWebSocketUpgrade(r) {
+        conn, err := wsUpgrader.Upgrade(w, r, nil)
+        if err != nil {
+            return
+        }
+
+        // Drain client frames so close and ping control messages are handled
+        closed := make(chan struct{})
+        go func() {
+            defer close(closed)
+            for {
+                if _, _, err := conn.NextReader(); err != nil {
+                    return
+                }
+            }
+        }()
+        defer func() { <-closed }()
+        defer conn.Close()
+
+        send = func(event VPSEvent) error { return conn.WriteJSON(event) }
+        ping = func() error {
+            return conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(time.Second))
+        }
+    } else {
+        w.Header().Set("Content-Type", "text/event-stream")
+        w.Header().Set("Cache-Control", "no-cache")
+        w.WriteHeader(http.StatusOK)
+        controller.Flush()
+
+        send = func(event VPSEvent) error {
+            data, err := json.Marshal(event)
+            if err != nil {
+                return err
+            }
+            if _, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event.Type, data); err != nil {
+                return err
+            }
+            return controller.Flush()
+        }
+        ping = func() error {
+            if _, err := io.WriteString(w, ": ping\n\n"); err != nil {
+                return err
+            }
+            return controller.Flush()
+        }
+    }
+
+    keepalive := time.NewTicker(EVENT_KEEPALIVE)
+    defer keepalive.Stop()
+
+    for {
+        select {
+        case event := <-events:
+            if (!caller.Admin() && event.Owner != caller.Owner) || (id != "" && event.VPSID != id) {
+                continue
+            }
+            if err := send(event); err != nil {
+                return
+            }
+        case <-keepalive.C:
+            if err := ping(); err != nil {
+                return
+            }
+        case <-r.Context().Done():
+            return
+        case <-m.ctx.Done():
+            return
+        }
+    }
+}
+
+func (m *VPSManager) DeleteVPS(id string) error {
+    m.mutex.Lock()
+    defer m.mutex.Unlock()
+
+    vps, exists := m.instances[id]
+    if !exists {
+        return errVPSNotFound
+    }
+
+    // Nothing exists on disk yet for a queued create, it just stops waiting
+    if cancel, queued := m.queuedCreates[id]; queued {
+        cancel()
+        delete(m.queuedCreates, id)
+    }
+
+    // Remove IP association
+    m.forgetIPInstanceLocked(id)
+
+    if vps.QEMUPid > 0 {
+        if proc, err := os.FindProcess(vps.QEMUPid); err == nil {
+            proc.Kill()
+        }
+    }
+
+    instanceDir := filepath.Join(m.baseDir, "disks", vps.ID)
+    os.RemoveAll(instanceDir)
+    if vps.ImagePath != "" && filepath.Dir(vps.ImagePath) != instanceDir {
+        os.RemoveAll(filepath.Dir(vps.ImagePath))
+    }
+    os.Remove(m.diskKeyPath(vps.ID))
+
+    go removeCgroup(id)
+    removeTapDevice(id)
+
+    delete(m.instances, id)
+    m.saveStateLocked()
+    m.events.publish(VPSEvent{Type: EventDeleted, VPSID: id, Owner: vps.Owner})
+    return nil
+}
+
+func (m *VPSManager) GetVPS(id string) (*VPS, error) {
+    m.mutex.RLock()
+    defer m.mutex.RUnlock()
+
+    vps, exists := m.instances[id]
+    if !exists {
+        return nil, errVPSNotFound
+    }
+    return vps, nil
+}
+
+var (
+    errVPSNotFound   = errors.New("VPS not found")
+    errVPSNotRunning = errors.New("VPS is not running")
+    errIPLimitReached = errors.New("this IP address already has the maximum number of active VPSes")
+    errQuotaReached   = errors.New("this API key already has the maximum number of active VPSes")
+    errHostPortInUse = errors.New("host port is already in use")
+    errAmbiguousName = errors.New("VPS name is ambiguous, use the ID instead")
+    errVPSBusy       = errors.New("VPS is busy")
+    errInvalidDiskSize = errors.New("invalid disk size")
+    errInvalidVCPUs  = errors.New("invalid vCPU count")
+    errInvalidMemory = errors.New("invalid memory size")
+)
+
+// Look up one of the caller's VPSes by ID, falling back to its name. Names
+// are only unique per owner, and not even then, so a name shared by several
+// instances is an error rather than a guess. Instances the caller can't
+// access are reported as not found.
+func (m *VPSManager) resolveVPS(caller apiIdentity, idOrName string) (*VPS, error) {
+    m.mutex.RLock()
+    defer m.mutex.RUnlock()
+
+    if vps, exists := m.instances[idOrName]; exists && caller.canAccess(vps) {
+        return vps, nil
+    }
+
+    var found *VPS
+    for _, vps := range m.instances {
+        if vps.Name != idOrName || !caller.canAccess(vps) {
+            continue
+        }
+        if found != nil {
+            return nil, errAmbiguousName
+        }
+        found = vps
+    }
+    if found == nil {
+        return nil, errVPSNotFound
+    }
+    return found, nil
+}
+
+// Helper function to resolve the VPS a request targets from ?id= or ?name=.
+// The ID wins when both are given. Writes the error response on failure.
+func (m *VPSManager) vpsIDFromRequest(w http.ResponseWriter, r *http.Request) (string, bool) {
+    caller := identityFromRequest(r)
+    var vps *VPS
+    var err error
+    if id := r.URL.Query().Get("id"); id != "" {
+        vps, err = m.GetVPS(id)
+        // 404 rather than 403 so other owners' IDs don't leak
+        if err == nil && !caller.canAccess(vps) {
+            err = errVPSNotFound
+        }
+    } else if name := r.URL.Query().Get("name"); name != "" {
+        vps, err = m.resolveVPS(caller, name)
+    } else {
+        http.Error(w, "Missing VPS ID or name", http.StatusBadRequest)
+        return "", false
+    }
+
+    if err != nil {
+        status := http.StatusNotFound
+        if errors.Is(err, errAmbiguousName) {
+            status = http.StatusConflict
+        }
+        http.Error(w, err.Error(), status)
+        return "", false
+    }
+    return vps.ID, true
+}
+
+func (m *VPSManager) ListVPS() []*VPS {
+    m.mutex.RLock()
+    defer m.mutex.RUnlock()
+
+    vpsList := make([]*VPS, 0, len(m.instances))
+    for _, vps := range m.instances {
+        vpsList = append(vpsList, vps)
+    }
+
+    // Stable ordering keeps the list ETag unchanged between polls
+    sort.Slice(vpsList, func(i, j int) bool {
+        if vpsList[i].CreatedAt.Equal(vpsList[j].CreatedAt) {
+            return vpsList[i].ID < vpsList[j].ID
+        }
+        return vpsList[i].CreatedAt.Before(vpsList[j].CreatedAt)
+    })
+    return vpsList
+}
+
+func (m *VPSManager) validateInstances() {
+    // Snapshot the instances to query so QMP I/O doesn't happen under the lock
+    m.mutex.RLock()
+    instances := make(map[string]*VPS)
+    for id, vps := range m.instances {
+        instances[id] = vps
+    }
+    m.mutex.RUnlock()
+
+    for id, vps := range instances {
+        m.mutex.RLock()
+        status, pid := vps.Status, vps.QEMUPid
+        m.mutex.RUnlock()
+
+        if status == "creating" || status == StatusRebuilding || status == StatusMoving || status == StatusCloning || status == StatusRepairing || status == StatusSnapshotting || status == "failed" {
+            continue
+        }
+
+        if err := checkProcess(pid); err != nil {
+            m.mutex.Lock()
+            if vps.Status != StatusStopped {
+                log.Printf("VPS %s (ID: %s) is no longer running: %v", vps.Name, id, err)
+            }
+            m.setStatus(vps, "stopped")
+            vps.RunState = ""
+            // A stat is cheap enough to run every pass; StartVPS does the
+            // full qemu-img check
+            if vps.DiskFormat != DiskFormatRaw && !vps.StandaloneDisk {
+                basePath := getBaseImagePath(vps.ImageType)
+                if _, err := os.Stat(basePath); os.IsNotExist(err) {
+                    if !strings.HasPrefix(vps.Alert, errBrokenBackingChain.Error()) {
+                        log.Printf("Warning: Base image %s for VPS %s (ID: %s) is missing", basePath, vps.Name, id)
+                    }
+                    vps.Alert = fmt.Sprintf("%v: backing file %s is missing, repair with /api/vps/repair-disk", errBrokenBackingChain, basePath)
+                } else if strings.HasPrefix(vps.Alert, errBrokenBackingChain.Error()) {
+                    vps.Alert = ""
+                }
+            }
+            m.mutex.Unlock()
+            continue
+        }
+
+        // The process is alive; ask QEMU what the guest is actually doing.
+        // If the monitor can't be reached the pid check above is all we have.
+        runState, err := m.queryRunState(id)
+        if err != nil {
+            continue
+        }
+
+        m.mutex.Lock()
+        vps.RunState = runState
+        // Leave in-flight power operations to the goroutines driving them
+        if vps.Status != StatusStarting && vps.Status != StatusStopping && vps.Status != StatusRestarting {
+            m.setStatus(vps, statusFromRunState(runState, vps.Status))
+        }
+        if runState == "io-error" {
+            if vps.Alert == "" {
+                log.Printf("VPS %s (ID: %s) paused by QEMU after a disk I/O error", vps.Name, id)
+            }
+            vps.Alert = "Guest paused after a disk I/O error, the host storage may be full. Free space on the host to resume."
+        } else if vps.Alert != "" && runState == "running" {
+            vps.Alert = ""
+        }
+        imagePath := vps.ImagePath
+        m.mutex.Unlock()
+
+        if runState == "io-error" && m.autoResumeIOError {
+            m.resumeAfterIOError(id, imagePath)
+        }
+    }
+}
+
+func (m *VPSManager) statusMonitor() {
+    ticker := time.NewTicker(STATUS_CHECK_INTERVAL)
+    defer ticker.Stop()
+
+    for range ticker.C {
+        m.validateInstances()
+
+        // Catches changes that don't go through setStatus, e.g. alerts,
+        // throttles and moved disks. Unchanged state isn't rewritten.
+        m.mutex.RLock()
+        m.saveStateLocked()
+        m.mutex.RUnlock()
+    }
+}
+
+// Resume a guest stuck in io-error once the filesystem holding its disk has
+// room again
+func (m *VPSManager) resumeAfterIOError(id string, imagePath string) {
+    var stat syscall.Statfs_t
+    if err := syscall.Statfs(filepath.Dir(imagePath), &stat); err != nil {
+        log.Printf("Warning: Failed to check free space for VPS %s: %v", id, err)
+        return
+    }
+
+    free := stat.Bavail * uint64(stat.Bsize)
+    if free < IO_ERROR_RESUME_MIN_FREE {
+        return
+    }
+
+    monitorSocket := filepath.Join(m.baseDir, "disks", id, "qemu-monitor.sock")
+    output, err := m.executeQMPCommand(monitorSocket, `{ "execute": "cont" }`)
+    if err == nil {
+        err = parseQMPReturn(output, nil)
+    }
+    if err != nil {
+        log.Printf("Warning: Failed to resume VPS %s after I/O error: %v", id, err)
+        return
+    }
+
+    log.Printf("Resumed VPS %s after I/O error, %d bytes now free", id, free)
+}
+
+// Ask QEMU for the guest run state (running, paused, io-error, ...)
+func (m *VPSManager) queryRunState(id string) (string, error) {
+    monitorSocket := filepath.Join(m.baseDir, "disks", id, "qemu-monitor.sock")
+    output, err := m.executeQMPCommand(monitorSocket, `{ "execute": "query-status" }`)
+    if err != nil {
+        return "", err
+    }
+
+    var status struct {
+        Status  string `json:"status"`
+        Running bool   `json:"running"`
+    }
+    if err := parseQMPReturn(output, &status); err != nil {
+        return "", err
+    }
+    return status.Status, nil
+}
+
+// Map a QMP run state onto a VPS status, keeping the current status for
+// transient states such as migration
+func statusFromRunState(runState string, current string) string {
+    switch runState {
+    case "running":
+        return StatusRunning
+    case "paused", "suspended", "debug":
+        return StatusPaused
+    case "guest-panicked", "internal-error", "watchdog":
+        return StatusCrashed
+    case "io-error":
+        return StatusIOError
+    case "shutdown":
+        return StatusStopped
+    default:
+        return current
+    }
+}
+
+// List the CPU models and CPUID flags QEMU knows from "-cpu help"
+func queryCPUModels(qemuBin string) (map[string]bool, map[string]bool, error) {
+    output, err := exec.Command(qemuBin, "-cpu", "help").CombinedOutput()
+    if err != nil {
+        return nil, nil, fmt.Errorf("%v, output: %s", err, string(output))
+    }
+
+    models, flags := parseCPUHelp(string(output))
+    if len(models) == 0 {
+        return nil, nil, fmt.Errorf("no CPU models in output")
+    }
+    return models, flags, nil
+}
+
+// Parse "-cpu help" output. QEMU before 7.1 prefixes each model with its
+// architecture ("x86 Haswell"); later releases list bare, indented names
+// under "Available CPUs:". Both put the flags after "Recognized CPUID flags:".
+func parseCPUHelp(output string) (map[string]bool, map[string]bool) {
+    models := make(map[string]bool)
+    flags := make(map[string]bool)
+    inModels, inFlags := false, false
+    for _, line := range strings.Split(output, "\n") {
+        fields := strings.Fields(line)
+        switch {
+        case strings.HasPrefix(line, "Available CPUs"):
+            inModels = true
+        case strings.HasPrefix(line, "Recognized CPUID flags"):
+            inModels, inFlags = false, true
+        case inFlags:
+            for _, flag := range fields {
+                flags[flag] = true
+            }
+        case len(fields) >= 2 && fields[0] == "x86":
+            models[fields[1]] = true
+        case inModels && len(fields) >= 1:
+            models[fields[0]] = true
+        }
+    }
+    return models, flags
+}
+
+// Helper function to check a CPU model and +flag/-flag list against what
+// this QEMU supports
+func (m *VPSManager) validateCPU(model string, flags []string) error {
+    if !m.cpuModels[model] {
+        return fmt.Errorf("unsupported CPU model: %s", model)
+    }
+    for _, flag := range flags {
+        if len(flag) < 2 || (flag[0] != '+' && flag[0] != '-') || !m.cpuFlags[flag[1:]] {
+            return fmt.Errorf("unsupported CPU flag: %s", flag)
+        }
+    }
+    return nil
+}
+
+// Helper function to build the -cpu value, e.g. Haswell-noTSX,+avx2
+func formatCPU(vps *VPS) string {
+    model := vps.CPUModel
+    if model == "" {
+        model = DEFAULT_CPU_MODEL
+    }
+    return strings.Join(append([]string{model}, vps.CPUFlags...), ",")
+}
+
+// HTTP Handlers
+// Helper function to check a drive cache mode is one QEMU accepts
+func isValidCacheMode(mode string) bool {
+    switch mode {
+    case CacheModeNone, CacheModeWriteback, CacheModeWritethrough, CacheModeUnsafe:
+        return true
+    }
+    return false
+}
+
+// Helper function to decode a size-limited JSON request body. Unknown fields
+// are rejected so client typos don't silently fall back to defaults. Writes the
+// error response and returns false on failure.
+func decodeJSONBody(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+    mediaType := strings.TrimSpace(strings.Split(r.Header.Get("Content-Type"), ";")[0])
+    if !strings.EqualFold(mediaType, "application/json") {
+        http.Error(w, "Content-Type must be application/json", http.StatusUnsupportedMediaType)
+        return false
+    }
+
+    r.Body = http.MaxBytesReader(w, r.Body, MAX_REQUEST_BODY)
+    decoder := json.NewDecoder(r.Body)
+    decoder.DisallowUnknownFields()
+    if err := decoder.Decode(v); err != nil {
+        var maxBytesErr *http.MaxBytesError
+        if errors.As(err, &maxBytesErr) {
+            http.Error(w, fmt.Sprintf("request body exceeds %d bytes", maxBytesErr.Limit), http.StatusRequestEntityTooLarge)
+            return false
+        }
+        // encoding/json reports these as: json: unknown field "imagetype"
+        if field, found := strings.CutPrefix(err.Error(), "json: unknown field "); found {
+            http.Error(w, fmt.Sprintf("unknown field %s", field), http.StatusBadRequest)
+            return false
+        }
+        http.Error(w, err.Error(), http.StatusBadRequest)
+        return false
+    }
+    return true
+}
+
+type idempotencyEntry struct {
+    fingerprint [32]byte // Hash of the decoded request, to catch a key reused for another request
+    vpsID       string   // Empty while the first request is still being handled
+    expires     time.Time
+    password    []byte   // Sealed root password, dropped after IDEMPOTENCY_PASSWORD_TTL
+    passwordExpires time.Time
+}
+
+// Helper function to make the AEAD that seals passwords in idempotency
+// entries. The key only lives in memory, so nothing sealed outlives a restart.
+func newIdempotencyCipher() (cipher.AEAD, error) {
+    key := make([]byte, 32)
+    if _, err := rand.Read(key); err != nil {
+        return nil, fmt.Errorf("failed to generate idempotency key: %v", err)
+    }
+    block, err := aes.NewCipher(key)
+    if err != nil {
+        return nil, err
+    }
+    return cipher.NewGCM(block)
+}
+
+var (
+    errIdempotencyInProgress = errors.New("a request with this Idempotency-Key is still being processed")
+    errIdempotencyMismatch   = errors.New("Idempotency-Key was already used with a different request")
+)
+
+// Claim an Idempotency-Key for a create. Returns the VPS ID to replay, with
+// its root password while that is still kept, when the key already produced
+// one, or "" when the caller now owns the key and must finish or release it.
+func (m *VPSManager) reserveIdempotencyKey(owner, key string, fingerprint [32]byte) (string, string, error) {
+    m.idempotencyMutex.Lock()
+    defer m.idempotencyMutex.Unlock()
+
+    now := time.Now()
+    for k, entry := range m.idempotencyKeys {
+        if now.After(entry.expires) {
+            delete(m.idempotencyKeys, k)
+        }
+    }
+
+    mapKey := owner + "\x00" + key
+    if entry, exists := m.idempotencyKeys[mapKey]; exists {
+        if entry.fingerprint != fingerprint {
+            return "", "", errIdempotencyMismatch
+        }
+        if entry.vpsID == "" {
+            return "", "", errIdempotencyInProgress
+        }
+        if now.After(entry.passwordExpires) {
+            entry.password = nil
+        }
+        var password string
+        if len(entry.password) > 0 {
+            nonceSize := m.idempotencyCipher.NonceSize()
+            if plain, err := m.idempotencyCipher.Open(nil, entry.password[:nonceSize], entry.password[nonceSize:], []byte(mapKey)); err == nil {
+                password = string(plain)
+            }
+        }
+        return entry.vpsID, password, nil
+    }
+
+    m.idempotencyKeys[mapKey] = &idempotencyEntry{fingerprint: fingerprint, expires: now.Add(m.idempotencyTTL)}
+    return "", "", nil
+}
+
+// Record the VPS a key created and its sealed root password, or drop the key
+// when the create failed so the request can be retried
+func (m *VPSManager) finishIdempotencyKey(owner, key, vpsID, password string) {
+    m.idempotencyMutex.Lock()
+    defer m.idempotencyMutex.Unlock()
+
+    mapKey := owner + "\x00" + key
+    if vpsID == "" {
+        delete(m.idempotencyKeys, mapKey)
+        return
+    }
+    if entry, exists := m.idempotencyKeys[mapKey]; exists {
+        entry.vpsID = vpsID
+        if password != "" {
+            nonce := make([]byte, m.idempotencyCipher.NonceSize())
+            if _, err := rand.Read(nonce); err == nil {
+                entry.password = m.idempotencyCipher.Seal(nonce, nonce, []byte(password), []byte(mapKey))
+                entry.passwordExpires = time.Now().Add(min(IDEMPOTENCY_PASSWORD_TTL, m.idempotencyTTL))
+            }
+        }
+    }
+}
+
+func (m *VPSManager) handleCreateVPS(w http.ResponseWriter, r *http.Request) {
+    if !allowMethods(w, r, http.MethodPost) {
+        return
+    }
+
+    var req struct {
+        Name      string `json:"name"`
+        Hostname  string `json:"hostname"`
+        ImageType string `json:"image_type"`
+        ImageURL  string `json:"image_url"`
+        OSFamily  string `json:"os_family"`
+        Template  string `json:"template"`
+        HTTPProxy  string `json:"http_proxy"`
+        HTTPSProxy string `json:"https_proxy"`
+        NoProxy    string `json:"no_proxy"`
+        DiskFormat string `json:"disk_format"`
+        EncryptDisk bool  `json:"encrypt_disk"`
+        CacheMode  string `json:"cache"`
+        Network    *NetworkConfig `json:"network"`
+        NICs       []NICConfig `json:"nics"`
+        NetworkMode string `json:"network_mode"`
+        PortForwards []PortForward `json:"port_forwards"`
+        TemplateVars map[string]string `json:"template_vars"`
+        MemoryMB   int    `json:"memory_mb"`
+        VCPUs      int    `json:"vcpus"`
+        DiskGB     int    `json:"disk_gb"`
+        DisableMetrics bool `json:"disable_metrics"`
+        CPUModel   string   `json:"cpu_model"`
+        CPUFlags   []string `json:"cpu_flags"`
+        CloudInitDatasource string `json:"cloud_init_datasource"`
+        CloudInitLabel string `json:"cloud_init_label"`
+        SSHAuthorizedKeys []string `json:"ssh_authorized_keys"`
+        DisablePasswordAuth bool `json:"disable_password_auth"`
+    }
+
+    if !decodeJSONBody(w, r, &req) {
+        return
+    }
 
-    // Get OS-specific packages and commandsa
-    packages := templateConfig.Packages[osFamily]
-    commands := templateConfig.Commands[osFamily]
+    // A retried create with the same key gets the VPS the first one made
+    caller := identityFromRequest(r)
+    owner := caller.Owner
+    var createdID, createdPassword string
+    if key := r.Header.Get("Idempotency-Key"); key != "" {
+        if len(key) > 255 {
+            http.Error(w, "Idempotency-Key must be at most 255 characters", http.StatusBadRequest)
+            return
+        }
+        body, err := json.Marshal(req)
+        if err != nil {
+            http.Error(w, err.Error(), http.StatusInternalServerError)
+            return
+        }
+        replayID, replayPassword, err := m.reserveIdempotencyKey(owner, key, sha256.Sum256(body))
+        if errors.Is(err, errIdempotencyInProgress) {
+            http.Error(w, err.Error(), http.StatusConflict)
+            return
+        } else if errors.Is(err, errIdempotencyMismatch) {
+            http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+            return
+        }
+        if replayID != "" {
+            vps, err := m.GetVPS(replayID)
+            if err != nil {
+                http.Error(w, "the VPS created with this Idempotency-Key has been deleted", http.StatusNotFound)
+                return
+            }
+            m.mutex.RLock()
+            replayed := *vps
+            m.mutex.RUnlock()
+            replayed.Password = replayPassword
+            w.Header().Set("Idempotent-Replayed", "true")
+            writeJSON(w, http.StatusOK, &replayed)
+            return
+        }
+        defer func() {
+            m.finishIdempotencyKey(owner, key, createdID, createdPassword)
+        }()
+    }
 
-    // Combine all commands including package installation
-    var allCommands []string
+    clientIP := m.clientIP(r)
+    if limited, _ := m.hasVPSForIP(clientIP); limited {
+        http.Error(w, errIPLimitReached.Error(), http.StatusConflict)
+        return
+    }
+    if m.ownerAtQuota(owner, caller.MaxVPSes) {
+        http.Error(w, errQuotaReached.Error(), http.StatusTooManyRequests)
+        return
+    }
 
-    // Add package installation commands based on OS family
-    if len(packages) > 0 {
-        switch osFamily {
-        case "ubuntu", "debian":
-            allCommands = append(allCommands,
-                "apt-get update",
-                "DEBIAN_FRONTEND=noninteractive apt-get install -y "+strings.Join(packages, " "))
-        case "fedora", "rocky", "almalinux", "centos":
-            allCommands = append(allCommands,
-                "dnf update -y",
-                "dnf install -y "+strings.Join(packages, " "))
+    // Set defaults if not provided
+    if req.Template == "" {
+        req.Template = m.defaultTemplate
+    }
+    if req.Hostname == "" {
+        req.Hostname = req.Name + ".vps.local"
+    }
+    if req.ImageURL != "" {
+        if req.ImageType != "" {
+            http.Error(w, "image_type and image_url are mutually exclusive", http.StatusBadRequest)
+            return
+        }
+        if err := validateImageURL(req.ImageURL); err != nil {
+            http.Error(w, err.Error(), http.StatusBadRequest)
+            return
         }
+        if !slices.Contains(OS_FAMILIES, req.OSFamily) {
+            http.Error(w, fmt.Sprintf("os_family is required with image_url, one of: %s", strings.Join(OS_FAMILIES, ", ")), http.StatusBadRequest)
+            return
+        }
+        req.ImageType = customImageType(req.ImageURL)
+        if err := m.checkCustomImageRoom(req.ImageType); err != nil {
+            status := http.StatusInternalServerError
+            if errors.Is(err, errCustomImageLimit) {
+                status = http.StatusInsufficientStorage
+            }
+            http.Error(w, err.Error(), status)
+            return
+        }
+    } else if req.OSFamily != "" {
+        http.Error(w, "os_family is only accepted with image_url", http.StatusBadRequest)
+        return
+    }
+    if req.ImageType == "" {
+        req.ImageType = m.defaultImage
+    }
+    if _, exists := SUPPORTED_IMAGES[req.ImageType]; !exists && req.ImageURL == "" {
+        http.Error(w, fmt.Sprintf("unsupported image type: %s", req.ImageType), http.StatusBadRequest)
+        return
+    }
+    if err := validateTemplateAndOS(req.Template, req.ImageType, req.OSFamily); err != nil {
+        http.Error(w, err.Error(), http.StatusBadRequest)
+        return
+    }
+    if req.DiskFormat == "" {
+        req.DiskFormat = DiskFormatQCOW2
+    }
+    if req.DiskFormat != DiskFormatQCOW2 && req.DiskFormat != DiskFormatRaw {
+        http.Error(w, fmt.Sprintf("unsupported disk format: %s", req.DiskFormat), http.StatusBadRequest)
+        return
+    }
+    if req.EncryptDisk && req.DiskFormat != DiskFormatQCOW2 {
+        http.Error(w, "encrypt_disk requires the qcow2 disk format", http.StatusBadRequest)
+        return
+    }
+    if req.CacheMode == "" {
+        req.CacheMode = CacheModeWriteback
+    }
+    if !isValidCacheMode(req.CacheMode) {
+        http.Error(w, fmt.Sprintf("unsupported cache mode: %s", req.CacheMode), http.StatusBadRequest)
+        return
     }
 
-    // Add template-specific commands
-    allCommands = append(allCommands, commands...)
+    if req.CPUModel == "" {
+        req.CPUModel = DEFAULT_CPU_MODEL
+    }
+    if err := m.validateCPU(req.CPUModel, req.CPUFlags); err != nil {
+        http.Error(w, err.Error(), http.StatusBadRequest)
+        return
+    }
 
-    // Create cloud-init user-data content
-    var userData bytes.Buffer
-    userData.WriteString(fmt.Sprintf(`#cloud-config
-users:
-  - name: root
-    lock_passwd: false
-    ssh_pwauth: true
+    if req.CloudInitDatasource == "" {
+        req.CloudInitDatasource = m.cloudInitDatasource
+        if req.CloudInitLabel == "" {
+            req.CloudInitLabel = m.cloudInitLabel
+        }
+    }
+    if req.CloudInitLabel == "" {
+        req.CloudInitLabel = defaultCloudInitLabel(req.CloudInitDatasource)
+    }
+    if err := validateCloudInitSeed(req.CloudInitDatasource, req.CloudInitLabel); err != nil {
+        http.Error(w, err.Error(), http.StatusBadRequest)
+        return
+    }
+    if req.CloudInitDatasource == CloudInitConfigDrive && m.cloudInitSeed == CloudInitSeedSMBIOS {
+        http.Error(w, "the configdrive datasource needs the iso cloud-init seed", http.StatusBadRequest)
+        return
+    }
+    // NoCloud-Net only fetches user-data and meta-data
+    if req.Network != nil && m.cloudInitSeed == CloudInitSeedSMBIOS {
+        http.Error(w, "static network config needs the iso cloud-init seed", http.StatusBadRequest)
+        return
+    }
+    // network_data.json isn't generated, so ConfigDrive guests use DHCP
+    if req.Network != nil && req.CloudInitDatasource == CloudInitConfigDrive {
+        http.Error(w, "static network config requires the nocloud datasource", http.StatusBadRequest)
+        return
+    }
 
-chpasswd:
-  list: |
-    root:%s
-  expire: false
+    if req.MemoryMB < 0 || req.VCPUs < 0 || req.DiskGB < 0 {
+        http.Error(w, "memory_mb, vcpus and disk_gb must not be negative", http.StatusBadRequest)
+        return
+    }
+    // Guests boot from the base image, which is already DISK_SIZE
+    if req.DiskGB != 0 && req.DiskGB < DISK_SIZE {
+        http.Error(w, fmt.Sprintf("disk_gb must be at least %d", DISK_SIZE), http.StatusBadRequest)
+        return
+    }
+    resources := &VPS{Template: req.Template, MemoryMB: req.MemoryMB, VCPUs: req.VCPUs, DiskGB: req.DiskGB}
+    resolveResources(resources)
+    if err := m.checkResourceLimits(resources); err != nil {
+        http.Error(w, err.Error(), http.StatusBadRequest)
+        return
+    }
 
-ssh_pwauth: true
-disable_root: false
+    var proxy *ProxyConfig
+    if req.HTTPProxy != "" || req.HTTPSProxy != "" || req.NoProxy != "" {
+        proxy = &ProxyConfig{
+            HTTPProxy:  req.HTTPProxy,
+            HTTPSProxy: req.HTTPSProxy,
+            NoProxy:    req.NoProxy,
+        }
+        if err := validateProxyConfig(proxy); err != nil {
+            http.Error(w, err.Error(), http.StatusBadRequest)
+            return
+        }
+    }
 
-hostname: %s
+    if _, exists := lookupTemplate(req.Template); exists {
+        if err := validateTemplateVars(req.Template, req.TemplateVars); err != nil {
+            http.Error(w, err.Error(), http.StatusBadRequest)
+            return
+        }
+    }
 
-package_update: true
-package_upgrade: true
+    if err := m.validateNICs(req.NICs); err != nil {
+        http.Error(w, err.Error(), http.StatusBadRequest)
+        return
+    }
+    switch {
+    case req.NetworkMode == "" && len(req.NICs) > 0:
+        req.NetworkMode = req.NICs[0].Type
+    case req.NetworkMode == "":
+        req.NetworkMode = m.networkMode
+    case req.NetworkMode != NetworkModeUser && req.NetworkMode != NetworkModeBridge:
+        http.Error(w, fmt.Sprintf("unsupported network_mode: %s", req.NetworkMode), http.StatusBadRequest)
+        return
+    case len(req.NICs) > 0 && req.NICs[0].Type != req.NetworkMode:
+        http.Error(w, "network_mode must match the type of the first NIC", http.StatusBadRequest)
+        return
+    case len(req.NICs) == 0:
+        // Same checks as an explicit NIC, e.g. that the host bridge exists
+        if err := m.validateNICs([]NICConfig{{Type: req.NetworkMode}}); err != nil {
+            http.Error(w, err.Error(), http.StatusBadRequest)
+            return
+        }
+    }
+    if len(req.PortForwards) > 0 {
+        if req.NetworkMode != NetworkModeUser {
+            http.Error(w, "port_forwards need user networking, bridged guests are reachable directly", http.StatusBadRequest)
+            return
+        }
+        if len(req.PortForwards) > MAX_PORT_FORWARDS {
+            http.Error(w, fmt.Sprintf("at most %d port_forwards are allowed", MAX_PORT_FORWARDS), http.StatusBadRequest)
+            return
+        }
+        // NIC forwards were checked already, so this also catches a port
+        // listed in both
+        hostPorts := make(map[string]bool)
+        for _, nic := range req.NICs {
+            for _, fwd := range nic.Forwards {
+                hostPorts[fmt.Sprintf("%s/%d", fwd.Protocol, fwd.HostPort)] = true
+            }
+        }
+        if err := validatePortForwards(req.PortForwards, hostPorts); err != nil {
+            http.Error(w, "port_forwards: "+err.Error(), http.StatusBadRequest)
+            return
+        }
+    }
+    // 10.0.2.2 is the host only from behind user-mode NAT
+    if req.NetworkMode == NetworkModeBridge && m.cloudInitSeed == CloudInitSeedSMBIOS && os.Getenv("BLST_SEED_URL") == "" {
+        http.Error(w, "bridged networking needs BLST_SEED_URL set for smbios seeding", http.StatusBadRequest)
+        return
+    }
 
-# Install required packages
-packages:
-%s
+    sshKeys, err := validateSSHAuthorizedKeys(req.SSHAuthorizedKeys)
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusBadRequest)
+        return
+    }
+    // Turning off passwords without a key would lock root out of SSH
+    if req.DisablePasswordAuth && len(sshKeys) == 0 {
+        http.Error(w, "disable_password_auth requires at least one ssh_authorized_keys entry", http.StatusBadRequest)
+        return
+    }
 
-# Run commands
-runcmd:
-  - sed -i 's/#PermitRootLogin.*/PermitRootLogin yes/' /etc/ssh/sshd_config
-  - systemctl restart ssh || systemctl restart sshd
-%s
-`, rootPassword, hostname, formatPackageList(packages), formatCommandList(allCommands)))
+    if req.Network != nil {
+        if err := validateNetworkConfig(req.Network); err != nil {
+            http.Error(w, err.Error(), http.StatusBadRequest)
+            return
+        }
+        // User-mode NAT always hands out 10.0.2.x over DHCP
+        if req.NetworkMode != NetworkModeBridge {
+            http.Error(w, "static network config is only supported with bridged networking", http.StatusBadRequest)
+            return
+        }
+    }
 
-    if err := os.WriteFile(filepath.Join(tmpDir, "user-data"), userData.Bytes(), 0644); err != nil {
+    vps, err := m.CreateVPS(req.Name, req.Hostname, req.ImageType, req.Template, CreateVPSOptions{
+        Owner:      owner,
+        ImageURL:   req.ImageURL,
+        OSFamily:   req.OSFamily,
+        Proxy:      proxy,
+        Network:    req.Network,
+        NICs:       req.NICs,
+        NetworkMode: req.NetworkMode,
+        PortForwards: req.PortForwards,
+        TemplateVars: req.TemplateVars,
+        DiskFormat: req.DiskFormat,
+        EncryptDisk: req.EncryptDisk,
+        CacheMode:  req.CacheMode,
+        MemoryMB:   req.MemoryMB,
+        VCPUs:      req.VCPUs,
+        DiskGB:     req.DiskGB,
+        DisableMetrics: req.DisableMetrics,
+        CPUModel:   req.CPUModel,
+        CPUFlags:   req.CPUFlags,
+        CloudInitDatasource: req.CloudInitDatasource,
+        CloudInitLabel: req.CloudInitLabel,
+        SSHAuthorizedKeys: sshKeys,
+        DisablePasswordAuth: req.DisablePasswordAuth,
+        ClientIP:   clientIP,
+        MaxVPSes:   caller.MaxVPSes,
+    })
+    if errors.Is(err, errIPLimitReached) || errors.Is(err, errHostPortInUse) {
+        http.Error(w, err.Error(), http.StatusConflict)
+        return
+    } else if errors.Is(err, errQuotaReached) {
+        http.Error(w, err.Error(), http.StatusTooManyRequests)
+        return
+    } else if errors.Is(err, errPortsExhausted) {
+        http.Error(w, err.Error(), http.StatusServiceUnavailable)
+        return
+    } else if err != nil {
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+    createdID, createdPassword = vps.ID, vps.Password
+
+    writeJSON(w, http.StatusOK, vps)
+}
+
+func (m *VPSManager) handleListVPS(w http.ResponseWriter, r *http.Request) {
+    if !allowMethods(w, r, http.MethodGet, http.MethodHead) {
+        return
+    }
+
+    m.validateInstances()
+    vpsList := m.ListVPS()
+
+    // Admins see every owner's instances, optionally narrowed with ?owner=
+    caller := identityFromRequest(r)
+    owner := r.URL.Query().Get("owner")
+    if !caller.Admin() {
+        owner = caller.Owner
+    }
+    if owner != "" {
+        owned := make([]*VPS, 0, len(vpsList))
+        for _, vps := range vpsList {
+            if vps.Owner == owner {
+                owned = append(owned, vps)
+            }
+        }
+        vpsList = owned
+    }
+
+    m.mutex.RLock()
+    defer m.mutex.RUnlock()
+    writeJSONWithETag(w, r, vpsList)
+}
+
+func (m *VPSManager) handleGetVPS(w http.ResponseWriter, r *http.Request) {
+    if !allowMethods(w, r, http.MethodGet, http.MethodHead) {
+        return
+    }
+
+    id, ok := m.vpsIDFromRequest(w, r)
+    if !ok {
+        return
+    }
+    vps, err := m.GetVPS(id)
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusNotFound)
+        return
+    }
+
+    m.mutex.RLock()
+    remaining := int64(time.Until(vps.ExpiresAt).Seconds())
+    m.mutex.RUnlock()
+    if remaining < 0 {
+        remaining = 0
+    }
+
+    // Admins also get the last launch command for debugging boot problems
+    var qemuCommand *QEMUCommand
+    if identityFromRequest(r).Admin() {
+        if data, err := os.ReadFile(filepath.Join(m.baseDir, "disks", id, "qemu-cmd.json")); err == nil {
+            qemuCommand = &QEMUCommand{}
+            if err := json.Unmarshal(data, qemuCommand); err != nil {
+                qemuCommand = nil
+            }
+        }
+    }
+
+    writeJSON(w, http.StatusOK, struct {
+        *VPS
+        SecondsUntilExpiry int64 `json:"seconds_until_expiry"`
+        QEMUCommand *QEMUCommand `json:"qemu_command,omitempty"`
+    }{vps, remaining, qemuCommand})
+}
+
+func (m *VPSManager) handleDeleteVPS(w http.ResponseWriter, r *http.Request) {
+    if !allowMethods(w, r, http.MethodDelete) {
+        return
+    }
+
+    id, ok := m.vpsIDFromRequest(w, r)
+    if !ok {
+        return
+    }
+    if err := m.DeleteVPS(id); err != nil {
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+
+    w.WriteHeader(http.StatusOK)
+}
+
+type VPSStats struct {
+    Total      int            `json:"total"`
+    ByStatus   map[string]int `json:"by_status"`
+    ByImage    map[string]int `json:"by_image"`
+    ByTemplate map[string]int `json:"by_template"`
+    // Resources held by every instance that hasn't failed
+    CommittedMemoryMB int `json:"committed_memory_mb"`
+    CommittedVCPUs    int `json:"committed_vcpus"`
+    CommittedDiskGB   int `json:"committed_disk_gb"`
+}
+
+func (m *VPSManager) handleVPSStats(w http.ResponseWriter, r *http.Request) {
+    if !allowMethods(w, r, http.MethodGet, http.MethodHead) {
+        return
+    }
+
+    stats := VPSStats{
+        // Always report the common states, even at zero
+        ByStatus:   map[string]int{"running": 0, "stopped": 0, "creating": 0, "failed": 0},
+        ByImage:    make(map[string]int),
+        ByTemplate: make(map[string]int),
+    }
+
+    caller := identityFromRequest(r)
+    m.mutex.RLock()
+    for _, vps := range m.instances {
+        if !caller.canAccess(vps) {
+            continue
+        }
+        stats.Total++
+        stats.ByStatus[vps.Status]++
+        stats.ByImage[vps.ImageType]++
+        stats.ByTemplate[vps.Template]++
+        if vps.Status != "failed" {
+            stats.CommittedMemoryMB += vps.MemoryMB
+            stats.CommittedVCPUs += vps.VCPUs
+            stats.CommittedDiskGB += vps.DiskGB
+        }
+    }
+    m.mutex.RUnlock()
+
+    writeJSON(w, http.StatusOK, stats)
+}
+
+func (m *VPSManager) handleListImages(w http.ResponseWriter, r *http.Request) {
+    if !allowMethods(w, r, http.MethodGet, http.MethodHead) {
+        return
+    }
+
+    images := make([]string, 0, len(SUPPORTED_IMAGES))
+    for imageType := range SUPPORTED_IMAGES {
+        images = append(images, imageType)
+    }
+
+    writeJSON(w, http.StatusOK, images)
+}
+
+var (
+    errImageNotPrepared = errors.New("base image is not prepared")
+    errImageInUse       = errors.New("base image is in use")
+)
+
+// Helper function to read the backing file of a disk image. -U lets it
+// inspect overlays that a running QEMU holds locked.
+func backingFile(imagePath string) (string, error) {
+    output, err := exec.Command("qemu-img", "info", "-U", "--output=json", imagePath).Output()
+    if err != nil {
+        return "", fmt.Errorf("failed to inspect %s: %v", imagePath, err)
+    }
+
+    var info struct {
+        BackingFilename     string `json:"backing-filename"`
+        FullBackingFilename string `json:"full-backing-filename"`
+    }
+    if err := json.Unmarshal(output, &info); err != nil {
+        return "", fmt.Errorf("failed to parse qemu-img info for %s: %v", imagePath, err)
+    }
+    if info.FullBackingFilename != "" {
+        return info.FullBackingFilename, nil
+    }
+    return info.BackingFilename, nil
+}
+
+var errBrokenBackingChain = errors.New("broken backing chain")
+
+// Helper function to make sure a qcow2 overlay's backing file still exists
+func checkBackingChain(vps *VPS) error {
+    if vps.DiskFormat == DiskFormatRaw || vps.ImagePath == "" {
+        return nil
+    }
+    backing, err := backingFile(vps.ImagePath)
+    if err != nil {
         return err
     }
+    if backing == "" {
+        return nil
+    }
+    if _, err := os.Stat(backing); err != nil {
+        return fmt.Errorf("%w: backing file %s of %s is missing, repair with /api/vps/repair-disk", errBrokenBackingChain, backing, vps.ImagePath)
+    }
+    return nil
+}
+
+// Point a stopped VPS's overlay at the current base image for its image type,
+// preparing the image first if needed. This is an unsafe rebase: it only
+// rewrites the header, so it is correct when the base was re-downloaded from
+// the same source, not when the image itself changed. Preparing the base can
+// mean a full download, so the repair runs in the background with status
+// repairing and sets alert if it fails.
+func (m *VPSManager) RepairDisk(id string) error {
+    m.mutex.Lock()
+    defer m.mutex.Unlock()
+
+    vps, exists := m.instances[id]
+    if !exists {
+        return errVPSNotFound
+    }
+    if m.ctx.Err() != nil {
+        return fmt.Errorf("server is shutting down")
+    }
+    if vps.Status != StatusStopped {
+        return fmt.Errorf("VPS must be stopped to repair its disk, current status: %s", vps.Status)
+    }
+    if vps.DiskFormat == DiskFormatRaw {
+        return fmt.Errorf("raw disks have no backing file")
+    }
 
-    metaData := fmt.Sprintf("instance-id: %s\nlocal-hostname: %s\n", uuid.New().String(), hostname)
-    if err := os.WriteFile(filepath.Join(tmpDir, "meta-data"), []byte(metaData), 0644); err != nil {
-        return err
-    }
+    imageType, imageURL, imagePath, encrypted := vps.ImageType, vps.ImageURL, vps.ImagePath, vps.Encrypted
+    m.setStatus(vps, StatusRepairing)
 
-    cmd := exec.Command("genisoimage", "-output", path, "-volid", "cidata", "-joliet", "-rock",
-        filepath.Join(tmpDir, "user-data"), filepath.Join(tmpDir, "meta-data"))
-    
-    if output, err := cmd.CombinedOutput(); err != nil {
-        return fmt.Errorf("failed to create ISO: %v, output: %s", err, string(output))
-    }
+    m.workers.Add(1)
+    go func() {
+        defer m.workers.Done()
+        basePath, err := m.repairDisk(id, imageType, imageURL, imagePath, encrypted)
+
+        m.mutex.Lock()
+        if err != nil {
+            log.Printf("Failed to repair disk of VPS %s: %v", id, err)
+            vps.Alert = fmt.Sprintf("disk repair failed: %v", err)
+        } else {
+            if strings.HasPrefix(vps.Alert, errBrokenBackingChain.Error()) || strings.HasPrefix(vps.Alert, "disk repair failed") {
+                vps.Alert = ""
+            }
+            log.Printf("Rebased disk of VPS %s onto %s", id, basePath)
+        }
+        m.setStatus(vps, StatusStopped)
+        m.mutex.Unlock()
+    }()
 
     return nil
 }
 
-// Helper function to format command list for cloud-init
-func formatCommandList(commands []string) string {
-    var formatted strings.Builder
-    for _, cmd := range commands {
-        formatted.WriteString(fmt.Sprintf("  - %s\n", cmd))
+// Helper function to prepare the base image and rebase the overlay onto it
+func (m *VPSManager) repairDisk(id, imageType, imageURL, imagePath string, encrypted bool) (string, error) {
+    if err := m.ensureBaseImage(m.ctx, imageType, imageURL, func(done, total int64) {}); err != nil {
+        return "", fmt.Errorf("failed to prepare %s base image: %v", imageType, err)
     }
-    return formatted.String()
-}
+    basePath := getBaseImagePath(imageType)
 
-// Helper function to format package list for cloud-init
-func formatPackageList(packages []string) string {
-    var formatted strings.Builder
-    for _, pkg := range packages {
-        formatted.WriteString(fmt.Sprintf("  - %s\n", pkg))
+    args := append([]string{"rebase", "-u", "-F", "qcow2", "-b", basePath}, m.qcow2ImageArgs(id, imagePath, encrypted)...)
+    if output, err := exec.CommandContext(m.ctx, "qemu-img", args...).CombinedOutput(); err != nil {
+        return "", fmt.Errorf("failed to rebase disk: %v, output: %s", err, string(output))
     }
-    return formatted.String()
+    return basePath, nil
 }
 
-// Helper function to determine OS family
-func getOSFamily(imageType string) string {
-    switch {
-    case strings.HasPrefix(imageType, "ubuntu"):
-        return "ubuntu"
-    case strings.HasPrefix(imageType, "debian"):
-        return "debian"
-    case strings.HasPrefix(imageType, "fedora"):
-        return "fedora"
-    case strings.HasPrefix(imageType, "rocky"):
-        return "rocky"
-    case strings.HasPrefix(imageType, "almalinux"):
-        return "almalinux"
-    case strings.HasPrefix(imageType, "centos"):
-        return "centos"
-    default:
-        return ""
+// Helper function to name a VPS's qcow2 disk on a qemu-img command line,
+// passing the key secret for encrypted overlays
+func (m *VPSManager) qcow2ImageArgs(id string, imagePath string, encrypted bool) []string {
+    if encrypted {
+        return []string{
+            "--object", diskSecretObject(m.diskKeyPath(id)),
+            "--image-opts", fmt.Sprintf("driver=qcow2,file.filename=%s,encrypt.key-secret=%s", imagePath, DISK_SECRET_ID),
+        }
     }
+    return []string{"-f", "qcow2", imagePath}
 }
 
-// Add validation for template and OS compatibility
-func validateTemplateAndOS(template string, imageType string) error {
-    templateConfig, exists := SUPPORTED_TEMPLATES[template]
-    if !exists {
-        return fmt.Errorf("unsupported template: %s", template)
+func (m *VPSManager) handleRepairDisk(w http.ResponseWriter, r *http.Request) {
+    if !allowMethods(w, r, http.MethodPost) {
+        return
     }
 
-    if len(templateConfig.OSVariants) > 0 {
-        supported := false
-        for _, variant := range templateConfig.OSVariants {
-            if variant == imageType {
-                supported = true
-                break
-            }
-        }
-        if !supported {
-            return fmt.Errorf("template %s does not support OS %s", template, imageType)
+    id, ok := m.vpsIDFromRequest(w, r)
+    if !ok {
+        return
+    }
+
+    if err := m.RepairDisk(id); err != nil {
+        status := http.StatusConflict
+        if errors.Is(err, errVPSNotFound) {
+            status = http.StatusNotFound
         }
+        http.Error(w, err.Error(), status)
+        return
     }
 
-    return nil
+    w.WriteHeader(http.StatusAccepted)
 }
 
-// Modify the HTTP handler for listing templates to include OS compatibility
-func (m *VPSManager) handleListTemplates(w http.ResponseWriter, r *http.Request) {
-    if r.Method != http.MethodGet {
-        http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
-        return
-    }
+var storageNamePattern = regexp.MustCompile(`^[A-Za-z0-9_-]{1,32}$`)
 
-    // Get OS filter from query parameter
-    osType := r.URL.Query().Get("os")
+// An internal qcow2 snapshot
+type Snapshot struct {
+    ID          string    `json:"id"`
+    Name        string    `json:"name"`
+    VMStateSize int64     `json:"vm_state_size"` // Saved guest RAM, 0 for disk-only snapshots
+    CreatedAt   time.Time `json:"created_at"`
+}
 
-    templates := make([]struct {
-        VPSTemplate
-        Compatible bool `json:"compatible"`
-    }, 0, len(SUPPORTED_TEMPLATES))
+var snapshotNamePattern = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
 
-    for _, template := range SUPPORTED_TEMPLATES {
-        compatible := true
-        if osType != "" {
-            compatible = false
-            for _, variant := range template.OSVariants {
-                if variant == osType {
-                    compatible = true
-                    break
-                }
-            }
-        }
+var (
+    errInvalidSnapshotName = errors.New("invalid snapshot name")
+    errSnapshotNotFound    = errors.New("snapshot not found")
+    errSnapshotExists      = errors.New("snapshot already exists")
+    errSnapshotUnsupported = errors.New("snapshots need a qcow2 disk")
+)
 
-        templates = append(templates, struct {
-            VPSTemplate
-            Compatible bool `json:"compatible"`
-        }{
-            VPSTemplate: template,
-            Compatible: compatible,
-        })
-    }
+// Helper function to get a VPS's qcow2 disk for listing its snapshots
+func (m *VPSManager) snapshotDisk(id string) (imagePath string, err error) {
+    m.mutex.RLock()
+    defer m.mutex.RUnlock()
 
-    w.Header().Set("Content-Type", "application/json")
-    json.NewEncoder(w).Encode(templates)
+    vps, exists := m.instances[id]
+    if !exists {
+        return "", errVPSNotFound
+    }
+    if vps.DiskFormat != DiskFormatQCOW2 || vps.ImagePath == "" {
+        return "", errSnapshotUnsupported
+    }
+    return vps.ImagePath, nil
 }
 
-func startWebsockifyProxy(vncPort int) error {
-    wsPort := vncPort + 1000
-
-    killCmd := exec.Command("pkill", "-f", fmt.Sprintf("websockify.*:%d", wsPort))
-    killCmd.Run()
+// Helper function to claim a stopped VPS's qcow2 disk for a snapshot create or
+// restore. The VPS is snapshotting until release is called, so it can't be
+// started while qemu-img has the disk open.
+func (m *VPSManager) claimSnapshotDisk(id string) (imagePath string, encrypted bool, release func(), err error) {
+    m.mutex.Lock()
+    defer m.mutex.Unlock()
 
-    time.Sleep(time.Second)
+    vps, exists := m.instances[id]
+    if !exists {
+        return "", false, nil, errVPSNotFound
+    }
+    if vps.DiskFormat != DiskFormatQCOW2 || vps.ImagePath == "" {
+        return "", false, nil, errSnapshotUnsupported
+    }
+    if vps.Status != StatusStopped {
+        return "", false, nil, fmt.Errorf("%w, VPS must be stopped, current status: %s", errVPSBusy, vps.Status)
+    }
+    m.setStatus(vps, StatusSnapshotting)
+    release = func() {
+        m.mutex.Lock()
+        m.setStatus(vps, StatusStopped)
+        m.mutex.Unlock()
+    }
+    return vps.ImagePath, vps.Encrypted, release, nil
+}
 
-    logFile, err := os.Create(fmt.Sprintf("/tmp/websockify_%d.log", wsPort))
+// Take an internal snapshot of a stopped VPS's disk
+func (m *VPSManager) CreateSnapshot(id string, name string) error {
+    if !snapshotNamePattern.MatchString(name) {
+        return fmt.Errorf("%w: %q", errInvalidSnapshotName, name)
+    }
+    imagePath, encrypted, release, err := m.claimSnapshotDisk(id)
     if err != nil {
-        return fmt.Errorf("failed to create websockify log file: %v", err)
+        return err
     }
-    defer logFile.Close()
-
-    cmd := exec.Command("websockify",
-        "--verbose",
-        fmt.Sprintf("%d", wsPort),
-        fmt.Sprintf("localhost:%d", vncPort),
-        "--web", "/usr/share/novnc",
-    )
-    
-    cmd.Stdout = logFile
-    cmd.Stderr = logFile
+    defer release()
 
-    if err := cmd.Start(); err != nil {
-        return fmt.Errorf("failed to start websockify: %v", err)
+    snapshots, err := readSnapshots(imagePath)
+    if err != nil {
+        return err
     }
-
-    go func() {
-        if err := cmd.Wait(); err != nil {
-            log.Printf("Websockify process ended: %v", err)
+    for _, snapshot := range snapshots {
+        if snapshot.Name == name {
+            return fmt.Errorf("%w: %s", errSnapshotExists, name)
         }
-    }()
+    }
+
+    args := append([]string{"snapshot", "-c", name}, m.qcow2ImageArgs(id, imagePath, encrypted)...)
+    if output, err := exec.Command("qemu-img", args...).CombinedOutput(); err != nil {
+        return fmt.Errorf("failed to create snapshot: %v, output: %s", err, string(output))
+    }
+    log.Printf("Created snapshot %s of VPS %s", name, id)
+    return nil
+}
 
-    time.Sleep(2 * time.Second)
+// Roll a stopped VPS's disk back to a snapshot
+func (m *VPSManager) RestoreSnapshot(id string, name string) error {
+    if !snapshotNamePattern.MatchString(name) {
+        return fmt.Errorf("%w: %q", errInvalidSnapshotName, name)
+    }
+    imagePath, encrypted, release, err := m.claimSnapshotDisk(id)
+    if err != nil {
+        return err
+    }
+    defer release()
 
-    checkCmd := exec.Command("pgrep", "-f", fmt.Sprintf("websockify.*:%d", wsPort))
-    if err := checkCmd.Run(); err != nil {
-        logContent, _ := os.ReadFile(fmt.Sprintf("/tmp/websockify_%d.log", wsPort))
-        return fmt.Errorf("websockify failed to start: %v, logs: %s", err, string(logContent))
+    snapshots, err := readSnapshots(imagePath)
+    if err != nil {
+        return err
+    }
+    if !slices.ContainsFunc(snapshots, func(snapshot Snapshot) bool { return snapshot.Name == name }) {
+        return fmt.Errorf("%w: %s", errSnapshotNotFound, name)
     }
 
+    args := append([]string{"snapshot", "-a", name}, m.qcow2ImageArgs(id, imagePath, encrypted)...)
+    if output, err := exec.Command("qemu-img", args...).CombinedOutput(); err != nil {
+        return fmt.Errorf("failed to restore snapshot: %v, output: %s", err, string(output))
+    }
+    log.Printf("Restored VPS %s to snapshot %s", id, name)
     return nil
 }
 
-func stopWebsockifyProxy(vncPort int) error {
-    wsPort := vncPort + 1000
-    cmd := exec.Command("pkill", "-f", fmt.Sprintf("websockify.*:%d", wsPort))
-    if err := cmd.Run(); err != nil {
-        return fmt.Errorf("failed to stop websockify: %v", err)
+// List a VPS's snapshots. Works while the VPS runs.
+func (m *VPSManager) ListSnapshots(id string) ([]Snapshot, error) {
+    imagePath, err := m.snapshotDisk(id)
+    if err != nil {
+        return nil, err
     }
-    return nil
+    return readSnapshots(imagePath)
 }
 
-func (m *VPSManager) CreateVPS(name string, hostname string, imageType string, template string) (*VPS, error) {
-    m.mutex.Lock()
-    defer m.mutex.Unlock()
+// Helper function to read a qcow2 image's snapshot table from qemu-img info's
+// JSON rather than the columns of snapshot -l
+func readSnapshots(imagePath string) ([]Snapshot, error) {
+    output, err := exec.Command("qemu-img", "info", "-U", "--output=json", imagePath).Output()
+    if err != nil {
+        return nil, fmt.Errorf("failed to inspect %s: %v", imagePath, err)
+    }
+    var info struct {
+        Snapshots []struct {
+            ID          string `json:"id"`
+            Name        string `json:"name"`
+            VMStateSize int64  `json:"vm-state-size"`
+            DateSec     int64  `json:"date-sec"`
+            DateNsec    int64  `json:"date-nsec"`
+        } `json:"snapshots"`
+    }
+    if err := json.Unmarshal(output, &info); err != nil {
+        return nil, fmt.Errorf("failed to parse qemu-img info for %s: %v", imagePath, err)
+    }
+
+    snapshots := make([]Snapshot, 0, len(info.Snapshots))
+    for _, snapshot := range info.Snapshots {
+        snapshots = append(snapshots, Snapshot{
+            ID:          snapshot.ID,
+            Name:        snapshot.Name,
+            VMStateSize: snapshot.VMStateSize,
+            CreatedAt:   time.Unix(snapshot.DateSec, snapshot.DateNsec),
+        })
+    }
+    return snapshots, nil
+}
 
-    log.Printf("Starting VPS creation process for: %s with image: %s, template: %s and hostname: %s", 
-        name, imageType, template, hostname)
+// Helper function to map snapshot errors onto HTTP statuses
+func snapshotErrorStatus(err error) int {
+    switch {
+    case errors.Is(err, errVPSNotFound), errors.Is(err, errSnapshotNotFound):
+        return http.StatusNotFound
+    case errors.Is(err, errInvalidSnapshotName):
+        return http.StatusBadRequest
+    case errors.Is(err, errVPSBusy), errors.Is(err, errSnapshotExists), errors.Is(err, errSnapshotUnsupported):
+        return http.StatusConflict
+    default:
+        return http.StatusInternalServerError
+    }
+}
 
-    // Initialize VPS with template
-    vps := &VPS{
-        ID:          uuid.New().String(),
-        Name:        name,
-        Hostname:    hostname,
-        Status:      "creating",
-        ImageType:   imageType,
-        Template:    template,  // Add template to VPS struct
-        VNCPort:     m.nextVNCPort,
-        SSHPort:     m.nextSSHPort,
-        CreatedAt:   time.Now(),
-        ExpiresAt:   time.Now().Add(VPS_LIFETIME),
-        Stage:       StageInitializing,
-        Progress:    0,
+func (m *VPSManager) handleSnapshot(w http.ResponseWriter, r *http.Request) {
+    action := strings.TrimPrefix(r.URL.Path, "/api/vps/snapshot/")
+    method := http.MethodPost
+    if action == "list" {
+        method = http.MethodGet
+    }
+    if !allowMethods(w, r, method) {
+        return
     }
-    m.nextVNCPort++
-    m.nextSSHPort++
-    
-    // Store the instance immediately so progress can be tracked
-    m.instances[vps.ID] = vps
 
-    // Run creation in a goroutine to allow progress tracking
-    go func() {
-        if err := m.createVPSWithProgress(vps); err != nil {
-            m.mutex.Lock()
-            vps.Status = "failed"
-            vps.Stage = StageFailed
-            vps.ErrorMsg = err.Error()
-            m.mutex.Unlock()
-            log.Printf("Failed to create VPS %s: %v", vps.ID, err)
+    id, ok := m.vpsIDFromRequest(w, r)
+    if !ok {
+        return
+    }
+
+    if action == "list" {
+        snapshots, err := m.ListSnapshots(id)
+        if err != nil {
+            http.Error(w, err.Error(), snapshotErrorStatus(err))
             return
         }
-    }()
+        writeJSON(w, http.StatusOK, snapshots)
+        return
+    }
 
-    return vps, nil
-}
+    var req struct {
+        Name string `json:"name"`
+    }
+    if !decodeJSONBody(w, r, &req) {
+        return
+    }
 
-func (m *VPSManager) createVPSWithProgress(vps *VPS) error {
-    updateProgress := func(stage string, progress int) {
-        m.mutex.Lock()
-        vps.Stage = stage
-        vps.Progress = progress
-        m.mutex.Unlock()
+    var err error
+    switch action {
+    case "create":
+        err = m.CreateSnapshot(id, req.Name)
+    case "restore":
+        err = m.RestoreSnapshot(id, req.Name)
+    default:
+        http.NotFound(w, r)
+        return
+    }
+    if err != nil {
+        http.Error(w, err.Error(), snapshotErrorStatus(err))
+        return
     }
 
-    // Validate image type
-    updateProgress(StageInitializing, 10)
-    if _, exists := SUPPORTED_IMAGES[vps.ImageType]; !exists {
-        return fmt.Errorf("unsupported image type: %s", vps.ImageType)
+    w.WriteHeader(http.StatusOK)
+}
+
+// Parse BLST_STORAGE_PATHS, a comma-separated list of name=/abs/path disk
+// storage locations. "default" is always baseDir/disks.
+func loadStoragePaths(baseDir string) (map[string]string, error) {
+    paths := map[string]string{DEFAULT_STORAGE: filepath.Join(baseDir, "disks")}
+    for _, entry := range strings.Split(os.Getenv("BLST_STORAGE_PATHS"), ",") {
+        entry = strings.TrimSpace(entry)
+        if entry == "" {
+            continue
+        }
+        name, path, ok := strings.Cut(entry, "=")
+        if !ok || !storageNamePattern.MatchString(name) || !filepath.IsAbs(path) {
+            return nil, fmt.Errorf("invalid BLST_STORAGE_PATHS entry %q, expected name=/absolute/path", entry)
+        }
+        if _, exists := paths[name]; exists {
+            return nil, fmt.Errorf("duplicate storage location in BLST_STORAGE_PATHS: %s", name)
+        }
+        if err := os.MkdirAll(path, 0755); err != nil {
+            return nil, fmt.Errorf("failed to create storage location %s: %v", path, err)
+        }
+        paths[name] = filepath.Clean(path)
+        log.Printf("Storage location %s: %s", name, path)
     }
+    return paths, nil
+}
 
-    // Validate hostname
-    if !isValidHostname(vps.Hostname) {
-        return fmt.Errorf("invalid hostname format: %s", vps.Hostname)
+// Helper function to get how much space a file actually takes up on disk
+func allocatedSize(path string) (int64, error) {
+    var stat syscall.Stat_t
+    if err := syscall.Stat(path, &stat); err != nil {
+        return 0, err
     }
+    return stat.Blocks * 512, nil
+}
 
-    // Check/prepare base image
-    updateProgress(StageInitializing, 20)
-    baseImagePath := getBaseImagePath(vps.ImageType)
-    if _, err := os.Stat(baseImagePath); os.IsNotExist(err) {
-        if err := downloadAndPrepareBaseImage(vps.ImageType); err != nil {
-            return fmt.Errorf("failed to prepare base image: %v", err)
-        }
+// Relocate a VPS's disk to another storage location. A running guest is
+// powered off first and started again afterwards, whether or not the move
+// worked. Within one filesystem the disk is renamed; otherwise it's copied
+// with qemu-img convert keeping its backing file, or flattened into a
+// standalone image when flatten is set so it no longer depends on the base
+// image's storage. Runs in the background; watch the status to follow it.
+func (m *VPSManager) MoveDisk(id string, storage string, flatten bool) (*VPS, error) {
+    root, exists := m.storagePaths[storage]
+    if !exists {
+        return nil, fmt.Errorf("unknown storage location: %s", storage)
     }
 
-    // Generate password
-    password, err := generatePassword()
-    if err != nil {
-        return fmt.Errorf("failed to generate password: %v", err)
+    m.mutex.Lock()
+    defer m.mutex.Unlock()
+
+    vps, exists := m.instances[id]
+    if !exists {
+        return nil, errVPSNotFound
+    }
+    if m.ctx.Err() != nil {
+        return nil, fmt.Errorf("server is shutting down")
+    }
+    if vps.Status != StatusRunning && vps.Status != StatusStopped {
+        return nil, fmt.Errorf("VPS must be running or stopped to move its disk, current status: %s", vps.Status)
+    }
+    if vps.ImagePath == "" {
+        return nil, fmt.Errorf("VPS has no disk")
+    }
+    if flatten && vps.DiskFormat == DiskFormatRaw {
+        return nil, fmt.Errorf("raw disks have no backing file to flatten")
     }
-    vps.Password = password
 
-    // Create instance directory
-    instanceDir := filepath.Join(m.baseDir, "disks", vps.ID)
-    if err := os.MkdirAll(instanceDir, 0755); err != nil {
-        return fmt.Errorf("failed to create instance directory: %v", err)
+    targetDir := filepath.Join(root, vps.ID)
+    if storage == DEFAULT_STORAGE {
+        targetDir = filepath.Join(m.baseDir, "disks", vps.ID)
+    }
+    if targetDir == filepath.Dir(vps.ImagePath) && !flatten {
+        return nil, fmt.Errorf("disk is already on storage location %s", storage)
     }
 
-    // Create disk image
-    updateProgress(StageCreatingDisk, 40)
-    vps.ImagePath = filepath.Join(instanceDir, "disk.qcow2")
-    createDisk := exec.Command("qemu-img", "create",
-        "-f", "qcow2",
-        "-F", "qcow2",
-        "-b", baseImagePath,
-        vps.ImagePath)
-    
-    if output, err := createDisk.CombinedOutput(); err != nil {
-        return fmt.Errorf("failed to create disk: %v, output: %s", err, string(output))
+    wasRunning := vps.Status == StatusRunning
+    pid := vps.QEMUPid
+    m.setStatus(vps, StatusMoving)
+
+    m.workers.Add(1)
+    go func() {
+        defer m.workers.Done()
+        err := m.moveDisk(vps, pid, targetDir, flatten)
+
+        m.mutex.Lock()
+        if err != nil {
+            log.Printf("Failed to move disk of VPS %s: %v", id, err)
+            vps.Alert = fmt.Sprintf("disk move failed: %v", err)
+        } else {
+            if storage == DEFAULT_STORAGE {
+                vps.Storage = ""
+            } else {
+                vps.Storage = storage
+            }
+            if flatten {
+                vps.StandaloneDisk = true
+            }
+            log.Printf("Moved disk of VPS %s to %s", id, vps.ImagePath)
+        }
+        m.setStatus(vps, StatusStopped)
+        vps.RunState = ""
+        m.mutex.Unlock()
+
+        if wasRunning {
+            if err := m.StartVPS(id); err != nil {
+                log.Printf("Warning: Failed to start VPS %s after moving its disk: %v", id, err)
+            }
+        }
+    }()
+
+    return vps, nil
+}
+
+// Ask a guest to power off so its disk can be copied or replaced, killing
+// QEMU if it hasn't gone after REBOOT_SHUTDOWN_TIMEOUT
+func (m *VPSManager) powerOffForDiskCopy(id string, pid int) {
+    if pid <= 0 || checkProcess(pid) != nil {
+        return
+    }
+    monitorSocket := filepath.Join(m.baseDir, "disks", id, "qemu-monitor.sock")
+    output, err := m.executeQMPCommand(monitorSocket, `{ "execute": "system_powerdown" }`)
+    if err == nil {
+        err = parseQMPReturn(output, nil)
+    }
+    if err != nil {
+        log.Printf("Warning: Failed to request power-off of VPS %s: %v", id, err)
     }
 
-    // Create cloud-init ISO
-    updateProgress(StagePreparingCloudInit, 60)
-    cloudInitPath := filepath.Join(instanceDir, "cloud-init.iso")
-    if err := createCloudInitISO(cloudInitPath, vps.Password, vps.ImageType, vps.Hostname, vps.Template); err != nil {
-        return fmt.Errorf("failed to create cloud-init ISO: %v", err)
+    deadline := time.Now().Add(REBOOT_SHUTDOWN_TIMEOUT)
+    for checkProcess(pid) == nil {
+        if time.Now().After(deadline) {
+            log.Printf("Warning: VPS %s ignored the power-off request, killing QEMU", id)
+            if err := killQEMU(pid); err != nil {
+                log.Printf("Warning: %v, copying the disk of VPS %s anyway", err, id)
+            }
+            break
+        }
+        time.Sleep(time.Second)
     }
+}
 
-    // Start QEMU
-    updateProgress(StageStartingQEMU, 80)
-    pidFile := filepath.Join(instanceDir, "qemu.pid")
-    logFile := filepath.Join(m.baseDir, "logs", fmt.Sprintf("%s.log", vps.ID))
-    monitorSocket := filepath.Join(instanceDir, "qemu-monitor.sock")
+// Power off the guest if needed and copy or rename its disk into targetDir.
+// The old disk is only removed once the new one is in place.
+func (m *VPSManager) moveDisk(vps *VPS, pid int, targetDir string, flatten bool) error {
+    m.powerOffForDiskCopy(vps.ID, pid)
 
-    args := []string{
-        "-name", fmt.Sprintf("guest=%s,debug-threads=on", vps.Name),
-        "-machine", "pc,accel=kvm,usb=off,vmport=off",
-        "-cpu", "host",
-        "-m", fmt.Sprintf("%d", RAM_SIZE),
-        "-smp", "2,sockets=2,cores=1,threads=1",
-        "-drive", fmt.Sprintf("file=%s,format=qcow2", vps.ImagePath),
-        "-drive", fmt.Sprintf("file=%s,format=raw", cloudInitPath),
-        "-vnc", fmt.Sprintf("0.0.0.0:%d", vps.VNCPort-5900),
-        "-device", fmt.Sprintf("virtio-net-pci,netdev=net0,mac=%s", generateMacAddress(vps.ID)),
-        "-netdev", fmt.Sprintf(
-            "user,id=net0,hostfwd=tcp:0.0.0.0:%d-:22",
-            vps.SSHPort,
-        ),
-        "-qmp", fmt.Sprintf("unix:%s,server,nowait", monitorSocket),
-        "-pidfile", pidFile,
-        "-daemonize",
-        "-enable-kvm",
-    }
+    m.mutex.RLock()
+    oldPath, diskFormat, encrypted := vps.ImagePath, vps.DiskFormat, vps.Encrypted
+    m.mutex.RUnlock()
+    newPath := filepath.Join(targetDir, filepath.Base(oldPath))
 
+    if err := os.MkdirAll(targetDir, 0755); err != nil {
+        return fmt.Errorf("failed to create %s: %v", targetDir, err)
+    }
 
-    cmd := exec.Command("qemu-system-x86_64", args...)
-    
-    stdout, err := os.Create(logFile)
+    // A flattened copy can grow to include everything it read from the base
+    needed, err := allocatedSize(oldPath)
     if err != nil {
-        return fmt.Errorf("failed to create log file: %v", err)
+        return fmt.Errorf("failed to stat disk: %v", err)
     }
-    defer stdout.Close()
-    cmd.Stdout = stdout
-    cmd.Stderr = stdout
-
-    if err := cmd.Start(); err != nil {
-        return fmt.Errorf("failed to start QEMU: %v", err)
+    if flatten {
+        if baseSize, err := allocatedSize(getBaseImagePath(vps.ImageType)); err == nil {
+            needed += baseSize
+        }
     }
 
-    // Wait for PID file
-    var pid int
-    timeout := time.After(30 * time.Second)
-    ticker := time.NewTicker(500 * time.Millisecond)
-    defer ticker.Stop()
+    renamed := false
+    if !flatten && newPath != oldPath {
+        err := os.Rename(oldPath, newPath)
+        if err == nil {
+            renamed = true
+        } else if !errors.Is(err, syscall.EXDEV) {
+            return fmt.Errorf("failed to move disk: %v", err)
+        }
+    }
 
-    for {
-        select {
-        case <-timeout:
-            logs, _ := os.ReadFile(logFile)
-            return fmt.Errorf("timeout waiting for QEMU to start. Logs: %s", string(logs))
-            
-        case <-ticker.C:
-            if pidBytes, err := os.ReadFile(pidFile); err == nil {
-                if _, err := fmt.Sscanf(string(pidBytes), "%d", &pid); err == nil {
-                    goto pidFound
-                }
+    if !renamed {
+        // qemu-img convert only copies the current state
+        if diskFormat == DiskFormatQCOW2 {
+            if snapshots, err := m.ListSnapshots(vps.ID); err == nil && len(snapshots) > 0 {
+                return fmt.Errorf("disk has %d snapshots, which can't be copied to another filesystem or flattened", len(snapshots))
             }
         }
-    }
 
-pidFound:
-    // Verify QEMU process
-    retries := 3
-    for i := 0; i < retries; i++ {
-        if err := checkProcess(pid); err == nil {
-            break
+        var stat syscall.Statfs_t
+        if err := syscall.Statfs(targetDir, &stat); err != nil {
+            return fmt.Errorf("failed to check free space in %s: %v", targetDir, err)
         }
-        if i == retries-1 {
-            logs, _ := os.ReadFile(logFile)
-            return fmt.Errorf("QEMU process verification failed after %d retries. Logs: %s", retries, string(logs))
+        if free := int64(stat.Bavail) * int64(stat.Bsize); free < needed {
+            return fmt.Errorf("not enough space in %s: %d bytes free, %d needed", targetDir, free, needed)
         }
-        time.Sleep(time.Second)
-    }
 
-    vps.QEMUPid = pid
+        tmpPath := newPath + ".tmp"
+        args := []string{"convert", "-O", diskFormat}
+        source := oldPath
+        if encrypted {
+            // The copy is encrypted with the same key
+            args = append(args,
+                "--object", diskSecretObject(m.diskKeyPath(vps.ID)),
+                "--image-opts",
+                "-o", "encrypt.format=luks,encrypt.key-secret="+DISK_SECRET_ID)
+            source = fmt.Sprintf("driver=qcow2,file.filename=%s,encrypt.key-secret=%s", oldPath, DISK_SECRET_ID)
+        } else {
+            args = append(args, "-f", diskFormat)
+        }
+        if diskFormat != DiskFormatRaw && !flatten {
+            // Keep the copy an overlay. A relative backing name would resolve
+            // against the new directory, so always record the absolute path.
+            backing, err := backingFile(oldPath)
+            if err != nil {
+                return err
+            }
+            if backing != "" {
+                if !filepath.IsAbs(backing) {
+                    backing = filepath.Join(filepath.Dir(oldPath), backing)
+                }
+                args = append(args, "-B", backing, "-F", "qcow2")
+            }
+        }
+        args = append(args, source, tmpPath)
 
-    // Configure VNC
-    updateProgress(StageConfigVNC, 90)
-    if err := startWebsockifyProxy(vps.VNCPort); err != nil {
-        log.Printf("Warning: Failed to start websockify proxy: %v", err)
+        cmd := exec.CommandContext(m.ctx, "qemu-img", args...)
+        if output, err := cmd.CombinedOutput(); err != nil {
+            os.Remove(tmpPath)
+            return fmt.Errorf("failed to copy disk: %v, output: %s", err, string(output))
+        }
+        if err := os.Rename(tmpPath, newPath); err != nil {
+            os.Remove(tmpPath)
+            return fmt.Errorf("failed to move disk into place: %v", err)
+        }
+        if newPath != oldPath {
+            if err := os.Remove(oldPath); err != nil {
+                log.Printf("Warning: Failed to remove old disk %s: %v", oldPath, err)
+            }
+        }
     }
 
-    // Complete
-    updateProgress(StageCompleted, 100)
     m.mutex.Lock()
-    vps.Status = "running"
+    vps.ImagePath = newPath
     m.mutex.Unlock()
 
-    // Schedule cleanup
-    go m.scheduleCleanup(vps)
-
+    // Leave the instance directory alone, it still holds the sockets and seed
+    if oldDir := filepath.Dir(oldPath); oldDir != filepath.Join(m.baseDir, "disks", vps.ID) && oldDir != targetDir {
+        os.Remove(oldDir)
+    }
     return nil
 }
 
-func isValidHostname(hostname string) bool {
-    if len(hostname) > 253 {
-        return false
+func (m *VPSManager) handleMoveDisk(w http.ResponseWriter, r *http.Request) {
+    if !allowMethods(w, r, http.MethodPost) {
+        return
     }
-    
-    parts := strings.Split(hostname, ".")
-    for _, part := range parts {
-        if len(part) > 63 {
-            return false
-        }
-        if !regexp.MustCompile(`^[a-zA-Z0-9]([a-zA-Z0-9-]*[a-zA-Z0-9])?$`).MatchString(part) {
-            return false
-        }
+    if !identityFromRequest(r).Admin() {
+        http.Error(w, "Admin API key required", http.StatusForbidden)
+        return
+    }
+
+    id, ok := m.vpsIDFromRequest(w, r)
+    if !ok {
+        return
+    }
+
+    var req struct {
+        Storage string `json:"storage"`
+        Flatten bool   `json:"flatten"`
+    }
+    if !decodeJSONBody(w, r, &req) {
+        return
+    }
+    if _, exists := m.storagePaths[req.Storage]; !exists {
+        http.Error(w, fmt.Sprintf("unknown storage location: %q", req.Storage), http.StatusBadRequest)
+        return
+    }
+
+    vps, err := m.MoveDisk(id, req.Storage, req.Flatten)
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusConflict)
+        return
     }
-    
-    return true
-}
 
+    writeJSON(w, http.StatusOK, vps)
+}
 
-func (m *VPSManager) StopVPS(id string) error {
+// Duplicate a VPS into a new one with its own ID, ports, MAC and root
+// password. A running source is powered off for the copy and started again
+// afterwards. The copy runs in the background; the clone shows up as
+// creating and is removed again if its disk can't be made. The clone counts
+// against maxVPSes for the source's owner, 0 means unlimited, and against
+// BLST_MAX_VPS_PER_IP for clientIP when that is set.
+func (m *VPSManager) CloneVPS(sourceID string, newName string, newHostname string, clientIP string, maxVPSes int) (*VPS, error) {
     m.mutex.Lock()
     defer m.mutex.Unlock()
 
-    vps, exists := m.instances[id]
+    source, exists := m.instances[sourceID]
     if !exists {
-        return fmt.Errorf("VPS not found")
+        return nil, errVPSNotFound
     }
-
-    if vps.Status == StatusStopped {
-        return fmt.Errorf("VPS is already stopped")
+    if m.ctx.Err() != nil {
+        return nil, fmt.Errorf("server is shutting down")
     }
-
-    if vps.QEMUPid <= 0 {
-        return fmt.Errorf("VPS does not have a valid PID")
+    if source.Status != StatusRunning && source.Status != StatusStopped {
+        return nil, fmt.Errorf("%w, current status: %s", errVPSBusy, source.Status)
+    }
+    if source.ImagePath == "" {
+        return nil, fmt.Errorf("VPS has no disk")
+    }
+    var ipInstances []string
+    if clientIP != "" {
+        ipInstances = m.liveVPSesForIPLocked(clientIP)
+        if m.maxVPSPerIP > 0 && len(ipInstances) >= m.maxVPSPerIP {
+            return nil, errIPLimitReached
+        }
+    }
+    if maxVPSes > 0 && m.liveVPSCountForOwnerLocked(source.Owner) >= maxVPSes {
+        return nil, fmt.Errorf("%w (%d)", errQuotaReached, maxVPSes)
     }
 
-    // Get the QEMU monitor socket path
-    instanceDir := filepath.Join(m.baseDir, "disks", vps.ID)
-    monitorSocket := filepath.Join(instanceDir, "qemu-monitor.sock")
+    if newName == "" {
+        newName = source.Name + "-clone"
+    }
+    if newHostname == "" {
+        newHostname = newName + ".vps.local"
+    }
+    if !isValidHostname(newHostname) {
+        return nil, fmt.Errorf("invalid hostname format: %s", newHostname)
+    }
 
-    // Create a temporary file for command output
-    tmpFile, err := os.CreateTemp("", "qemu-command-*")
+    // Static addresses and explicit MACs would clash with the source's, so
+    // the clone's NICs take DHCP and MACs derived from its own ID
+    clone := &VPS{
+        ID:          uuid.New().String(),
+        Name:        newName,
+        Hostname:    newHostname,
+        Owner:       source.Owner,
+        Status:      "creating",
+        ImageType:   source.ImageType,
+        ImageURL:    source.ImageURL,
+        OSFamily:    source.OSFamily,
+        Template:    source.Template,
+        TemplateVars: maps.Clone(source.TemplateVars),
+        Proxy:       source.Proxy,
+        NetworkMode: source.NetworkMode,
+        DiskFormat:  source.DiskFormat,
+        Encrypted:   source.Encrypted,
+        StandaloneDisk: source.DiskFormat == DiskFormatQCOW2,
+        CacheMode:   source.CacheMode,
+        MemoryMB:    source.MemoryMB,
+        VCPUs:       source.VCPUs,
+        MaxVCPUs:    source.MaxVCPUs,
+        CurrentVCPUs: source.VCPUs,
+        DiskGB:      source.DiskGB,
+        MetricsDisabled: source.MetricsDisabled,
+        Media:       source.Media,
+        CPUModel:    source.CPUModel,
+        CPUFlags:    slices.Clone(source.CPUFlags),
+        CloudInitDatasource: source.CloudInitDatasource,
+        CloudInitLabel: source.CloudInitLabel,
+        CloudInitSeed: source.CloudInitSeed,
+        SSHAuthorizedKeys: slices.Clone(source.SSHAuthorizedKeys),
+        DisablePasswordAuth: source.DisablePasswordAuth,
+        CreatedAt:   time.Now(),
+        ExpiresAt:   time.Now().Add(VPS_LIFETIME),
+        Stage:       StageCreatingDisk,
+        Progress:    40,
+        StageHistory: []StageEvent{{Stage: StageCreatingDisk, At: time.Now()}},
+    }
+    if source.IOThrottle != nil {
+        throttle := *source.IOThrottle
+        clone.IOThrottle = &throttle
+    }
+    if clone.CloudInitSeed == CloudInitSeedSMBIOS {
+        token := make([]byte, 16)
+        if _, err := rand.Read(token); err != nil {
+            return nil, fmt.Errorf("failed to generate seed token: %v", err)
+        }
+        clone.SeedToken = base64.RawURLEncoding.EncodeToString(token)
+    }
+    password, err := generatePassword()
     if err != nil {
-        return fmt.Errorf("failed to create temp file: %v", err)
+        return nil, fmt.Errorf("failed to generate password: %v", err)
     }
-    defer os.Remove(tmpFile.Name())
-
-    // Send system_powerdown command to QEMU monitor
-    cmd := exec.Command("echo", "system_powerdown")
-    socat := exec.Command("socat", "-", fmt.Sprintf("UNIX-CONNECT:%s", monitorSocket))
-    
-    // Connect the commands
-    socatIn, err := socat.StdinPipe()
+    clone.PasswordHash, err = hashPassword(password)
     if err != nil {
-        return fmt.Errorf("failed to create pipe: %v", err)
+        return nil, fmt.Errorf("failed to hash password: %v", err)
     }
-    
-    cmd.Stdout = socatIn
-    socat.Stdout = tmpFile
-    socat.Stderr = tmpFile
 
-    // Start socat first
-    if err := socat.Start(); err != nil {
-        return fmt.Errorf("failed to start socat: %v", err)
+    // Every host port is the source's, so all of them are allocated afresh
+    inUse := m.hostPortsInUseLocked()
+    if clone.VNCPort, err = m.allocatePortLocked(m.vncPorts, inUse); err != nil {
+        return nil, fmt.Errorf("VNC port: %w", err)
     }
-
-    // Run the echo command
-    if err := cmd.Run(); err != nil {
-        return fmt.Errorf("failed to send command: %v", err)
+    if source.SSHPort > 0 {
+        if clone.SSHPort, err = m.allocatePortLocked(m.sshPorts, inUse); err != nil {
+            return nil, fmt.Errorf("SSH port: %w", err)
+        }
     }
-
-    // Close stdin pipe
-    socatIn.Close()
-
-    // Wait for socat to finish
-    if err := socat.Wait(); err != nil {
-        output, _ := os.ReadFile(tmpFile.Name())
-        return fmt.Errorf("failed to execute command: %v, output: %s", err, string(output))
+    reallocate := func(forwards []PortForward) ([]PortForward, error) {
+        var fresh []PortForward
+        for _, fwd := range forwards {
+            hostPort, err := m.allocatePortLocked(m.forwardPorts, inUse)
+            // allocatePortLocked only tracks TCP
+            for err == nil && fwd.Protocol != "tcp" && inUse[fmt.Sprintf("%s/%d", fwd.Protocol, hostPort)] {
+                hostPort, err = m.allocatePortLocked(m.forwardPorts, inUse)
+            }
+            if err != nil {
+                return nil, fmt.Errorf("forward port: %w", err)
+            }
+            inUse[fmt.Sprintf("%s/%d", fwd.Protocol, hostPort)] = true
+            fresh = append(fresh, PortForward{HostPort: hostPort, GuestPort: fwd.GuestPort, Protocol: fwd.Protocol})
+        }
+        return fresh, nil
+    }
+    if clone.PortForwards, err = reallocate(source.PortForwards); err != nil {
+        return nil, err
+    }
+    for _, nic := range source.NICs {
+        nic.MAC = ""
+        if nic.Forwards, err = reallocate(nic.Forwards); err != nil {
+            return nil, err
+        }
+        clone.NICs = append(clone.NICs, nic)
     }
 
-    vps.Status = StatusStopping
+    wasRunning := source.Status == StatusRunning
+    pid := source.QEMUPid
+    m.setStatus(source, StatusCloning)
+    m.instances[clone.ID] = clone
+    m.createdTotal++
+    if clientIP != "" {
+        m.ipInstances[clientIP] = append(ipInstances, clone.ID)
+    }
+    m.publishState(clone)
+    log.Printf("Cloning VPS %s into %s (ID: %s)", sourceID, newName, clone.ID)
 
-    // Wait for shutdown to complete
+    m.workers.Add(1)
     go func() {
-        timeout := time.After(2 * time.Minute)
-        ticker := time.NewTicker(5 * time.Second)
-        defer ticker.Stop()
+        defer m.workers.Done()
+        err := m.cloneDisk(source, clone, pid)
 
-        for {
-            select {
-            case <-timeout:
-                // Force stop if graceful shutdown fails
-                if proc, err := os.FindProcess(vps.QEMUPid); err == nil {
-                    proc.Kill()
-                }
-                m.mutex.Lock()
-                vps.Status = StatusStopped
-                m.mutex.Unlock()
-                return
-                
-            case <-ticker.C:
-                if err := checkProcess(vps.QEMUPid); err != nil {
-                    m.mutex.Lock()
-                    vps.Status = StatusStopped
-                    m.mutex.Unlock()
-                    return
-                }
+        m.mutex.Lock()
+        // The source may have been deleted while its disk was read
+        sourceKept := m.instances[sourceID] == source
+        if sourceKept {
+            m.setStatus(source, StatusStopped)
+            source.RunState = ""
+        }
+        _, cloneKept := m.instances[clone.ID]
+        if err != nil || !cloneKept {
+            // No half-made clone is left behind, on disk or in the list
+            if err != nil {
+                log.Printf("Failed to clone VPS %s: %v", sourceID, err)
+            }
+            if cloneKept {
+                delete(m.instances, clone.ID)
+                m.saveStateLocked()
+                m.events.publish(VPSEvent{Type: EventDeleted, VPSID: clone.ID, Owner: clone.Owner})
+            }
+            m.mutex.Unlock()
+            m.abortCreate(clone)
+        } else {
+            clone.Stage = StageCompleted
+            clone.Progress = 100
+            clone.StageHistory = append(clone.StageHistory, StageEvent{Stage: StageCompleted, At: time.Now()})
+            m.setStatus(clone, StatusStopped)
+            m.mutex.Unlock()
+            log.Printf("Cloned VPS %s into %s", sourceID, clone.ID)
+
+            if err := m.StartVPS(clone.ID); err != nil {
+                log.Printf("Warning: Failed to start clone %s: %v", clone.ID, err)
+            }
+            go m.scheduleCleanup(clone)
+        }
+
+        if wasRunning && sourceKept {
+            if err := m.StartVPS(sourceID); err != nil {
+                log.Printf("Warning: Failed to start VPS %s after cloning it: %v", sourceID, err)
             }
         }
     }()
 
-    return nil
+    created := *clone
+    created.Password = password
+    return &created, nil
 }
 
-func (m *VPSManager) StartVPS(id string) error {
-    m.mutex.Lock()
-    defer m.mutex.Unlock()
+// Power off the source if needed, flatten its disk into the clone's instance
+// directory and render the clone's cloud-init. An encrypted clone gets a copy
+// of the source's key.
+func (m *VPSManager) cloneDisk(source *VPS, clone *VPS, pid int) error {
+    m.powerOffForDiskCopy(source.ID, pid)
 
-    vps, exists := m.instances[id]
-    if !exists {
-        return fmt.Errorf("VPS not found")
+    m.mutex.RLock()
+    sourcePath, diskFormat, encrypted, imageType := source.ImagePath, source.DiskFormat, source.Encrypted, source.ImageType
+    m.mutex.RUnlock()
+
+    instanceDir := filepath.Join(m.baseDir, "disks", clone.ID)
+    if err := os.MkdirAll(instanceDir, 0755); err != nil {
+        return fmt.Errorf("failed to create instance directory: %v", err)
     }
 
-    if vps.Status == StatusRunning {
-        return fmt.Errorf("VPS is already running")
+    // The flattened copy holds everything the overlay reads from its base
+    needed, err := allocatedSize(sourcePath)
+    if err != nil {
+        return fmt.Errorf("failed to stat disk: %v", err)
+    }
+    if baseSize, err := allocatedSize(getBaseImagePath(imageType)); err == nil && diskFormat == DiskFormatQCOW2 {
+        needed += baseSize
+    }
+    var stat syscall.Statfs_t
+    if err := syscall.Statfs(instanceDir, &stat); err != nil {
+        return fmt.Errorf("failed to check free space in %s: %v", instanceDir, err)
+    }
+    if free := int64(stat.Bavail) * int64(stat.Bsize); free < needed {
+        return fmt.Errorf("not enough space in %s: %d bytes free, %d needed", instanceDir, free, needed)
     }
 
-    instanceDir := filepath.Join(m.baseDir, "disks", vps.ID)
-    pidFile := filepath.Join(instanceDir, "qemu.pid")
-    logFile := filepath.Join(m.baseDir, "logs", fmt.Sprintf("%s.log", vps.ID))
-    cloudInitPath := filepath.Join(instanceDir, "cloud-init.iso")
-    monitorSocket := filepath.Join(instanceDir, "qemu-monitor.sock")
+    imagePath := filepath.Join(instanceDir, filepath.Base(sourcePath))
+    args := []string{"convert", "-O", diskFormat}
+    input := sourcePath
+    if encrypted {
+        keyData, err := os.ReadFile(m.diskKeyPath(source.ID))
+        if err != nil {
+            return fmt.Errorf("failed to read disk key: %v", err)
+        }
+        if err := os.MkdirAll(filepath.Dir(m.diskKeyPath(clone.ID)), 0700); err != nil {
+            return fmt.Errorf("failed to create key directory: %v", err)
+        }
+        if err := os.WriteFile(m.diskKeyPath(clone.ID), keyData, 0600); err != nil {
+            return fmt.Errorf("failed to write disk key: %v", err)
+        }
+        args = append(args,
+            "--object", diskSecretObject(m.diskKeyPath(clone.ID)),
+            "--image-opts",
+            "-o", "encrypt.format=luks,encrypt.key-secret="+DISK_SECRET_ID)
+        input = fmt.Sprintf("driver=qcow2,file.filename=%s,encrypt.key-secret=%s", sourcePath, DISK_SECRET_ID)
+    } else {
+        args = append(args, "-f", diskFormat)
+    }
+    args = append(args, input, imagePath)
 
-    // Remove existing monitor socket if it exists
-    os.Remove(monitorSocket)
+    cmd := exec.CommandContext(m.ctx, "qemu-img", args...)
+    if output, err := cmd.CombinedOutput(); err != nil {
+        return fmt.Errorf("failed to copy disk: %v, output: %s", err, string(output))
+    }
 
-    args := []string{
-        "-name", fmt.Sprintf("guest=%s,debug-threads=on", vps.Name),
-        "-machine", "pc,accel=kvm,usb=off,vmport=off",
-        "-cpu", "host",
-        "-m", fmt.Sprintf("%d", RAM_SIZE),
-        "-smp", "2,sockets=2,cores=1,threads=1",
-        "-drive", fmt.Sprintf("file=%s,format=qcow2", vps.ImagePath),
-        "-drive", fmt.Sprintf("file=%s,format=raw", cloudInitPath),
-        "-vnc", fmt.Sprintf("0.0.0.0:%d", vps.VNCPort-5900),
-        "-device", "virtio-net-pci,netdev=user0",
-        "-netdev", fmt.Sprintf(
-            "user,id=user0,hostfwd=tcp:0.0.0.0:%d-:22",
-            vps.SSHPort,
-        ),
-        "-qmp", fmt.Sprintf("unix:%s,server,nowait", monitorSocket),
-        "-pidfile", pidFile,
-        "-daemonize",
-        "-enable-kvm",
+    m.mutex.Lock()
+    clone.ImagePath = imagePath
+    clone.Stage = StagePreparingCloudInit
+    clone.Progress = 80
+    clone.StageHistory = append(clone.StageHistory, StageEvent{Stage: StagePreparingCloudInit, At: time.Now()})
+    m.publishState(clone)
+    m.mutex.Unlock()
+
+    // A new instance-id makes cloud-init apply the new hostname and password
+    if err := createCloudInitISO(filepath.Join(instanceDir, "cloud-init.iso"), clone); err != nil {
+        return fmt.Errorf("failed to create cloud-init ISO: %v", err)
+    }
+    return nil
+}
+
+func (m *VPSManager) handleCloneVPS(w http.ResponseWriter, r *http.Request) {
+    if !allowMethods(w, r, http.MethodPost) {
+        return
+    }
+
+    id, ok := m.vpsIDFromRequest(w, r)
+    if !ok {
+        return
+    }
+
+    var req struct {
+        Name     string `json:"name"`
+        Hostname string `json:"hostname"`
+    }
+    if !decodeJSONBody(w, r, &req) {
+        return
     }
 
-    cmd := exec.Command("qemu-system-x86_64", args...)
-    
-    stdout, err := os.Create(logFile)
+    clone, err := m.CloneVPS(id, req.Name, req.Hostname, m.clientIP(r), identityFromRequest(r).MaxVPSes)
     if err != nil {
-        return fmt.Errorf("failed to create log file: %v", err)
+        status := http.StatusBadRequest
+        if errors.Is(err, errVPSNotFound) {
+            status = http.StatusNotFound
+        } else if errors.Is(err, errVPSBusy) || errors.Is(err, errIPLimitReached) {
+            status = http.StatusConflict
+        } else if errors.Is(err, errQuotaReached) {
+            status = http.StatusTooManyRequests
+        } else if errors.Is(err, errPortsExhausted) {
+            status = http.StatusServiceUnavailable
+        }
+        http.Error(w, err.Error(), status)
+        return
     }
-    defer stdout.Close()
-    cmd.Stdout = stdout
-    cmd.Stderr = stdout
 
-    vps.Status = StatusStarting
+    writeJSON(w, http.StatusOK, clone)
+}
 
-    if err := cmd.Start(); err != nil {
-        vps.Status = StatusStopped
-        return fmt.Errorf("failed to start QEMU: %v", err)
+// Remove a prepared base image, refusing while any instance's overlay is
+// backed by it or it is still being downloaded
+func (m *VPSManager) DeleteBaseImage(imageType string) (int64, error) {
+    if _, exists := SUPPORTED_IMAGES[imageType]; !exists && !isCustomImageType(imageType) {
+        return 0, fmt.Errorf("unsupported image type: %s", imageType)
     }
 
-    // Wait for PID file
-    var pid int
-    timeout := time.After(30 * time.Second)
-    ticker := time.NewTicker(500 * time.Millisecond)
-    defer ticker.Stop()
+    // Holding the downloads lock keeps a create from starting a fresh
+    // download of the image while it's checked and removed
+    m.downloadsMutex.Lock()
+    defer m.downloadsMutex.Unlock()
 
-    for {
-        select {
-        case <-timeout:
-            vps.Status = StatusStopped
-            logs, _ := os.ReadFile(logFile)
-            return fmt.Errorf("timeout waiting for QEMU to start. Logs: %s", string(logs))
-            
-        case <-ticker.C:
-            if pidBytes, err := os.ReadFile(pidFile); err == nil {
-                if _, err := fmt.Sscanf(string(pidBytes), "%d", &pid); err == nil {
-                    goto pidFound
-                }
-            }
-        }
+    basePath := getBaseImagePath(imageType)
+    info, err := os.Stat(basePath)
+    if os.IsNotExist(err) {
+        return 0, fmt.Errorf("%w: %s", errImageNotPrepared, imageType)
+    } else if err != nil {
+        return 0, fmt.Errorf("failed to stat base image: %v", err)
+    }
+    if _, inFlight := m.downloads[imageType]; inFlight {
+        return 0, fmt.Errorf("%w: %s is being downloaded", errImageInUse, imageType)
     }
 
-pidFound:
-    // Verify QEMU process
-    retries := 3
-    for i := 0; i < retries; i++ {
-        if err := checkProcess(pid); err == nil {
-            break
+    type disk struct {
+        id, imageType, status, path string
+    }
+    m.mutex.RLock()
+    disks := make([]disk, 0, len(m.instances))
+    for _, vps := range m.instances {
+        disks = append(disks, disk{vps.ID, vps.ImageType, vps.Status, vps.ImagePath})
+    }
+    m.mutex.RUnlock()
+
+    for _, d := range disks {
+        // Overlays for these may not exist yet
+        if d.imageType == imageType && (d.status == "creating" || d.status == StatusRebuilding) {
+            return 0, fmt.Errorf("%w: VPS %s is being built from it", errImageInUse, d.id)
         }
-        if i == retries-1 {
-            vps.Status = StatusStopped
-            logs, _ := os.ReadFile(logFile)
-            return fmt.Errorf("QEMU process verification failed after %d retries. Logs: %s", retries, string(logs))
+        if d.path == "" {
+            continue
+        }
+        backing, err := backingFile(d.path)
+        if err != nil {
+            // Deleted along with its VPS since the snapshot was taken
+            if _, statErr := os.Stat(d.path); os.IsNotExist(statErr) {
+                continue
+            }
+            return 0, fmt.Errorf("%w: could not check VPS %s: %v", errImageInUse, d.id, err)
+        }
+        if backing != "" && filepath.Clean(backing) == filepath.Clean(basePath) {
+            return 0, fmt.Errorf("%w: VPS %s is backed by it", errImageInUse, d.id)
         }
-        time.Sleep(time.Second)
     }
 
-    vps.QEMUPid = pid
-    vps.Status = StatusRunning
-
-    return nil
+    if err := os.Remove(basePath); err != nil {
+        return 0, fmt.Errorf("failed to remove base image: %v", err)
+    }
+    log.Printf("Removed %s base image %s (%d bytes)", imageType, basePath, info.Size())
+    return info.Size(), nil
 }
 
-func (m *VPSManager) RestartVPS(id string) error {
-    m.mutex.Lock()
-    defer m.mutex.Unlock()
-
-    vps, exists := m.instances[id]
-    if !exists {
-        return fmt.Errorf("VPS not found")
+func (m *VPSManager) handleDeleteImage(w http.ResponseWriter, r *http.Request) {
+    if !allowMethods(w, r, http.MethodDelete) {
+        return
+    }
+    if !identityFromRequest(r).Admin() {
+        http.Error(w, "Admin API key required", http.StatusForbidden)
+        return
     }
 
-    if vps.Status != StatusRunning {
-        return fmt.Errorf("VPS must be running to restart")
+    imageType := r.URL.Query().Get("type")
+    if imageType == "" {
+        http.Error(w, "Missing image type", http.StatusBadRequest)
+        return
     }
 
-    if vps.QEMUPid <= 0 {
-        return fmt.Errorf("VPS does not have a valid PID")
+    freed, err := m.DeleteBaseImage(imageType)
+    if err != nil {
+        status := http.StatusBadRequest
+        if errors.Is(err, errImageNotPrepared) {
+            status = http.StatusNotFound
+        } else if errors.Is(err, errImageInUse) {
+            status = http.StatusConflict
+        } else if _, supported := SUPPORTED_IMAGES[imageType]; supported || isCustomImageType(imageType) {
+            status = http.StatusInternalServerError
+        }
+        http.Error(w, err.Error(), status)
+        return
     }
 
-    // Get the QEMU monitor socket path
-    instanceDir := filepath.Join(m.baseDir, "disks", vps.ID)
-    monitorSocket := filepath.Join(instanceDir, "qemu-monitor.sock")
+    writeJSON(w, http.StatusOK, struct {
+        Type       string `json:"type"`
+        FreedBytes int64  `json:"freed_bytes"`
+    }{imageType, freed})
+}
 
-    // Create a temporary file for command output
-    tmpFile, err := os.CreateTemp("", "qemu-command-*")
-    if err != nil {
-        return fmt.Errorf("failed to create temp file: %v", err)
+type progressUpdate struct {
+    Stage    string `json:"stage"`
+    Progress int    `json:"progress"`
+    Status   string `json:"status"`
+    Error    string `json:"error,omitempty"`
+}
+
+// Push a VPS's creation progress over a WebSocket as it moves, instead of
+// clients polling /api/vps/progress. The socket is closed once the VPS
+// reaches StageCompleted or StageFailed, or is deleted.
+func (m *VPSManager) handleProgressWS(w http.ResponseWriter, r *http.Request) {
+    if !allowMethods(w, r, http.MethodGet) {
+        return
+    }
+    if !websocket.IsWebSocketUpgrade(r) {
+        http.Error(w, "WebSocket upgrade required", http.StatusBadRequest)
+        return
     }
-    defer os.Remove(tmpFile.Name())
 
-    // Send system_reset command to QEMU monitor
-    cmd := exec.Command("echo", "system_reset")
-    socat := exec.Command("socat", "-", fmt.Sprintf("UNIX-CONNECT:%s", monitorSocket))
-    
-    // Connect the commands
-    socatIn, err := socat.StdinPipe()
-    if err != nil {
-        return fmt.Errorf("failed to create pipe: %v", err)
+    id, ok := m.vpsIDFromRequest(w, r)
+    if !ok {
+        return
     }
-    
-    cmd.Stdout = socatIn
-    socat.Stdout = tmpFile
-    socat.Stderr = tmpFile
 
-    // Start socat first
-    if err := socat.Start(); err != nil {
-        return fmt.Errorf("failed to start socat: %v", err)
+    // Subscribe before the first snapshot so no update is missed
+    events := m.events.subscribeVPS(id)
+    defer m.events.unsubscribe(events)
+
+    controller := http.NewResponseController(w)
+    controller.SetReadDeadline(time.Time{})
+    controller.SetWriteDeadline(time.Time{})
+
+    conn, err := wsUpgrader.Upgrade(w, r, nil)
+    if err != nil {
+        return
     }
+    closed := make(chan struct{})
+    go func() {
+        defer close(closed)
+        for {
+            if _, _, err := conn.NextReader(); err != nil {
+                return
+            }
+        }
+    }()
+    defer func() { <-closed }()
+    defer conn.Close()
 
-    // Run the echo command
-    if err := cmd.Run(); err != nil {
-        return fmt.Errorf("failed to send command: %v", err)
+    closeWith := func(code int, text string) {
+        conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, text), time.Now().Add(time.Second))
     }
 
-    // Close stdin pipe
-    socatIn.Close()
+    var last progressUpdate
+    sent := false
+    // Returns false once the stream is over
+    update := func() bool {
+        m.mutex.RLock()
+        vps, exists := m.instances[id]
+        var current progressUpdate
+        if exists {
+            current = progressUpdate{Stage: vps.Stage, Progress: vps.Progress, Status: vps.Status, Error: vps.ErrorMsg}
+        }
+        m.mutex.RUnlock()
+        if !exists {
+            closeWith(websocket.CloseNormalClosure, "VPS deleted")
+            return false
+        }
 
-    // Wait for socat to finish
-    if err := socat.Wait(); err != nil {
-        output, _ := os.ReadFile(tmpFile.Name())
-        return fmt.Errorf("failed to execute command: %v, output: %s", err, string(output))
+        if !sent || current != last {
+            if err := conn.WriteJSON(current); err != nil {
+                return false
+            }
+            last, sent = current, true
+        }
+        if current.Stage == StageCompleted || current.Stage == StageFailed || current.Status == "failed" {
+            closeWith(websocket.CloseNormalClosure, current.Stage)
+            return false
+        }
+        return true
     }
 
-    vps.Status = StatusRestarting
+    if !update() {
+        return
+    }
 
-    // Update status after a delay
-    go func() {
-        time.Sleep(30 * time.Second)
-        m.mutex.Lock()
-        vps.Status = StatusRunning
-        m.mutex.Unlock()
-    }()
+    keepalive := time.NewTicker(EVENT_KEEPALIVE)
+    defer keepalive.Stop()
 
-    return nil
+    for {
+        select {
+        case <-events:
+            if !update() {
+                return
+            }
+        case <-keepalive.C:
+            if err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(time.Second)); err != nil {
+                return
+            }
+            // A full channel drops events, so re-read the VPS in case the
+            // one that finished it was lost
+            if !update() {
+                return
+            }
+        case <-closed:
+            return
+        case <-m.ctx.Done():
+            closeWith(websocket.CloseGoingAway, "server shutting down")
+            return
+        }
+    }
 }
 
-// Add new HTTP handlers for the start/stop operations
-func (m *VPSManager) handleStartVPS(w http.ResponseWriter, r *http.Request) {
-    if r.Method != http.MethodPost {
-        http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+func (m *VPSManager) handleGetProgress(w http.ResponseWriter, r *http.Request) {
+    if !allowMethods(w, r, http.MethodGet, http.MethodHead) {
         return
     }
 
-    id := r.URL.Query().Get("id")
-    if err := m.StartVPS(id); err != nil {
-        http.Error(w, err.Error(), http.StatusInternalServerError)
+    id, ok := m.vpsIDFromRequest(w, r)
+    if !ok {
         return
     }
 
-    w.WriteHeader(http.StatusOK)
-}
+    m.mutex.RLock()
+    vps, exists := m.instances[id]
+    m.mutex.RUnlock()
 
-func (m *VPSManager) handleStopVPS(w http.ResponseWriter, r *http.Request) {
-    if r.Method != http.MethodPost {
-        http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+    if !exists {
+        http.Error(w, "VPS not found", http.StatusNotFound)
         return
     }
 
-    id := r.URL.Query().Get("id")
-    if err := m.StopVPS(id); err != nil {
-        http.Error(w, err.Error(), http.StatusInternalServerError)
-        return
+    response := progressUpdate{
+        Stage:    vps.Stage,
+        Progress: vps.Progress,
+        Status:   vps.Status,
+        Error:    vps.ErrorMsg,
     }
 
-    w.WriteHeader(http.StatusOK)
+    writeJSON(w, http.StatusOK, response)
 }
-// Add new HTTP handler for restart endpoint
-func (m *VPSManager) handleRestartVPS(w http.ResponseWriter, r *http.Request) {
-    if r.Method != http.MethodPost {
-        http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+
+//go:embed openapi.json
+var openAPISpec []byte
+
+// Serve the OpenAPI document describing the /api/* endpoints. Keep
+// openapi.json in sync when adding or changing handlers.
+func handleOpenAPISpec(w http.ResponseWriter, r *http.Request) {
+    if !allowMethods(w, r, http.MethodGet, http.MethodHead) {
         return
     }
 
-    id := r.URL.Query().Get("id")
-    if err := m.RestartVPS(id); err != nil {
-        http.Error(w, err.Error(), http.StatusInternalServerError)
-        return
+    w.Header().Set("Access-Control-Allow-Origin", "*")
+    w.Header().Set("Content-Type", "application/json")
+    w.Write(openAPISpec)
+}
+
+// Helper function to reject other methods with a 405 that lists the allowed
+// ones. Handlers that allow HEAD run as for GET; net/http drops the body.
+func allowMethods(w http.ResponseWriter, r *http.Request, methods ...string) bool {
+    for _, method := range methods {
+        if r.Method == method {
+            return true
+        }
     }
+    w.Header().Set("Allow", strings.Join(methods, ", "))
+    http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+    return false
+}
 
-    w.WriteHeader(http.StatusOK)
+type contextKey string
+
+const identityContextKey contextKey = "identity"
+
+// What an API key may do. Admins see and manage every owner's instances,
+// operators manage their own and read-only keys can only look at them.
+const (
+    RoleAdmin    = "admin"
+    RoleOperator = "operator"
+    RoleReadOnly = "readonly"
+)
+
+// apiIdentity is who an API key acts as
+type apiIdentity struct {
+    Owner    string
+    Role     string
+    MaxVPSes int // Live VPSes the owner may hold through this key, 0 means unlimited
 }
 
-func (m *VPSManager) scheduleCleanup(vps *VPS) {
-    time.Sleep(VPS_LIFETIME)
-    m.DeleteVPS(vps.ID)
+func (id apiIdentity) Admin() bool {
+    return id.Role == RoleAdmin
 }
 
-func (m *VPSManager) DeleteVPS(id string) error {
-    m.mutex.Lock()
-    defer m.mutex.Unlock()
+func (id apiIdentity) canAccess(vps *VPS) bool {
+    return id.Admin() || vps.Owner == id.Owner
+}
 
-    vps, exists := m.instances[id]
-    if !exists {
-        return fmt.Errorf("VPS not found")
+// Read-only keys get GET and HEAD, except the consoles, which type into the guest
+func (id apiIdentity) canRequest(r *http.Request) bool {
+    if id.Role != RoleReadOnly {
+        return true
+    }
+    if r.Method != http.MethodGet && r.Method != http.MethodHead {
+        return false
     }
+    return r.URL.Path != "/api/vps/vnc" && r.URL.Path != "/api/vps/console"
+}
 
-    // Remove IP association
-    for ip, vpsID := range m.ipInstances {
-        if vpsID == id {
-            delete(m.ipInstances, ip)
-            break
+// Helper function to get the identity AuthMiddleware resolved for this request
+func identityFromRequest(r *http.Request) apiIdentity {
+    identity, _ := r.Context().Value(identityContextKey).(apiIdentity)
+    return identity
+}
+
+// An entry of the BLST_API_KEYS_FILE JSON array
+type apiKeyEntry struct {
+    Owner  string `json:"owner"`
+    Key    string `json:"key"`
+    Role   string `json:"role"`    // Defaults to operator
+    MaxVPS *int   `json:"max_vps"` // Defaults to BLST_MAX_VPS_PER_KEY, admins to unlimited
+}
+
+// Load the accepted API keys and who they act as. API_KEY is an admin key;
+// BLST_API_KEYS adds comma-separated owner:key[:role[:max_vps]] entries and
+// BLST_API_KEYS_FILE a JSON array of {owner, key, role, max_vps}. Keys without
+// a role are operators, and non-admin keys without a max_vps get
+// BLST_MAX_VPS_PER_KEY.
+func loadAPIKeys() (map[string]apiIdentity, error) {
+    defaultMaxVPSes := getEnvInt("BLST_MAX_VPS_PER_KEY", 0)
+
+    keys := make(map[string]apiIdentity)
+    if apiKey := os.Getenv("API_KEY"); apiKey != "" {
+        keys[apiKey] = apiIdentity{Owner: ADMIN_OWNER, Role: RoleAdmin}
+    }
+
+    var entries []apiKeyEntry
+    for _, entry := range strings.Split(os.Getenv("BLST_API_KEYS"), ",") {
+        entry = strings.TrimSpace(entry)
+        if entry == "" {
+            continue
+        }
+        parts := strings.Split(entry, ":")
+        if len(parts) < 2 || len(parts) > 4 {
+            return nil, fmt.Errorf("invalid BLST_API_KEYS entry %q, expected owner:key, owner:key:role or owner:key:role:max_vps", entry)
         }
+        parsed := apiKeyEntry{Owner: parts[0], Key: parts[1]}
+        if len(parts) >= 3 {
+            parsed.Role = parts[2]
+        }
+        if len(parts) == 4 {
+            maxVPS, err := strconv.Atoi(parts[3])
+            if err != nil {
+                return nil, fmt.Errorf("invalid max_vps %q for owner %s", parts[3], parts[0])
+            }
+            parsed.MaxVPS = &maxVPS
+        }
+        entries = append(entries, parsed)
     }
 
-    if err := stopWebsockifyProxy(vps.VNCPort); err != nil {
-        log.Printf("Warning: Failed to stop websockify: %v", err)
+    if path := os.Getenv("BLST_API_KEYS_FILE"); path != "" {
+        data, err := os.ReadFile(path)
+        if err != nil {
+            return nil, fmt.Errorf("failed to read BLST_API_KEYS_FILE: %v", err)
+        }
+        var fromFile []apiKeyEntry
+        if err := json.Unmarshal(data, &fromFile); err != nil {
+            return nil, fmt.Errorf("failed to parse BLST_API_KEYS_FILE: %v", err)
+        }
+        entries = append(entries, fromFile...)
     }
 
-    if vps.QEMUPid > 0 {
-        if proc, err := os.FindProcess(vps.QEMUPid); err == nil {
-            proc.Kill()
+    for _, entry := range entries {
+        if entry.Owner == "" || entry.Key == "" {
+            return nil, fmt.Errorf("API key entry for owner %q needs both an owner and a key", entry.Owner)
         }
+        if entry.Role == "" {
+            entry.Role = RoleOperator
+        }
+        if entry.Role != RoleAdmin && entry.Role != RoleOperator && entry.Role != RoleReadOnly {
+            return nil, fmt.Errorf("invalid role %q for owner %s, expected %s, %s or %s", entry.Role, entry.Owner, RoleAdmin, RoleOperator, RoleReadOnly)
+        }
+        // VPSes owned by admin came from API_KEY, a lesser key must not see them
+        if entry.Owner == ADMIN_OWNER && entry.Role != RoleAdmin {
+            return nil, fmt.Errorf("owner %s is reserved for admin keys, got role %s", ADMIN_OWNER, entry.Role)
+        }
+        maxVPSes := defaultMaxVPSes
+        if entry.Role == RoleAdmin {
+            maxVPSes = 0
+        }
+        if entry.MaxVPS != nil {
+            if *entry.MaxVPS < 0 {
+                return nil, fmt.Errorf("max_vps for owner %s can't be negative", entry.Owner)
+            }
+            maxVPSes = *entry.MaxVPS
+        }
+        if _, exists := keys[entry.Key]; exists {
+            return nil, fmt.Errorf("duplicate API key for owner %s", entry.Owner)
+        }
+        keys[entry.Key] = apiIdentity{Owner: entry.Owner, Role: entry.Role, MaxVPSes: maxVPSes}
     }
 
-    instanceDir := filepath.Join(m.baseDir, "disks", vps.ID)
-    os.RemoveAll(instanceDir)
+    if len(keys) == 0 {
+        return nil, fmt.Errorf("API_KEY environment variable is required")
+    }
+    return keys, nil
+}
+
+type AuthMiddleware struct {
+    keys map[string]apiIdentity
+    next http.Handler
+}
+
+func NewAuthMiddleware(keys map[string]apiIdentity, next http.Handler) *AuthMiddleware {
+    return &AuthMiddleware{
+        keys: keys,
+        next: next,
+    }
+}
+
+func (m *AuthMiddleware) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+    w.Header().Set("Access-Control-Allow-Origin", "*")
+    w.Header().Set("Access-Control-Allow-Methods", "GET, HEAD, POST, DELETE, OPTIONS")
+    w.Header().Set("Access-Control-Allow-Headers", "Content-Type, X-API-Key, If-None-Match, Idempotency-Key")
+    w.Header().Set("Access-Control-Expose-Headers", "ETag, Idempotent-Replayed")
+
+    if r.Method == "OPTIONS" {
+        w.WriteHeader(http.StatusOK)
+        return
+    }
+
+    identity, ok := m.keys[r.Header.Get("X-API-Key")]
+    if !ok {
+        http.Error(w, "Unauthorized", http.StatusUnauthorized)
+        return
+    }
+    if !identity.canRequest(r) {
+        http.Error(w, "Read-only API key", http.StatusForbidden)
+        return
+    }
+    // Reads are too frequent to be worth an audit line
+    if r.Method != http.MethodGet && r.Method != http.MethodHead {
+        log.Printf("%s %s by %s (%s)", r.Method, r.URL.Path, identity.Owner, identity.Role)
+    }
 
-    delete(m.instances, id)
-    return nil
+    m.next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), identityContextKey, identity)))
 }
 
-func (m *VPSManager) GetVPS(id string) (*VPS, error) {
-    m.mutex.RLock()
-    defer m.mutex.RUnlock()
+type GzipMiddleware struct {
+    next http.Handler
+}
 
-    vps, exists := m.instances[id]
-    if !exists {
-        return nil, fmt.Errorf("VPS not found")
+func NewGzipMiddleware(next http.Handler) *GzipMiddleware {
+    return &GzipMiddleware{
+        next: next,
     }
-    return vps, nil
 }
 
-func (m *VPSManager) ListVPS() []*VPS {
-    m.mutex.RLock()
-    defer m.mutex.RUnlock()
+func (m *GzipMiddleware) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+    // WebSocket upgrades need the raw connection, HEAD has no body to compress
+    if r.Header.Get("Upgrade") != "" || r.Method == http.MethodHead {
+        m.next.ServeHTTP(w, r)
+        return
+    }
 
-    vpsList := make([]*VPS, 0, len(m.instances))
-    for _, vps := range m.instances {
-        vpsList = append(vpsList, vps)
+    w.Header().Add("Vary", "Accept-Encoding")
+    if !strings.Contains(r.Header.Get("Accept-Encoding"), "gzip") {
+        m.next.ServeHTTP(w, r)
+        return
     }
-    return vpsList
+
+    gw := &gzipResponseWriter{ResponseWriter: w, status: http.StatusOK}
+    defer gw.finish()
+    m.next.ServeHTTP(gw, r)
 }
 
-func (m *VPSManager) validateInstances() {
-    m.mutex.Lock()
-    defer m.mutex.Unlock()
+// gzipResponseWriter buffers the start of a response until it knows whether
+// the body is JSON and large enough to be worth compressing
+type gzipResponseWriter struct {
+    http.ResponseWriter
+    gz      *gzip.Writer
+    buf     []byte
+    status  int
+    decided bool
+}
 
-    for id, vps := range m.instances {
-        if err := checkProcess(vps.QEMUPid); err != nil {
-            log.Printf("VPS %s (ID: %s) is no longer running: %v", vps.Name, id, err)
-            vps.Status = "stopped"
+func (w *gzipResponseWriter) WriteHeader(status int) {
+    w.status = status
+}
+
+func (w *gzipResponseWriter) Write(p []byte) (int, error) {
+    if w.decided {
+        if w.gz != nil {
+            return w.gz.Write(p)
         }
+        return w.ResponseWriter.Write(p)
     }
-}
 
-// HTTP Handlers
-func (m *VPSManager) handleCreateVPS(w http.ResponseWriter, r *http.Request) {
-    if r.Method != http.MethodPost {
-        http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
-        return
+    w.buf = append(w.buf, p...)
+    if len(w.buf) >= GZIP_MIN_SIZE {
+        if err := w.decide(); err != nil {
+            return 0, err
+        }
     }
+    return len(p), nil
+}
 
-    var req struct {
-        Name      string `json:"name"`
-        Hostname  string `json:"hostname"`
-        ImageType string `json:"image_type"`
-        Template  string `json:"template"`
+func (w *gzipResponseWriter) decide() error {
+    w.decided = true
+
+    header := w.Header()
+    if len(w.buf) >= GZIP_MIN_SIZE &&
+        strings.HasPrefix(header.Get("Content-Type"), "application/json") &&
+        header.Get("Content-Encoding") == "" {
+        header.Del("Content-Length")
+        header.Set("Content-Encoding", "gzip")
+        w.gz = gzip.NewWriter(w.ResponseWriter)
     }
 
-    if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-        http.Error(w, err.Error(), http.StatusBadRequest)
-        return
+    w.ResponseWriter.WriteHeader(w.status)
+    if len(w.buf) == 0 {
+        return nil
     }
 
-    // Set defaults if not provided
-    if req.Template == "" {
-        req.Template = "blank"
+    var err error
+    if w.gz != nil {
+        _, err = w.gz.Write(w.buf)
+    } else {
+        _, err = w.ResponseWriter.Write(w.buf)
     }
-    if req.ImageType == "" {
-        req.ImageType = "ubuntu-22.04"
+    w.buf = nil
+    return err
+}
+
+func (w *gzipResponseWriter) Flush() {
+    if !w.decided {
+        w.decide()
     }
-    if req.Hostname == "" {
-        req.Hostname = req.Name + ".vps.local"
+    if w.gz != nil {
+        w.gz.Flush()
     }
-
-    vps, err := m.CreateVPS(req.Name, req.Hostname, req.ImageType, req.Template)
-    if err != nil {
-        http.Error(w, err.Error(), http.StatusInternalServerError)
-        return
+    if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+        flusher.Flush()
     }
+}
 
-    json.NewEncoder(w).Encode(vps)
+// Lets http.ResponseController reach the underlying connection's deadlines
+func (w *gzipResponseWriter) Unwrap() http.ResponseWriter {
+    return w.ResponseWriter
 }
 
-func (m *VPSManager) handleListVPS(w http.ResponseWriter, r *http.Request) {
-    if r.Method != http.MethodGet {
-        http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
-        return
+func (w *gzipResponseWriter) finish() {
+    if !w.decided {
+        w.decide()
+    }
+    if w.gz != nil {
+        w.gz.Close()
     }
-
-    m.validateInstances()
-    vpsList := m.ListVPS()
-    
-    w.Header().Set("Content-Type", "application/json")
-    json.NewEncoder(w).Encode(vpsList)
 }
 
-func (m *VPSManager) handleGetVPS(w http.ResponseWriter, r *http.Request) {
-    if r.Method != http.MethodGet {
-        http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
-        return
+// Helper function to read a boolean setting from the environment
+func getEnvBool(key string, defaultValue bool) bool {
+    value := os.Getenv(key)
+    if value == "" {
+        return defaultValue
     }
-
-    id := r.URL.Query().Get("id")
-    vps, err := m.GetVPS(id)
+    parsed, err := strconv.ParseBool(value)
     if err != nil {
-        http.Error(w, err.Error(), http.StatusNotFound)
-        return
+        log.Printf("Warning: Invalid value %q for %s, using default %v", value, key, defaultValue)
+        return defaultValue
     }
-
-    json.NewEncoder(w).Encode(vps)
+    return parsed
 }
 
-func (m *VPSManager) handleDeleteVPS(w http.ResponseWriter, r *http.Request) {
-    if r.Method != http.MethodDelete {
-        http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
-        return
+// Helper function to read a string setting from the environment
+func getEnvString(key string, defaultValue string) string {
+    if value := os.Getenv(key); value != "" {
+        return value
     }
+    return defaultValue
+}
 
-    id := r.URL.Query().Get("id")
-    if err := m.DeleteVPS(id); err != nil {
-        http.Error(w, err.Error(), http.StatusInternalServerError)
-        return
+// Helper function to read a positive integer setting from the environment
+func getEnvInt(key string, defaultValue int) int {
+    value := os.Getenv(key)
+    if value == "" {
+        return defaultValue
     }
-
-    w.WriteHeader(http.StatusOK)
+    parsed, err := strconv.Atoi(value)
+    if err != nil || parsed <= 0 {
+        log.Printf("Warning: Invalid value %q for %s, using default %d", value, key, defaultValue)
+        return defaultValue
+    }
+    return parsed
 }
 
-func (m *VPSManager) handleListImages(w http.ResponseWriter, r *http.Request) {
-    if r.Method != http.MethodGet {
-        http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
-        return
+// Helper function to read a numeric setting from the environment
+func getEnvFloat(key string, defaultValue float64) float64 {
+    value := os.Getenv(key)
+    if value == "" {
+        return defaultValue
     }
-
-    images := make([]string, 0, len(SUPPORTED_IMAGES))
-    for imageType := range SUPPORTED_IMAGES {
-        images = append(images, imageType)
+    parsed, err := strconv.ParseFloat(value, 64)
+    if err != nil || parsed < 0 {
+        log.Printf("Warning: Invalid value %q for %s, using default %v", value, key, defaultValue)
+        return defaultValue
     }
-
-    w.Header().Set("Content-Type", "application/json")
-    json.NewEncoder(w).Encode(images)
+    return parsed
 }
 
-func (m *VPSManager) handleGetProgress(w http.ResponseWriter, r *http.Request) {
-    if r.Method != http.MethodGet {
-        http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
-        return
+// Helper function to read a duration setting (e.g. "5m") from the environment
+func getEnvDuration(key string, defaultValue time.Duration) time.Duration {
+    value := os.Getenv(key)
+    if value == "" {
+        return defaultValue
     }
-
-    id := r.URL.Query().Get("id")
-    if id == "" {
-        http.Error(w, "Missing VPS ID", http.StatusBadRequest)
-        return
+    parsed, err := time.ParseDuration(value)
+    if err != nil || parsed <= 0 {
+        log.Printf("Warning: Invalid value %q for %s, using default %s", value, key, defaultValue)
+        return defaultValue
     }
+    return parsed
+}
 
-    m.mutex.RLock()
-    vps, exists := m.instances[id]
-    m.mutex.RUnlock()
+// Helper function to resolve the QEMU binary, overridable for hosts that
+// install it outside PATH or under another name
+func qemuBinary() string {
+    return getEnvString("BLST_QEMU_BIN", "qemu-system-x86_64")
+}
 
-    if !exists {
-        http.Error(w, "VPS not found", http.StatusNotFound)
-        return
-    }
+// rotatingFile is an io.Writer that starts a new file once the current one
+// would grow past maxSize, keeping path.1 .. path.<keep> as older logs, or
+// none when keep is 0
+type rotatingFile struct {
+    mutex   sync.Mutex
+    path    string
+    maxSize int64
+    keep    int
+    file    *os.File
+    size    int64
+    failing bool // Set after a failed rotation, to warn about it once
+}
 
-    response := struct {
-        Stage    string `json:"stage"`
-        Progress int    `json:"progress"`
-        Status   string `json:"status"`
-        Error    string `json:"error,omitempty"`
-    }{
-        Stage:    vps.Stage,
-        Progress: vps.Progress,
-        Status:   vps.Status,
-        Error:    vps.ErrorMsg,
+func openRotatingFile(path string, maxSize int64, keep int) (*rotatingFile, error) {
+    rf := &rotatingFile{path: path, maxSize: maxSize, keep: keep}
+    if err := rf.open(); err != nil {
+        return nil, err
     }
+    return rf, nil
+}
 
-    w.Header().Set("Content-Type", "application/json")
-    json.NewEncoder(w).Encode(response)
+func (rf *rotatingFile) open() error {
+    file, err := os.OpenFile(rf.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+    if err != nil {
+        return fmt.Errorf("failed to open log file: %v", err)
+    }
+    info, err := file.Stat()
+    if err != nil {
+        file.Close()
+        return fmt.Errorf("failed to stat log file: %v", err)
+    }
+    rf.file = file
+    rf.size = info.Size()
+    return nil
 }
 
-type AuthMiddleware struct {
-    apiKey string
-    next   http.Handler
+func (rf *rotatingFile) rotate() error {
+    rf.file.Close()
+    rf.file = nil
+    if rf.keep == 0 {
+        if err := os.Remove(rf.path); err != nil && !os.IsNotExist(err) {
+            return fmt.Errorf("failed to rotate log file: %v", err)
+        }
+        return rf.open()
+    }
+    os.Remove(fmt.Sprintf("%s.%d", rf.path, rf.keep))
+    for i := rf.keep - 1; i >= 1; i-- {
+        os.Rename(fmt.Sprintf("%s.%d", rf.path, i), fmt.Sprintf("%s.%d", rf.path, i+1))
+    }
+    if err := os.Rename(rf.path, rf.path+".1"); err != nil && !os.IsNotExist(err) {
+        return fmt.Errorf("failed to rotate log file: %v", err)
+    }
+    return rf.open()
 }
 
-func NewAuthMiddleware(apiKey string, next http.Handler) *AuthMiddleware {
-    return &AuthMiddleware{
-        apiKey: apiKey,
-        next:   next,
+// Stderr comes first in the log's MultiWriter, so a line this drops while the
+// file can't be reopened has still been logged there
+func (rf *rotatingFile) Write(p []byte) (int, error) {
+    rf.mutex.Lock()
+    defer rf.mutex.Unlock()
+
+    if rf.file == nil {
+        if err := rf.open(); err != nil {
+            return len(p), nil
+        }
+    }
+    if rf.size > 0 && rf.size+int64(len(p)) > rf.maxSize {
+        if err := rf.rotate(); err != nil {
+            if !rf.failing {
+                fmt.Fprintf(os.Stderr, "Warning: %v, logging to stderr only until it can be rotated\n", err)
+            }
+            rf.failing = true
+            return len(p), nil
+        }
     }
+    rf.failing = false
+    n, err := rf.file.Write(p)
+    rf.size += int64(n)
+    return n, err
 }
 
-func (m *AuthMiddleware) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-    w.Header().Set("Access-Control-Allow-Origin", "*")
-    w.Header().Set("Access-Control-Allow-Methods", "GET, POST, DELETE, OPTIONS")
-    w.Header().Set("Access-Control-Allow-Headers", "Content-Type, X-API-Key")
+// Also send the service's own logs to logs/service.log when BLST_LOG_FILE is
+// set. Stderr keeps receiving everything so supervisors still capture it.
+func setupLogFile(baseDir string) error {
+    if !getEnvBool("BLST_LOG_FILE", false) {
+        return nil
+    }
 
-    if r.Method == "OPTIONS" {
-        w.WriteHeader(http.StatusOK)
-        return
+    logDir := filepath.Join(baseDir, "logs")
+    if err := os.MkdirAll(logDir, 0755); err != nil {
+        return fmt.Errorf("failed to create log directory: %v", err)
     }
 
-    apiKey := r.Header.Get("X-API-Key")
-    if apiKey == "" || apiKey != m.apiKey {
-        http.Error(w, "Unauthorized", http.StatusUnauthorized)
-        return
+    maxSize := int64(getEnvInt("BLST_LOG_MAX_SIZE_MB", 10)) << 20
+    keep := getEnvInt("BLST_LOG_KEEP", 5)
+    if keep < 0 {
+        return fmt.Errorf("BLST_LOG_KEEP must not be negative")
+    }
+    file, err := openRotatingFile(filepath.Join(logDir, "service.log"), maxSize, keep)
+    if err != nil {
+        return err
     }
 
-    m.next.ServeHTTP(w, r)
+    log.SetOutput(io.MultiWriter(os.Stderr, file))
+    log.Printf("Logging to %s (rotating at %d MB, keeping %d)", file.path, maxSize>>20, keep)
+    return nil
 }
 
 func verifySystemRequirements() error {
-    if _, err := exec.LookPath("qemu-system-x86_64"); err != nil {
-        return fmt.Errorf("qemu-system-x86_64 not found: %v", err)
+    // Check every external tool up front and report all missing ones at once
+    // rather than failing one create at a time
+    tools := []string{qemuBinary(), "qemu-img", "socat"}
+    if getEnvString("BLST_CLOUD_INIT_SEED", CloudInitSeedISO) != CloudInitSeedSMBIOS {
+        tools = append(tools, "genisoimage")
+    }
+    if getEnvString("BLST_NETWORK_MODE", NetworkModeUser) == NetworkModeBridge {
+        tools = append(tools, "ip")
+    }
+
+    var missing []string
+    for _, tool := range tools {
+        if _, err := exec.LookPath(tool); err != nil {
+            missing = append(missing, tool)
+        }
+    }
+    if len(missing) > 0 {
+        return fmt.Errorf("required tools not found in PATH: %s", strings.Join(missing, ", "))
     }
 
     if _, err := os.Stat("/dev/kvm"); err != nil {
         return fmt.Errorf("KVM not available: %v", err)
     }
 
-    if output, err := exec.Command("ls", "-l", "/dev/kvm").CombinedOutput(); err != nil {
-        return fmt.Errorf("failed to check KVM permissions: %v", err)
-    } else {
-        log.Printf("KVM device permissions: %s", string(output))
+    // QEMU opens it read-write, existing isn't enough
+    kvm, err := os.OpenFile("/dev/kvm", os.O_RDWR, 0)
+    if err != nil {
+        return fmt.Errorf("KVM not accessible: %v", err)
     }
+    kvm.Close()
 
     return nil
 }
 
+// Safe to call more than once (signal and panic paths), later calls block
+// until the first has finished.
 func (m *VPSManager) cleanup() {
+    m.cleanupOnce.Do(m.doCleanup)
+}
+
+func (m *VPSManager) doCleanup() {
     log.Println("Starting cleanup of all VPS instances...")
-    
+
+    // Cancel under the lock so no create can register after we start waiting
     m.mutex.Lock()
-    defer m.mutex.Unlock()
+    m.cancel()
+    m.mutex.Unlock()
+
+    unwound := make(chan struct{})
+    go func() {
+        m.workers.Wait()
+        close(unwound)
+    }()
+    select {
+    case <-unwound:
+    case <-time.After(SHUTDOWN_GRACE):
+        log.Printf("Warning: In-flight creates did not finish within %s, cleaning up anyway", SHUTDOWN_GRACE)
+    }
+
+    m.mutex.Lock()
+    instances := m.instances
+    m.instances = make(map[string]*VPS)
+    m.mutex.Unlock()
 
     var wg sync.WaitGroup
-    for id, vps := range m.instances {
+    for id, vps := range instances {
         wg.Add(1)
         go func(id string, vps *VPS) {
             defer wg.Done()
             
             log.Printf("Cleaning up VPS %s (ID: %s)", vps.Name, id)
             
-            if err := stopWebsockifyProxy(vps.VNCPort); err != nil {
-                log.Printf("Warning: Failed to stop websockify for VPS %s: %v", id, err)
-            }
-
             if vps.QEMUPid > 0 {
                 if proc, err := os.FindProcess(vps.QEMUPid); err == nil {
                     log.Printf("Killing QEMU process %d for VPS %s", vps.QEMUPid, id)
@@ -1635,11 +9821,17 @@ func (m *VPSManager) cleanup() {
                 log.Printf("Warning: Failed to remove instance directory for VPS %s: %v", id, err)
             }
 
+            removeCgroup(id)
+            removeTapDevice(id)
+
             log.Printf("Successfully cleaned up VPS %s", id)
         }(id, vps)
     }
 
     wg.Wait()
+    m.mutex.RLock()
+    m.saveStateLocked()
+    m.mutex.RUnlock()
     log.Println("All VPS instances have been cleaned up")
 }
 
@@ -1656,12 +9848,14 @@ type ResourceMetrics struct {
 
 type CPUMetrics struct {
     Usage float64 `json:"usage"` // Percentage (0-100)
+    ticks int64                   // Raw utime+stime, used to compute Usage between samples
 }
 
 type MemoryMetrics struct {
     Used  int64 `json:"used"`  // Bytes
     Total int64 `json:"total"` // Bytes
     Cache int64 `json:"cache"` // Bytes
+    Balloon int64 `json:"balloon,omitempty"` // Bytes the balloon leaves the guest, 0 without one
 }
 
 type DiskMetrics struct {
@@ -1671,6 +9865,8 @@ type DiskMetrics struct {
     WriteOps   int64   `json:"write_ops"`
     ReadSpeed  float64 `json:"read_speed"`  // Bytes per second
     WriteSpeed float64 `json:"write_speed"` // Bytes per second
+    ReadIOPS   float64 `json:"read_iops"`   // Operations per second
+    WriteIOPS  float64 `json:"write_iops"`  // Operations per second
 }
 
 type NetworkMetrics struct {
@@ -1680,12 +9876,44 @@ type NetworkMetrics struct {
     TXPackets  int64   `json:"tx_packets"`
     RXSpeed    float64 `json:"rx_speed"` // Bytes per second
     TXSpeed    float64 `json:"tx_speed"` // Bytes per second
+    Interfaces []InterfaceMetrics `json:"interfaces,omitempty"` // Per-NIC counters
+}
+
+// Counters for one guest NIC, from the guest's point of view
+type InterfaceMetrics struct {
+    Name      string `json:"name"` // QEMU netdev id, e.g. net1
+    RXBytes   int64  `json:"rx_bytes"`
+    TXBytes   int64  `json:"tx_bytes"`
+    RXPackets int64  `json:"rx_packets"`
+    TXPackets int64  `json:"tx_packets"`
+}
+
+// Helper function to read a tap's counters. What the host sends into the tap
+// is what the guest receives, so rx and tx swap.
+func readTapStats(tap string) (InterfaceMetrics, bool) {
+    read := func(name string) (int64, error) {
+        data, err := os.ReadFile(filepath.Join("/sys/class/net", tap, "statistics", name))
+        if err != nil {
+            return 0, err
+        }
+        return strconv.ParseInt(strings.TrimSpace(string(data)), 10, 64)
+    }
+
+    var stats InterfaceMetrics
+    var err error
+    if stats.RXBytes, err = read("tx_bytes"); err != nil {
+        return stats, false
+    }
+    stats.TXBytes, _ = read("rx_bytes")
+    stats.RXPackets, _ = read("tx_packets")
+    stats.TXPackets, _ = read("rx_packets")
+    return stats, true
 }
 
 
 
 func (m *VPSManager) metricsCollector() {
-    ticker := time.NewTicker(2 * time.Second)
+    ticker := time.NewTicker(m.metricsInterval)
     defer ticker.Stop()
 
     for range ticker.C {
@@ -1698,14 +9926,118 @@ func (m *VPSManager) metricsCollector() {
 
         for id, vps := range instances {
             if vps.Status == StatusRunning {
+                m.refreshGuestIP(vps)
+            }
+            if vps.Status == StatusRunning && !vps.MetricsDisabled {
                 if metrics, err := m.collectMetrics(id); err == nil {
                     m.updateMetricsCache(id, metrics)
+                    m.checkIdle(vps, metrics)
                 }
             }
         }
     }
 }
 
+func loadIdlePolicy() IdlePolicy {
+    policy := IdlePolicy{
+        Action:       os.Getenv("BLST_IDLE_ACTION"),
+        CPUThreshold: getEnvFloat("BLST_IDLE_CPU_PERCENT", 5),
+        NetThreshold: getEnvFloat("BLST_IDLE_NET_BPS", 2048),
+        Grace:        getEnvDuration("BLST_IDLE_GRACE", 5*time.Minute),
+    }
+
+    switch policy.Action {
+    case "":
+        policy.Action = IdleActionNone
+    case IdleActionNone, IdleActionStop, IdleActionDelete:
+    default:
+        log.Printf("Warning: Unknown BLST_IDLE_ACTION %q, idle policy disabled", policy.Action)
+        policy.Action = IdleActionNone
+    }
+
+    if policy.Action != IdleActionNone {
+        log.Printf("Idle policy: %s after %s below %.1f%% CPU and %.0f B/s network",
+            policy.Action, policy.Grace, policy.CPUThreshold, policy.NetThreshold)
+    }
+    return policy
+}
+
+// Track how long a VPS has been idle and apply the idle policy once the
+// grace period runs out
+func (m *VPSManager) checkIdle(vps *VPS, metrics *ResourceMetrics) {
+    policy := m.idlePolicy
+    if policy.Action == IdleActionNone {
+        return
+    }
+
+    netSpeed := metrics.Network.RXSpeed + metrics.Network.TXSpeed
+    idle := metrics.CPU.Usage < policy.CPUThreshold && netSpeed < policy.NetThreshold
+
+    m.mutex.Lock()
+    if !idle || vps.Status != StatusRunning {
+        vps.IdleSince = nil
+        vps.IdleShutdownAt = nil
+        m.mutex.Unlock()
+        return
+    }
+
+    if vps.IdleSince == nil {
+        since := metrics.Time
+        deadline := since.Add(policy.Grace)
+        vps.IdleSince = &since
+        vps.IdleShutdownAt = &deadline
+    }
+    idleSince := *vps.IdleSince
+    expired := !metrics.Time.Before(*vps.IdleShutdownAt)
+    m.mutex.Unlock()
+
+    if !expired {
+        return
+    }
+
+    log.Printf("VPS %s idle since %s, applying idle policy: %s", vps.ID, idleSince.Format(time.RFC3339), policy.Action)
+    switch policy.Action {
+    case IdleActionStop:
+        if err := m.StopVPS(vps.ID, 0); err != nil {
+            log.Printf("Warning: Idle stop of VPS %s failed: %v", vps.ID, err)
+            return
+        }
+        m.mutex.Lock()
+        vps.IdleSince = nil
+        vps.IdleShutdownAt = nil
+        m.mutex.Unlock()
+    case IdleActionDelete:
+        if err := m.DeleteVPS(vps.ID); err != nil {
+            log.Printf("Warning: Idle delete of VPS %s failed: %v", vps.ID, err)
+        }
+    }
+}
+
+// Helper function to build the hostfwd clauses for a user netdev. Forwarding
+// from "::" adds a matching IPv4 listener since slirp binds v6 sockets v6-only.
+func formatHostForwards(forwards []PortForward, bindAddress string) string {
+    hosts := []string{formatHostAddress(bindAddress)}
+    if bindAddress == "::" {
+        hosts = []string{"0.0.0.0", "[::]"}
+    }
+
+    var formatted strings.Builder
+    for _, fwd := range forwards {
+        for _, host := range hosts {
+            formatted.WriteString(fmt.Sprintf(",hostfwd=%s:%s:%d-:%d", fwd.Protocol, host, fwd.HostPort, fwd.GuestPort))
+        }
+    }
+    return formatted.String()
+}
+
+// Helper function to bracket IPv6 literals for host:port arguments
+func formatHostAddress(address string) string {
+    if strings.Contains(address, ":") {
+        return "[" + address + "]"
+    }
+    return address
+}
+
 func generateMacAddress(id string) string {
     // Use first 6 bytes of UUID as MAC address
     cleanID := strings.ReplaceAll(id, "-", "")
@@ -1727,6 +10059,13 @@ func (m *VPSManager) collectMetrics(id string) (*ResourceMetrics, error) {
         return nil, fmt.Errorf("VPS not found or not running")
     }
 
+    // Right after boot QEMU may not have created its monitor yet. Skip the
+    // sample quietly rather than erroring on every tick until it appears.
+    monitorSocket := filepath.Join(m.baseDir, "disks", id, "qemu-monitor.sock")
+    if _, err := os.Stat(monitorSocket); err != nil {
+        return nil, errMonitorNotReady
+    }
+
     metrics := &ResourceMetrics{
         Time: time.Now(),
     }
@@ -1738,7 +10077,7 @@ func (m *VPSManager) collectMetrics(id string) (*ResourceMetrics, error) {
             utime, _ := strconv.ParseInt(fields[13], 10, 64)
             stime, _ := strconv.ParseInt(fields[14], 10, 64)
             
-            total := float64(utime + stime)
+            total := float64(utime + stime) / CLOCK_TICKS_PER_SEC
             // Calculate percentage based on total system time
             if uptime, err := os.ReadFile("/proc/uptime"); err == nil {
                 uptimeFields := strings.Fields(string(uptime))
@@ -1750,6 +10089,7 @@ func (m *VPSManager) collectMetrics(id string) (*ResourceMetrics, error) {
                     }
                 }
             }
+            metrics.CPU.ticks = utime + stime
         }
     }
 
@@ -1775,13 +10115,25 @@ func (m *VPSManager) collectMetrics(id string) (*ResourceMetrics, error) {
         }
         metrics.Memory = MemoryMetrics{
             Used:  rss,
-            Total: int64(RAM_SIZE) * 1024 * 1024, // Convert MB to bytes
+            Total: int64(vps.MemoryMB) * 1024 * 1024, // Convert MB to bytes
             Cache: vmSize - rss,
         }
     }
 
-    // Get disk I/O stats from /proc/[pid]/io
-    if ioStats, err := os.ReadFile(fmt.Sprintf("/proc/%d/io", vps.QEMUPid)); err == nil {
+    // The balloon's size is what the guest may use, not what it does use,
+    // so it is reported next to RSS rather than in place of it
+    if output, err := m.executeQMPCommand(monitorSocket, `{ "execute": "query-memory-size-summary" }`); err == nil {
+        if memory := m.parseMemoryMetrics(monitorSocket, output); memory.Total > 0 {
+            metrics.Memory.Total = memory.Total
+            metrics.Memory.Balloon = memory.Balloon
+        }
+    }
+
+    // Get disk I/O stats from the guest's block devices. /proc/[pid]/io is
+    // only a fallback, it counts all of QEMU's I/O including the base image.
+    if output, err := m.executeQMPCommand(monitorSocket, `{ "execute": "query-blockstats" }`); err == nil && parseQMPReturn(output, nil) == nil {
+        metrics.Disk = m.parseDiskMetrics(output)
+    } else if ioStats, err := os.ReadFile(fmt.Sprintf("/proc/%d/io", vps.QEMUPid)); err == nil {
         var readBytes, writeBytes int64
         scanner := bufio.NewScanner(strings.NewReader(string(ioStats)))
         for scanner.Scan() {
@@ -1801,127 +10153,99 @@ func (m *VPSManager) collectMetrics(id string) (*ResourceMetrics, error) {
         metrics.Disk = DiskMetrics{
             ReadBytes:  readBytes,
             WriteBytes: writeBytes,
-            ReadOps:    0, // These will be calculated from differences
+            ReadOps:    0, // Not counted by /proc
             WriteOps:   0,
             ReadSpeed:  0,
             WriteSpeed: 0,
         }
     }
 
-    instanceDir := filepath.Join(m.baseDir, "disks", id)
-    monitorSocket := filepath.Join(instanceDir, "qemu-monitor.sock")
-    
-    log.Printf("[NetworkMetrics] Starting network metrics collection for VPS %s", id)
-    
-    // Initialize network metrics
-    metrics.Network = NetworkMetrics{
-        RXBytes:   0,
-        TXBytes:   0,
-        RXPackets: 0,
-        TXPackets: 0,
-        RXSpeed:   0,
-        TXSpeed:   0,
-    }
-
-    // First, get the list of PCI devices
-    pciListCmd := `{ "execute": "qom-list", "arguments": {"path": "/machine/i440fx/pci.0"} }`
-    if output, err := m.executeQMPCommand(monitorSocket, pciListCmd); err == nil {
-        log.Printf("[NetworkMetrics] PCI devices list: %s", string(output))
-
-        // Try to find our network device
-        netDevCmd := `{ "execute": "qom-list", "arguments": {"path": "/machine/i440fx/pci.0/virtio-net-pci.0"} }`
-        if netOutput, err := m.executeQMPCommand(monitorSocket, netDevCmd); err == nil {
-            log.Printf("[NetworkMetrics] Network device properties: %s", string(netOutput))
-
-            // Get the device properties
-            statsCmd := `{ "execute": "qom-get", "arguments": {"path": "/machine/i440fx/pci.0/virtio-net-pci.0", "property": "host_features"} }`
-            if statsOutput, err := m.executeQMPCommand(monitorSocket, statsCmd); err == nil {
-                log.Printf("[NetworkMetrics] Network device stats: %s", string(statsOutput))
-            }
-
-            // Try alternative stats command
-            altStatsCmd := `{ "execute": "query-rx-filter", "arguments": {"name": "net0"} }`
-            if statsOutput, err := m.executeQMPCommand(monitorSocket, altStatsCmd); err == nil {
-                log.Printf("[NetworkMetrics] RX filter stats: %s", string(statsOutput))
-            }
+    // Bridge NICs are counted on their host tap. User-mode NICs have no
+    // host-side device and QMP keeps no netdev counters, so theirs come from
+    // the guest agent, matched to our NICs by MAC. Guests without the agent
+    // report zeros for them.
+    m.mutex.RLock()
+    nics := m.vpsNICs(vps)
+    m.mutex.RUnlock()
+    var interfaces []InterfaceMetrics
+    userMACs := make(map[string]string)
+    for i, nic := range nics {
+        name := fmt.Sprintf("net%d", i)
+        if nic.Type != NetworkModeBridge {
+            userMACs[strings.ToLower(nicMAC(id, i, nic))] = name
+            continue
         }
-
-        // Try querying netdev directly
-        netdevCmd := `{ "execute": "query-netdev" }`
-        if netdevOutput, err := m.executeQMPCommand(monitorSocket, netdevCmd); err == nil {
-            log.Printf("[NetworkMetrics] Netdev info: %s", string(netdevOutput))
+        if stats, ok := readTapStats(nicTapName(id, i)); ok {
+            stats.Name = name
+            interfaces = append(interfaces, stats)
         }
     }
-
-    // If we still don't have stats, try reading from /proc
-    if metrics.Network.RXBytes == 0 {
-        m.mutex.RLock()
-        vps, exists := m.instances[id]
-        m.mutex.RUnlock()
-
-        if exists && vps.QEMUPid > 0 {
-            // Try to read network stats from /proc/[pid]/net/dev
-            if data, err := os.ReadFile(fmt.Sprintf("/proc/%d/net/dev", vps.QEMUPid)); err == nil {
-                scanner := bufio.NewScanner(bytes.NewReader(data))
-                for scanner.Scan() {
-                    line := scanner.Text()
-                    if strings.Contains(line, "eth0:") || strings.Contains(line, "ens3:") {
-                        fields := strings.Fields(line)
-                        if len(fields) >= 17 {
-                            metrics.Network.RXBytes, _ = strconv.ParseInt(fields[1], 10, 64)
-                            metrics.Network.RXPackets, _ = strconv.ParseInt(fields[2], 10, 64)
-                            metrics.Network.TXBytes, _ = strconv.ParseInt(fields[9], 10, 64)
-                            metrics.Network.TXPackets, _ = strconv.ParseInt(fields[10], 10, 64)
-                            log.Printf("[NetworkMetrics] Found network stats in /proc/net/dev")
-                            break
-                        }
-                    }
-                }
-            }
+    if len(userMACs) > 0 {
+        agentSocket := filepath.Join(m.baseDir, "disks", id, "qemu-ga.sock")
+        if output, err := executeGuestAgentCommand(agentSocket, `{"execute":"guest-network-get-interfaces"}`, GUEST_AGENT_METRICS_TIMEOUT); err == nil {
+            interfaces = append(interfaces, m.parseNetworkMetrics(output, userMACs).Interfaces...)
         }
     }
-
-    // Calculate speeds using the metrics cache
-    m.metricsMutex.Lock()
-    cache, exists := m.metricsCache[id]
-    if exists && !cache.LastUpdate.IsZero() {
-        duration := metrics.Time.Sub(cache.LastUpdate).Seconds()
-        if duration > 0 {
-            metrics.Network.RXSpeed = float64(metrics.Network.RXBytes-cache.LastNetStats.RXBytes) / duration
-            metrics.Network.TXSpeed = float64(metrics.Network.TXBytes-cache.LastNetStats.TXBytes) / duration
-            log.Printf("[NetworkMetrics] Calculated speeds - RX: %.2f bytes/sec, TX: %.2f bytes/sec",
-                metrics.Network.RXSpeed, metrics.Network.TXSpeed)
-        }
+    sort.Slice(interfaces, func(i, j int) bool {
+        return interfaces[i].Name < interfaces[j].Name
+    })
+    for _, stats := range interfaces {
+        metrics.Network.RXBytes += stats.RXBytes
+        metrics.Network.TXBytes += stats.TXBytes
+        metrics.Network.RXPackets += stats.RXPackets
+        metrics.Network.TXPackets += stats.TXPackets
     }
-    m.metricsMutex.Unlock()
-
-    log.Printf("[NetworkMetrics] Final metrics for VPS %s:", id)
-    log.Printf("[NetworkMetrics] RX Bytes: %d", metrics.Network.RXBytes)
-    log.Printf("[NetworkMetrics] TX Bytes: %d", metrics.Network.TXBytes)
-    log.Printf("[NetworkMetrics] RX Packets: %d", metrics.Network.RXPackets)
-    log.Printf("[NetworkMetrics] TX Packets: %d", metrics.Network.TXPackets)
+    metrics.Network.Interfaces = interfaces
 
     return metrics, nil
 }
 
+var errMonitorNotReady = errors.New("QMP monitor not ready")
+
+// Dial the QMP socket, retrying briefly while QEMU is still creating it or
+// not yet accepting connections right after launch
+func dialQMP(socket string) (net.Conn, error) {
+    backoff := QMP_DIAL_BACKOFF
+    for attempt := 1; ; attempt++ {
+        conn, err := net.Dial("unix", socket)
+        if err == nil {
+            return conn, nil
+        }
+        if !errors.Is(err, syscall.ENOENT) && !errors.Is(err, syscall.ECONNREFUSED) {
+            return nil, fmt.Errorf("failed to connect to QMP socket: %v", err)
+        }
+        if attempt == QMP_DIAL_ATTEMPTS {
+            return nil, fmt.Errorf("%w: %v", errMonitorNotReady, err)
+        }
+        time.Sleep(backoff)
+        backoff *= 2
+    }
+}
+
 func (m *VPSManager) executeQMPCommand(socket, command string) ([]byte, error) {
     log.Printf("[QMP] Connecting to socket: %s", socket)
     
-    conn, err := net.Dial("unix", socket)
+    conn, err := dialQMP(socket)
     if err != nil {
-        log.Printf("[QMP] Failed to connect to socket: %v", err)
-        return nil, fmt.Errorf("failed to connect to QMP socket: %v", err)
+        if !errors.Is(err, errMonitorNotReady) {
+            log.Printf("[QMP] Failed to connect to socket: %v", err)
+        }
+        return nil, err
     }
     defer conn.Close()
+    conn.SetDeadline(time.Now().Add(10 * time.Second))
+
+    // Every QMP message is one line of JSON. Replies can be far larger
+    // than a single read, query-blockstats especially.
+    reader := bufio.NewReader(conn)
 
     // Read the greeting
-    greeting := make([]byte, 1024)
-    n, err := conn.Read(greeting)
+    greeting, err := reader.ReadBytes('\n')
     if err != nil {
         log.Printf("[QMP] Failed to read greeting: %v", err)
         return nil, fmt.Errorf("failed to read QMP greeting: %v", err)
     }
-    log.Printf("[QMP] Received greeting: %s", string(greeting[:n]))
+    log.Printf("[QMP] Received greeting: %s", strings.TrimSpace(string(greeting)))
 
     // First, switch to JSON mode
     jsonMode := `{ "execute": "qmp_capabilities" }` + "\n"
@@ -1931,8 +10255,7 @@ func (m *VPSManager) executeQMPCommand(socket, command string) ([]byte, error) {
     }
 
     // Read and discard the response
-    buf := make([]byte, 1024)
-    if _, err := conn.Read(buf); err != nil {
+    if _, err := readQMPReply(reader); err != nil {
         log.Printf("[QMP] Failed to read JSON mode response: %v", err)
         return nil, fmt.Errorf("failed to read JSON mode response: %v", err)
     }
@@ -1945,31 +10268,185 @@ func (m *VPSManager) executeQMPCommand(socket, command string) ([]byte, error) {
         return nil, fmt.Errorf("failed to send command: %v", err)
     }
 
-    // Read the response with a larger buffer
-    response := make([]byte, 4096)
-    n, err = conn.Read(response)
+    response, err := readQMPReply(reader)
     if err != nil {
         log.Printf("[QMP] Failed to read command response: %v", err)
         return nil, fmt.Errorf("failed to read command response: %v", err)
     }
+    log.Printf("[QMP] Raw response: %s", string(response))
 
-    // Try to find the complete JSON response
-    respStr := string(response[:n])
-    log.Printf("[QMP] Raw response: %s", respStr)
+    return response, nil
+}
 
-    // Look for complete JSON object
-    start := strings.Index(respStr, "{")
-    end := strings.LastIndex(respStr, "}")
-    
-    if start == -1 || end == -1 || start > end {
-        log.Printf("[QMP] Invalid JSON response format")
-        return nil, fmt.Errorf("invalid JSON response format")
+// Helper function to read lines until the reply to the last command, skipping
+// asynchronous events such as STOP or RESUME
+func readQMPReply(reader *bufio.Reader) ([]byte, error) {
+    for {
+        line, err := reader.ReadBytes('\n')
+        if err != nil {
+            return nil, err
+        }
+        var msg struct {
+            Event string `json:"event"`
+        }
+        if err := json.Unmarshal(line, &msg); err != nil {
+            return nil, fmt.Errorf("invalid JSON response format: %v", err)
+        }
+        if msg.Event == "" {
+            return bytes.TrimSpace(line), nil
+        }
     }
+}
 
-    jsonResponse := respStr[start:end+1]
-    log.Printf("[QMP] Extracted JSON: %s", jsonResponse)
-    
-    return []byte(jsonResponse), nil
+// Extract the "return" payload of a QMP reply into v, skipping any
+// asynchronous events that arrived ahead of it
+func parseQMPReturn(data []byte, v interface{}) error {
+    decoder := json.NewDecoder(bytes.NewReader(data))
+    for {
+        var msg struct {
+            Return json.RawMessage `json:"return"`
+            Error  *struct {
+                Class string `json:"class"`
+                Desc  string `json:"desc"`
+            } `json:"error"`
+        }
+        if err := decoder.Decode(&msg); err != nil {
+            return fmt.Errorf("no QMP return value in response: %v", err)
+        }
+        if msg.Error != nil {
+            return fmt.Errorf("QMP error: %s: %s", msg.Error.Class, msg.Error.Desc)
+        }
+        if msg.Return != nil {
+            if v == nil {
+                return nil
+            }
+            return json.Unmarshal(msg.Return, v)
+        }
+    }
+}
+
+// Send a command to the QEMU guest agent and return the "return" payload
+func executeGuestAgentCommand(socket string, command string, timeout time.Duration) ([]byte, error) {
+    conn, err := net.DialTimeout("unix", socket, 5*time.Second)
+    if err != nil {
+        return nil, fmt.Errorf("failed to connect to guest agent socket: %v", err)
+    }
+    defer conn.Close()
+    conn.SetDeadline(time.Now().Add(timeout))
+
+    reader := bufio.NewReader(conn)
+
+    // Sync first so a stale reply left by an earlier client isn't mistaken for ours
+    syncID := time.Now().UnixNano() & 0x7fffffff
+    if _, err := fmt.Fprintf(conn, "{\"execute\":\"guest-sync\",\"arguments\":{\"id\":%d}}\n", syncID); err != nil {
+        return nil, fmt.Errorf("failed to send guest-sync: %v", err)
+    }
+    for {
+        line, err := reader.ReadBytes('\n')
+        if err != nil {
+            return nil, fmt.Errorf("failed to read guest-sync response: %v", err)
+        }
+        var syncResp struct {
+            Return int64 `json:"return"`
+        }
+        if json.Unmarshal(line, &syncResp) == nil && syncResp.Return == syncID {
+            break
+        }
+    }
+
+    if _, err := conn.Write([]byte(command + "\n")); err != nil {
+        return nil, fmt.Errorf("failed to send guest agent command: %v", err)
+    }
+
+    line, err := reader.ReadBytes('\n')
+    if err != nil {
+        return nil, fmt.Errorf("failed to read guest agent response: %v", err)
+    }
+
+    var resp struct {
+        Return json.RawMessage `json:"return"`
+        Error  *struct {
+            Class string `json:"class"`
+            Desc  string `json:"desc"`
+        } `json:"error"`
+    }
+    if err := json.Unmarshal(line, &resp); err != nil {
+        return nil, fmt.Errorf("invalid guest agent response: %v", err)
+    }
+    if resp.Error != nil {
+        return nil, fmt.Errorf("guest agent error: %s: %s", resp.Error.Class, resp.Error.Desc)
+    }
+
+    return resp.Return, nil
+}
+
+func waitForGuestAgent(socket string, timeout time.Duration) error {
+    deadline := time.Now().Add(timeout)
+    for {
+        _, err := executeGuestAgentCommand(socket, `{"execute":"guest-ping"}`, 5*time.Second)
+        if err == nil {
+            return nil
+        }
+        if time.Now().After(deadline) {
+            return fmt.Errorf("guest agent not available: %v", err)
+        }
+        time.Sleep(5 * time.Second)
+    }
+}
+
+// Run a shell command inside the guest and wait for it to exit
+func guestExec(socket string, command string, timeout time.Duration) (int, string, error) {
+    execCmd, err := json.Marshal(map[string]interface{}{
+        "execute": "guest-exec",
+        "arguments": map[string]interface{}{
+            "path":           "/bin/sh",
+            "arg":            []string{"-c", command},
+            "capture-output": true,
+        },
+    })
+    if err != nil {
+        return -1, "", err
+    }
+
+    output, err := executeGuestAgentCommand(socket, string(execCmd), 10*time.Second)
+    if err != nil {
+        return -1, "", err
+    }
+
+    var started struct {
+        PID int `json:"pid"`
+    }
+    if err := json.Unmarshal(output, &started); err != nil {
+        return -1, "", fmt.Errorf("failed to parse guest-exec response: %v", err)
+    }
+
+    statusCmd := fmt.Sprintf(`{"execute":"guest-exec-status","arguments":{"pid":%d}}`, started.PID)
+    deadline := time.Now().Add(timeout)
+    for time.Now().Before(deadline) {
+        output, err := executeGuestAgentCommand(socket, statusCmd, 10*time.Second)
+        if err != nil {
+            return -1, "", err
+        }
+
+        var status struct {
+            Exited   bool   `json:"exited"`
+            ExitCode int    `json:"exitcode"`
+            OutData  string `json:"out-data"`
+            ErrData  string `json:"err-data"`
+        }
+        if err := json.Unmarshal(output, &status); err != nil {
+            return -1, "", fmt.Errorf("failed to parse guest-exec-status response: %v", err)
+        }
+
+        if status.Exited {
+            stdout, _ := base64.StdEncoding.DecodeString(status.OutData)
+            stderr, _ := base64.StdEncoding.DecodeString(status.ErrData)
+            return status.ExitCode, string(stdout) + string(stderr), nil
+        }
+        time.Sleep(time.Second)
+    }
+
+    return -1, "", fmt.Errorf("timeout waiting for guest command: %s", command)
 }
 
 
@@ -1980,7 +10457,7 @@ func (m *VPSManager) updateMetricsCache(id string, metrics *ResourceMetrics) {
     cache, exists := m.metricsCache[id]
     if !exists {
         cache = &MetricsCache{
-            MetricsHistory: make([]ResourceMetrics, 0, 300), // Store 10 minutes of data at 2s intervals
+            MetricsHistory: make([]ResourceMetrics, 0, m.metricsHistorySize),
         }
         m.metricsCache[id] = cache
     }
@@ -1989,43 +10466,153 @@ func (m *VPSManager) updateMetricsCache(id string, metrics *ResourceMetrics) {
     if !cache.LastUpdate.IsZero() {
         duration := metrics.Time.Sub(cache.LastUpdate).Seconds()
         if duration > 0 {
-            // Calculate disk speeds
-            metrics.Disk.ReadSpeed = float64(metrics.Disk.ReadBytes-cache.LastDiskStats.ReadBytes) / duration
-            metrics.Disk.WriteSpeed = float64(metrics.Disk.WriteBytes-cache.LastDiskStats.WriteBytes) / duration
+            // Calculate CPU usage over the interval rather than since boot
+            if cache.LastCPUTicks > 0 && metrics.CPU.ticks >= cache.LastCPUTicks {
+                cpuSeconds := float64(metrics.CPU.ticks-cache.LastCPUTicks) / CLOCK_TICKS_PER_SEC
+                metrics.CPU.Usage = (cpuSeconds / duration) * (100 / float64(runtime.NumCPU()))
+            }
+
+            // Calculate disk speeds. Counters start over when QEMU restarts.
+            last := cache.LastDiskStats
+            rate := func(current, previous int64) float64 {
+                if current < previous {
+                    return 0
+                }
+                return float64(current-previous) / duration
+            }
+            metrics.Disk.ReadSpeed = rate(metrics.Disk.ReadBytes, last.ReadBytes)
+            metrics.Disk.WriteSpeed = rate(metrics.Disk.WriteBytes, last.WriteBytes)
+            metrics.Disk.ReadIOPS = rate(metrics.Disk.ReadOps, last.ReadOps)
+            metrics.Disk.WriteIOPS = rate(metrics.Disk.WriteOps, last.WriteOps)
 
             // Calculate network speeds
-            metrics.Network.RXSpeed = float64(metrics.Network.RXBytes-cache.LastNetStats.RXBytes) / duration
-            metrics.Network.TXSpeed = float64(metrics.Network.TXBytes-cache.LastNetStats.TXBytes) / duration
+            metrics.Network.RXSpeed = rate(metrics.Network.RXBytes, cache.LastNetStats.RXBytes)
+            metrics.Network.TXSpeed = rate(metrics.Network.TXBytes, cache.LastNetStats.TXBytes)
         }
     }
 
     // Update cache
     cache.LastUpdate = metrics.Time
+    cache.LastCPUTicks = metrics.CPU.ticks
     cache.LastDiskStats = metrics.Disk
     cache.LastNetStats = metrics.Network
     
     // Add to history and maintain window
     cache.MetricsHistory = append(cache.MetricsHistory, *metrics)
-    if len(cache.MetricsHistory) > 300 {
+    if len(cache.MetricsHistory) > m.metricsHistorySize {
         cache.MetricsHistory = cache.MetricsHistory[1:]
     }
 }
 
 // Add new HTTP handler
 func (m *VPSManager) handleGetMetrics(w http.ResponseWriter, r *http.Request) {
-    if r.Method != http.MethodGet {
-        http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+    if !allowMethods(w, r, http.MethodGet, http.MethodHead) {
+        return
+    }
+
+    // ?limit=N keeps the newest N samples, ?latest=true returns only the
+    // newest one as an object rather than an array
+    limit := 0
+    if value := r.URL.Query().Get("limit"); value != "" {
+        parsed, err := strconv.Atoi(value)
+        if err != nil || parsed <= 0 {
+            http.Error(w, fmt.Sprintf("invalid limit: %s", value), http.StatusBadRequest)
+            return
+        }
+        limit = parsed
+    }
+    latest := false
+    if value := r.URL.Query().Get("latest"); value != "" {
+        parsed, err := strconv.ParseBool(value)
+        if err != nil {
+            http.Error(w, fmt.Sprintf("invalid latest: %s", value), http.StatusBadRequest)
+            return
+        }
+        latest = parsed
+    }
+
+    id, ok := m.vpsIDFromRequest(w, r)
+    if !ok {
+        return
+    }
+
+    m.metricsMutex.RLock()
+    cache, exists := m.metricsCache[id]
+    var history []ResourceMetrics
+    if exists {
+        start := 0
+        if limit > 0 && len(cache.MetricsHistory) > limit {
+            start = len(cache.MetricsHistory) - limit
+        }
+        history = make([]ResourceMetrics, len(cache.MetricsHistory)-start)
+        copy(history, cache.MetricsHistory[start:])
+    }
+    m.metricsMutex.RUnlock()
+
+    if !exists {
+        http.Error(w, "No metrics available for this VPS", http.StatusNotFound)
+        return
+    }
+
+    if latest {
+        if len(history) == 0 {
+            http.Error(w, "No metrics samples yet", http.StatusNotFound)
+            return
+        }
+        writeJSONWithETag(w, r, history[len(history)-1])
+        return
+    }
+
+    writeJSONWithETag(w, r, history)
+}
+
+type MetricsSummary struct {
+    Window    string      `json:"window"`
+    Samples   int         `json:"samples"`
+    From      time.Time   `json:"from,omitempty"`
+    To        time.Time   `json:"to,omitempty"`
+    CPU       MetricStats `json:"cpu"`          // Percent
+    Memory    MetricStats `json:"memory"`       // Used bytes
+    DiskRead  MetricStats `json:"disk_read"`    // Bytes per second
+    DiskWrite MetricStats `json:"disk_write"`   // Bytes per second
+    NetworkRX MetricStats `json:"network_rx"`   // Bytes per second
+    NetworkTX MetricStats `json:"network_tx"`   // Bytes per second
+}
+
+type MetricStats struct {
+    Min float64 `json:"min"`
+    Max float64 `json:"max"`
+    Avg float64 `json:"avg"`
+    P95 float64 `json:"p95"`
+}
+
+func (m *VPSManager) handleGetMetricsSummary(w http.ResponseWriter, r *http.Request) {
+    if !allowMethods(w, r, http.MethodGet, http.MethodHead) {
         return
     }
 
-    id := r.URL.Query().Get("id")
-    if id == "" {
-        http.Error(w, "Missing VPS ID", http.StatusBadRequest)
+    id, ok := m.vpsIDFromRequest(w, r)
+    if !ok {
         return
     }
 
+    window := 5 * time.Minute
+    if value := r.URL.Query().Get("window"); value != "" {
+        parsed, err := time.ParseDuration(value)
+        if err != nil || parsed <= 0 {
+            http.Error(w, fmt.Sprintf("invalid window: %s", value), http.StatusBadRequest)
+            return
+        }
+        window = parsed
+    }
+
     m.metricsMutex.RLock()
     cache, exists := m.metricsCache[id]
+    var history []ResourceMetrics
+    if exists {
+        history = make([]ResourceMetrics, len(cache.MetricsHistory))
+        copy(history, cache.MetricsHistory)
+    }
     m.metricsMutex.RUnlock()
 
     if !exists {
@@ -2033,8 +10620,192 @@ func (m *VPSManager) handleGetMetrics(w http.ResponseWriter, r *http.Request) {
         return
     }
 
+    writeJSONWithETag(w, r, summarizeMetrics(history, window, time.Now()))
+}
+
+// Serve the latest sample of every running VPS and a few service counters in
+// the Prometheus text format. Values come from metricsCache, nothing is
+// collected here.
+func (m *VPSManager) handlePrometheusMetrics(w http.ResponseWriter, r *http.Request) {
+    if !allowMethods(w, r, http.MethodGet, http.MethodHead) {
+        return
+    }
+
+    type instance struct {
+        id, name, imageType string
+    }
+    m.mutex.RLock()
+    var running []instance
+    for _, vps := range m.instances {
+        if vps.Status == StatusRunning {
+            running = append(running, instance{vps.ID, vps.Name, vps.ImageType})
+        }
+    }
+    total := len(m.instances)
+    created := m.createdTotal
+    m.mutex.RUnlock()
+    sort.Slice(running, func(i, j int) bool {
+        return running[i].id < running[j].id
+    })
+
+    samples := make(map[string]ResourceMetrics)
+    m.metricsMutex.RLock()
+    for _, inst := range running {
+        if cache, exists := m.metricsCache[inst.id]; exists && len(cache.MetricsHistory) > 0 {
+            samples[inst.id] = cache.MetricsHistory[len(cache.MetricsHistory)-1]
+        }
+    }
+    m.metricsMutex.RUnlock()
+
+    var out bytes.Buffer
+    gauges := []struct {
+        name, help string
+        value      func(ResourceMetrics) float64
+    }{
+        {"blstlite_vps_cpu_usage_percent", "CPU used by the guest's QEMU process, 0-100 of the host.", func(s ResourceMetrics) float64 { return s.CPU.Usage }},
+        {"blstlite_vps_memory_used_bytes", "Resident memory of the guest's QEMU process.", func(s ResourceMetrics) float64 { return float64(s.Memory.Used) }},
+        {"blstlite_vps_memory_total_bytes", "Memory assigned to the guest.", func(s ResourceMetrics) float64 { return float64(s.Memory.Total) }},
+        {"blstlite_vps_memory_balloon_bytes", "Memory the balloon leaves the guest, 0 without a balloon.", func(s ResourceMetrics) float64 { return float64(s.Memory.Balloon) }},
+        {"blstlite_vps_disk_read_bytes_per_second", "Guest disk reads.", func(s ResourceMetrics) float64 { return s.Disk.ReadSpeed }},
+        {"blstlite_vps_disk_write_bytes_per_second", "Guest disk writes.", func(s ResourceMetrics) float64 { return s.Disk.WriteSpeed }},
+        {"blstlite_vps_network_rx_bytes_per_second", "Bytes received by the guest.", func(s ResourceMetrics) float64 { return s.Network.RXSpeed }},
+        {"blstlite_vps_network_tx_bytes_per_second", "Bytes sent by the guest.", func(s ResourceMetrics) float64 { return s.Network.TXSpeed }},
+    }
+    for _, gauge := range gauges {
+        fmt.Fprintf(&out, "# HELP %s %s\n# TYPE %s gauge\n", gauge.name, gauge.help, gauge.name)
+        for _, inst := range running {
+            sample, exists := samples[inst.id]
+            if !exists {
+                continue
+            }
+            fmt.Fprintf(&out, "%s{id=\"%s\",name=\"%s\",image_type=\"%s\"} %s\n", gauge.name,
+                prometheusLabel(inst.id), prometheusLabel(inst.name), prometheusLabel(inst.imageType),
+                strconv.FormatFloat(gauge.value(sample), 'g', -1, 64))
+        }
+    }
+
+    fmt.Fprintf(&out, "# HELP blstlite_vps_created_total VPSes created since the service started.\n# TYPE blstlite_vps_created_total counter\nblstlite_vps_created_total %d\n", created)
+    fmt.Fprintf(&out, "# HELP blstlite_vps_running VPSes currently running.\n# TYPE blstlite_vps_running gauge\nblstlite_vps_running %d\n", len(running))
+    fmt.Fprintf(&out, "# HELP blstlite_vps_instances VPSes known to the service in any state.\n# TYPE blstlite_vps_instances gauge\nblstlite_vps_instances %d\n", total)
+
+    w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+    w.Write(out.Bytes())
+}
+
+// Helper function to escape a Prometheus label value
+func prometheusLabel(value string) string {
+    return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value)
+}
+
+// Helper function to roll up the samples newer than now-window. The history
+// only holds BLST_METRICS_HISTORY_SIZE samples (10 minutes' worth by default),
+// so longer windows cover what is available.
+func summarizeMetrics(history []ResourceMetrics, window time.Duration, now time.Time) MetricsSummary {
+    summary := MetricsSummary{Window: window.String()}
+
+    var cpu, memory, diskRead, diskWrite, netRX, netTX []float64
+    for _, sample := range history {
+        if sample.Time.Before(now.Add(-window)) {
+            continue
+        }
+        if summary.Samples == 0 {
+            summary.From = sample.Time
+        }
+        summary.To = sample.Time
+        summary.Samples++
+
+        cpu = append(cpu, sample.CPU.Usage)
+        memory = append(memory, float64(sample.Memory.Used))
+        diskRead = append(diskRead, sample.Disk.ReadSpeed)
+        diskWrite = append(diskWrite, sample.Disk.WriteSpeed)
+        netRX = append(netRX, sample.Network.RXSpeed)
+        netTX = append(netTX, sample.Network.TXSpeed)
+    }
+
+    summary.CPU = computeStats(cpu)
+    summary.Memory = computeStats(memory)
+    summary.DiskRead = computeStats(diskRead)
+    summary.DiskWrite = computeStats(diskWrite)
+    summary.NetworkRX = computeStats(netRX)
+    summary.NetworkTX = computeStats(netTX)
+    return summary
+}
+
+// Helper function to compute min/max/avg and nearest-rank p95
+func computeStats(values []float64) MetricStats {
+    if len(values) == 0 {
+        return MetricStats{}
+    }
+
+    sorted := make([]float64, len(values))
+    copy(sorted, values)
+    sort.Float64s(sorted)
+
+    var sum float64
+    for _, v := range sorted {
+        sum += v
+    }
+
+    rank := int(math.Ceil(0.95*float64(len(sorted)))) - 1
+    return MetricStats{
+        Min: sorted[0],
+        Max: sorted[len(sorted)-1],
+        Avg: sum / float64(len(sorted)),
+        P95: sorted[rank],
+    }
+}
+
+// Encode a small JSON response into a buffer first so it goes out with a
+// Content-Length instead of chunked. Streaming responses keep their encoders.
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+    var body bytes.Buffer
+    if err := json.NewEncoder(&body).Encode(v); err != nil {
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    w.Header().Set("Content-Length", strconv.Itoa(body.Len()))
+    w.WriteHeader(status)
+    w.Write(body.Bytes())
+}
+
+// Encode v as JSON with a weak ETag derived from the body, replying 304 Not
+// Modified when the client's If-None-Match already covers it
+func writeJSONWithETag(w http.ResponseWriter, r *http.Request, v interface{}) {
+    var body bytes.Buffer
+    if err := json.NewEncoder(&body).Encode(v); err != nil {
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+
+    sum := sha256.Sum256(body.Bytes())
+    etag := fmt.Sprintf(`W/"%x"`, sum[:16])
+    w.Header().Set("ETag", etag)
+    w.Header().Set("Cache-Control", "no-cache")
+
+    if etagMatches(r.Header.Get("If-None-Match"), etag) {
+        w.WriteHeader(http.StatusNotModified)
+        return
+    }
+
     w.Header().Set("Content-Type", "application/json")
-    json.NewEncoder(w).Encode(cache.MetricsHistory)
+    w.Header().Set("Content-Length", strconv.Itoa(body.Len()))
+    w.Write(body.Bytes())
+}
+
+// Weak comparison of an If-None-Match header against an ETag
+func etagMatches(header string, etag string) bool {
+    if header == "" {
+        return false
+    }
+    for _, candidate := range strings.Split(header, ",") {
+        candidate = strings.TrimSpace(candidate)
+        if candidate == "*" || strings.TrimPrefix(candidate, "W/") == strings.TrimPrefix(etag, "W/") {
+            return true
+        }
+    }
+    return false
 }
 
 
@@ -2073,31 +10844,32 @@ func (m *VPSManager) parseCPUMetrics(data []byte) CPUMetrics {
     return cpuMetrics
 }
 
-func (m *VPSManager) parseMemoryMetrics(data []byte) MemoryMetrics {
+// Read a query-memory-size-summary reply, then ask the VPS's balloon how much
+// of that it leaves the guest. Balloon is zero when there's no balloon.
+func (m *VPSManager) parseMemoryMetrics(monitorSocket string, data []byte) MemoryMetrics {
     var memMetrics MemoryMetrics
     
-    // Example JSON response from QEMU:
-    // {"base-memory": 4294967296, "plugged-memory": 0}
+    // Example QMP reply to query-memory-size-summary:
+    // {"return":{"base-memory": 4294967296, "plugged-memory": 0}}
     type MemInfo struct {
         BaseMemory    int64 `json:"base-memory"`
         PluggedMemory int64 `json:"plugged-memory"`
     }
     
     var memInfo MemInfo
-    if err := json.Unmarshal(data, &memInfo); err != nil {
+    if err := parseQMPReturn(data, &memInfo); err != nil {
         return memMetrics
     }
 
     memMetrics.Total = memInfo.BaseMemory + memInfo.PluggedMemory
     
-    // Try to get actual memory usage from balloon device
-    if balloonData, err := m.executeQMPCommand(filepath.Join(m.baseDir, "monitor.sock"), "query-balloon"); err == nil {
+    if balloonData, err := m.executeQMPCommand(monitorSocket, `{ "execute": "query-balloon" }`); err == nil {
         type BalloonInfo struct {
             Actual int64 `json:"actual"`
         }
         var balloonInfo BalloonInfo
-        if err := json.Unmarshal(balloonData, &balloonInfo); err == nil {
-            memMetrics.Used = balloonInfo.Actual
+        if err := parseQMPReturn(balloonData, &balloonInfo); err == nil {
+            memMetrics.Balloon = balloonInfo.Actual
         }
     }
 
@@ -2107,8 +10879,8 @@ func (m *VPSManager) parseMemoryMetrics(data []byte) MemoryMetrics {
 func (m *VPSManager) parseDiskMetrics(data []byte) DiskMetrics {
     var diskMetrics DiskMetrics
     
-    // Example JSON response from QEMU:
-    // [{"device":"drive-virtio-disk0","stats":{"rd_bytes":1234,"wr_bytes":5678,"rd_operations":10,"wr_operations":20}}]
+    // Example QMP reply to query-blockstats:
+    // {"return":[{"device":"ide0-hd0","stats":{"rd_bytes":1234,"wr_bytes":5678,"rd_operations":10,"wr_operations":20}}]}
     type BlockStats struct {
         Stats struct {
             ReadBytes    int64 `json:"rd_bytes"`
@@ -2119,7 +10891,7 @@ func (m *VPSManager) parseDiskMetrics(data []byte) DiskMetrics {
     }
     
     var blockInfos []BlockStats
-    if err := json.Unmarshal(data, &blockInfos); err != nil {
+    if err := parseQMPReturn(data, &blockInfos); err != nil {
         return diskMetrics
     }
 
@@ -2134,18 +10906,86 @@ func (m *VPSManager) parseDiskMetrics(data []byte) DiskMetrics {
     return diskMetrics
 }
 
-func (m *VPSManager) parseNetworkMetrics(data []byte) NetworkMetrics {
+// Record the address a bridged VPS's primary NIC got from the LAN's DHCP
+// server. Only the guest knows it, so this needs the guest agent; without one
+// GuestIP stays empty.
+func (m *VPSManager) refreshGuestIP(vps *VPS) {
+    m.mutex.RLock()
+    nic := m.vpsNICs(vps)[0]
+    m.mutex.RUnlock()
+    if nic.Type != NetworkModeBridge {
+        return
+    }
+
+    agentSocket := filepath.Join(m.baseDir, "disks", vps.ID, "qemu-ga.sock")
+    output, err := executeGuestAgentCommand(agentSocket, `{"execute":"guest-network-get-interfaces"}`, GUEST_AGENT_METRICS_TIMEOUT)
+    if err != nil {
+        return
+    }
+    ip := parseGuestIP(output, nicMAC(vps.ID, 0, nic))
+    if ip == "" {
+        return
+    }
+
+    m.mutex.Lock()
+    defer m.mutex.Unlock()
+    if vps.GuestIP != ip {
+        vps.GuestIP = ip
+        m.saveStateLocked()
+    }
+}
+
+// Helper function to pick the address of the interface with the given MAC
+// from a guest-network-get-interfaces reply, preferring IPv4 and skipping
+// link-local addresses
+func parseGuestIP(data []byte, mac string) string {
+    var interfaces []struct {
+        HardwareAddress string `json:"hardware-address"`
+        IPAddresses     []struct {
+            Address string `json:"ip-address"`
+        } `json:"ip-addresses"`
+    }
+    if err := json.Unmarshal(data, &interfaces); err != nil {
+        return ""
+    }
+
+    var fallback string
+    for _, iface := range interfaces {
+        if !strings.EqualFold(iface.HardwareAddress, mac) {
+            continue
+        }
+        for _, addr := range iface.IPAddresses {
+            ip := net.ParseIP(addr.Address)
+            if ip == nil || ip.IsLinkLocalUnicast() || ip.IsLoopback() {
+                continue
+            }
+            if ip.To4() != nil {
+                return ip.String()
+            }
+            if fallback == "" {
+                fallback = ip.String()
+            }
+        }
+    }
+    return fallback
+}
+
+// Parse the guest agent's guest-network-get-interfaces reply. Only
+// interfaces whose MAC is in macs count, which leaves out lo and anything
+// the guest created itself; each is named after the netdev id macs maps to.
+func (m *VPSManager) parseNetworkMetrics(data []byte, macs map[string]string) NetworkMetrics {
     var netMetrics NetworkMetrics
     
-    // Example JSON response from QEMU:
-    // [{"name":"net0","stats":{"rx_bytes":1234,"tx_bytes":5678,"rx_packets":10,"tx_packets":20}}]
+    // Example guest agent reply:
+    // [{"name":"eth0","hardware-address":"52:54:00:12:34:56","statistics":{"rx-bytes":1234,"tx-bytes":5678,"rx-packets":10,"tx-packets":20}}]
     type NetStats struct {
-        Stats struct {
-            RXBytes     int64 `json:"rx_bytes"`
-            TXBytes     int64 `json:"tx_bytes"`
-            RXPackets   int64 `json:"rx_packets"`
-            TXPackets   int64 `json:"tx_packets"`
-        } `json:"stats"`
+        HardwareAddress string `json:"hardware-address"`
+        Statistics *struct {
+            RXBytes     int64 `json:"rx-bytes"`
+            TXBytes     int64 `json:"tx-bytes"`
+            RXPackets   int64 `json:"rx-packets"`
+            TXPackets   int64 `json:"tx-packets"`
+        } `json:"statistics"`
     }
     
     var netInfos []NetStats
@@ -2153,12 +10993,24 @@ func (m *VPSManager) parseNetworkMetrics(data []byte) NetworkMetrics {
         return netMetrics
     }
 
-    // Sum up stats from all network interfaces
-    for _, net := range netInfos {
-        netMetrics.RXBytes += net.Stats.RXBytes
-        netMetrics.TXBytes += net.Stats.TXBytes
-        netMetrics.RXPackets += net.Stats.RXPackets
-        netMetrics.TXPackets += net.Stats.TXPackets
+    // Sum up stats from the guest's interfaces on our NICs
+    for _, iface := range netInfos {
+        name, ours := macs[strings.ToLower(iface.HardwareAddress)]
+        if !ours || iface.Statistics == nil {
+            continue
+        }
+        stats := InterfaceMetrics{
+            Name:      name,
+            RXBytes:   iface.Statistics.RXBytes,
+            TXBytes:   iface.Statistics.TXBytes,
+            RXPackets: iface.Statistics.RXPackets,
+            TXPackets: iface.Statistics.TXPackets,
+        }
+        netMetrics.RXBytes += stats.RXBytes
+        netMetrics.TXBytes += stats.TXBytes
+        netMetrics.RXPackets += stats.RXPackets
+        netMetrics.TXPackets += stats.TXPackets
+        netMetrics.Interfaces = append(netMetrics.Interfaces, stats)
     }
 
     return netMetrics
@@ -2199,23 +11051,37 @@ func getThreadCPUUsage(threadID int) float64 {
 
 
 
+// Wrap handlers that block on QEMU or the guest agent so a stuck operation
+// returns 503 instead of holding the connection open indefinitely
+func withTimeout(handler http.HandlerFunc) http.Handler {
+    return http.TimeoutHandler(handler, LONG_REQUEST_TIMEOUT, "Request timed out")
+}
+
 func main() {
+    baseDir := "/var/lib/vps-service"
+    if err := setupLogFile(baseDir); err != nil {
+        log.Fatal(err)
+    }
+
     log.Printf("Verifying system requirements...")
     if err := verifySystemRequirements(); err != nil {
         log.Fatal(err)
     }
+    if output, err := exec.Command("ls", "-l", "/dev/kvm").CombinedOutput(); err == nil {
+        log.Printf("KVM device permissions: %s", string(output))
+    }
 
-    apiKey := os.Getenv("API_KEY")
-    if apiKey == "" {
-        log.Fatal("API_KEY environment variable is required")
+    apiKeys, err := loadAPIKeys()
+    if err != nil {
+        log.Fatal(err)
     }
 
-    baseDir := "/var/lib/vps-service"
     for _, dir := range []string{
         baseDir,
         filepath.Join(baseDir, "base"),
         filepath.Join(baseDir, "disks"),
         filepath.Join(baseDir, "logs"),
+        filepath.Join(baseDir, "uploads"),
     } {
         if err := os.MkdirAll(dir, 0755); err != nil {
             log.Fatalf("Failed to create directory %s: %v", dir, err)
@@ -2255,17 +11121,178 @@ func main() {
     apiMux.HandleFunc("/api/vps/list", manager.handleListVPS)
     apiMux.HandleFunc("/api/vps/get", manager.handleGetVPS)
     apiMux.HandleFunc("/api/vps/progress", manager.handleGetProgress)
+    apiMux.HandleFunc("/api/vps/progress/ws", manager.handleProgressWS)
     apiMux.HandleFunc("/api/images/list", manager.handleListImages)
+    apiMux.Handle("/api/images", withTimeout(manager.handleDeleteImage))
     apiMux.HandleFunc("/api/vps/delete", manager.handleDeleteVPS)
-    apiMux.HandleFunc("/api/vps/restart", manager.handleRestartVPS)
-    apiMux.HandleFunc("/api/vps/start", manager.handleStartVPS)
+    apiMux.Handle("/api/vps/restart", withTimeout(manager.handleRestartVPS))
+    apiMux.Handle("/api/vps/start", withTimeout(manager.handleStartVPS))
+    apiMux.Handle("/api/vps/reboot", withTimeout(manager.handleRebootVPS))
+    apiMux.Handle("/api/vps/attach-iso", withTimeout(manager.handleAttachISO))
+    apiMux.Handle("/api/vps/eject-iso", withTimeout(manager.handleEjectISO))
+    apiMux.HandleFunc("/api/vps/repair-disk", manager.handleRepairDisk)
+    apiMux.HandleFunc("/api/vps/move", manager.handleMoveDisk)
+    apiMux.HandleFunc("/api/vps/clone", manager.handleCloneVPS)
+    apiMux.Handle("/api/vps/snapshot/create", withTimeout(manager.handleSnapshot))
+    apiMux.Handle("/api/vps/snapshot/restore", withTimeout(manager.handleSnapshot))
+    apiMux.Handle("/api/vps/snapshot/list", withTimeout(manager.handleSnapshot))
+    apiMux.Handle("/api/vps/throttle", withTimeout(manager.handleThrottle))
+    apiMux.Handle("/api/vps/resize-disk", withTimeout(manager.handleResizeDisk))
+    apiMux.Handle("/api/vps/set-vcpus", withTimeout(manager.handleSetVCPUs))
+    apiMux.Handle("/api/vps/set-memory", withTimeout(manager.handleSetMemory))
     apiMux.HandleFunc("/api/vps/metrics", manager.handleGetMetrics)
-    apiMux.HandleFunc("/api/vps/stop", manager.handleStopVPS)
+    apiMux.HandleFunc("/api/vps/metrics/summary", manager.handleGetMetricsSummary)
+    apiMux.Handle("/api/vps/stop", withTimeout(manager.handleStopVPS))
+    apiMux.Handle("/api/vps/pause", withTimeout(manager.handlePauseVPS))
+    apiMux.HandleFunc("/api/vps/extend", manager.handleExtendVPS)
+    apiMux.Handle("/api/vps/resume", withTimeout(manager.handleResumeVPS))
+    apiMux.Handle("/api/vps/set-hostname", withTimeout(manager.handleSetHostname))
+    apiMux.HandleFunc("/api/vps/rebuild", manager.handleRebuildVPS)
     apiMux.HandleFunc("/api/templates/list", manager.handleListTemplates)
+    apiMux.HandleFunc("/api/templates/create", manager.handleCreateTemplate)
+    apiMux.HandleFunc("/api/system/orphans", manager.handleOrphans)
+    apiMux.HandleFunc("/api/system/selftest", manager.handleSelfTest)
+    apiMux.HandleFunc("/api/vps/console-token", manager.handleConsoleToken)
+    apiMux.HandleFunc("/api/vps/vnc", manager.handleVNC)
+    apiMux.HandleFunc("/api/vps/console", manager.handleSerialConsole)
+    apiMux.Handle("/api/vps/screenshot", withTimeout(manager.handleScreenshot))
+    apiMux.HandleFunc("/api/events", manager.handleEvents)
+    apiMux.HandleFunc("/api/vps/stats", manager.handleVPSStats)
+    apiMux.HandleFunc("/api/vps/wait", manager.handleWaitVPS)
+    apiMux.HandleFunc("/api/vps/cloud-init", manager.handleGetCloudInit)
     
-    http.Handle("/api/", NewAuthMiddleware(apiKey, apiMux))
+    // Set BLST_GZIP=false to get uncompressed responses when debugging
+    var apiHandler http.Handler = apiMux
+    if getEnvBool("BLST_GZIP", true) {
+        apiHandler = NewGzipMiddleware(apiMux)
+    } else {
+        log.Printf("Response compression disabled")
+    }
+
+    authHandler := NewAuthMiddleware(apiKeys, apiHandler)
+    http.Handle("/api/", authHandler)
+    http.HandleFunc("/api/openapi.json", handleOpenAPISpec)
+    // Browsers can't set headers on a WebSocket, so the console also accepts
+    // a console token in place of the API key
+    http.HandleFunc("/api/vps/vnc", func(w http.ResponseWriter, r *http.Request) {
+        if r.URL.Query().Get("token") != "" {
+            manager.handleVNC(w, r)
+            return
+        }
+        authHandler.ServeHTTP(w, r)
+    })
+    http.HandleFunc("/api/vps/console", func(w http.ResponseWriter, r *http.Request) {
+        if r.URL.Query().Get("token") != "" {
+            manager.handleSerialConsole(w, r)
+            return
+        }
+        authHandler.ServeHTTP(w, r)
+    })
+    // Probes for load balancers and orchestrators, which have no API key
+    http.HandleFunc("/healthz", handleHealthz)
+    http.HandleFunc("/readyz", manager.handleReadyz)
+    // Fetched by smbios-seeded guests, which authenticate with a seed token
+    http.HandleFunc("/seed/", manager.handleSeed)
+    // Prometheus sends the scrape token as a bearer token, not an API key
+    if token := os.Getenv("BLST_METRICS_TOKEN"); token != "" {
+        http.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+            if !hmac.Equal([]byte(r.Header.Get("Authorization")), []byte("Bearer "+token)) {
+                http.Error(w, "Unauthorized", http.StatusUnauthorized)
+                return
+            }
+            manager.handlePrometheusMetrics(w, r)
+        })
+        log.Printf("Prometheus metrics served at /metrics")
+    }
     http.Handle("/novnc/", http.StripPrefix("/novnc/", http.FileServer(http.Dir("/usr/share/novnc"))))
 
-    log.Printf("Server starting on :8080")
-    log.Fatal(http.ListenAndServe(":8080", nil))
+    listenAddress := getEnvString("BLST_LISTEN_ADDRESS", DEFAULT_LISTEN_ADDRESS)
+    server := &http.Server{
+        Addr:              listenAddress,
+        ReadHeaderTimeout: 10 * time.Second,
+        ReadTimeout:       30 * time.Second,
+        WriteTimeout:      LONG_REQUEST_TIMEOUT + 30*time.Second,
+        IdleTimeout:       120 * time.Second,
+    }
+
+    // Without a certificate API keys cross the wire in cleartext, which is
+    // only fine for local development
+    certFile, keyFile := os.Getenv("TLS_CERT_FILE"), os.Getenv("TLS_KEY_FILE")
+    if (certFile == "") != (keyFile == "") {
+        log.Fatal("TLS_CERT_FILE and TLS_KEY_FILE must be set together")
+    }
+    if certFile == "" {
+        log.Printf("Warning: TLS_CERT_FILE not set, serving plain HTTP")
+        log.Printf("Server starting on %s", listenAddress)
+        log.Fatal(server.ListenAndServe())
+    }
+
+    if redirectAddress := os.Getenv("BLST_HTTP_REDIRECT_ADDRESS"); redirectAddress != "" {
+        redirect, err := newHTTPSRedirect(listenAddress)
+        if err != nil {
+            log.Fatal(err)
+        }
+        go func() {
+            redirectServer := &http.Server{
+                Addr:              redirectAddress,
+                Handler:           redirect,
+                ReadHeaderTimeout: 10 * time.Second,
+                IdleTimeout:       120 * time.Second,
+            }
+            log.Printf("Redirecting HTTP on %s to HTTPS", redirectAddress)
+            log.Fatal(redirectServer.ListenAndServe())
+        }()
+    }
+
+    log.Printf("Server starting on %s with TLS", listenAddress)
+    log.Fatal(server.ListenAndServeTLS(certFile, keyFile))
+}
+
+// Work out the base URL smbios-seeded guests fetch /seed/ from. Unless
+// BLST_SEED_URL says otherwise that is this service as user-mode NAT guests
+// see the host, on the port BLST_LISTEN_ADDRESS listens on. A TLS listener
+// needs BLST_SEED_URL, since guests can't verify a certificate for 10.0.2.2.
+func seedURLFromEnv() (string, error) {
+    if seedURL := os.Getenv("BLST_SEED_URL"); seedURL != "" {
+        return strings.TrimSuffix(seedURL, "/"), nil
+    }
+    if os.Getenv("TLS_CERT_FILE") != "" {
+        return "", fmt.Errorf("BLST_SEED_URL is required for smbios seeding when serving TLS")
+    }
+    listenAddress := getEnvString("BLST_LISTEN_ADDRESS", DEFAULT_LISTEN_ADDRESS)
+    _, port, err := net.SplitHostPort(listenAddress)
+    if err != nil {
+        return "", fmt.Errorf("invalid BLST_LISTEN_ADDRESS %q: %v", listenAddress, err)
+    }
+    return "http://10.0.2.2:" + port, nil
+}
+
+// Send plain HTTP requests to the same host and path on the TLS listener.
+// Only GET and HEAD are redirected, anything else would have already sent
+// its API key in the clear and is refused so clients notice.
+func newHTTPSRedirect(listenAddress string) (http.Handler, error) {
+    _, port, err := net.SplitHostPort(listenAddress)
+    if err != nil {
+        return nil, fmt.Errorf("invalid BLST_LISTEN_ADDRESS %q: %v", listenAddress, err)
+    }
+
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        if r.Method != http.MethodGet && r.Method != http.MethodHead {
+            http.Error(w, "HTTPS required", http.StatusBadRequest)
+            return
+        }
+        host := r.Host
+        if h, _, err := net.SplitHostPort(r.Host); err == nil {
+            host = h
+        }
+        if host == "" {
+            http.Error(w, "Missing Host header", http.StatusBadRequest)
+            return
+        }
+        target := "https://" + formatHostAddress(strings.Trim(host, "[]"))
+        if port != "443" {
+            target += ":" + port
+        }
+        http.Redirect(w, r, target+r.URL.RequestURI(), http.StatusMovedPermanently)
+    }), nil
 }
\ No newline at end of file
@@ -0,0 +1,1204 @@
+package main
+
+import (
+    "bufio"
+    "context"
+    "crypto/sha256"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "log"
+    "net"
+    "net/http"
+    "net/http/httptest"
+    "os"
+    "os/exec"
+    "path/filepath"
+    "regexp"
+    "slices"
+    "strconv"
+    "strings"
+    "testing"
+    "time"
+)
+
+// A manager with just enough state for the code under test, rooted in a
+// temporary directory instead of /var/lib/vps-service
+func newTestManager(t *testing.T) *VPSManager {
+    t.Helper()
+    m := &VPSManager{
+        instances:     make(map[string]*VPS),
+        ipInstances:   make(map[string][]string),
+        baseDir:       t.TempDir(),
+        bindAddress:   "127.0.0.1",
+        vncPorts:      portRange{First: 47000, Last: 47099},
+        launchSlots:   make(chan struct{}, 1),
+        createSlots:   make(chan struct{}, 1),
+        queuedCreates: make(map[string]context.CancelFunc),
+        createTimeout: time.Minute,
+        events:        newEventHub(),
+        expiryTimers:  make(map[string]*time.Timer),
+        metricsCache:  make(map[string]*MetricsCache),
+    }
+    m.ctx, m.cancel = context.WithCancel(context.Background())
+    t.Cleanup(m.cancel)
+    for _, dir := range []string{"disks", "keys", "logs"} {
+        if err := os.MkdirAll(filepath.Join(m.baseDir, dir), 0755); err != nil {
+            t.Fatal(err)
+        }
+    }
+    return m
+}
+
+// Serve canned QMP replies on a unix socket, keyed by the command's execute
+// name, the way QEMU's monitor would
+func fakeQMPSocket(t *testing.T, replies map[string]string) string {
+    t.Helper()
+    socket := filepath.Join(t.TempDir(), "qemu-monitor.sock")
+    listener, err := net.Listen("unix", socket)
+    if err != nil {
+        t.Fatalf("failed to listen on %s: %v", socket, err)
+    }
+    t.Cleanup(func() { listener.Close() })
+
+    go func() {
+        for {
+            conn, err := listener.Accept()
+            if err != nil {
+                return
+            }
+            go func(conn net.Conn) {
+                defer conn.Close()
+                conn.Write([]byte(`{"QMP": {"version": {}, "capabilities": []}}` + "\n"))
+                scanner := bufio.NewScanner(conn)
+                for scanner.Scan() {
+                    reply := `{"error": {"class": "CommandNotFound", "desc": "unknown command"}}`
+                    if strings.Contains(scanner.Text(), `"qmp_capabilities"`) {
+                        reply = `{"return": {}}`
+                    }
+                    for command, canned := range replies {
+                        if strings.Contains(scanner.Text(), `"`+command+`"`) {
+                            reply = canned
+                        }
+                    }
+                    conn.Write([]byte(reply + "\n"))
+                }
+            }(conn)
+        }
+    }()
+    return socket
+}
+
+func TestParseMemoryMetricsUsesBalloon(t *testing.T) {
+    socket := fakeQMPSocket(t, map[string]string{
+        "query-balloon": `{"return": {"actual": 1073741824}}`,
+    })
+    m := &VPSManager{}
+
+    summary := []byte(`{"return": {"base-memory": 2147483648, "plugged-memory": 0}}`)
+    metrics := m.parseMemoryMetrics(socket, summary)
+    if metrics.Total != 2147483648 {
+        t.Errorf("Total = %d, want 2147483648", metrics.Total)
+    }
+    if metrics.Balloon != 1073741824 {
+        t.Errorf("Balloon = %d, want 1073741824", metrics.Balloon)
+    }
+}
+
+func TestParseMemoryMetricsWithoutBalloon(t *testing.T) {
+    // QEMU answers query-balloon with an error when there's no balloon device
+    socket := fakeQMPSocket(t, map[string]string{
+        "query-balloon": `{"error": {"class": "DeviceNotActive", "desc": "No balloon device has been activated"}}`,
+    })
+    m := &VPSManager{}
+
+    summary := []byte(`{"return": {"base-memory": 2147483648, "plugged-memory": 0}}`)
+    metrics := m.parseMemoryMetrics(socket, summary)
+    if metrics.Total != 2147483648 || metrics.Balloon != 0 {
+        t.Errorf("got Total %d Balloon %d, want 2147483648 and 0", metrics.Total, metrics.Balloon)
+    }
+}
+
+func TestCollectMetricsKeepsRSSAsUsed(t *testing.T) {
+    m := newTestManager(t)
+    // This test process stands in for QEMU, its /proc entries are real
+    vps := &VPS{ID: "vps1", Status: "running", MemoryMB: 2048, QEMUPid: os.Getpid()}
+    m.instances[vps.ID] = vps
+
+    // A balloon that hasn't been inflated reports all of guest memory
+    socket := fakeQMPSocket(t, map[string]string{
+        "query-memory-size-summary": `{"return": {"base-memory": 2147483648, "plugged-memory": 0}}`,
+        "query-balloon":             `{"return": {"actual": 2147483648}}`,
+    })
+    instanceDir := filepath.Join(m.baseDir, "disks", vps.ID)
+    if err := os.MkdirAll(instanceDir, 0755); err != nil {
+        t.Fatal(err)
+    }
+    if err := os.Symlink(socket, filepath.Join(instanceDir, "qemu-monitor.sock")); err != nil {
+        t.Fatal(err)
+    }
+
+    metrics, err := m.collectMetrics(vps.ID)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if metrics.Memory.Used <= 0 || metrics.Memory.Used >= metrics.Memory.Total {
+        t.Errorf("Used = %d, want this process's RSS, below Total %d", metrics.Memory.Used, metrics.Memory.Total)
+    }
+    if metrics.Memory.Balloon != 2147483648 {
+        t.Errorf("Balloon = %d, want 2147483648", metrics.Memory.Balloon)
+    }
+}
+
+func TestFailedCreateLeaksNothing(t *testing.T) {
+    m := newTestManager(t)
+    m.removeFailed = true
+
+    // Taps and cgroups need root, so only record what would be removed
+    removedTaps := make(chan string, 1)
+    removedCgroups := make(chan string, 1)
+    oldTaps, oldCgroup := teardownTaps, teardownCgroup
+    teardownTaps = func(id string) { removedTaps <- id }
+    teardownCgroup = func(id string) { removedCgroups <- id }
+    t.Cleanup(func() { teardownTaps, teardownCgroup = oldTaps, oldCgroup })
+
+    m.mutex.Lock()
+    port, err := m.allocatePortLocked(m.vncPorts, m.hostPortsInUseLocked())
+    if err != nil {
+        m.mutex.Unlock()
+        t.Fatal(err)
+    }
+    vps := &VPS{
+        ID:        "5f0c7a52-0000-4000-8000-000000000001",
+        Name:      "leaky",
+        Hostname:  "leaky.vps.local",
+        Owner:     "alice",
+        Status:    "creating",
+        ImageType: "no-such-image", // Fails once the create slot is held
+        VNCPort:   port,
+        ExpiresAt: time.Now().Add(time.Hour),
+    }
+    m.instances[vps.ID] = vps
+    m.ipInstances["192.0.2.1"] = []string{vps.ID}
+    m.mutex.Unlock()
+
+    // What earlier stages leave behind. Building them for real needs
+    // qemu-img and a base image.
+    instanceDir := filepath.Join(m.baseDir, "disks", vps.ID)
+    if err := os.MkdirAll(instanceDir, 0755); err != nil {
+        t.Fatal(err)
+    }
+    if err := os.WriteFile(filepath.Join(instanceDir, "disk.qcow2"), []byte("overlay"), 0644); err != nil {
+        t.Fatal(err)
+    }
+    if err := os.WriteFile(m.diskKeyPath(vps.ID), []byte("key"), 0600); err != nil {
+        t.Fatal(err)
+    }
+
+    // As the create worker in CreateVPS does
+    createErr := m.createVPSWithProgress(vps)
+    if createErr == nil {
+        t.Fatal("create of an unsupported image succeeded")
+    }
+    m.markFailed(vps, createErr)
+
+    if _, err := os.Stat(instanceDir); !os.IsNotExist(err) {
+        t.Errorf("instance directory left behind: %v", err)
+    }
+    if _, err := os.Stat(m.diskKeyPath(vps.ID)); !os.IsNotExist(err) {
+        t.Errorf("disk key left behind: %v", err)
+    }
+    for name, removed := range map[string]chan string{"tap": removedTaps, "cgroup": removedCgroups} {
+        select {
+        case id := <-removed:
+            if id != vps.ID {
+                t.Errorf("%s of %s removed, want %s", name, id, vps.ID)
+            }
+        case <-time.After(5 * time.Second):
+            t.Errorf("%s never removed", name)
+        }
+    }
+    if held := len(m.createSlots); held != 0 {
+        t.Errorf("%d create slots still held", held)
+    }
+
+    m.mutex.Lock()
+    defer m.mutex.Unlock()
+    if _, exists := m.instances[vps.ID]; exists {
+        t.Error("failed VPS still listed with BLST_REMOVE_FAILED set")
+    }
+    if live := m.liveVPSesForIPLocked("192.0.2.1"); len(live) != 0 {
+        t.Errorf("failed VPS still counts against its IP: %v", live)
+    }
+    again, err := m.allocatePortLocked(m.vncPorts, m.hostPortsInUseLocked())
+    if err != nil || again != port {
+        t.Errorf("next VNC port = %d, %v, want the freed %d", again, err, port)
+    }
+}
+
+func TestMarkFailedKeepsRecord(t *testing.T) {
+    m := newTestManager(t)
+    vps := &VPS{ID: "5f0c7a52-0000-4000-8000-000000000002", Status: "creating", ExpiresAt: time.Now().Add(time.Hour)}
+    m.instances[vps.ID] = vps
+
+    m.markFailed(vps, errInvalidDiskSize)
+
+    if vps.Status != "failed" || vps.Stage != StageFailed || vps.ErrorMsg != errInvalidDiskSize.Error() {
+        t.Errorf("got status %q stage %q error %q", vps.Status, vps.Stage, vps.ErrorMsg)
+    }
+    if _, exists := m.instances[vps.ID]; !exists {
+        t.Error("failed VPS dropped without BLST_REMOVE_FAILED")
+    }
+}
+
+// Add a stopped VPS owned by owner to m
+func addTestVPS(m *VPSManager, id, name, owner string) *VPS {
+    vps := &VPS{
+        ID:             id,
+        Name:           name,
+        Owner:          owner,
+        Status:         StatusStopped,
+        StandaloneDisk: true,
+        ExpiresAt:      time.Now().Add(time.Hour),
+    }
+    m.mutex.Lock()
+    m.instances[id] = vps
+    m.mutex.Unlock()
+    return vps
+}
+
+var testAPIKeys = map[string]apiIdentity{
+    "admin-key":    {Owner: ADMIN_OWNER, Role: RoleAdmin},
+    "alice-key":    {Owner: "alice", Role: RoleOperator},
+    "bob-key":      {Owner: "bob", Role: RoleOperator},
+    "readonly-key": {Owner: "alice", Role: RoleReadOnly},
+}
+
+// Send a request through AuthMiddleware as the holder of key
+func serveAs(handler http.Handler, key, method, target string) *httptest.ResponseRecorder {
+    r := httptest.NewRequest(method, target, nil)
+    r.Header.Set("X-API-Key", key)
+    w := httptest.NewRecorder()
+    NewAuthMiddleware(testAPIKeys, handler).ServeHTTP(w, r)
+    return w
+}
+
+func TestCanAccess(t *testing.T) {
+    alices := &VPS{ID: "a", Owner: "alice"}
+    bobs := &VPS{ID: "b", Owner: "bob"}
+
+    tests := []struct {
+        key        string
+        alice, bob bool
+    }{
+        {"admin-key", true, true},
+        {"alice-key", true, false},
+        {"bob-key", false, true},
+        {"readonly-key", true, false},
+    }
+    for _, tt := range tests {
+        identity := testAPIKeys[tt.key]
+        if got := identity.canAccess(alices); got != tt.alice {
+            t.Errorf("%s canAccess(alice's VPS) = %v, want %v", tt.key, got, tt.alice)
+        }
+        if got := identity.canAccess(bobs); got != tt.bob {
+            t.Errorf("%s canAccess(bob's VPS) = %v, want %v", tt.key, got, tt.bob)
+        }
+    }
+}
+
+func TestReadOnlyKeyOnlyReads(t *testing.T) {
+    m := newTestManager(t)
+    addTestVPS(m, "5f0c7a52-0000-4000-8000-00000000000a", "web", "alice")
+    handler := http.HandlerFunc(m.handleListVPS)
+
+    if w := serveAs(handler, "readonly-key", http.MethodGet, "/api/vps/list"); w.Code != http.StatusOK {
+        t.Errorf("read-only GET = %d, want 200", w.Code)
+    }
+    for _, target := range []string{"/api/vps/delete?id=x", "/api/vps/create"} {
+        if w := serveAs(handler, "readonly-key", http.MethodPost, target); w.Code != http.StatusForbidden {
+            t.Errorf("read-only POST %s = %d, want 403", target, w.Code)
+        }
+    }
+    if w := serveAs(handler, "readonly-key", http.MethodGet, "/api/vps/console?id=x"); w.Code != http.StatusForbidden {
+        t.Errorf("read-only console = %d, want 403", w.Code)
+    }
+}
+
+func TestVPSIDFromRequestHidesOtherOwners(t *testing.T) {
+    m := newTestManager(t)
+    alices := addTestVPS(m, "5f0c7a52-0000-4000-8000-00000000000a", "web", "alice")
+    handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        if id, ok := m.vpsIDFromRequest(w, r); ok {
+            w.Write([]byte(id))
+        }
+    })
+
+    tests := []struct {
+        key, target string
+        want        int
+    }{
+        {"alice-key", "/api/vps/get?id=" + alices.ID, http.StatusOK},
+        {"admin-key", "/api/vps/get?id=" + alices.ID, http.StatusOK},
+        {"bob-key", "/api/vps/get?id=" + alices.ID, http.StatusNotFound},
+        {"alice-key", "/api/vps/get?name=web", http.StatusOK},
+        {"bob-key", "/api/vps/get?name=web", http.StatusNotFound},
+    }
+    for _, tt := range tests {
+        w := serveAs(handler, tt.key, http.MethodGet, tt.target)
+        if w.Code != tt.want {
+            t.Errorf("%s %s = %d, want %d", tt.key, tt.target, w.Code, tt.want)
+        }
+        if w.Code == http.StatusOK && w.Body.String() != alices.ID {
+            t.Errorf("%s %s resolved %q, want %s", tt.key, tt.target, w.Body.String(), alices.ID)
+        }
+    }
+}
+
+func TestListShowsOnlyOwnVPSes(t *testing.T) {
+    m := newTestManager(t)
+    addTestVPS(m, "5f0c7a52-0000-4000-8000-00000000000a", "web", "alice")
+    addTestVPS(m, "5f0c7a52-0000-4000-8000-00000000000b", "db", "alice")
+    addTestVPS(m, "5f0c7a52-0000-4000-8000-00000000000c", "web", "bob")
+
+    tests := []struct {
+        key, target string
+        want        []string
+    }{
+        {"alice-key", "/api/vps/list", []string{"alice", "alice"}},
+        {"bob-key", "/api/vps/list", []string{"bob"}},
+        {"readonly-key", "/api/vps/list", []string{"alice", "alice"}},
+        // Only admins can look at another owner
+        {"bob-key", "/api/vps/list?owner=alice", []string{"bob"}},
+        {"admin-key", "/api/vps/list", []string{"alice", "alice", "bob"}},
+        {"admin-key", "/api/vps/list?owner=bob", []string{"bob"}},
+    }
+    for _, tt := range tests {
+        w := serveAs(http.HandlerFunc(m.handleListVPS), tt.key, http.MethodGet, tt.target)
+        if w.Code != http.StatusOK {
+            t.Fatalf("%s %s = %d: %s", tt.key, tt.target, w.Code, w.Body.String())
+        }
+        var listed []VPS
+        if err := json.Unmarshal(w.Body.Bytes(), &listed); err != nil {
+            t.Fatalf("%s %s: %v", tt.key, tt.target, err)
+        }
+        var owners []string
+        for _, vps := range listed {
+            owners = append(owners, vps.Owner)
+        }
+        slices.Sort(owners)
+        if !slices.Equal(owners, tt.want) {
+            t.Errorf("%s %s listed owners %v, want %v", tt.key, tt.target, owners, tt.want)
+        }
+    }
+}
+
+func TestHashPasswordFormat(t *testing.T) {
+    hash, err := hashPassword("correct horse")
+    if err != nil {
+        t.Fatal(err)
+    }
+    format := regexp.MustCompile(`^\$6\$rounds=5000\$([./0-9A-Za-z]{16})\$[./0-9A-Za-z]{86}$`)
+    match := format.FindStringSubmatch(hash)
+    if match == nil {
+        t.Fatalf("hash %q is not $6$rounds=5000$<16 char salt>$<86 char hash>", hash)
+    }
+    if again := sha512Crypt([]byte("correct horse"), []byte(match[1])); again != hash {
+        t.Errorf("rehashing with the same salt gave %q, want %q", again, hash)
+    }
+
+    other, err := hashPassword("correct horse")
+    if err != nil {
+        t.Fatal(err)
+    }
+    if other == hash {
+        t.Error("two hashes of one password share a salt")
+    }
+}
+
+// Test vectors from Ulrich Drepper's SHA-crypt specification, as used by glibc
+func TestSHA512CryptReferenceVectors(t *testing.T) {
+    tests := []struct {
+        key, salt, want string
+    }{
+        // Salts are truncated to 16 characters
+        {"This is just a test", "toolongsaltstrin",
+            "$6$rounds=5000$toolongsaltstrin$lQ8jolhgVRVhY4b5pZKaysCLi0QBxGoNeKQzQ3glMhwllF7oGDZxUhx1yxdYcz/e1JSbq3y6JMxxl8audkUEm0"},
+        // The spec lists this one without rounds=, which only changes the prefix
+        {"Hello world!", "saltstring",
+            "$6$rounds=5000$saltstring$svn8UoSVapNtMuq1ukKS4tPQd8iKwSMHWjl/O817G3uBnIFNjnQJuesI68u4OTLiBFdcbYEdFCoEOfaS35inz1"},
+    }
+    for _, tt := range tests {
+        if got := sha512Crypt([]byte(tt.key), []byte(tt.salt)); got != tt.want {
+            t.Errorf("sha512Crypt(%q, %q) = %q, want %q", tt.key, tt.salt, got, tt.want)
+        }
+    }
+}
+
+func TestFormatCommandListQuotesEntries(t *testing.T) {
+    // Each would change the YAML's structure written bare
+    commands := []string{
+        "[ -e /srv/www/htdocs/index.html ] || echo ok > /srv/www/htdocs/index.html",
+        "{ echo a; echo b; } > /tmp/ab",
+        "*.log cleanup",
+        "&anchor",
+        "!tag",
+        "% literal",
+        "echo key: value",
+        "echo done # comment",
+        `echo "quoted" 'single' \ backslash <html>`,
+    }
+
+    lines := strings.Split(strings.TrimSuffix(formatCommandList(commands), "\n"), "\n")
+    if len(lines) != len(commands) {
+        t.Fatalf("got %d lines for %d commands", len(lines), len(commands))
+    }
+    for i, line := range lines {
+        item, found := strings.CutPrefix(line, "  - ")
+        if !found {
+            t.Fatalf("line %q is not a list item", line)
+        }
+        // A JSON string is a valid YAML double-quoted scalar
+        var decoded string
+        if err := json.Unmarshal([]byte(item), &decoded); err != nil {
+            t.Fatalf("item %s is not a quoted scalar: %v", item, err)
+        }
+        if decoded != commands[i] {
+            t.Errorf("item decodes to %q, want %q", decoded, commands[i])
+        }
+    }
+}
+
+func TestLoadStateExpiresFailedVPSes(t *testing.T) {
+    m := newTestManager(t)
+    m.networkMode = NetworkModeUser
+    failed := &VPS{
+        ID:        "5f0c7a52-0000-4000-8000-000000000003",
+        Name:      "broken",
+        Status:    "failed",
+        Stage:     StageFailed,
+        ExpiresAt: time.Now().Add(-time.Minute),
+    }
+    data, err := json.Marshal(persistedState{Instances: []persistedVPS{{VPS: failed}}})
+    if err != nil {
+        t.Fatal(err)
+    }
+    if err := os.WriteFile(filepath.Join(m.baseDir, STATE_FILE), data, 0600); err != nil {
+        t.Fatal(err)
+    }
+
+    if err := m.loadState(); err != nil {
+        t.Fatal(err)
+    }
+    deadline := time.Now().Add(5 * time.Second)
+    for {
+        m.mutex.RLock()
+        _, exists := m.instances[failed.ID]
+        m.mutex.RUnlock()
+        if !exists {
+            return
+        }
+        if time.Now().After(deadline) {
+            t.Fatal("expired failed VPS still present after loading state")
+        }
+        time.Sleep(50 * time.Millisecond)
+    }
+}
+
+func TestImageURLRefusesNonPublicHosts(t *testing.T) {
+    for _, imageURL := range []string{
+        "http://127.0.0.1/disk.qcow2",
+        "http://[::1]/disk.qcow2",
+        "http://169.254.169.254/latest/meta-data/",
+        "http://10.0.0.5/disk.qcow2",
+        "https://192.168.1.1/disk.qcow2",
+        "http://[::ffff:172.16.0.1]/disk.qcow2",
+        "http://0.0.0.0/disk.qcow2",
+    } {
+        if err := validateImageURL(imageURL); !errors.Is(err, errNonPublicAddress) {
+            t.Errorf("validateImageURL(%s) = %v, want %v", imageURL, err, errNonPublicAddress)
+        }
+    }
+    if err := validateImageURL("https://cloud-images.ubuntu.com/jammy/current/jammy-server-cloudimg-amd64.img"); err != nil {
+        t.Errorf("public image_url refused: %v", err)
+    }
+
+    // A name resolving to loopback only shows up once dialed
+    server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        w.Write([]byte("internal"))
+    }))
+    defer server.Close()
+    target := strings.Replace(server.URL, "127.0.0.1", "localhost", 1)
+    path := filepath.Join(t.TempDir(), "image")
+    err := downloadFile(context.Background(), imageURLClient, target, path, 0, nil)
+    if !errors.Is(err, errNonPublicAddress) {
+        t.Errorf("download from %s = %v, want %v", target, err, errNonPublicAddress)
+    }
+    if _, err := os.Stat(path); !os.IsNotExist(err) {
+        t.Errorf("refused download left %s behind", path)
+    }
+}
+
+func TestCloneCountsAgainstClientIP(t *testing.T) {
+    m := newTestManager(t)
+    m.maxVPSPerIP = 2
+    oldTaps, oldCgroup := teardownTaps, teardownCgroup
+    teardownTaps = func(id string) {}
+    teardownCgroup = func(id string) {}
+    t.Cleanup(func() { teardownTaps, teardownCgroup = oldTaps, oldCgroup })
+
+    source := addTestVPS(m, "5f0c7a52-0000-4000-8000-000000000004", "web", "alice")
+    // Missing, so the copy fails once the clone is registered
+    source.ImagePath = filepath.Join(m.baseDir, "disks", source.ID, "disk.qcow2")
+    m.ipInstances["192.0.2.1"] = []string{source.ID}
+
+    clone, err := m.CloneVPS(source.ID, "", "", "192.0.2.1", 0)
+    if err != nil {
+        t.Fatal(err)
+    }
+    m.mutex.RLock()
+    counted := slices.Contains(m.ipInstances["192.0.2.1"], clone.ID)
+    m.mutex.RUnlock()
+    if !counted {
+        t.Error("clone not counted against the client IP")
+    }
+
+    // Two live VPSes now, so cloning another is over the limit
+    other := addTestVPS(m, "5f0c7a52-0000-4000-8000-000000000005", "db", "alice")
+    other.ImagePath = source.ImagePath
+    if _, err := m.CloneVPS(other.ID, "", "", "192.0.2.1", 0); !errors.Is(err, errIPLimitReached) {
+        t.Errorf("second clone = %v, want %v", err, errIPLimitReached)
+    }
+    m.workers.Wait()
+}
+
+func TestSeedURLFromEnv(t *testing.T) {
+    tests := []struct {
+        seedURL, listen, cert string
+        want                  string
+        wantErr               bool
+    }{
+        {want: "http://10.0.2.2:8080"},
+        {listen: ":9443", want: "http://10.0.2.2:9443"},
+        {listen: "127.0.0.1:8000", want: "http://10.0.2.2:8000"},
+        {cert: "/etc/blst/cert.pem", wantErr: true},
+        {seedURL: "https://seed.example.com/", cert: "/etc/blst/cert.pem", want: "https://seed.example.com"},
+        {listen: "8080", wantErr: true},
+    }
+    for _, tt := range tests {
+        t.Setenv("BLST_SEED_URL", tt.seedURL)
+        t.Setenv("BLST_LISTEN_ADDRESS", tt.listen)
+        t.Setenv("TLS_CERT_FILE", tt.cert)
+        got, err := seedURLFromEnv()
+        if (err != nil) != tt.wantErr || got != tt.want {
+            t.Errorf("seed URL %q, listen %q, cert %q: got %q, %v", tt.seedURL, tt.listen, tt.cert, got, err)
+        }
+    }
+}
+
+func TestStopMarksStoppedOnlyAfterQEMUExits(t *testing.T) {
+    m := newTestManager(t)
+    // Ignores the power-off request like a hung guest would. Named so
+    // checkProcess takes it for QEMU.
+    qemu := exec.Command("bash", "-c", "exec -a qemu-system-x86_64 sleep 60")
+    if err := qemu.Start(); err != nil {
+        t.Skipf("no bash binary: %v", err)
+    }
+    t.Cleanup(func() {
+        qemu.Process.Kill()
+        qemu.Wait()
+    })
+
+    vps := addTestVPS(m, "vps2", "web", "alice")
+    vps.Status = StatusRunning
+    vps.QEMUPid = qemu.Process.Pid
+    socket := fakeQMPSocket(t, map[string]string{"system_powerdown": `{"return": {}}`})
+    instanceDir := filepath.Join(m.baseDir, "disks", vps.ID)
+    if err := os.MkdirAll(instanceDir, 0755); err != nil {
+        t.Fatal(err)
+    }
+    if err := os.Symlink(socket, filepath.Join(instanceDir, "qemu-monitor.sock")); err != nil {
+        t.Fatal(err)
+    }
+
+    if err := m.StopVPS(vps.ID, 100*time.Millisecond); err != nil {
+        t.Fatal(err)
+    }
+    if err := m.StartVPS(vps.ID); err == nil || !strings.Contains(err.Error(), "busy") {
+        t.Errorf("StartVPS while stopping = %v, want busy", err)
+    }
+
+    deadline := time.Now().Add(5 * time.Second)
+    for {
+        m.mutex.RLock()
+        status := vps.Status
+        m.mutex.RUnlock()
+        if status == StatusStopped {
+            break
+        }
+        if time.Now().After(deadline) {
+            t.Fatalf("status still %s after the stop timeout", status)
+        }
+        time.Sleep(10 * time.Millisecond)
+    }
+    if checkProcess(qemu.Process.Pid) == nil {
+        t.Error("marked stopped while QEMU was still running")
+    }
+}
+
+func TestSubscribeVPSIgnoresOtherInstances(t *testing.T) {
+    hub := newEventHub()
+    events := hub.subscribeVPS("a")
+    defer hub.unsubscribe(events)
+
+    // Enough traffic from another VPS to fill an unfiltered subscriber
+    for i := 0; i < 2*EVENT_BUFFER; i++ {
+        hub.publish(VPSEvent{Type: EventProgress, VPSID: "b"})
+    }
+    hub.publish(VPSEvent{Type: EventStatusChanged, VPSID: "a", Status: "running"})
+
+    select {
+    case event := <-events:
+        if event.VPSID != "a" || event.Status != "running" {
+            t.Errorf("got %+v, want a's status change", event)
+        }
+    default:
+        t.Fatal("a's event was dropped")
+    }
+    if len(events) != 0 {
+        t.Errorf("%d more events queued, want none", len(events))
+    }
+}
+
+func TestBuildQEMUArgsMachineType(t *testing.T) {
+    m := newTestManager(t)
+    vps := &VPS{ID: "vps3", Name: "web", MemoryMB: 1024, VCPUs: 1, VNCPort: 5901, SSHPort: 2201, ImagePath: "/disks/vps3/disk.qcow2"}
+
+    argsFor := func(q35 bool) []string {
+        m.q35Machine = q35
+        return m.buildQEMUArgs(vps)
+    }
+    pc, q35 := argsFor(false), argsFor(true)
+
+    machine := func(args []string) string {
+        if i := slices.Index(args, "-machine"); i >= 0 && i+1 < len(args) {
+            return args[i+1]
+        }
+        return ""
+    }
+    if got := machine(pc); got != "pc,accel=kvm,usb=off,vmport=off" {
+        t.Errorf("default machine = %q", got)
+    }
+    if got := machine(q35); got != "q35,accel=kvm,usb=off,vmport=off,kernel-irqchip=on" {
+        t.Errorf("BLST_QEMU_Q35 machine = %q", got)
+    }
+    if slices.Contains(pc, "-no-user-config") || q35[0] != "-no-user-config" {
+        t.Errorf("-no-user-config should lead the q35 args only")
+    }
+
+    // Nothing but the machine differs, devices included
+    rest := slices.DeleteFunc(slices.Clone(q35[1:]), func(arg string) bool { return arg == machine(q35) })
+    if !slices.Equal(rest, slices.DeleteFunc(slices.Clone(pc), func(arg string) bool { return arg == machine(pc) })) {
+        t.Errorf("q35 args differ beyond the machine:\n%v\n%v", pc, q35)
+    }
+}
+
+// Boot a real image on both machine types and log how long each takes to
+// reach a login prompt on the serial console. Needs KVM, QEMU, qemu-img and
+// a cloud image, e.g.
+//
+//     BLST_TEST_BOOT_IMAGE=/var/lib/vps-service/base/ubuntu-22.04.qcow2 go test -run TestQ35BootTime -v
+func TestQ35BootTime(t *testing.T) {
+    image := os.Getenv("BLST_TEST_BOOT_IMAGE")
+    if image == "" {
+        t.Skip("BLST_TEST_BOOT_IMAGE not set")
+    }
+    if _, err := os.Stat("/dev/kvm"); err != nil {
+        t.Skipf("no KVM: %v", err)
+    }
+    qemuBin, err := exec.LookPath(qemuBinary())
+    if err != nil {
+        t.Skip(err)
+    }
+
+    // Answers the smbios seed so cloud-init doesn't wait on a missing one
+    seed := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        switch filepath.Base(r.URL.Path) {
+        case "meta-data":
+            w.Write([]byte("instance-id: boot-time\n"))
+        case "user-data":
+            w.Write([]byte("#cloud-config\n{}\n"))
+        default:
+            http.NotFound(w, r)
+        }
+    }))
+    defer seed.Close()
+    _, seedPort, _ := net.SplitHostPort(seed.Listener.Addr().String())
+
+    m := newTestManager(t)
+    m.seedURL = "http://10.0.2.2:" + seedPort
+    times := make(map[bool]time.Duration)
+    for i, q35 := range []bool{false, true} {
+        m.q35Machine = q35
+        vps := &VPS{
+            ID:            fmt.Sprintf("boot%d", i),
+            Name:          "boot-time",
+            MemoryMB:      1024,
+            VCPUs:         1,
+            VNCPort:       5990 + i,
+            SSHPort:       2290 + i,
+            NetworkMode:   NetworkModeUser,
+            CloudInitSeed: CloudInitSeedSMBIOS,
+            SeedToken:     "token",
+        }
+        instanceDir := filepath.Join(m.baseDir, "disks", vps.ID)
+        if err := os.MkdirAll(instanceDir, 0755); err != nil {
+            t.Fatal(err)
+        }
+        vps.ImagePath = filepath.Join(instanceDir, "disk.qcow2")
+        if output, err := exec.Command("qemu-img", "create", "-f", "qcow2", "-F", "qcow2", "-b", image, vps.ImagePath).CombinedOutput(); err != nil {
+            t.Fatalf("qemu-img create: %v: %s", err, output)
+        }
+
+        started := time.Now()
+        if output, err := exec.Command(qemuBin, m.buildQEMUArgs(vps)...).CombinedOutput(); err != nil {
+            t.Fatalf("QEMU: %v: %s", err, output)
+        }
+        pidData, err := os.ReadFile(filepath.Join(instanceDir, "qemu.pid"))
+        if err != nil {
+            t.Fatal(err)
+        }
+        pid, _ := strconv.Atoi(strings.TrimSpace(string(pidData)))
+        defer killQEMU(pid)
+
+        serial, err := net.Dial("unix", filepath.Join(instanceDir, "serial.sock"))
+        if err != nil {
+            t.Fatal(err)
+        }
+        serial.SetReadDeadline(time.Now().Add(5 * time.Minute))
+        var console strings.Builder
+        buf := make([]byte, 4096)
+        for !strings.Contains(console.String(), "login:") {
+            n, err := serial.Read(buf)
+            if err != nil {
+                t.Fatalf("no login prompt on the q35=%v console: %v", q35, err)
+            }
+            console.Write(buf[:n])
+        }
+        times[q35] = time.Since(started)
+        serial.Close()
+        killQEMU(pid)
+    }
+
+    t.Logf("boot to login prompt: pc %s, q35 %s (%+.1f%%)", times[false].Round(time.Millisecond), times[true].Round(time.Millisecond),
+        100*(times[true].Seconds()-times[false].Seconds())/times[false].Seconds())
+}
+
+func TestParseCPUHelp(t *testing.T) {
+    // Abridged "qemu-system-x86_64 -cpu help" from QEMU 6.2 and 8.2.
+    outputs := map[string]string{
+        "6.2": `Available CPUs:
+x86 486                   (alias configured by machine type)
+x86 486-v1
+x86 Haswell               (alias configured by machine type)
+x86 Haswell-v1            Intel Core Processor (Haswell)
+x86 host                  KVM processor with all supported host features
+x86 max                   Enables all features supported by the accelerator in the current host
+
+Recognized CPUID flags:
+  3dnow 3dnowext 3dnowprefetch abm ace2 ace2-en acpi adx aes avx avx2
+  vmx x2apic xsave
+`,
+        "8.2": `Available CPUs:
+  486                   (alias configured by machine type)
+  486-v1
+  Haswell               (alias configured by machine type)
+  Haswell-v1            Intel Core Processor (Haswell)
+  host                  processor with all supported host features
+  max                   Enables all features supported by the accelerator in the current host
+
+Recognized CPUID flags:
+  3dnow 3dnowext 3dnowprefetch abm ace2 ace2-en acpi adx aes avx avx2
+  vmx x2apic xsave
+`,
+    }
+
+    for version, output := range outputs {
+        models, flags := parseCPUHelp(output)
+        for _, model := range []string{"486", "486-v1", "Haswell", "Haswell-v1", "host", "max"} {
+            if !models[model] {
+                t.Errorf("%s: model %q not parsed", version, model)
+            }
+        }
+        if len(models) != 6 {
+            t.Errorf("%s: got %d models, want 6: %v", version, len(models), models)
+        }
+        for _, flag := range []string{"3dnow", "avx2", "vmx", "xsave"} {
+            if !flags[flag] {
+                t.Errorf("%s: flag %q not parsed", version, flag)
+            }
+        }
+        if models["Recognized"] || flags["Haswell"] {
+            t.Errorf("%s: models and flags mixed up", version)
+        }
+    }
+}
+
+func TestRepairDiskRunsInBackground(t *testing.T) {
+    m := newTestManager(t)
+    vps := addTestVPS(m, "vps1", "web", "alice")
+    vps.Status = StatusRunning
+    if err := m.RepairDisk(vps.ID); err == nil {
+        t.Error("repaired the disk of a running VPS")
+    }
+    if err := m.RepairDisk("missing"); !errors.Is(err, errVPSNotFound) {
+        t.Errorf("RepairDisk(missing) = %v, want errVPSNotFound", err)
+    }
+
+    // No such image type, so preparing the base fails without downloading
+    vps.Status = StatusStopped
+    vps.ImageType = "custom-0000000000000000"
+    vps.Alert = errBrokenBackingChain.Error() + ": backing file is missing"
+    if err := m.RepairDisk(vps.ID); err != nil {
+        t.Fatal(err)
+    }
+    m.workers.Wait()
+
+    if vps.Status != StatusStopped {
+        t.Errorf("status = %s after the repair, want stopped", vps.Status)
+    }
+    if !strings.HasPrefix(vps.Alert, "disk repair failed") {
+        t.Errorf("alert = %q, want the repair failure", vps.Alert)
+    }
+}
+
+func TestLoadAPIKeysReservesAdminOwner(t *testing.T) {
+    t.Setenv("API_KEY", "root-key")
+    t.Setenv("BLST_API_KEYS_FILE", "")
+    for _, tt := range []struct {
+        keys    string
+        wantErr bool
+    }{
+        {"admin:k1", true},
+        {"admin:k1:readonly", true},
+        {"admin:k1:admin", false},
+        {"alice:k1", false},
+    } {
+        t.Setenv("BLST_API_KEYS", tt.keys)
+        _, err := loadAPIKeys()
+        if (err != nil) != tt.wantErr {
+            t.Errorf("BLST_API_KEYS=%s: err = %v, want error %v", tt.keys, err, tt.wantErr)
+        }
+    }
+}
+
+func TestIdempotencyReplayKeepsPasswordBriefly(t *testing.T) {
+    m := newTestManager(t)
+    m.idempotencyKeys = make(map[string]*idempotencyEntry)
+    m.idempotencyTTL = time.Hour
+    var err error
+    if m.idempotencyCipher, err = newIdempotencyCipher(); err != nil {
+        t.Fatal(err)
+    }
+    fingerprint := sha256.Sum256([]byte("request"))
+
+    if id, _, err := m.reserveIdempotencyKey("alice", "k1", fingerprint); err != nil || id != "" {
+        t.Fatalf("first reserve = %q, %v", id, err)
+    }
+    m.finishIdempotencyKey("alice", "k1", "vps1", "hunter22")
+
+    entry := m.idempotencyKeys["alice\x00k1"]
+    if strings.Contains(string(entry.password), "hunter22") {
+        t.Error("password kept in the clear")
+    }
+    id, password, err := m.reserveIdempotencyKey("alice", "k1", fingerprint)
+    if err != nil || id != "vps1" || password != "hunter22" {
+        t.Errorf("replay = %q, %q, %v, want vps1 and the password", id, password, err)
+    }
+    if _, password, _ := m.reserveIdempotencyKey("bob", "k1", fingerprint); password != "" {
+        t.Error("another owner's key replayed the password")
+    }
+
+    entry.passwordExpires = time.Now().Add(-time.Second)
+    id, password, err = m.reserveIdempotencyKey("alice", "k1", fingerprint)
+    if err != nil || id != "vps1" || password != "" {
+        t.Errorf("replay after the password TTL = %q, %q, %v, want vps1 without a password", id, password, err)
+    }
+    if entry.password != nil {
+        t.Error("expired password not dropped")
+    }
+}
+
+func TestDownloadFileChecksPartialSizeOn416(t *testing.T) {
+    image := []byte("0123456789")
+    server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        if r.Header.Get("Range") != "" {
+            w.Header().Set("Content-Range", fmt.Sprintf("bytes */%d", len(image)))
+            w.WriteHeader(http.StatusRequestedRangeNotSatisfiable)
+            return
+        }
+        w.Write(image)
+    }))
+    defer server.Close()
+
+    for _, part := range []string{"0123456789", "0123456789abcdef"} {
+        path := filepath.Join(t.TempDir(), "image")
+        if err := os.WriteFile(path+".part", []byte(part), 0644); err != nil {
+            t.Fatal(err)
+        }
+        if err := downloadFile(context.Background(), server.Client(), server.URL, path, 0, nil); err != nil {
+            t.Fatalf("part of %d bytes: %v", len(part), err)
+        }
+        data, err := os.ReadFile(path)
+        if err != nil || string(data) != string(image) {
+            t.Errorf("part of %d bytes: got %q, %v, want %q", len(part), data, err, image)
+        }
+    }
+}
+
+func TestDeleteOrphansKeepsInstances(t *testing.T) {
+    m := newTestManager(t)
+    addTestVPS(m, "vps1", "web", "alice")
+    for _, id := range []string{"vps1", "gone"} {
+        if err := os.MkdirAll(filepath.Join(m.baseDir, "disks", id), 0755); err != nil {
+            t.Fatal(err)
+        }
+        if err := os.WriteFile(filepath.Join(m.baseDir, "disks", id, "disk.qcow2"), []byte("disk"), 0644); err != nil {
+            t.Fatal(err)
+        }
+    }
+
+    w := serveAs(http.HandlerFunc(m.handleOrphans), "admin-key", http.MethodDelete, "/api/system/orphans")
+    if w.Code != http.StatusOK {
+        t.Fatalf("status %d: %s", w.Code, w.Body)
+    }
+    var resp struct {
+        Removed []OrphanDir `json:"removed"`
+    }
+    if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+        t.Fatal(err)
+    }
+    if len(resp.Removed) != 1 || resp.Removed[0].ID != "gone" {
+        t.Errorf("removed %+v, want only gone", resp.Removed)
+    }
+
+    entries, err := os.ReadDir(filepath.Join(m.baseDir, "disks"))
+    if err != nil {
+        t.Fatal(err)
+    }
+    if len(entries) != 1 || entries[0].Name() != "vps1" {
+        t.Errorf("disks directory holds %v, want only vps1", entries)
+    }
+}
+
+func TestSnapshotClaimsDisk(t *testing.T) {
+    m := newTestManager(t)
+    vps := addTestVPS(m, "vps1", "web", "alice")
+    vps.DiskFormat = DiskFormatQCOW2
+    vps.ImagePath = filepath.Join(m.baseDir, "disks", vps.ID, "disk.qcow2")
+
+    _, _, release, err := m.claimSnapshotDisk(vps.ID)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if vps.Status != StatusSnapshotting {
+        t.Errorf("status = %s while claimed, want snapshotting", vps.Status)
+    }
+    if err := m.StartVPS(vps.ID); err == nil || !strings.Contains(err.Error(), "busy") {
+        t.Errorf("StartVPS while snapshotting = %v, want busy", err)
+    }
+    if _, _, _, err := m.claimSnapshotDisk(vps.ID); snapshotErrorStatus(err) != http.StatusConflict {
+        t.Errorf("second claim = %v, want a conflict", err)
+    }
+    release()
+    if vps.Status != StatusStopped {
+        t.Errorf("status = %s after release, want stopped", vps.Status)
+    }
+
+    for _, tt := range []struct {
+        err  error
+        want int
+    }{
+        {fmt.Errorf("%w: nightly", errSnapshotNotFound), http.StatusNotFound},
+        {errVPSNotFound, http.StatusNotFound},
+        {fmt.Errorf("%w: %q", errInvalidSnapshotName, "a b"), http.StatusBadRequest},
+        {fmt.Errorf("%w: nightly", errSnapshotExists), http.StatusConflict},
+        {errSnapshotUnsupported, http.StatusConflict},
+        {fmt.Errorf("failed to restore snapshot: exit status 1"), http.StatusInternalServerError},
+    } {
+        if got := snapshotErrorStatus(tt.err); got != tt.want {
+            t.Errorf("snapshotErrorStatus(%v) = %d, want %d", tt.err, got, tt.want)
+        }
+    }
+}
+
+func TestDequeuedCreateGivesBackItsSlot(t *testing.T) {
+    m := newTestManager(t)
+    for i := 0; i < 50; i++ {
+        vps := addTestVPS(m, "queued", "web", "alice")
+        m.createSlots <- struct{}{}
+        result := make(chan error, 1)
+        go func() { result <- m.acquireCreateSlot(vps) }()
+
+        for {
+            m.mutex.RLock()
+            _, queued := m.queuedCreates[vps.ID]
+            m.mutex.RUnlock()
+            if queued {
+                break
+            }
+            time.Sleep(time.Millisecond)
+        }
+        // Free the slot and delete the queued VPS before it can get back
+        // to the lock, the way DeleteVPS would
+        m.mutex.Lock()
+        <-m.createSlots
+        m.queuedCreates[vps.ID]()
+        delete(m.queuedCreates, vps.ID)
+        m.mutex.Unlock()
+
+        if err := <-result; !errors.Is(err, errDequeued) {
+            t.Fatalf("acquireCreateSlot after delete = %v, want errDequeued", err)
+        }
+        if held := len(m.createSlots); held != 0 {
+            t.Fatalf("dequeued create kept %d create slot(s)", held)
+        }
+    }
+}
+
+func TestImageSHA256Entries(t *testing.T) {
+    for imageType, sum := range IMAGE_SHA256 {
+        if _, exists := SUPPORTED_IMAGES[imageType]; !exists {
+            t.Errorf("IMAGE_SHA256 pins unknown image type %s", imageType)
+        }
+        if !regexp.MustCompile(`^[0-9a-f]{64}$`).MatchString(sum) {
+            t.Errorf("IMAGE_SHA256[%s] = %q, want 64 lowercase hex digits", imageType, sum)
+        }
+    }
+}
+
+func TestSetVCPUsWaitsForUnplug(t *testing.T) {
+    // The guest never gives up vcpu1, so it stays in its slot
+    socket := fakeQMPSocket(t, map[string]string{
+        "query-hotpluggable-cpus": `{"return": [` +
+            `{"type": "qemu64-x86_64-cpu", "props": {"socket-id": 2}}, ` +
+            `{"type": "qemu64-x86_64-cpu", "props": {"socket-id": 1}, "qom-path": "/machine/peripheral/vcpu1"}, ` +
+            `{"type": "qemu64-x86_64-cpu", "props": {"socket-id": 0}, "qom-path": "/machine/unattached/device[0]"}]}`,
+    })
+    m := newTestManager(t)
+
+    empty, hotplugged, present, err := m.queryCPUSlots(socket)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if len(empty) != 1 || len(hotplugged) != 1 || present != 2 {
+        t.Fatalf("got %d empty, %d hot-plugged, %d present, want 1, 1, 2", len(empty), len(hotplugged), present)
+    }
+
+    started := time.Now()
+    present, err = m.waitForCPUUnplug(socket, 1, 300*time.Millisecond)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if present != 2 {
+        t.Errorf("present = %d, want the unreleased CPU counted", present)
+    }
+    if waited := time.Since(started); waited < 300*time.Millisecond {
+        t.Errorf("gave up after %s, before the timeout", waited)
+    }
+}
+
+func TestReadyzLogsOnlyChanges(t *testing.T) {
+    m := newTestManager(t)
+    var logged strings.Builder
+    log.SetOutput(&logged)
+    t.Cleanup(func() { log.SetOutput(os.Stderr) })
+
+    // No base directory, so every probe fails the same way
+    for i := 0; i < 3; i++ {
+        w := httptest.NewRecorder()
+        m.handleReadyz(w, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+        if w.Code != http.StatusServiceUnavailable {
+            t.Fatalf("status %d, want 503", w.Code)
+        }
+    }
+    if n := strings.Count(logged.String(), "readiness check failed"); n != 1 {
+        t.Errorf("logged %d failures for 3 identical probes, want 1", n)
+    }
+}
+
+func TestRotatingFileKeepZero(t *testing.T) {
+    path := filepath.Join(t.TempDir(), "service.log")
+    rf, err := openRotatingFile(path, 10, 0)
+    if err != nil {
+        t.Fatal(err)
+    }
+    for _, line := range []string{"first line\n", "second line\n"} {
+        if _, err := rf.Write([]byte(line)); err != nil {
+            t.Fatal(err)
+        }
+    }
+    if _, err := os.Stat(path + ".1"); !os.IsNotExist(err) {
+        t.Errorf("BLST_LOG_KEEP=0 kept %s.1", path)
+    }
+    if data, _ := os.ReadFile(path); string(data) != "second line\n" {
+        t.Errorf("log holds %q, want only the second line", data)
+    }
+}
+
+func TestRotatingFileSurvivesFailedRotation(t *testing.T) {
+    path := filepath.Join(t.TempDir(), "service.log")
+    rf, err := openRotatingFile(path, 10, 1)
+    if err != nil {
+        t.Fatal(err)
+    }
+    // A non-empty directory where the old log goes makes the rename fail
+    if err := os.MkdirAll(filepath.Join(path+".1", "blocker"), 0755); err != nil {
+        t.Fatal(err)
+    }
+    for _, line := range []string{"first line\n", "second line\n", "third line\n"} {
+        if n, err := rf.Write([]byte(line)); err != nil || n != len(line) {
+            t.Fatalf("Write(%q) = %d, %v, want the line accepted", line, n, err)
+        }
+    }
+
+    // Rotation works again once the obstacle is gone
+    if err := os.RemoveAll(path + ".1"); err != nil {
+        t.Fatal(err)
+    }
+    if _, err := rf.Write([]byte("fourth line\n")); err != nil {
+        t.Fatal(err)
+    }
+    if data, _ := os.ReadFile(path); string(data) != "fourth line\n" {
+        t.Errorf("log holds %q after recovering, want the fourth line", data)
+    }
+}
+
+func TestProxyWriteFilesSkipsEmptyAptConfig(t *testing.T) {
+    noProxyOnly := formatProxyWriteFiles(&ProxyConfig{NoProxy: "10.0.0.0/8"}, "debian")
+    if strings.Contains(noProxyOnly, "95proxy") {
+        t.Errorf("wrote an apt proxy file with only no_proxy set:\n%s", noProxyOnly)
+    }
+    if !strings.Contains(noProxyOnly, "no_proxy=10.0.0.0/8") {
+        t.Errorf("no_proxy missing from /etc/environment:\n%s", noProxyOnly)
+    }
+
+    withProxy := formatProxyWriteFiles(&ProxyConfig{HTTPProxy: "http://proxy:3128"}, "ubuntu")
+    if !strings.Contains(withProxy, `Acquire::http::Proxy "http://proxy:3128";`) {
+        t.Errorf("apt proxy missing:\n%s", withProxy)
+    }
+}
+
+func TestProxyWriteFilesAlpine(t *testing.T) {
+    formatted := formatProxyWriteFiles(&ProxyConfig{HTTPProxy: "http://proxy:3128", NoProxy: "localhost"}, "alpine")
+    for _, want := range []string{
+        "  - path: /etc/profile.d/proxy.sh\n",
+        "      export http_proxy=http://proxy:3128\n",
+        "      export HTTP_PROXY=http://proxy:3128\n",
+        "      export no_proxy=localhost\n",
+    } {
+        if !strings.Contains(formatted, want) {
+            t.Errorf("missing %q in:\n%s", want, formatted)
+        }
+    }
+}
@@ -1,6 +1,7 @@
 // app/actions.ts
 'use server'
 
+import { headers } from 'next/headers';
 import { API_CONFIG } from '@/lib/config';
 import { VPS, ResourceMetrics  } from '@/types/vps'
 
@@ -85,16 +86,37 @@ export async function getVPSList(): Promise<VPS[]> {
     template: string;
   }
   
+// Next.js doesn't give server actions the socket address and only fills in
+// X-Forwarded-For when the browser sent none, so the header is whatever the
+// browser claims unless a reverse proxy appends the real address. Only the
+// entry added by the outermost trusted proxy is used; with none configured
+// nothing is forwarded and the backend counts the frontend's own address.
+function clientAddress(): string | undefined {
+  const hops = API_CONFIG.trustedProxyHops;
+  if (!Number.isInteger(hops) || hops <= 0) {
+    return undefined;
+  }
+  const chain = (headers().get('x-forwarded-for') ?? '')
+    .split(',')
+    .map((entry) => entry.trim())
+    .filter(Boolean);
+  return chain.length >= hops ? chain[chain.length - hops] : undefined;
+}
+
   // Update the createVPS function to include the template parameter
 // app/actions.ts
 export async function createVPS(params: CreateVPSParams) {
   console.log('Creating VPS with params:', params); // Add logging to verify data
 
+  // The backend limits VPSes per client IP, so pass the browser's along
+  const forwardedFor = clientAddress();
+
   const response = await fetch(`${API_CONFIG.baseUrl}/api/vps/create`, {
     method: 'POST',
     headers: {
       'Content-Type': 'application/json',
-      'X-API-Key': API_CONFIG.apiKey!
+      'X-API-Key': API_CONFIG.apiKey!,
+      ...(forwardedFor ? { 'X-Forwarded-For': forwardedFor } : {})
     },
     body: JSON.stringify({
       name: params.name,
@@ -145,6 +167,22 @@ export async function getVPSDetails(id: string) {
   return response.json();
 }
 
+export async function getConsoleToken(id: string): Promise<{ token: string; expires_at: string; path: string }> {
+  const response = await fetch(`${API_CONFIG.baseUrl}/api/vps/console-token?id=${id}`, {
+    method: 'POST',
+    headers: {
+      'X-API-Key': API_CONFIG.apiKey!
+    },
+    cache: 'no-store'
+  });
+
+  if (!response.ok) {
+    throw new Error('Failed to get console token');
+  }
+
+  return response.json();
+}
+
 export async function getAvailableImages() {
   const response = await fetch(`${API_CONFIG.baseUrl}/api/images/list`, {
     headers: {
@@ -45,9 +45,12 @@ interface VPSProgress {
 }
 
 const STAGE_MESSAGES = {
+  queued: 'Waiting in the creation queue...',
   initializing: 'Initializing your VPS...',
+  downloading_image: 'Downloading OS image...',
   creating_disk: 'Creating disk image...',
   preparing_cloud_init: 'Preparing cloud configuration...',
+  waiting_for_launch: 'Waiting for a free launch slot...',
   starting_qemu: 'Starting virtual machine...',
   configuring_vnc: 'Configuring remote access...',
   completed: 'Setup completed!',
@@ -65,6 +68,8 @@ export default function CreateVPSForm({ onSuccess }: CreateVPSFormProps) {
   const [availableTemplates, setAvailableTemplates] = useState<Template[]>([]);
   const [creationProgress, setCreationProgress] = useState<VPSProgress | null>(null);
   const [vpsId, setVpsId] = useState<string | null>(null);
+  // Only the create response carries the root password
+  const [password, setPassword] = useState('');
   
   // List of adjectives and nouns for random name generation
   const adjectives = ['swift', 'brave', 'mighty', 'cosmic', 'stellar', 'noble', 'rapid', 'clever', 'nimble', 'radiant'];
@@ -100,6 +105,8 @@ export default function CreateVPSForm({ onSuccess }: CreateVPSFormProps) {
       'rocky-8': { name: 'Rocky Linux 8', category: 'Rocky Linux' },
       'centos-9': { name: 'CentOS Stream 9', category: 'Centos Linux' },
       'centos-7': { name: 'CentOS 7', category: 'Centos Linux' },
+      'opensuse-15.5': { name: 'openSUSE Leap 15.5', category: 'openSUSE' },
+      'alpine-3.19': { name: 'Alpine Linux 3.19', category: 'Alpine Linux' },
     };
 
     const details = displayNames[osId] || {
@@ -197,7 +204,7 @@ export default function CreateVPSForm({ onSuccess }: CreateVPSFormProps) {
             clearInterval(progressInterval);
             const vpsData = await getVPSDetails(vpsId);
             setLoading(false);
-            onSuccess(vpsData);
+            onSuccess({ ...vpsData, password });
           } else if (progressData.stage === 'failed') {
             clearInterval(progressInterval);
             setLoading(false);
@@ -217,7 +224,7 @@ export default function CreateVPSForm({ onSuccess }: CreateVPSFormProps) {
         clearInterval(progressInterval);
       }
     };
-  }, [vpsId, loading, onSuccess]);
+  }, [vpsId, loading, onSuccess, password]);
 
   const handleSubmit = async (e: React.FormEvent) => {
     e.preventDefault();
@@ -234,6 +241,7 @@ export default function CreateVPSForm({ onSuccess }: CreateVPSFormProps) {
         template: selectedTemplate
       });
       
+      setPassword(data.password);
       setVpsId(data.id);
     } catch (err) {
       setLoading(false);
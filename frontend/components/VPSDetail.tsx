@@ -34,7 +34,7 @@ import {
   AlertDialogHeader,
   AlertDialogTitle,
 } from "@/components/ui/alert-dialog";
-import { restartVPS, startVPS, stopVPS, getVPSDetails, deleteVPS } from '@/app/actions';
+import { restartVPS, startVPS, stopVPS, getVPSDetails, deleteVPS, getConsoleToken } from '@/app/actions';
 import ResourceMonitoring from './ResourceChart';
 
 interface VPSDetailProps {
@@ -60,7 +60,7 @@ export default function VPSDetail({ vps: initialVPS, onClose, onDelete }: VPSDet
     const pollInterval = setInterval(async () => {
       try {
         const updatedVPS = await getVPSDetails(vps.id);
-        setVPS(updatedVPS);
+        setVPS(prev => ({ ...updatedVPS, password: prev.password }));
         setError(null);
       } catch (err) {
         console.error('Failed to fetch VPS status:', err);
@@ -77,23 +77,36 @@ export default function VPSDetail({ vps: initialVPS, onClose, onDelete }: VPSDet
       return;
     }
 
-    const wsPort = vps.vnc_port + 1000;
-    
-    const vncParams = new URLSearchParams({
-      autoconnect: '1',
-      host: backendHost,
-      port: wsPort.toString(),
-      resize: 'scale',
-      quality: '6',
-      reconnect: 'true',
-    });
-
-    if (iframeRef.current && vps.status === 'running') {
-      const novncUrl = `${backendUrl}/novnc/vnc.html?${vncParams.toString()}`;
-      console.log('Connecting to VNC:', novncUrl);
-      iframeRef.current.src = novncUrl;
+    if (vps.status !== 'running') {
+      return;
     }
-  }, [vps.status, vps.vnc_port, backendUrl, backendHost]);
+
+    // The console is proxied by the backend and authorized with a
+    // short-lived token, so the API key never reaches the browser
+    const backend = new URL(backendUrl);
+    const backendPort = backend.port || (backend.protocol === 'https:' ? '443' : '80');
+
+    getConsoleToken(vps.id)
+      .then(({ path }) => {
+        const vncParams = new URLSearchParams({
+          autoconnect: '1',
+          host: backend.hostname,
+          port: backendPort,
+          encrypt: backend.protocol === 'https:' ? '1' : '0',
+          path: path.replace(/^\//, ''),
+          resize: 'scale',
+          quality: '6',
+        });
+
+        if (iframeRef.current) {
+          iframeRef.current.src = `${backendUrl}/novnc/vnc.html?${vncParams.toString()}`;
+        }
+      })
+      .catch(err => {
+        console.error('Failed to get console token:', err);
+        setError('Failed to open console');
+      });
+  }, [vps.id, vps.status, backendUrl]);
 
   useEffect(() => {
     if (copyAlert) {
@@ -167,7 +180,11 @@ export default function VPSDetail({ vps: initialVPS, onClose, onDelete }: VPSDet
     }
   };
 
-  const sshCommand = `ssh root@${backendHost} -p ${vps.ssh_port}`;
+  // Bridged guests are reached on their own LAN address instead of a forward
+  const bridged = vps.network_mode === 'bridge';
+  const sshCommand = bridged
+    ? (vps.guest_ip ? `ssh root@${vps.guest_ip}` : 'Waiting for the guest to report its IP address...')
+    : `ssh root@${backendHost} -p ${vps.ssh_port}`;
 
   const getStatusColor = (status: string) => {
     switch (status.toLowerCase()) {
@@ -434,8 +451,8 @@ export default function VPSDetail({ vps: initialVPS, onClose, onDelete }: VPSDet
               <p className="font-mono bg-muted/50 p-2 rounded">{vps.vnc_port}</p>
             </div>
             <div className="space-y-1">
-              <p className="font-medium text-muted-foreground">SSH Port</p>
-              <p className="font-mono bg-muted/50 p-2 rounded">{vps.ssh_port}</p>
+              <p className="font-medium text-muted-foreground">{bridged ? 'IP Address' : 'SSH Port'}</p>
+              <p className="font-mono bg-muted/50 p-2 rounded">{bridged ? (vps.guest_ip || 'Unknown') : vps.ssh_port}</p>
             </div>
             <div className="space-y-1">
               <p className="font-medium text-muted-foreground">Created At</p>
@@ -1,5 +1,8 @@
 export const API_CONFIG = {
     baseUrl: process.env.NEXT_PUBLIC_API_URL || 'http://185.206.149.211:8080',
-    apiKey: process.env.API_KEY || "testdev"
+    apiKey: process.env.API_KEY || "testdev",
+    // Reverse proxies in front of the frontend that append the client's
+    // address to X-Forwarded-For, 0 when browsers connect directly
+    trustedProxyHops: Number(process.env.TRUSTED_PROXY_HOPS || 0)
   };
   
\ No newline at end of file
@@ -25,9 +25,13 @@ export interface VPSBackend {
   hostname: string;
   status: string;
   image_type: string;
+  image_url?: string;  // Custom images only
+  os_family?: string;
   qemu_pid?: number;
   vnc_port: number;
-  ssh_port: number;
+  ssh_port: number;  // 0 in bridge mode
+  network_mode?: 'user' | 'bridge';
+  guest_ip?: string;  // Bridge mode only, once the guest agent reports it
   created_at: string;
   expires_at: string;
   image_path: string;
@@ -50,6 +54,7 @@ export interface MemoryMetrics {
   used: number;   // Bytes
   total: number;  // Bytes
   cache: number;  // Bytes
+  balloon?: number; // Bytes the balloon leaves the guest, absent without one
 }
 
 export interface DiskMetrics {
@@ -59,6 +64,8 @@ export interface DiskMetrics {
   write_ops: number;
   read_speed: number;  // Bytes per second
   write_speed: number; // Bytes per second
+  read_iops: number;   // Operations per second
+  write_iops: number;  // Operations per second
 }
 
 export interface NetworkMetrics {